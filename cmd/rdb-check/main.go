@@ -0,0 +1,137 @@
+// rdb-check validates the RDB and AOF files offline.
+//
+//	rdb-check rdb <file.rdb>
+//	rdb-check aof [--fix] [--truncate-to-timestamp <unix>] <file.manifest>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+
+	"github.com/sunminx/RDB/internal/dump"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: rdb-check rdb <file.rdb>")
+	fmt.Fprintln(os.Stderr, "       rdb-check aof [--fix] [--truncate-to-timestamp <unix>] <file.manifest>")
+	os.Exit(1)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	fs.Usage = usage
+	verbose := fs.Bool("v", false, "print the logs of the loader")
+	fix := fs.Bool("fix", false, "truncate the last incr file to the last valid command")
+	timestamp := fs.Int64("truncate-to-timestamp", 0,
+		"truncate the last incr file before the commands written after the unix time")
+	fs.Parse(os.Args[2:])
+	if fs.NArg() != 1 {
+		usage()
+	}
+	if !*verbose {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+
+	var ok bool
+	switch os.Args[1] {
+	case "rdb":
+		ok = checkRdb(fs.Arg(0))
+	case "aof":
+		ok = checkAof(fs.Arg(0), dump.AofCheckOptions{Fix: *fix, TruncateToTimestamp: *timestamp})
+	default:
+		usage()
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func checkRdb(filename string) bool {
+	fmt.Printf("[offset 0] Checking RDB file %s\n", filename)
+	report, err := dump.CheckRdb(filename)
+	if err != nil {
+		fmt.Printf("Cannot open RDB file: %v\n", err)
+		return false
+	}
+	printRdbReport(report)
+	if report.Err != nil {
+		fmt.Println("--- RDB ERROR DETECTED ---")
+		fmt.Printf("[offset %d] %v\n", report.Offset, report.Err)
+		fmt.Printf("[additional info] While reading the record at offset %d\n", report.RecordOffset)
+		return false
+	}
+	fmt.Println("\\o/ RDB looks OK! \\o/")
+	return true
+}
+
+func printRdbReport(report *dump.RdbCheckReport) {
+	if report.Version > 0 {
+		fmt.Printf("[info] RDB version %d\n", report.Version)
+	}
+	for _, kv := range report.Aux {
+		fmt.Printf("[info] AUX FIELD %s = '%s'\n", kv[0], kv[1])
+	}
+	fmt.Printf("[info] %d keys read\n", report.TotalKeys())
+	types := make([]string, 0, len(report.Keys))
+	for typ := range report.Keys {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		fmt.Printf("[info] %s: %d keys\n", typ, report.Keys[typ])
+	}
+	fmt.Printf("[info] %d expires\n", report.Expires)
+	fmt.Printf("[info] %d already expired\n", report.Expired)
+	fmt.Printf("[info] checksum: %s\n", report.Cksum)
+}
+
+func checkAof(manifest string, opts dump.AofCheckOptions) bool {
+	fmt.Printf("Checking AOF manifest %s\n", manifest)
+	report, err := dump.CheckAof(manifest, opts)
+	if report == nil {
+		fmt.Println(err)
+		return false
+	}
+	for _, f := range report.Files {
+		fmt.Printf("Checking %s AOF %s (%d bytes)\n", f.Type, f.Name, f.Size)
+		if f.Rdb != nil {
+			printRdbReport(f.Rdb)
+			if f.Rdb.Err != nil {
+				fmt.Printf("RDB part is not valid at offset %d (record at offset %d): %v\n",
+					f.Rdb.Offset, f.Rdb.RecordOffset, f.Rdb.Err)
+				continue
+			}
+		}
+		fmt.Printf("%d commands, valid up to offset %d\n", f.Commands, f.ValidUpTo)
+		if f.Err != nil {
+			fmt.Printf("AOF %s is not valid %v\n", f.Name, f.Err)
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	last := report.Files[len(report.Files)-1]
+	if report.Fixed {
+		fmt.Printf("Successfully truncated AOF %s to %d bytes\n", last.Name, last.ValidUpTo)
+		return true
+	}
+	if report.Truncated {
+		fmt.Printf("Successfully truncated AOF %s to timestamp %d at offset %d\n",
+			last.Name, opts.TruncateToTimestamp, last.TimestampOffset)
+		return true
+	}
+	if !report.Ok() {
+		fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+		return false
+	}
+	fmt.Println("AOF is valid")
+	return true
+}
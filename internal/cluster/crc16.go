@@ -0,0 +1,35 @@
+package cluster
+
+// crc16 is the CRC16 implementation used by the hash slots, according to
+// the CCITT specification (also known as XMODEM):
+//
+// Name                       : "XMODEM", also known as "ZMODEM", "CRC-16/ACORN"
+// Width                      : 16 bit
+// Poly                       : 1021 (That is actually x^16 + x^12 + x^5 + 1)
+// Initialization             : 0000
+// Reflect Input byte         : False
+// Reflect Output CRC         : False
+// Xor constant to output CRC : 0000
+// Output for "123456789"     : 31C3
+func crc16(buf []byte) uint16 {
+	var crc uint16
+	for _, c := range buf {
+		crc = crc<<8 ^ crc16tab[byte(crc>>8)^c]
+	}
+	return crc
+}
+
+var crc16tab = func() (tab [256]uint16) {
+	for i := range tab {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		tab[i] = crc
+	}
+	return tab
+}()
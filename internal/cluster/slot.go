@@ -0,0 +1,42 @@
+package cluster
+
+// Slots is the number of hash slots of the keyspace, each key belongs to
+// a hash slot, and each hash slot is served by a single master.
+const Slots = 16384
+
+// KeyHashSlot maps the key to its hash slot.
+//
+// If the key contains a {...} pattern, only the part between { and } is
+// hashed, which is called hash tag. This is useful in order to force some
+// keys to be in the same hash slot. The first { and the first } after it
+// are used, and if there is nothing between them the whole key is hashed.
+func KeyHashSlot(key []byte) int {
+	s := -1
+	for i, c := range key {
+		if c == '{' {
+			s = i
+			break
+		}
+	}
+	// No '{' ? Hash the whole key. This is the base case.
+	if s == -1 {
+		return int(crc16(key) & (Slots - 1))
+	}
+
+	// '{' found? Check if we have the corresponding '}'.
+	e := -1
+	for i := s + 1; i < len(key); i++ {
+		if key[i] == '}' {
+			e = i
+			break
+		}
+	}
+	// No '}' or nothing between {} ? Hash the whole key.
+	if e == -1 || e == s+1 {
+		return int(crc16(key) & (Slots - 1))
+	}
+
+	// If we are here there is both a { and a } on its right. Hash
+	// what is in the middle between { and }.
+	return int(crc16(key[s+1:e]) & (Slots - 1))
+}
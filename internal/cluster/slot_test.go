@@ -0,0 +1,45 @@
+package cluster
+
+import "testing"
+
+func TestCrc16(t *testing.T) {
+	if crc := crc16([]byte("123456789")); crc != 0x31c3 {
+		t.Errorf("crc16: %x want: %x", crc, 0x31c3)
+	}
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	testcases := []struct {
+		key  string
+		slot int
+	}{
+		{key: "foo", slot: 12182},
+		{key: "bar", slot: 5061},
+		{key: "{}", slot: 15257},
+	}
+	for _, tc := range testcases {
+		if slot := KeyHashSlot([]byte(tc.key)); slot != tc.slot {
+			t.Errorf("KeyHashSlot(%q): %d want: %d", tc.key, slot, tc.slot)
+		}
+	}
+
+	// The keys with the same hash tag are in the same slot.
+	tagcases := []struct {
+		key  string
+		same string
+	}{
+		{key: "{user1000}.following", same: "user1000"},
+		{key: "{user1000}.followers", same: "user1000"},
+		{key: "foo{user1000}{bar}", same: "user1000"},
+		{key: "foo{bar", same: "foo{bar"},
+		{key: "foo{}{bar}", same: "foo{}{bar}"},
+	}
+	for _, tc := range tagcases {
+		if slot, want := KeyHashSlot([]byte(tc.key)), KeyHashSlot([]byte(tc.same)); slot != want {
+			t.Errorf("KeyHashSlot(%q): %d want: %d", tc.key, slot, want)
+		}
+	}
+	if KeyHashSlot([]byte("foo{}{bar}")) == KeyHashSlot([]byte("bar")) {
+		t.Error("empty hash tag must hash the whole key")
+	}
+}
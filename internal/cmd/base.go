@@ -1,6 +1,11 @@
 package cmd
 
-import "github.com/sunminx/RDB/internal/common"
+import (
+	"strings"
+
+	"github.com/sunminx/RDB/internal/common"
+	"github.com/sunminx/RDB/internal/sds"
+)
 
 func CommandCommand(cli client) bool {
 	argv := cli.Argv()
@@ -15,6 +20,36 @@ func CommandCommand(cli client) bool {
 	return OK
 }
 
+func PingCommand(cli client) bool {
+	argv := cli.Argv()
+	if len(argv) > 2 {
+		cli.AddReplyErrorFormat(`wrong number of arguments for "ping" command`)
+		return ERR
+	}
+	if len(argv) == 1 {
+		cli.AddReplyStatus(common.Shared["pong"])
+	} else {
+		cli.AddReplyBulk(sds.NewRobj(sds.New(argv[1])))
+	}
+	return OK
+}
+
+// INFO [section]
+// Returns the information about the server, all the sections by default.
+func InfoCommand(cli client) bool {
+	argv := cli.Argv()
+	if len(argv) > 2 {
+		cli.AddReplyError(common.Shared["syntaxerr"])
+		return ERR
+	}
+	section := "default"
+	if len(argv) == 2 {
+		section = strings.ToLower(string(argv[1]))
+	}
+	cli.Info(section)
+	return OK
+}
+
 func MultiCommand(cli client) bool {
 	if cli.Multi() {
 		cli.AddReplyError([]byte("MULTI calls can not be nested"))
@@ -34,8 +69,38 @@ func ExecCommand(cli client) bool {
 	return OK
 }
 
+// The options of FLUSHALL and FLUSHDB.
+const (
+	// FlushDefault flushes in background if lazyfree-lazy-user-flush is set.
+	FlushDefault = iota
+	FlushSync
+	FlushAsync
+)
+
+// FLUSHALL [ASYNC|SYNC]
+// FLUSHDB [ASYNC|SYNC]
+// There is only one db, so both remove all the keys.
 func FlushAllCommand(cli client) bool {
-	_ = cli.Empty()
+	argv := cli.Argv()
+	flags := FlushDefault
+	if len(argv) > 2 {
+		cli.AddReplyError(common.Shared["syntaxerr"])
+		return ERR
+	}
+	if len(argv) == 2 {
+		switch strings.ToLower(string(argv[1])) {
+		case "sync":
+			flags = FlushSync
+		case "async":
+			flags = FlushAsync
+		default:
+			cli.AddReplyError(common.Shared["syntaxerr"])
+			return ERR
+		}
+	}
+	// The flush is propagated even if the db was already empty, like in
+	// Redis, since the replicas and the AOF may still have the keys.
+	cli.AddDirty(cli.FlushAll(flags) + 1)
 	cli.AddReplyStatus(common.Shared["ok"])
 	return OK
 }
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sunminx/RDB/internal/cluster"
+	"github.com/sunminx/RDB/internal/common"
+	obj "github.com/sunminx/RDB/internal/object"
+	"github.com/sunminx/RDB/internal/sds"
+)
+
+var errInvalidSlot = errors.New("Invalid or out of range slot")
+
+// CLUSTER <subcommand> [<arg> [value] [opt] ...]
+func ClusterCommand(cli client) bool {
+	if !cli.ClusterEnabled() {
+		cli.AddReplyError([]byte("This instance has cluster support disabled"))
+		return ERR
+	}
+
+	argv := cli.Argv()
+	subcommand := strings.ToLower(string(argv[1]))
+	switch {
+	case subcommand == "info" && len(argv) == 2:
+		cli.ClusterInfo()
+	case subcommand == "nodes" && len(argv) == 2:
+		cli.ClusterNodes()
+	case subcommand == "slots" && len(argv) == 2:
+		cli.ClusterSlots()
+	case subcommand == "shards" && len(argv) == 2:
+		cli.ClusterShards()
+	case subcommand == "myid" && len(argv) == 2:
+		cli.ClusterMyId()
+	case subcommand == "keyslot" && len(argv) == 3:
+		cli.AddReplyInt64(int64(cluster.KeyHashSlot(argv[2])))
+	case (subcommand == "addslots" || subcommand == "delslots") && len(argv) >= 3:
+		// CLUSTER ADDSLOTS <slot> [slot] ...
+		// CLUSTER DELSLOTS <slot> [slot] ...
+		slots := make([]int, 0, len(argv)-2)
+		for _, arg := range argv[2:] {
+			slot, err := getSlot(arg)
+			if err != nil {
+				cli.AddReplyError([]byte(err.Error()))
+				return ERR
+			}
+			slots = append(slots, slot)
+		}
+		if subcommand == "addslots" {
+			return clusterReplyOk(cli, cli.ClusterAddSlots(slots))
+		}
+		return clusterReplyOk(cli, cli.ClusterDelSlots(slots))
+	case (subcommand == "addslotsrange" || subcommand == "delslotsrange") && len(argv) >= 4 && len(argv)%2 == 0:
+		// CLUSTER ADDSLOTSRANGE <start slot> <end slot> [<start slot> <end slot> ...]
+		// CLUSTER DELSLOTSRANGE <start slot> <end slot> [<start slot> <end slot> ...]
+		var slots []int
+		for i := 2; i < len(argv); i += 2 {
+			start, err := getSlot(argv[i])
+			if err != nil {
+				cli.AddReplyError([]byte(err.Error()))
+				return ERR
+			}
+			end, err := getSlot(argv[i+1])
+			if err != nil {
+				cli.AddReplyError([]byte(err.Error()))
+				return ERR
+			}
+			if start > end {
+				cli.AddReplyErrorFormat("start slot number %d is greater than end slot number %d", start, end)
+				return ERR
+			}
+			for slot := start; slot <= end; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+		if subcommand == "addslotsrange" {
+			return clusterReplyOk(cli, cli.ClusterAddSlots(slots))
+		}
+		return clusterReplyOk(cli, cli.ClusterDelSlots(slots))
+	case subcommand == "meet" && (len(argv) == 4 || len(argv) == 5):
+		// CLUSTER MEET <ip> <port> [cport]
+		port, err := strconv.Atoi(string(argv[3]))
+		if err != nil {
+			cli.AddReplyErrorFormat("Invalid base port specified: %s", argv[3])
+			return ERR
+		}
+		cport := 0
+		if len(argv) == 5 {
+			if cport, err = strconv.Atoi(string(argv[4])); err != nil {
+				cli.AddReplyErrorFormat("Invalid bus port specified: %s", argv[4])
+				return ERR
+			}
+		}
+		ip := string(argv[2])
+		if net.ParseIP(ip) == nil {
+			cli.AddReplyErrorFormat("Invalid node address specified: %s:%s", argv[2], argv[3])
+			return ERR
+		}
+		return clusterReplyOk(cli, cli.ClusterMeet(ip, port, cport))
+	case subcommand == "setslot" && len(argv) >= 4:
+		// CLUSTER SETSLOT <slot> MIGRATING <node>
+		// CLUSTER SETSLOT <slot> IMPORTING <node>
+		// CLUSTER SETSLOT <slot> STABLE
+		// CLUSTER SETSLOT <slot> NODE <node>
+		slot, err := getSlot(argv[2])
+		if err != nil {
+			cli.AddReplyError([]byte(err.Error()))
+			return ERR
+		}
+		action := strings.ToLower(string(argv[3]))
+		switch {
+		case action == "stable" && len(argv) == 4:
+			return clusterReplyOk(cli, cli.ClusterSetSlot(slot, action, ""))
+		case (action == "migrating" || action == "importing" || action == "node") && len(argv) == 5:
+			return clusterReplyOk(cli, cli.ClusterSetSlot(slot, action, string(argv[4])))
+		default:
+			cli.AddReplyError([]byte("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP"))
+			return ERR
+		}
+	case subcommand == "countkeysinslot" && len(argv) == 3:
+		// CLUSTER COUNTKEYSINSLOT <slot>
+		slot, err := strconv.Atoi(string(argv[2]))
+		if err != nil {
+			cli.AddReplyError(common.Shared["notinteger"])
+			return ERR
+		}
+		if slot < 0 || slot >= cluster.Slots {
+			cli.AddReplyError([]byte("Invalid slot"))
+			return ERR
+		}
+		cli.AddReplyInt64(int64(cli.CountKeysInSlot(slot)))
+	case subcommand == "getkeysinslot" && len(argv) == 4:
+		// CLUSTER GETKEYSINSLOT <slot> <count>
+		slot, err := strconv.Atoi(string(argv[2]))
+		if err != nil {
+			cli.AddReplyError(common.Shared["notinteger"])
+			return ERR
+		}
+		count, err := strconv.Atoi(string(argv[3]))
+		if err != nil {
+			cli.AddReplyError(common.Shared["notinteger"])
+			return ERR
+		}
+		if slot < 0 || slot >= cluster.Slots || count < 0 {
+			cli.AddReplyError([]byte("Invalid slot or number of keys"))
+			return ERR
+		}
+		keys := cli.GetKeysInSlot(slot, count)
+		replies := make([]*obj.Robj, 0, len(keys))
+		for _, key := range keys {
+			replies = append(replies, sds.NewRobj(sds.New([]byte(key))))
+		}
+		cli.AddReplyMultibulk(replies)
+	default:
+		cli.AddReplyErrorFormat("unknown subcommand '%s'. Try CLUSTER HELP.", argv[1])
+		return ERR
+	}
+	return OK
+}
+
+// ASKING
+func AskingCommand(cli client) bool {
+	if !cli.ClusterEnabled() {
+		cli.AddReplyError([]byte("This instance has cluster support disabled"))
+		return ERR
+	}
+	cli.Asking()
+	cli.AddReplyStatus(common.Shared["ok"])
+	return OK
+}
+
+// getSlot parses the hash slot.
+func getSlot(arg []byte) (int, error) {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= cluster.Slots {
+		return 0, errInvalidSlot
+	}
+	return slot, nil
+}
+
+func clusterReplyOk(cli client, err error) bool {
+	if err != nil {
+		cli.AddReplyError([]byte(err.Error()))
+		return ERR
+	}
+	cli.AddReplyStatus(common.Shared["ok"])
+	return OK
+}
@@ -21,8 +21,12 @@ type client interface {
 	LookupKeyWrite(string) (*obj.Robj, bool)
 	SetKey(string, *obj.Robj)
 	SetExpire(string, time.Duration)
-	DelKey(string)
-	Empty() int
+	TrackFieldExpires(string)
+	DelKey(string) bool
+	SyncDelete(string) bool
+	AsyncDelete(string) bool
+	FlushAll(int) int
+	SetArgument([][]byte)
 	AddDirty(int)
 	AddReply(*obj.Robj)
 	AddReplyRaw([]byte)
@@ -33,6 +37,57 @@ type client interface {
 	AddReplyUint64(uint64)
 	AddReplyBulk(*obj.Robj)
 	AddReplyMultibulk([]*obj.Robj)
+	AddReplyMultibulkLen(int64)
+	ReplicaOf(string, int) error
+	Psync(string, int64)
+	ReplconfListeningPort(int)
+	ReplconfCapa(string)
+	ReplconfAck(int64, int64)
+	ReplconfGetAck()
+	Role()
+	Info(string)
+	Wait(int, int64)
+	WaitAof(int, int, int64)
+	Save() error
+	Bgsave(bool) (bool, error)
+	BgrewriteAof() error
+	LastSave() int64
+	Shutdown(int) error
+	BackupList() error
+	BackupRestore(string) error
+	DumpObject(*obj.Robj) []byte
+	RestoreObject([]byte) (*obj.Robj, error)
+	Migrate(*MigrateOptions) (int, error)
+	ClusterEnabled() bool
+	ClusterInfo()
+	ClusterNodes()
+	ClusterSlots()
+	ClusterShards()
+	ClusterMyId()
+	ClusterAddSlots([]int) error
+	ClusterDelSlots([]int) error
+	ClusterMeet(string, int, int) error
+	ClusterSetSlot(int, string, string) error
+	CountKeysInSlot(int) int
+	GetKeysInSlot(int, int) []string
+	Asking()
+	Subscribe([]string)
+	Unsubscribe([]string)
+	Publish(string, []byte) int
+	SentinelMyId()
+	SentinelMasters()
+	SentinelMaster(string)
+	SentinelReplicas(string)
+	SentinelSentinels(string)
+	SentinelGetMasterAddrByName(string)
+	SentinelIsMasterDownByAddr(string, int, uint64, string)
+	SentinelFailover(string)
+	SentinelReset(string) int
+	SentinelMonitor(string, string, int, int) error
+	SentinelRemove(string) error
+	SentinelSet(string, []string) error
+	SentinelCkquorum(string)
+	SentinelFlushConfig() error
 }
 
 type CommandProc func(client) bool
@@ -52,11 +107,20 @@ type Command struct {
 
 var EmptyCommand = Command{"", nil, 0, "", 0, 0, 0, 0, 0, 0}
 
+// The commands with keys run in parallel with the commands on the other
+// shards of the keyspace, unless they have the 'x' flag, which marks the
+// ones accessing the state of the server besides their keys.
 var CommandTable []Command = []Command{
 	{"get", GetCommand, 2, "rF", 0, 1, 1, 1, 0, 0},
 	{"set", SetCommand, -3, "wm", 0, 1, 1, 1, 0, 0},
 	{"del", DelCommand, -2, "w", 0, 1, -1, 1, 0, 0},
+	{"unlink", UnlinkCommand, -2, "wF", 0, 1, -1, 1, 0, 0},
 	{"exists", ExistsCommand, -2, "rF", 0, 1, -1, 1, 0, 0},
+	{"pexpireat", PExpireAtCommand, 3, "wF", 0, 1, 1, 1, 0, 0},
+	{"dump", DumpCommand, 2, "rR", 0, 1, 1, 1, 0, 0},
+	{"restore", RestoreCommand, -4, "wm", 0, 1, 1, 1, 0, 0},
+	{"restore-asking", RestoreCommand, -4, "wmk", 0, 1, 1, 1, 0, 0},
+	{"migrate", MigrateCommand, -6, "wRx", 0, 3, 3, 1, 0, 0},
 	{"incr", IncrCommand, 2, "wmF", 0, 1, 1, 1, 0, 0},
 	{"decr", DecrCommand, 2, "wmF", 0, 1, 1, 1, 0, 0},
 	{"append", AppendCommand, 3, "wmF", 0, 1, 1, 1, 0, 0},
@@ -70,14 +134,64 @@ var CommandTable []Command = []Command{
 	{"lindex", LIndexCommand, 3, "r", 0, 1, 1, 1, 0, 0},
 	{"ltrim", LTrimCommand, 4, "w", 0, 1, 1, 1, 0, 0},
 	{"lset", LSetCommand, 4, "wm", 0, 1, 1, 1, 0, 0},
-	{"hset", HSetCommand, 4, "wmF", 0, 1, 1, 1, 0, 0},
+	{"hset", HSetCommand, -4, "wmF", 0, 1, 1, 1, 0, 0},
 	{"hmset", HMSetCommand, -4, "wmF", 0, 1, 1, 1, 0, 0},
+	{"hsetnx", HSetNxCommand, 4, "wmF", 0, 1, 1, 1, 0, 0},
 	{"hget", HGetCommand, 3, "rF", 0, 1, 1, 1, 0, 0},
+	{"hmget", HMGetCommand, -3, "rF", 0, 1, 1, 1, 0, 0},
 	{"hdel", HDelCommand, -3, "wF", 0, 1, 1, 1, 0, 0},
 	{"hlen", HLenCommand, 2, "rF", 0, 1, 1, 1, 0, 0},
+	{"hstrlen", HStrlenCommand, 3, "rF", 0, 1, 1, 1, 0, 0},
 	{"hexists", HExistsCommand, 3, "rF", 0, 1, 1, 1, 0, 0},
+	{"hincrby", HIncrByCommand, 4, "wmF", 0, 1, 1, 1, 0, 0},
+	{"hincrbyfloat", HIncrByFloatCommand, 4, "wmF", 0, 1, 1, 1, 0, 0},
+	{"hgetall", HGetAllCommand, 2, "rR", 0, 1, 1, 1, 0, 0},
+	{"hkeys", HKeysCommand, 2, "rR", 0, 1, 1, 1, 0, 0},
+	{"hvals", HValsCommand, 2, "rR", 0, 1, 1, 1, 0, 0},
+	{"hrandfield", HRandFieldCommand, -2, "rR", 0, 1, 1, 1, 0, 0},
+	{"hscan", HScanCommand, -3, "rR", 0, 1, 1, 1, 0, 0},
+	{"hexpire", HExpireCommand, -6, "wF", 0, 1, 1, 1, 0, 0},
+	{"hpexpire", HPExpireCommand, -6, "wF", 0, 1, 1, 1, 0, 0},
+	{"hexpireat", HExpireAtCommand, -6, "wF", 0, 1, 1, 1, 0, 0},
+	{"hpexpireat", HPExpireAtCommand, -6, "wF", 0, 1, 1, 1, 0, 0},
+	{"httl", HTTLCommand, -5, "rF", 0, 1, 1, 1, 0, 0},
+	{"hpttl", HPTTLCommand, -5, "rF", 0, 1, 1, 1, 0, 0},
+	{"hexpiretime", HExpireTimeCommand, -5, "rF", 0, 1, 1, 1, 0, 0},
+	{"hpexpiretime", HPExpireTimeCommand, -5, "rF", 0, 1, 1, 1, 0, 0},
+	{"hpersist", HPersistCommand, -5, "wF", 0, 1, 1, 1, 0, 0},
 	{"multi", MultiCommand, 1, "sF", 0, 0, 0, 0, 0, 0},
 	{"exec", ExecCommand, 1, "sM", 0, 0, 0, 0, 0, 0},
 	{"flushdb", FlushAllCommand, -1, "w", 0, 0, 0, 0, 0, 0},
 	{"flushall", FlushAllCommand, -1, "w", 0, 0, 0, 0, 0, 0},
+	{"ping", PingCommand, -1, "tF", 0, 0, 0, 0, 0, 0},
+	{"info", InfoCommand, -1, "lt", 0, 0, 0, 0, 0, 0},
+	{"replicaof", ReplicaOfCommand, 3, "ast", 0, 0, 0, 0, 0, 0},
+	{"slaveof", ReplicaOfCommand, 3, "ast", 0, 0, 0, 0, 0, 0},
+	{"sync", SyncCommand, 1, "ars", 0, 0, 0, 0, 0, 0},
+	{"psync", PsyncCommand, 3, "ars", 0, 0, 0, 0, 0, 0},
+	{"replconf", ReplconfCommand, -1, "aslt", 0, 0, 0, 0, 0, 0},
+	{"role", RoleCommand, 1, "ltF", 0, 0, 0, 0, 0, 0},
+	{"wait", WaitCommand, 3, "s", 0, 0, 0, 0, 0, 0},
+	{"waitaof", WaitaofCommand, 4, "s", 0, 0, 0, 0, 0, 0},
+	{"save", SaveCommand, 1, "as", 0, 0, 0, 0, 0, 0},
+	{"bgsave", BgsaveCommand, -1, "a", 0, 0, 0, 0, 0, 0},
+	{"bgrewriteaof", BgrewriteaofCommand, 1, "a", 0, 0, 0, 0, 0, 0},
+	{"lastsave", LastsaveCommand, 1, "RF", 0, 0, 0, 0, 0, 0},
+	{"shutdown", ShutdownCommand, -1, "alt", 0, 0, 0, 0, 0, 0},
+	{"backup", BackupCommand, -2, "a", 0, 0, 0, 0, 0, 0},
+	{"cluster", ClusterCommand, -2, "at", 0, 0, 0, 0, 0, 0},
+	{"asking", AskingCommand, 1, "F", 0, 0, 0, 0, 0, 0},
+	{"subscribe", SubscribeCommand, -2, "pslt", 0, 0, 0, 0, 0, 0},
+	{"unsubscribe", UnsubscribeCommand, -1, "pslt", 0, 0, 0, 0, 0, 0},
+	{"publish", PublishCommand, 3, "pltF", 0, 0, 0, 0, 0, 0},
+}
+
+// SentinelCommandTable is the command table used in sentinel mode.
+var SentinelCommandTable []Command = []Command{
+	{"ping", PingCommand, -1, "tF", 0, 0, 0, 0, 0, 0},
+	{"sentinel", SentinelCommand, -2, "at", 0, 0, 0, 0, 0, 0},
+	{"subscribe", SubscribeCommand, -2, "pslt", 0, 0, 0, 0, 0, 0},
+	{"unsubscribe", UnsubscribeCommand, -1, "pslt", 0, 0, 0, 0, 0, 0},
+	{"publish", PublishCommand, 3, "pltF", 0, 0, 0, 0, 0, 0},
+	{"role", RoleCommand, 1, "ltF", 0, 0, 0, 0, 0, 0},
 }
@@ -1,81 +1,183 @@
 package cmd
 
 import (
+	"bytes"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
 	"github.com/sunminx/RDB/internal/common"
 	"github.com/sunminx/RDB/internal/hash"
 	obj "github.com/sunminx/RDB/internal/object"
 	"github.com/sunminx/RDB/internal/sds"
+	"github.com/sunminx/RDB/pkg/util"
 )
 
+// lookupHash returns the hash of the key of the command, nil if there is no
+// such key. It replies and returns false if the key is not a hash. The hash
+// to be modified is looked up for writing.
+func lookupHash(cli client, write bool) (*obj.Robj, bool) {
+	lookup := cli.LookupKeyRead
+	if write {
+		lookup = cli.LookupKeyWrite
+	}
+	val, exists := lookup(cli.Key())
+	if !exists {
+		return nil, true
+	}
+	if !val.CheckType(obj.TypeHash) {
+		cli.AddReplyError(common.Shared["wrongtypeerr"])
+		return nil, false
+	}
+	return val, true
+}
+
+// lookupHashOrCreate returns the hash of the key of the command to be
+// modified, a new hash is created if there is no such key.
+func lookupHashOrCreate(cli client) (*obj.Robj, bool) {
+	val, ok := lookupHash(cli, true)
+	if ok && val == nil {
+		val = hash.NewRobj(hash.NewZipmap())
+		cli.SetKey(cli.Key(), val)
+	}
+	return val, ok
+}
+
+func addReplyBulkBytes(cli client, b []byte) {
+	cli.AddReplyBulk(sds.NewRobj(sds.New(b)))
+}
+
+// HSET key field value [field value ...]
+// Replies the number of the fields added.
 func HSetCommand(cli client) bool {
-	return genericHSetCommand(cli)
+	created, ok := genericHSetCommand(cli, "hset")
+	if !ok {
+		return ERR
+	}
+	cli.AddReplyInt64(int64(created))
+	return OK
 }
 
+// HMSET key field value [field value ...]
+// Like HSET, but replies OK.
 func HMSetCommand(cli client) bool {
-	return genericHSetCommand(cli)
+	if _, ok := genericHSetCommand(cli, "hmset"); !ok {
+		return ERR
+	}
+	cli.AddReplyStatus(common.Shared["ok"])
+	return OK
 }
 
-func genericHSetCommand(cli client) bool {
-	key, argv := cli.Key(), cli.Argv()
-	val, exists := cli.LookupKeyRead(key)
-	if exists {
-		if !val.CheckType(obj.TypeHash) {
-			cli.AddReplyError(common.Shared["wrongtypeerr"])
-			return ERR
-		}
-	} else {
-		val = hash.NewRobj(hash.NewZipmap())
+// genericHSetCommand sets the fields of the command, and returns the number
+// of the new ones.
+func genericHSetCommand(cli client, name string) (int, bool) {
+	argv := cli.Argv()
+	if len(argv)%2 != 0 {
+		cli.AddReplyErrorFormat(`wrong number of arguments for %q command`, name)
+		return 0, false
+	}
+	val, ok := lookupHashOrCreate(cli)
+	if !ok {
+		return 0, false
 	}
 
-	setedNum := 0
+	created := 0
 	for i := 2; i < len(argv); i += 2 {
+		if !hash.Exists(val, argv[i]) {
+			created++
+		}
 		hash.Set(val, argv[i], argv[i+1])
-		setedNum++
 	}
+	cli.AddDirty((len(argv) - 2) / 2)
+	return created, true
+}
 
-	cli.SetKey(key, val)
-	cli.AddReplyStatus(common.Shared["ok"])
-	cli.AddDirty(setedNum)
+// HSETNX key field value
+// Sets field only if it doesn't exist yet.
+func HSetNxCommand(cli client) bool {
+	argv := cli.Argv()
+	val, ok := lookupHashOrCreate(cli)
+	if !ok {
+		return ERR
+	}
+	if hash.Exists(val, argv[2]) {
+		cli.AddReplyRaw(common.Shared["czero"])
+		return OK
+	}
+	hash.Set(val, argv[2], argv[3])
+	cli.AddReplyRaw(common.Shared["cone"])
+	cli.AddDirty(1)
 	return OK
 }
 
 func HGetCommand(cli client) bool {
-	key, argv := cli.Key(), cli.Argv()
-	val, exists := cli.LookupKeyRead(key)
-	if exists {
-		if !val.CheckType(obj.TypeHash) {
-			cli.AddReplyError(common.Shared["wrongtypeerr"])
-			return ERR
-		}
-	} else {
-		cli.AddReplyRaw(common.Shared["nullbulk"])
+	argv := cli.Argv()
+	val, ok := lookupHash(cli, false)
+	if !ok {
 		return ERR
 	}
+	if val == nil {
+		cli.AddReplyRaw(common.Shared["nullbulk"])
+		return OK
+	}
 
 	hval, exists := hash.Get(val, argv[2])
 	if !exists {
+		cli.AddReplyRaw(common.Shared["nullbulk"])
+		return OK
+	}
+	addReplyBulkBytes(cli, hval)
+	return OK
+}
+
+// HMGET key field [field ...]
+// Replies the values of the fields, nil for the missing ones.
+func HMGetCommand(cli client) bool {
+	argv := cli.Argv()
+	val, ok := lookupHash(cli, false)
+	if !ok {
+		return ERR
+	}
+
+	cli.AddReplyMultibulkLen(int64(len(argv) - 2))
+	for _, field := range argv[2:] {
+		var hval []byte
+		exists := false
+		if val != nil {
+			hval, exists = hash.Get(val, field)
+		}
+		if exists {
+			addReplyBulkBytes(cli, hval)
+		} else {
+			cli.AddReplyRaw(common.Shared["nullbulk"])
+		}
 	}
-	cli.AddReplyBulk(sds.NewRobj(sds.New(hval)))
 	return OK
 }
 
+// HDEL key field [field ...]
+// Replies the number of the fields deleted, the key is deleted with its
+// last field.
 func HDelCommand(cli client) bool {
 	key, argv := cli.Key(), cli.Argv()
-	val, exists := cli.LookupKeyRead(key)
-	if exists {
-		if !val.CheckType(obj.TypeHash) {
-			cli.AddReplyError(common.Shared["wrongtypeerr"])
-			return ERR
-		}
-	} else {
-		cli.AddReplyRaw(common.Shared["nullbulk"])
+	val, ok := lookupHash(cli, true)
+	if !ok {
 		return ERR
 	}
+	if val == nil {
+		cli.AddReplyRaw(common.Shared["czero"])
+		return OK
+	}
 
 	deletedNum := 0
-	for i := 2; i < len(argv); i++ {
-		hash.Del(val, argv[i])
-		deletedNum++
+	for _, field := range argv[2:] {
+		if hash.Del(val, field) {
+			deletedNum++
+		}
+	}
+	if hash.Len(val) == 0 {
+		cli.DelKey(key)
 	}
 	cli.AddReplyInt64(int64(deletedNum))
 	cli.AddDirty(deletedNum)
@@ -83,39 +185,563 @@ func HDelCommand(cli client) bool {
 }
 
 func HLenCommand(cli client) bool {
-	key := cli.Key()
-	val, exists := cli.LookupKeyRead(key)
-	if exists {
-		if !val.CheckType(obj.TypeHash) {
-			cli.AddReplyError(common.Shared["wrongtypeerr"])
-			return ERR
-		}
-	} else {
-		cli.AddReplyRaw(common.Shared["nullbulk"])
+	val, ok := lookupHash(cli, false)
+	if !ok {
 		return ERR
 	}
+	if val == nil {
+		cli.AddReplyRaw(common.Shared["czero"])
+		return OK
+	}
 
 	cli.AddReplyInt64(hash.Len(val))
 	return OK
 }
 
+// HSTRLEN key field
+// Replies the length of the value of field, 0 if it doesn't exist.
+func HStrlenCommand(cli client) bool {
+	argv := cli.Argv()
+	val, ok := lookupHash(cli, false)
+	if !ok {
+		return ERR
+	}
+	var hval []byte
+	if val != nil {
+		hval, _ = hash.Get(val, argv[2])
+	}
+	cli.AddReplyInt64(int64(len(hval)))
+	return OK
+}
+
 func HExistsCommand(cli client) bool {
+	argv := cli.Argv()
+	val, ok := lookupHash(cli, false)
+	if !ok {
+		return ERR
+	}
+
+	if val != nil && hash.Exists(val, argv[2]) {
+		cli.AddReplyRaw(common.Shared["cone"])
+	} else {
+		cli.AddReplyRaw(common.Shared["czero"])
+	}
+	return OK
+}
+
+// HINCRBY key field increment
+// A missing field is set to the increment.
+func HIncrByCommand(cli client) bool {
+	argv := cli.Argv()
+	incr, err := strconv.ParseInt(string(argv[3]), 10, 64)
+	if err != nil {
+		cli.AddReplyError(common.Shared["notinteger"])
+		return ERR
+	}
+	val, ok := lookupHashOrCreate(cli)
+	if !ok {
+		return ERR
+	}
+
+	var n int64
+	if hval, exists := hash.Get(val, argv[2]); exists {
+		if n, err = strconv.ParseInt(string(hval), 10, 64); err != nil {
+			cli.AddReplyError([]byte("hash value is not an integer"))
+			return ERR
+		}
+	}
+	if (incr < 0 && n < 0 && incr < math.MinInt64-n) ||
+		(incr > 0 && n > 0 && incr > math.MaxInt64-n) {
+		cli.AddReplyError([]byte("increment or decrement would overflow"))
+		return ERR
+	}
+	n += incr
+	hash.SetKeepExpire(val, argv[2], strconv.AppendInt(nil, n, 10))
+	cli.AddReplyInt64(n)
+	cli.AddDirty(1)
+	return OK
+}
+
+// HINCRBYFLOAT key field increment
+// The command is propagated as a HSET of the new value, so that the float
+// isn't computed again, unless the field has a TTL, which HSET removes.
+func HIncrByFloatCommand(cli client) bool {
 	key, argv := cli.Key(), cli.Argv()
-	val, exists := cli.LookupKeyRead(key)
-	if exists {
-		if !val.CheckType(obj.TypeHash) {
-			cli.AddReplyError(common.Shared["wrongtypeerr"])
+	incr, err := strconv.ParseFloat(string(argv[3]), 64)
+	if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+		cli.AddReplyError([]byte("value is not a valid float"))
+		return ERR
+	}
+	val, ok := lookupHashOrCreate(cli)
+	if !ok {
+		return ERR
+	}
+
+	var n float64
+	if hval, exists := hash.Get(val, argv[2]); exists {
+		if n, err = strconv.ParseFloat(string(hval), 64); err != nil {
+			cli.AddReplyError([]byte("hash value is not a float"))
 			return ERR
 		}
+	}
+	n += incr
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		cli.AddReplyError([]byte("increment would produce NaN or Infinity"))
+		return ERR
+	}
+	newval := []byte(strconv.FormatFloat(n, 'f', -1, 64))
+	hash.SetKeepExpire(val, argv[2], newval)
+	addReplyBulkBytes(cli, newval)
+	if hash.GetExpire(val, argv[2]) == hash.NoExpire {
+		cli.SetArgument([][]byte{[]byte("HSET"), []byte(key), argv[2], newval})
+	}
+	cli.AddDirty(1)
+	return OK
+}
+
+// HGETALL key
+func HGetAllCommand(cli client) bool {
+	return genericHGetAllCommand(cli, true, true)
+}
+
+// HKEYS key
+func HKeysCommand(cli client) bool {
+	return genericHGetAllCommand(cli, true, false)
+}
+
+// HVALS key
+func HValsCommand(cli client) bool {
+	return genericHGetAllCommand(cli, false, true)
+}
+
+func genericHGetAllCommand(cli client, fields, values bool) bool {
+	val, ok := lookupHash(cli, false)
+	if !ok {
+		return ERR
+	}
+	if val == nil {
+		cli.AddReplyMultibulkLen(0)
+		return OK
+	}
+
+	n := hash.Len(val)
+	if fields && values {
+		n *= 2
+	}
+	cli.AddReplyMultibulkLen(n)
+	for iter := hash.NewIterator(val); iter.HasNext(); {
+		kv := iter.Next().(hash.KVPair)
+		if fields {
+			addReplyBulkBytes(cli, kv[0])
+		}
+		if values {
+			addReplyBulkBytes(cli, kv[1])
+		}
+	}
+	return OK
+}
+
+// HRANDFIELD key [count [WITHVALUES]]
+// Without count, replies a random field. A positive count replies up to
+// count distinct fields, a negative count replies -count fields which may
+// repeat, up to hrandfieldMaxRepeated.
+func HRandFieldCommand(cli client) bool {
+	argv := cli.Argv()
+	if len(argv) > 4 || (len(argv) == 4 && !bytes.EqualFold(argv[3], []byte("withvalues"))) {
+		cli.AddReplyError(common.Shared["syntaxerr"])
+		return ERR
+	}
+	withvalues := len(argv) == 4
+
+	var count int64
+	if len(argv) >= 3 {
+		var err error
+		if count, err = strconv.ParseInt(string(argv[2]), 10, 64); err != nil {
+			cli.AddReplyError(common.Shared["notinteger"])
+			return ERR
+		} else if count < -hrandfieldMaxRepeated {
+			cli.AddReplyError([]byte("value is out of range"))
+			return ERR
+		}
+	}
+	val, ok := lookupHash(cli, false)
+	if !ok {
+		return ERR
+	}
+
+	if len(argv) == 2 {
+		if val == nil {
+			cli.AddReplyRaw(common.Shared["nullbulk"])
+			return OK
+		}
+		iter := hash.NewIterator(val)
+		for i := rand.Int64N(hash.Len(val)); i > 0; i-- {
+			iter.Next()
+		}
+		addReplyBulkBytes(cli, iter.Next().(hash.KVPair)[0])
+		return OK
+	}
+	if val == nil || count == 0 {
+		cli.AddReplyMultibulkLen(0)
+		return OK
+	}
+
+	pairs := make([]hash.KVPair, 0, hash.Len(val))
+	for iter := hash.NewIterator(val); iter.HasNext(); {
+		pairs = append(pairs, iter.Next().(hash.KVPair))
+	}
+	n := -count
+	if count > 0 {
+		// The first fields of a partial shuffle.
+		n = min(count, int64(len(pairs)))
+		for i := range int(n) {
+			j := i + rand.IntN(len(pairs)-i)
+			pairs[i], pairs[j] = pairs[j], pairs[i]
+		}
+	}
+
+	if withvalues {
+		cli.AddReplyMultibulkLen(2 * n)
 	} else {
-		cli.AddReplyRaw(common.Shared["nullbulk"])
+		cli.AddReplyMultibulkLen(n)
+	}
+	for i := range n {
+		var kv hash.KVPair
+		if count > 0 {
+			kv = pairs[i]
+		} else {
+			// The repeated fields are picked as they are replied.
+			kv = pairs[rand.IntN(len(pairs))]
+		}
+		addReplyBulkBytes(cli, kv[0])
+		if withvalues {
+			addReplyBulkBytes(cli, kv[1])
+		}
+	}
+	return OK
+}
+
+// hrandfieldMaxRepeated is the maximum number of fields replied by
+// HRANDFIELD with a negative count, as many as the elements of a request,
+// so that a huge count doesn't exhaust the memory.
+const hrandfieldMaxRepeated = 1024 * 1024
+
+// HSCAN key cursor [MATCH pattern] [COUNT count] [NOVALUES]
+// Replies the cursor of the next call, 0 at the end, and the fields and
+// the values scanned.
+func HScanCommand(cli client) bool {
+	argv := cli.Argv()
+	cursor, err := strconv.ParseUint(string(argv[2]), 10, 64)
+	if err != nil {
+		cli.AddReplyError([]byte("invalid cursor"))
+		return ERR
+	}
+	var pattern []byte
+	count, novalues := 10, false
+	for i := 3; i < len(argv); i++ {
+		opt := string(bytes.ToLower(argv[i]))
+		switch {
+		case opt == "match" && i+1 < len(argv):
+			i++
+			pattern = argv[i]
+		case opt == "count" && i+1 < len(argv):
+			i++
+			n, err := strconv.Atoi(string(argv[i]))
+			if err != nil {
+				cli.AddReplyError(common.Shared["notinteger"])
+				return ERR
+			} else if n < 1 {
+				cli.AddReplyError(common.Shared["syntaxerr"])
+				return ERR
+			}
+			count = n
+		case opt == "novalues":
+			novalues = true
+		default:
+			cli.AddReplyError(common.Shared["syntaxerr"])
+			return ERR
+		}
+	}
+	val, ok := lookupHash(cli, false)
+	if !ok {
 		return ERR
 	}
 
-	if hash.Exists(val, argv[2]) {
-		cli.AddReplyRaw(common.Shared["cone"])
+	var pairs []hash.KVPair
+	if val != nil {
+		cursor = hash.Scan(val, cursor, count, func(kv hash.KVPair) {
+			if pattern == nil || util.StringMatch(pattern, kv[0]) {
+				pairs = append(pairs, kv)
+			}
+		})
 	} else {
-		cli.AddReplyRaw(common.Shared["czero"])
+		cursor = 0
+	}
+
+	cli.AddReplyMultibulkLen(2)
+	addReplyBulkBytes(cli, strconv.AppendUint(nil, cursor, 10))
+	n := int64(len(pairs))
+	if !novalues {
+		n *= 2
+	}
+	cli.AddReplyMultibulkLen(n)
+	for _, kv := range pairs {
+		addReplyBulkBytes(cli, kv[0])
+		if !novalues {
+			addReplyBulkBytes(cli, kv[1])
+		}
+	}
+	return OK
+}
+
+// The replies of HEXPIRE and its variants for every field.
+const (
+	hexpireNoField = -2
+	hexpireNotSet  = 0
+	hexpireSet     = 1
+	hexpireDeleted = 2
+)
+
+// The replies of HTTL, HPERSIST and their variants, besides the expires.
+const (
+	hfieldNoField   = -2
+	hfieldNoTTL     = -1
+	hfieldPersisted = 1
+)
+
+// hexpireMaxTime is the latest expire of a field, in milliseconds, as
+// Redis limits it.
+const hexpireMaxTime = (1<<48 - 1) >> 2
+
+// HEXPIRE key seconds [NX | XX | GT | LT] FIELDS numfields field [field ...]
+func HExpireCommand(cli client) bool {
+	return hexpireGenericCommand(cli, time.Now().UnixMilli(), time.Second)
+}
+
+// HPEXPIRE key milliseconds [NX | XX | GT | LT] FIELDS numfields field [field ...]
+func HPExpireCommand(cli client) bool {
+	return hexpireGenericCommand(cli, time.Now().UnixMilli(), time.Millisecond)
+}
+
+// HEXPIREAT key unix-time-seconds [NX | XX | GT | LT] FIELDS numfields field [field ...]
+func HExpireAtCommand(cli client) bool {
+	return hexpireGenericCommand(cli, 0, time.Second)
+}
+
+// HPEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT] FIELDS numfields field [field ...]
+func HPExpireAtCommand(cli client) bool {
+	return hexpireGenericCommand(cli, 0, time.Millisecond)
+}
+
+// hexpireGenericCommand sets the expire of the fields to basetime plus the
+// time argument in unit. It replies for every field -2 if it doesn't exist,
+// 0 if the condition isn't met, 1 if the expire is set, and 2 if the field
+// is deleted, as the time is already past.
+//
+// The command is propagated as a HPEXPIREAT of the fields set, or a HDEL of
+// the fields deleted, so that the fields expire at the same time when the
+// AOF is loaded.
+func hexpireGenericCommand(cli client, basetime int64, unit time.Duration) bool {
+	key, argv := cli.Key(), cli.Argv()
+	when, err := strconv.ParseInt(string(argv[2]), 10, 64)
+	if err != nil {
+		cli.AddReplyError(common.Shared["notinteger"])
+		return ERR
+	}
+	if when < 0 {
+		cli.AddReplyError([]byte("invalid expire time, must be >= 0"))
+		return ERR
+	}
+	if unit == time.Second {
+		if when > hexpireMaxTime/1000 {
+			cli.AddReplyErrorFormat("invalid expire time in '%s' command", bytes.ToLower(argv[0]))
+			return ERR
+		}
+		when *= 1000
+	}
+	if when > hexpireMaxTime-basetime {
+		cli.AddReplyErrorFormat("invalid expire time in '%s' command", bytes.ToLower(argv[0]))
+		return ERR
+	}
+	when += basetime
+
+	cond, at := "", 3
+	switch opt := string(bytes.ToLower(argv[3])); opt {
+	case "nx", "xx", "gt", "lt":
+		cond, at = opt, at+1
+	}
+	fields, ok := parseFields(cli, at)
+	if !ok {
+		return ERR
+	}
+	val, ok := lookupHash(cli, true)
+	if !ok {
+		return ERR
+	}
+
+	cli.AddReplyMultibulkLen(int64(len(fields)))
+	if val == nil {
+		for range fields {
+			cli.AddReplyInt64(hexpireNoField)
+		}
+		return OK
+	}
+	now := time.Now().UnixMilli()
+	var set, deleted [][]byte
+	for _, field := range fields {
+		switch {
+		case !hash.Exists(val, field):
+			cli.AddReplyInt64(hexpireNoField)
+		case !hexpireConditionMet(cond, hash.GetExpire(val, field), when):
+			cli.AddReplyInt64(hexpireNotSet)
+		case when <= now:
+			hash.Del(val, field)
+			deleted = append(deleted, field)
+			cli.AddReplyInt64(hexpireDeleted)
+		default:
+			hash.SetExpire(val, field, when)
+			set = append(set, field)
+			cli.AddReplyInt64(hexpireSet)
+		}
+	}
+
+	// The fields are either all deleted or all set, since they have the
+	// same expire.
+	if len(deleted) > 0 {
+		if hash.Len(val) == 0 {
+			cli.DelKey(key)
+		}
+		cli.SetArgument(append([][]byte{[]byte("HDEL"), []byte(key)}, deleted...))
+		cli.AddDirty(len(deleted))
+	} else if len(set) > 0 {
+		cli.TrackFieldExpires(key)
+		cli.SetArgument(append([][]byte{[]byte("HPEXPIREAT"), []byte(key),
+			strconv.AppendInt(nil, when, 10), []byte("FIELDS"),
+			strconv.AppendInt(nil, int64(len(set)), 10)}, set...))
+		cli.AddDirty(len(set))
+	}
+	return OK
+}
+
+// hexpireConditionMet tells whether the expire of a field may be changed
+// from expire to when, according to the NX, XX, GT or LT option of HEXPIRE.
+// A field without a TTL is taken as one which never expires.
+func hexpireConditionMet(cond string, expire, when int64) bool {
+	switch cond {
+	case "nx":
+		return expire == hash.NoExpire
+	case "xx":
+		return expire != hash.NoExpire
+	case "gt":
+		return expire != hash.NoExpire && when > expire
+	case "lt":
+		return expire == hash.NoExpire || when < expire
+	}
+	return true
+}
+
+// parseFields returns the fields of the FIELDS numfields field [field ...]
+// arguments, which start at argv[at] and end the command.
+func parseFields(cli client, at int) ([][]byte, bool) {
+	argv := cli.Argv()
+	if at+1 >= len(argv) || !bytes.EqualFold(argv[at], []byte("fields")) {
+		cli.AddReplyError([]byte("Mandatory argument FIELDS is missing or not at the right position"))
+		return nil, false
+	}
+	n, err := strconv.ParseInt(string(argv[at+1]), 10, 64)
+	if err != nil || n < 1 {
+		cli.AddReplyError([]byte("Number of fields must be a positive integer"))
+		return nil, false
+	}
+	if n != int64(len(argv)-at-2) {
+		cli.AddReplyError([]byte("The `numfields` parameter must match the number of arguments"))
+		return nil, false
+	}
+	return argv[at+2:], true
+}
+
+// HTTL key FIELDS numfields field [field ...]
+func HTTLCommand(cli client) bool {
+	return httlGenericCommand(cli, time.Now().UnixMilli(), time.Second)
+}
+
+// HPTTL key FIELDS numfields field [field ...]
+func HPTTLCommand(cli client) bool {
+	return httlGenericCommand(cli, time.Now().UnixMilli(), time.Millisecond)
+}
+
+// HEXPIRETIME key FIELDS numfields field [field ...]
+func HExpireTimeCommand(cli client) bool {
+	return httlGenericCommand(cli, 0, time.Second)
+}
+
+// HPEXPIRETIME key FIELDS numfields field [field ...]
+func HPExpireTimeCommand(cli client) bool {
+	return httlGenericCommand(cli, 0, time.Millisecond)
+}
+
+// httlGenericCommand replies for every field the time left from basetime
+// to its expire in unit, which is the unix time of the expire if basetime
+// is 0, rounded up to the second. It is -2 if the field doesn't exist and
+// -1 if it has no TTL.
+func httlGenericCommand(cli client, basetime int64, unit time.Duration) bool {
+	fields, ok := parseFields(cli, 2)
+	if !ok {
+		return ERR
+	}
+	val, ok := lookupHash(cli, false)
+	if !ok {
+		return ERR
+	}
+
+	cli.AddReplyMultibulkLen(int64(len(fields)))
+	for _, field := range fields {
+		if val == nil || !hash.Exists(val, field) {
+			cli.AddReplyInt64(hfieldNoField)
+			continue
+		}
+		expire := hash.GetExpire(val, field)
+		if expire == hash.NoExpire {
+			cli.AddReplyInt64(hfieldNoTTL)
+		} else if unit == time.Second {
+			cli.AddReplyInt64((expire + 999 - basetime) / 1000)
+		} else {
+			cli.AddReplyInt64(expire - basetime)
+		}
+	}
+	return OK
+}
+
+// HPERSIST key FIELDS numfields field [field ...]
+// Removes the TTL of the fields, and replies for every field -2 if it
+// doesn't exist, -1 if it has no TTL, and 1 if the TTL is removed.
+func HPersistCommand(cli client) bool {
+	key := cli.Key()
+	fields, ok := parseFields(cli, 2)
+	if !ok {
+		return ERR
+	}
+	val, ok := lookupHash(cli, true)
+	if !ok {
+		return ERR
+	}
+
+	cli.AddReplyMultibulkLen(int64(len(fields)))
+	persisted := 0
+	for _, field := range fields {
+		switch {
+		case val == nil || !hash.Exists(val, field):
+			cli.AddReplyInt64(hfieldNoField)
+		case !hash.Persist(val, field):
+			cli.AddReplyInt64(hfieldNoTTL)
+		default:
+			persisted++
+			cli.AddReplyInt64(hfieldPersisted)
+		}
+	}
+	if persisted > 0 {
+		cli.TrackFieldExpires(key)
+		cli.AddDirty(persisted)
 	}
 	return OK
 }
@@ -149,7 +149,8 @@ func LTrimCommand(cli client) bool {
 		cli.AddReplyError(common.Shared["invalidindex"])
 		return ERR
 	}
-	list.Trim(val, start, end)
+	// The end of LTRIM is included.
+	list.Trim(val, start, end+1)
 	cli.AddReplyStatus(common.Shared["ok"])
 	return OK
 }
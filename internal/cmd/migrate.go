@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sunminx/RDB/internal/common"
+	"github.com/sunminx/RDB/internal/sds"
+)
+
+// DUMP key
+// Replies with the value of key serialized in the RDB format, followed by
+// the RDB version and a CRC64 checksum.
+func DumpCommand(cli client) bool {
+	val, ok := cli.LookupKeyRead(cli.Key())
+	if !ok {
+		cli.AddReplyRaw(common.Shared["nullbulk"])
+		return OK
+	}
+	cli.AddReplyBulk(sds.NewRobj(sds.New(cli.DumpObject(val))))
+	return OK
+}
+
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+// Creates key from the payload of DUMP. There is no eviction policy, so
+// IDLETIME and FREQ are only validated.
+func RestoreCommand(cli client) bool {
+	key, argv := cli.Key(), cli.Argv()
+	var replace, absttl bool
+	idle, freq := int64(-1), int64(-1)
+	for j := 4; j < len(argv); j++ {
+		moreargs := len(argv) - 1 - j
+		switch opt := strings.ToLower(string(argv[j])); {
+		case opt == "replace":
+			replace = true
+		case opt == "absttl":
+			absttl = true
+		case opt == "idletime" && moreargs > 0 && freq == -1:
+			j++
+			n, err := strconv.ParseInt(string(argv[j]), 10, 64)
+			if err != nil {
+				cli.AddReplyError(common.Shared["notinteger"])
+				return ERR
+			}
+			if n < 0 {
+				cli.AddReplyError([]byte("Invalid IDLETIME value, must be >= 0"))
+				return ERR
+			}
+			idle = n
+		case opt == "freq" && moreargs > 0 && idle == -1:
+			j++
+			n, err := strconv.ParseInt(string(argv[j]), 10, 64)
+			if err != nil {
+				cli.AddReplyError(common.Shared["notinteger"])
+				return ERR
+			}
+			if n < 0 || n > 255 {
+				cli.AddReplyError([]byte("Invalid FREQ value, must be >= 0 and <= 255"))
+				return ERR
+			}
+			freq = n
+		default:
+			cli.AddReplyError(common.Shared["syntaxerr"])
+			return ERR
+		}
+	}
+
+	ttl, err := strconv.ParseInt(string(argv[2]), 10, 64)
+	if err != nil {
+		cli.AddReplyError(common.Shared["notinteger"])
+		return ERR
+	}
+	if ttl < 0 {
+		cli.AddReplyError([]byte("Invalid TTL value, must be >= 0"))
+		return ERR
+	}
+	_, exists := cli.LookupKeyRead(key)
+	if exists && !replace {
+		cli.AddReplyError([]byte("-BUSYKEY Target key name already exists."))
+		return ERR
+	}
+	val, err := cli.RestoreObject(argv[3])
+	if err != nil {
+		cli.AddReplyError([]byte(err.Error()))
+		return ERR
+	}
+
+	now := time.Now().UnixMilli()
+	if ttl > 0 && !absttl {
+		ttl += now
+	}
+	// An already expired key is not created, the old one is deleted anyway.
+	if ttl > 0 && ttl <= now {
+		if exists {
+			cli.DelKey(key)
+			cli.SetArgument([][]byte{[]byte("DEL"), argv[1]})
+			cli.AddDirty(1)
+		}
+		cli.AddReplyStatus(common.Shared["ok"])
+		return OK
+	}
+	if exists {
+		cli.DelKey(key)
+	}
+	cli.SetKey(key, val)
+	if ttl > 0 {
+		cli.SetExpire(key, time.Duration(ttl))
+		// The TTL is propagated as an absolute time, so that the key
+		// expires at the same time when the AOF is loaded.
+		if !absttl {
+			argv = append(slices.Clone(argv), []byte("ABSTTL"))
+			argv[2] = []byte(strconv.FormatInt(ttl, 10))
+			cli.SetArgument(argv)
+		}
+	}
+	cli.AddDirty(1)
+	cli.AddReplyStatus(common.Shared["ok"])
+	return OK
+}
+
+// MigrateOptions are the arguments of MIGRATE.
+type MigrateOptions struct {
+	Host    string
+	Port    int
+	DB      int
+	Timeout time.Duration
+	Copy    bool
+	Replace bool
+	// Auth is the password, or the username and the password.
+	Auth []string
+	Keys []string
+}
+
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key ...]
+// Moves the keys to another instance by RESTORE, they are deleted here
+// once the target instance has created them, unless COPY is given.
+func MigrateCommand(cli client) bool {
+	argv := cli.Argv()
+	opts := &MigrateOptions{Host: string(argv[1])}
+	var err error
+	if opts.Port, err = strconv.Atoi(string(argv[2])); err != nil {
+		cli.AddReplyError(common.Shared["notinteger"])
+		return ERR
+	}
+	if opts.DB, err = strconv.Atoi(string(argv[4])); err != nil {
+		cli.AddReplyError(common.Shared["notinteger"])
+		return ERR
+	}
+	timeout, err := strconv.ParseInt(string(argv[5]), 10, 64)
+	if err != nil {
+		cli.AddReplyError(common.Shared["notinteger"])
+		return ERR
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+	opts.Timeout = time.Duration(timeout) * time.Millisecond
+
+	first := 3
+	for j := 6; j < len(argv); j++ {
+		moreargs := len(argv) - 1 - j
+		switch opt := strings.ToLower(string(argv[j])); {
+		case opt == "copy":
+			opts.Copy = true
+		case opt == "replace":
+			opts.Replace = true
+		case opt == "auth" && moreargs > 0:
+			j++
+			opts.Auth = []string{string(argv[j])}
+		case opt == "auth2" && moreargs > 1:
+			opts.Auth = []string{string(argv[j+1]), string(argv[j+2])}
+			j += 2
+		case opt == "keys":
+			if len(argv[3]) != 0 {
+				cli.AddReplyError([]byte("When using MIGRATE KEYS option, the key argument" +
+					" must be set to the empty string"))
+				return ERR
+			}
+			first = j + 1
+			j = len(argv)
+		default:
+			cli.AddReplyError(common.Shared["syntaxerr"])
+			return ERR
+		}
+	}
+	last := len(argv) - 1
+	if first == 3 {
+		last = 3
+	}
+	for j := first; j <= last; j++ {
+		opts.Keys = append(opts.Keys, string(argv[j]))
+	}
+
+	n, err := cli.Migrate(opts)
+	if err != nil {
+		cli.AddReplyError([]byte(err.Error()))
+		return ERR
+	}
+	if n == 0 {
+		cli.AddReplyStatus([]byte("NOKEY"))
+		return OK
+	}
+	cli.AddReplyStatus(common.Shared["ok"])
+	return OK
+}
+
+// MigrateGetKeys returns the keys of MIGRATE, which are given either
+// as the third argument, or after KEYS when it is empty.
+func MigrateGetKeys(argv [][]byte) [][]byte {
+	if len(argv) > 6 && len(argv[3]) == 0 {
+		for j := 6; j < len(argv); j++ {
+			switch strings.ToLower(string(argv[j])) {
+			case "auth":
+				j++
+			case "auth2":
+				j += 2
+			case "keys":
+				return argv[j+1:]
+			}
+		}
+	}
+	return argv[3:4]
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/sunminx/RDB/internal/common"
+)
+
+// SAVE
+// Saves the RDB file in the foreground, all the clients are blocked.
+func SaveCommand(cli client) bool {
+	if err := cli.Save(); err != nil {
+		cli.AddReplyError([]byte(err.Error()))
+		return ERR
+	}
+	cli.AddReplyStatus(common.Shared["ok"])
+	return OK
+}
+
+// BGSAVE [SCHEDULE]
+// With SCHEDULE the save is queued when an AOF rewrite is running or the
+// RDB is being transferred to the replicas, instead of failing.
+func BgsaveCommand(cli client) bool {
+	argv := cli.Argv()
+	schedule := false
+	if len(argv) > 1 {
+		if len(argv) > 2 || !strings.EqualFold(string(argv[1]), "schedule") {
+			cli.AddReplyError(common.Shared["syntaxerr"])
+			return ERR
+		}
+		schedule = true
+	}
+	scheduled, err := cli.Bgsave(schedule)
+	if err != nil {
+		cli.AddReplyError([]byte(err.Error()))
+		return ERR
+	}
+	if scheduled {
+		cli.AddReplyStatus([]byte("Background saving scheduled"))
+	} else {
+		cli.AddReplyStatus([]byte("Background saving started"))
+	}
+	return OK
+}
+
+// BGREWRITEAOF
+func BgrewriteaofCommand(cli client) bool {
+	if err := cli.BgrewriteAof(); err != nil {
+		cli.AddReplyError([]byte(err.Error()))
+		return ERR
+	}
+	cli.AddReplyStatus([]byte("Background append only file rewriting started"))
+	return OK
+}
+
+// LASTSAVE
+// Returns the unix time of the last successful save.
+func LastsaveCommand(cli client) bool {
+	cli.AddReplyInt64(cli.LastSave())
+	return OK
+}
+
+// BACKUP LIST
+// BACKUP RESTORE <name>
+// The backup is restored at the next startup.
+func BackupCommand(cli client) bool {
+	argv := cli.Argv()
+	subcommand := strings.ToLower(string(argv[1]))
+	switch {
+	case subcommand == "list" && len(argv) == 2:
+		if err := cli.BackupList(); err != nil {
+			cli.AddReplyError([]byte(err.Error()))
+			return ERR
+		}
+	case subcommand == "restore" && len(argv) == 3:
+		if err := cli.BackupRestore(string(argv[2])); err != nil {
+			cli.AddReplyError([]byte(err.Error()))
+			return ERR
+		}
+		cli.AddReplyStatus(common.Shared["ok"])
+	default:
+		cli.AddReplyErrorFormat("unknown subcommand or wrong number of arguments for '%s'", argv[1])
+		return ERR
+	}
+	return OK
+}
+
+// The options of SHUTDOWN.
+const (
+	ShutdownNosave = 1 << iota
+	ShutdownSave
+	ShutdownNow
+	ShutdownForce
+	ShutdownAbort
+)
+
+// SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE] [ABORT]
+// On success the connection is closed without a reply.
+func ShutdownCommand(cli client) bool {
+	argv := cli.Argv()
+	flags := 0
+	for _, arg := range argv[1:] {
+		switch strings.ToLower(string(arg)) {
+		case "nosave":
+			flags |= ShutdownNosave
+		case "save":
+			flags |= ShutdownSave
+		case "now":
+			flags |= ShutdownNow
+		case "force":
+			flags |= ShutdownForce
+		case "abort":
+			flags |= ShutdownAbort
+		default:
+			cli.AddReplyError(common.Shared["syntaxerr"])
+			return ERR
+		}
+	}
+	if (flags&ShutdownAbort != 0 && flags != ShutdownAbort) ||
+		(flags&ShutdownNosave != 0 && flags&ShutdownSave != 0) {
+		cli.AddReplyError(common.Shared["syntaxerr"])
+		return ERR
+	}
+	if err := cli.Shutdown(flags); err != nil {
+		cli.AddReplyError([]byte(err.Error()))
+		return ERR
+	}
+	if flags&ShutdownAbort != 0 {
+		cli.AddReplyStatus(common.Shared["ok"])
+	}
+	return OK
+}
@@ -0,0 +1,29 @@
+package cmd
+
+// SUBSCRIBE channel [channel ...]
+func SubscribeCommand(cli client) bool {
+	cli.Subscribe(stringArgs(cli.Argv()[1:]))
+	return OK
+}
+
+// UNSUBSCRIBE [channel [channel ...]]
+func UnsubscribeCommand(cli client) bool {
+	cli.Unsubscribe(stringArgs(cli.Argv()[1:]))
+	return OK
+}
+
+// PUBLISH channel message
+func PublishCommand(cli client) bool {
+	argv := cli.Argv()
+	receivers := cli.Publish(string(argv[1]), argv[2])
+	cli.AddReplyInt64(int64(receivers))
+	return OK
+}
+
+func stringArgs(argv [][]byte) []string {
+	args := make([]string, 0, len(argv))
+	for _, arg := range argv {
+		args = append(args, string(arg))
+	}
+	return args
+}
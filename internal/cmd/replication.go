@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sunminx/RDB/internal/common"
+)
+
+// REPLICAOF host port | NO ONE
+func ReplicaOfCommand(cli client) bool {
+	argv := cli.Argv()
+	host, port := string(argv[1]), string(argv[2])
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		if err := cli.ReplicaOf("", 0); err != nil {
+			cli.AddReplyError([]byte(err.Error()))
+			return ERR
+		}
+		cli.AddReplyStatus(common.Shared["ok"])
+		return OK
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		cli.AddReplyError([]byte("Invalid master port"))
+		return ERR
+	}
+	if err := cli.ReplicaOf(host, n); err != nil {
+		cli.AddReplyError([]byte(err.Error()))
+		return ERR
+	}
+	cli.AddReplyStatus(common.Shared["ok"])
+	return OK
+}
+
+// SYNC is the legacy full synchronization request, it never
+// accepts a partial resynchronization.
+func SyncCommand(cli client) bool {
+	cli.Psync("", -1)
+	return OK
+}
+
+// PSYNC replid offset
+func PsyncCommand(cli client) bool {
+	argv := cli.Argv()
+	offset, err := strconv.ParseInt(string(argv[2]), 10, 64)
+	if err != nil {
+		cli.AddReplyError(common.Shared["notinteger"])
+		return ERR
+	}
+	cli.Psync(string(argv[1]), offset)
+	return OK
+}
+
+// REPLCONF <option> <value> <option> <value> ...
+// This command is used by a replica in order to configure the replication
+// process before starting it with the SYNC / PSYNC command, and by the
+// replica to report the processed offset to the master.
+func ReplconfCommand(cli client) bool {
+	argv := cli.Argv()
+	if len(argv)%2 == 0 {
+		cli.AddReplyError(common.Shared["syntaxerr"])
+		return ERR
+	}
+
+	for i := 1; i < len(argv); i += 2 {
+		option, value := strings.ToLower(string(argv[i])), string(argv[i+1])
+		switch option {
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				cli.AddReplyError(common.Shared["notinteger"])
+				return ERR
+			}
+			cli.ReplconfListeningPort(port)
+		case "capa":
+			// We only support the psync2 and eof capabilities, other
+			// capabilities are ignored for forward compatibility.
+			cli.ReplconfCapa(value)
+		case "ack":
+			// REPLCONF ACK is used by replica to inform the master the amount
+			// of replication stream that it processed so far. It is an
+			// internal only command that normal clients should never use,
+			// so no reply is sent back.
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return ERR
+			}
+			// The optional FACK reports the offset fsynced to the AOF.
+			aofOffset := int64(-1)
+			if i+3 < len(argv) && strings.EqualFold(string(argv[i+2]), "fack") {
+				aofOffset, err = strconv.ParseInt(string(argv[i+3]), 10, 64)
+				if err != nil {
+					return ERR
+				}
+			}
+			cli.ReplconfAck(offset, aofOffset)
+			return OK
+		case "getack":
+			// REPLCONF GETACK is used in order to request an ACK ASAP
+			// to the replica.
+			cli.ReplconfGetAck()
+			return OK
+		default:
+			cli.AddReplyErrorFormat("Unrecognized REPLCONF option: %s", option)
+			return ERR
+		}
+	}
+	cli.AddReplyStatus(common.Shared["ok"])
+	return OK
+}
+
+func RoleCommand(cli client) bool {
+	cli.Role()
+	return OK
+}
+
+// WAIT numreplicas timeout
+// Blocks the client until all the previous write commands are acknowledged
+// by at least numreplicas replicas, or the timeout in milliseconds is reached.
+func WaitCommand(cli client) bool {
+	argv := cli.Argv()
+	numreplicas, err := strconv.Atoi(string(argv[1]))
+	if err != nil {
+		cli.AddReplyError(common.Shared["notinteger"])
+		return ERR
+	}
+	timeout, ok := getTimeout(cli, argv[2])
+	if !ok {
+		return ERR
+	}
+	cli.Wait(numreplicas, timeout)
+	return OK
+}
+
+// WAITAOF numlocal numreplicas timeout
+// Blocks the client until all the previous write commands are fsynced to the
+// AOF of the local server and of at least numreplicas replicas.
+//
+// Note that only a real fsync counts, so with appendfsync no the client is
+// only unblocked by the timeout.
+func WaitaofCommand(cli client) bool {
+	argv := cli.Argv()
+	numlocal, err := strconv.Atoi(string(argv[1]))
+	if err != nil {
+		cli.AddReplyError(common.Shared["notinteger"])
+		return ERR
+	}
+	numreplicas, err := strconv.Atoi(string(argv[2]))
+	if err != nil {
+		cli.AddReplyError(common.Shared["notinteger"])
+		return ERR
+	}
+	timeout, ok := getTimeout(cli, argv[3])
+	if !ok {
+		return ERR
+	}
+	cli.WaitAof(numlocal, numreplicas, timeout)
+	return OK
+}
+
+// getTimeout parses a timeout in milliseconds, 0 means no timeout.
+func getTimeout(cli client, arg []byte) (int64, bool) {
+	timeout, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		cli.AddReplyError([]byte("timeout is not an integer or out of range"))
+		return 0, false
+	}
+	if timeout < 0 {
+		cli.AddReplyError([]byte("timeout is negative"))
+		return 0, false
+	}
+	return timeout, true
+}
@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"bytes"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sunminx/RDB/internal/common"
@@ -25,18 +28,45 @@ func GetCommand(cli client) bool {
 	return OK
 }
 
+// SET key value [EX seconds|PX milliseconds|EXAT unix-time-seconds|PXAT unix-time-milliseconds]
 func SetCommand(cli client) bool {
 	key, argv := cli.Key(), cli.Argv()
-	for i := 2; i < len(argv); i++ {
-		_ = setGenericCommand(cli, key, argv[i], nil)
+	var when int64
+	if len(argv) > 3 {
+		var unit time.Duration
+		var absolute bool
+		switch strings.ToLower(string(argv[3])) {
+		case "ex":
+			unit = time.Second
+		case "px":
+			unit = time.Millisecond
+		case "exat":
+			unit, absolute = time.Second, true
+		case "pxat":
+			unit, absolute = time.Millisecond, true
+		}
+		if unit == 0 || len(argv) != 5 {
+			cli.AddReplyError(common.Shared["syntaxerr"])
+			return ERR
+		}
+		var ok bool
+		if when, ok = parseExpire(cli, argv[4], unit, absolute); !ok {
+			return ERR
+		}
 	}
+	setGenericCommand(cli, key, argv[2], when)
 	cli.AddReplyStatus(common.Shared["ok"])
 	return OK
 }
 
+// SETEX key seconds value
 func SetexCommand(cli client) bool {
 	key, argv := cli.Key(), cli.Argv()
-	_ = setGenericCommand(cli, key, argv[3], argv[2])
+	when, ok := parseExpire(cli, argv[2], time.Second, false)
+	if !ok {
+		return ERR
+	}
+	setGenericCommand(cli, key, argv[3], when)
 	cli.AddReplyStatus(common.Shared["ok"])
 	return OK
 }
@@ -45,7 +75,7 @@ func AppendCommand(cli client) bool {
 	key, argv := cli.Key(), cli.Argv()
 	val, ok := cli.LookupKeyRead(key)
 	if !ok {
-		_ = setGenericCommand(cli, key, argv[2], nil)
+		setGenericCommand(cli, key, argv[2], 0)
 		return OK
 	}
 	if !val.CheckType(obj.TypeString) {
@@ -54,31 +84,45 @@ func AppendCommand(cli client) bool {
 	}
 
 	sds.Append(val, argv[2])
-	_ = setGenericCommand(cli, key, val.Val().(sds.SDS), nil)
+	setGenericCommand(cli, key, val.Val().(sds.SDS), 0)
 
 	cli.AddReplyBulk(val)
 	return OK
 }
 
-func setGenericCommand(cli client, key string, val, expire []byte) bool {
-	var milliseconds int64
-	if expire != nil {
-		var err error
-		milliseconds, err = strconv.ParseInt(string(expire), 10, 64)
-		if err != nil {
-			cli.AddReplyErrorFormat(`invalid expire time in %s`, key)
-			return OK
-		}
-		milliseconds *= 1000
-	}
-
+// setGenericCommand sets key to val, and its expire to when, a unix time in
+// milliseconds, if not 0. The expire is propagated as SET key val PXAT when,
+// so that the key expires at the same time on the replicas and when the AOF
+// is loaded.
+func setGenericCommand(cli client, key string, val []byte, when int64) {
 	cli.SetKey(key, sds.NewRobj(val))
-	if milliseconds > 0 {
-		now := time.Now().UnixMilli()
-		cli.SetExpire(key, time.Duration(now+milliseconds))
+	if when != 0 {
+		cli.SetExpire(key, time.Duration(when))
+		cli.SetArgument([][]byte{[]byte("SET"), []byte(key), val,
+			[]byte("PXAT"), strconv.AppendInt(nil, when, 10)})
 	}
 	cli.AddDirty(1)
-	return OK
+}
+
+// parseExpire returns the expire of a key as a unix time in milliseconds,
+// from expire in unit, relative to now unless absolute.
+func parseExpire(cli client, expire []byte, unit time.Duration, absolute bool) (int64, bool) {
+	when, err := strconv.ParseInt(string(expire), 10, 64)
+	if err != nil {
+		cli.AddReplyError(common.Shared["notinteger"])
+		return 0, false
+	}
+	var basetime int64
+	if !absolute {
+		basetime = time.Now().UnixMilli()
+	}
+	scale := int64(unit / time.Millisecond)
+	if when <= 0 || when > (math.MaxInt64-basetime)/scale {
+		cli.AddReplyErrorFormat("invalid expire time in '%s' command",
+			bytes.ToLower(cli.Argv()[0]))
+		return 0, false
+	}
+	return when*scale + basetime, true
 }
 
 func StrlenCommand(cli client) bool {
@@ -97,14 +141,31 @@ func StrlenCommand(cli client) bool {
 }
 
 func DelCommand(cli client) bool {
+	return delGenericCommand(cli, false)
+}
+
+// UNLINK key [key ...]
+// Like DEL, but the values are released in background.
+func UnlinkCommand(cli client) bool {
+	return delGenericCommand(cli, true)
+}
+
+func delGenericCommand(cli client, lazy bool) bool {
 	var numdel int64
 	argv := cli.Argv()
 	for i := 1; i < len(argv); i++ {
-		cli.DelKey(string(argv[i]))
-		numdel += 1
+		var deleted bool
+		if lazy {
+			deleted = cli.AsyncDelete(string(argv[i]))
+		} else {
+			deleted = cli.SyncDelete(string(argv[i]))
+		}
+		if deleted {
+			numdel += 1
+		}
 	}
 	cli.AddReplyInt64(numdel)
-	cli.AddDirty(1)
+	cli.AddDirty(int(numdel))
 	return OK
 }
 
@@ -121,6 +182,26 @@ func ExistsCommand(cli client) bool {
 	return OK
 }
 
+// PEXPIREAT key unix-time-milliseconds
+// A time in the past expires the key at once, its deletion is propagated by
+// the expiration, like any other.
+func PExpireAtCommand(cli client) bool {
+	key, argv := cli.Key(), cli.Argv()
+	when, err := strconv.ParseInt(string(argv[2]), 10, 64)
+	if err != nil {
+		cli.AddReplyError(common.Shared["notinteger"])
+		return ERR
+	}
+	if _, ok := cli.LookupKeyWrite(key); !ok {
+		cli.AddReplyRaw(common.Shared["czero"])
+		return OK
+	}
+	cli.SetExpire(key, time.Duration(when))
+	cli.AddDirty(1)
+	cli.AddReplyRaw(common.Shared["cone"])
+	return OK
+}
+
 func IncrCommand(cli client) bool {
 	return incrdecrCommand(cli, cli.Key(), 1)
 }
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sunminx/RDB/internal/common"
+)
+
+// SENTINEL <subcommand> [<arg> ...]
+func SentinelCommand(cli client) bool {
+	argv := cli.Argv()
+	subcommand := strings.ToLower(string(argv[1]))
+	switch {
+	case subcommand == "myid" && len(argv) == 2:
+		cli.SentinelMyId()
+	case subcommand == "masters" && len(argv) == 2:
+		cli.SentinelMasters()
+	case subcommand == "master" && len(argv) == 3:
+		cli.SentinelMaster(string(argv[2]))
+	case (subcommand == "replicas" || subcommand == "slaves") && len(argv) == 3:
+		cli.SentinelReplicas(string(argv[2]))
+	case subcommand == "sentinels" && len(argv) == 3:
+		cli.SentinelSentinels(string(argv[2]))
+	case subcommand == "get-master-addr-by-name" && len(argv) == 3:
+		cli.SentinelGetMasterAddrByName(string(argv[2]))
+	case subcommand == "is-master-down-by-addr" && len(argv) == 6:
+		// SENTINEL IS-MASTER-DOWN-BY-ADDR <ip> <port> <current-epoch> <runid>
+		//
+		// Arguments:
+		//
+		// 1) We want to know if someone else believes the master at ip:port
+		//    is down from its point of view.
+		// 2) Sentinels send the current epoch so that the voted leader is
+		//    associated to the epoch.
+		// 3) runid is "*" if we are not seeking for a vote, otherwise the
+		//    runid of the sentinel asking for the vote.
+		port, err := strconv.Atoi(string(argv[3]))
+		if err != nil {
+			cli.AddReplyError(common.Shared["notinteger"])
+			return ERR
+		}
+		epoch, err := strconv.ParseUint(string(argv[4]), 10, 64)
+		if err != nil {
+			cli.AddReplyError(common.Shared["notinteger"])
+			return ERR
+		}
+		cli.SentinelIsMasterDownByAddr(string(argv[2]), port, epoch, string(argv[5]))
+	case subcommand == "failover" && len(argv) == 3:
+		cli.SentinelFailover(string(argv[2]))
+	case subcommand == "reset" && len(argv) == 3:
+		cli.AddReplyInt64(int64(cli.SentinelReset(string(argv[2]))))
+	case subcommand == "monitor" && len(argv) == 6:
+		// SENTINEL MONITOR <name> <ip> <port> <quorum>
+		port, err := strconv.Atoi(string(argv[4]))
+		if err != nil || port <= 0 || port > 65535 {
+			cli.AddReplyErrorFormat("Invalid port: %s", argv[4])
+			return ERR
+		}
+		quorum, err := strconv.Atoi(string(argv[5]))
+		if err != nil || quorum <= 0 {
+			cli.AddReplyError([]byte("Quorum must be 1 or greater."))
+			return ERR
+		}
+		return sentinelReplyOk(cli, cli.SentinelMonitor(string(argv[2]), string(argv[3]), port, quorum))
+	case subcommand == "remove" && len(argv) == 3:
+		return sentinelReplyOk(cli, cli.SentinelRemove(string(argv[2])))
+	case subcommand == "set" && len(argv) >= 5 && len(argv)%2 == 1:
+		// SENTINEL SET <name> <option> <value> [<option> <value> ...]
+		return sentinelReplyOk(cli, cli.SentinelSet(string(argv[2]), stringArgs(argv[3:])))
+	case subcommand == "ckquorum" && len(argv) == 3:
+		cli.SentinelCkquorum(string(argv[2]))
+	case subcommand == "flushconfig" && len(argv) == 2:
+		return sentinelReplyOk(cli, cli.SentinelFlushConfig())
+	default:
+		cli.AddReplyErrorFormat("unknown subcommand '%s'. Try SENTINEL HELP.", argv[1])
+		return ERR
+	}
+	return OK
+}
+
+func sentinelReplyOk(cli client, err error) bool {
+	if err != nil {
+		cli.AddReplyError([]byte(err.Error()))
+		return ERR
+	}
+	cli.AddReplyStatus(common.Shared["ok"])
+	return OK
+}
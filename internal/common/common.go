@@ -1,11 +1,16 @@
 package common
 
 var Shared map[string][]byte = map[string][]byte{
-	"wrongtypeerr": []byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"),
+	"wrongtypeerr": []byte("-WRONGTYPE Operation against a key holding the wrong kind of value"),
 	"crlf":         []byte("\r\n"),
 	"ok":           []byte("OK"),
 	"czero":        []byte(":0\r\n"),
 	"cone":         []byte(":1\r\n"),
 	"nullbulk":     []byte("$-1\r\n"),
 	"invalidindex": []byte("invalid index value"),
+	"pong":         []byte("PONG"),
+	"notinteger":   []byte("value is not an integer or out of range"),
+	"syntaxerr":    []byte("syntax error"),
+	"roslaveerr":   []byte("-READONLY You can't write against a read only replica."),
+	"loadingerr":   []byte("-LOADING Redis is loading the dataset in memory"),
 }
@@ -11,9 +11,13 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/sunminx/RDB/internal/list"
 	"github.com/sunminx/RDB/internal/networking"
 )
 
+// maxIoThreads is the maximum value of io-threads.
+const maxIoThreads = 128
+
 // Load load RDB config file
 func Load(server *networking.Server, filename string) {
 	var err error
@@ -23,6 +27,7 @@ func Load(server *networking.Server, filename string) {
 		goto loaderr
 	}
 	defer file.Close()
+	server.ConfigFile = filename
 	{
 		scanner := bufio.NewScanner(file)
 		for scanner.Scan() {
@@ -78,6 +83,52 @@ func Load(server *networking.Server, filename string) {
 				server.LogPath = logfile
 			case argv[0] == "dbfilename" && len(argv) == 2:
 				server.RdbFilename = argv[1]
+			case argv[0] == "rdbcompression" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.RdbCompression = yesorno
+			case argv[0] == "aof-timestamp-enabled" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.AofTimestampEnabled = yesorno
+			case argv[0] == "rdbchecksum" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.RdbChecksum = yesorno
+			case argv[0] == "rdb-skip-unsupported-types" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.RdbSkipUnsupported = yesorno
+			case argv[0] == "backup-dir" && len(argv) == 2:
+				server.BackupDir = strings.Trim(argv[1], "\"")
+			case argv[0] == "backup-interval" && len(argv) == 2:
+				var interval int
+				interval, err = strconv.Atoi(argv[1])
+				if err != nil || interval < 0 {
+					err = errors.New("invalid backup-interval value")
+					goto loaderr
+				}
+				server.BackupInterval = interval
+			case argv[0] == "backup-keep" && len(argv) == 2:
+				var keep int
+				keep, err = strconv.Atoi(argv[1])
+				if err != nil || keep < 0 {
+					err = errors.New("invalid backup-keep value")
+					goto loaderr
+				}
+				server.BackupKeep = keep
 			case argv[0] == "save":
 				if len(argv) == 3 {
 					seconds, err := strconv.Atoi(argv[1])
@@ -104,6 +155,25 @@ func Load(server *networking.Server, filename string) {
 				if argv[1] == "yes" {
 					server.AofState = 1
 				}
+			case argv[0] == "appendfsync" && len(argv) == 2:
+				switch strings.ToLower(argv[1]) {
+				case "no":
+					server.AofFsync = networking.AofFsyncNo
+				case "everysec":
+					server.AofFsync = networking.AofFsyncSec
+				case "always":
+					server.AofFsync = networking.AofFsyncAlways
+				default:
+					err = errors.New("argument must be 'no', 'always' or 'everysec'")
+					goto loaderr
+				}
+			case argv[0] == "no-appendfsync-on-rewrite" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.AofNoFsyncOnRewrite = yesorno
 			case argv[0] == "appendfilename" && len(argv) == 2:
 				filename := strings.Trim(argv[1], "\"")
 				server.AofFilename = filename
@@ -115,25 +185,189 @@ func Load(server *networking.Server, filename string) {
 				if argv[1] == "0" {
 					break
 				}
-				re := regexp.MustCompile(`(\d+)([k|kb|m|mb|g|gb])`)
-				mt := re.FindStringSubmatch(argv[1])
-				if len(mt) == 3 {
-					v, _ := strconv.ParseInt(mt[1], 10, 64)
-					unit := mt[2]
-					if unit == "k" {
-						server.AofRewriteMinSize = 1000 * v
-					} else if unit == "kb" {
-						server.AofRewriteMinSize = 1024 * v
-					} else if unit == "m" {
-						server.AofRewriteMinSize = 1000 * 1000 * v
-					} else if unit == "mb" {
-						server.AofRewriteMinSize = 1024 * 1024 * v
-					} else if unit == "g" {
-						server.AofRewriteMinSize = 1000 * 1000 * 1000 * v
-					} else if unit == "gb" {
-						server.AofRewriteMinSize = 1024 * 1024 * 1024 * v
-					}
+				if size, valid := memtoll(argv[1]); valid {
+					server.AofRewriteMinSize = size
+				}
+			case (argv[0] == "replicaof" || argv[0] == "slaveof") && len(argv) == 3:
+				var port int
+				port, err = strconv.Atoi(argv[2])
+				if err != nil || port <= 0 || port > 65535 {
+					err = errors.New("invalid master port")
+					goto loaderr
+				}
+				server.MasterHost = argv[1]
+				server.MasterPort = port
+			case (argv[0] == "replica-read-only" || argv[0] == "slave-read-only") && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.ReplicaReadOnly = yesorno
+			case argv[0] == "repl-backlog-size" && len(argv) == 2:
+				size, valid := memtoll(argv[1])
+				if !valid || size <= 0 {
+					err = errors.New("invalid repl-backlog-size value")
+					goto loaderr
+				}
+				server.ReplBacklogSize = size
+			case (argv[0] == "repl-ping-replica-period" || argv[0] == "repl-ping-slave-period") && len(argv) == 2:
+				var period int64
+				period, err = strconv.ParseInt(argv[1], 10, 64)
+				if err != nil || period <= 0 {
+					err = errors.New("repl-ping-replica-period must be 1 or greater")
+					goto loaderr
+				}
+				server.ReplPingPeriod = period
+			case argv[0] == "repl-timeout" && len(argv) == 2:
+				var timeout int64
+				timeout, err = strconv.ParseInt(argv[1], 10, 64)
+				if err != nil || timeout <= 0 {
+					err = errors.New("repl-timeout must be 1 or greater")
+					goto loaderr
+				}
+				server.ReplTimeout = timeout
+			case argv[0] == "lazyfree-lazy-eviction" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
 				}
+				server.LazyfreeLazyEviction = yesorno
+			case argv[0] == "lazyfree-lazy-expire" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.LazyfreeLazyExpire = yesorno
+			case argv[0] == "lazyfree-lazy-server-del" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.LazyfreeLazyServerDel = yesorno
+			case argv[0] == "lazyfree-lazy-user-flush" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.LazyfreeLazyUserFlush = yesorno
+			case argv[0] == "activerehashing" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.ActiveRehashing = yesorno
+			case (argv[0] == "hash-max-listpack-entries" || argv[0] == "hash-max-ziplist-entries") && len(argv) == 2:
+				var entries int
+				entries, err = strconv.Atoi(argv[1])
+				if err != nil || entries < 0 {
+					err = errors.New("invalid hash-max-listpack-entries value")
+					goto loaderr
+				}
+				server.HashMaxListpackEntries = entries
+			case (argv[0] == "hash-max-listpack-value" || argv[0] == "hash-max-ziplist-value") && len(argv) == 2:
+				var value int
+				value, err = strconv.Atoi(argv[1])
+				if err != nil || value < 0 {
+					err = errors.New("invalid hash-max-listpack-value value")
+					goto loaderr
+				}
+				server.HashMaxListpackValue = value
+			case (argv[0] == "list-max-listpack-size" || argv[0] == "list-max-ziplist-size") && len(argv) == 2:
+				var size int
+				size, err = strconv.Atoi(argv[1])
+				if err != nil || size < -5 || size == 0 || size > list.FillMax {
+					err = errors.New("invalid list-max-listpack-size value, must be -5 to -1 or a positive number of entries")
+					goto loaderr
+				}
+				server.ListMaxListpackSize = size
+			case argv[0] == "list-compress-depth" && len(argv) == 2:
+				var depth int
+				depth, err = strconv.Atoi(argv[1])
+				if err != nil || depth < 0 || depth > list.CompressMax {
+					err = errors.New("invalid list-compress-depth value")
+					goto loaderr
+				}
+				server.ListCompressDepth = depth
+			case argv[0] == "io-threads" && len(argv) == 2:
+				var threads int
+				threads, err = strconv.Atoi(argv[1])
+				if err != nil || threads < 1 || threads > maxIoThreads {
+					err = errors.New("invalid io-threads value")
+					goto loaderr
+				}
+				server.IoThreads = threads
+			case argv[0] == "async-loading" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.AsyncLoading = yesorno
+			case argv[0] == "repl-diskless-sync" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.ReplDisklessSync = yesorno
+			case argv[0] == "repl-diskless-sync-delay" && len(argv) == 2:
+				var delay int64
+				delay, err = strconv.ParseInt(argv[1], 10, 64)
+				if err != nil || delay < 0 {
+					err = errors.New("repl-diskless-sync-delay can't be negative")
+					goto loaderr
+				}
+				server.ReplDisklessSyncDelay = delay
+			case argv[0] == "repl-diskless-load" && len(argv) == 2:
+				switch strings.ToLower(argv[1]) {
+				case "disabled":
+					server.ReplDisklessLoad = networking.ReplDisklessLoadDisabled
+				case "on-empty-db":
+					server.ReplDisklessLoad = networking.ReplDisklessLoadWhenDbEmpty
+				case "swapdb":
+					server.ReplDisklessLoad = networking.ReplDisklessLoadSwapdb
+				default:
+					err = errors.New("invalid repl-diskless-load value, must be one of disabled, on-empty-db, swapdb")
+					goto loaderr
+				}
+			case argv[0] == "cluster-enabled" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.ClusterEnabled = yesorno
+			case argv[0] == "cluster-config-file" && len(argv) == 2:
+				server.ClusterConfigFile = strings.Trim(argv[1], "\"")
+			case argv[0] == "cluster-node-timeout" && len(argv) == 2:
+				var timeout int64
+				timeout, err = strconv.ParseInt(argv[1], 10, 64)
+				if err != nil || timeout <= 0 {
+					err = errors.New("cluster-node-timeout must be 1 or greater")
+					goto loaderr
+				}
+				server.ClusterNodeTimeout = timeout
+			case argv[0] == "cluster-port" && len(argv) == 2:
+				var port int
+				port, err = strconv.Atoi(argv[1])
+				if err != nil || port < 0 || port > 65535 {
+					err = errors.New("invalid cluster port")
+					goto loaderr
+				}
+				server.ClusterPort = port
+			case argv[0] == "cluster-require-full-coverage" && len(argv) == 2:
+				yesorno, valid := yesnotoi(argv[1])
+				if !valid {
+					err = errors.New(`argument must be 'yes' or 'no'`)
+					goto loaderr
+				}
+				server.ClusterRequireFullCoverage = yesorno
 			case argv[0] == "shutdown-timeout" && len(argv) == 2:
 				n, err := strconv.ParseInt(argv[1], 10, 64)
 				if err != nil {
@@ -141,6 +375,10 @@ func Load(server *networking.Server, filename string) {
 				} else {
 					server.ShutdownTimeout = n * 1000
 				}
+			case argv[0] == "sentinel":
+				if err = server.SentinelHandleConfiguration(argv[1:]); err != nil {
+					goto loaderr
+				}
 			default:
 			}
 		}
@@ -149,9 +387,9 @@ func Load(server *networking.Server, filename string) {
 			err = fmt.Errorf("scan configfile %s: %w", filename, err)
 			goto loaderr
 		}
+		server.ProtoAddr = fmt.Sprintf("tcp://%s:%d", server.Ip, server.Port)
 		return
 	}
-	server.ProtoAddr = fmt.Sprintf("tcp://%s:%d", server.Ip, server.Port)
 
 loaderr:
 	slog.Error(err.Error())
@@ -167,6 +405,34 @@ func splitArgs(line string) ([]string, bool) {
 	return argv, true
 }
 
+// memtoll convert a memory amount like "1gb" or "64m" to the number of bytes.
+func memtoll(arg string) (int64, bool) {
+	re := regexp.MustCompile(`^(\d+)(k|kb|m|mb|g|gb)?$`)
+	mt := re.FindStringSubmatch(strings.ToLower(arg))
+	if len(mt) != 3 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(mt[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	switch mt[2] {
+	case "k":
+		v *= 1000
+	case "kb":
+		v *= 1024
+	case "m":
+		v *= 1000 * 1000
+	case "mb":
+		v *= 1024 * 1024
+	case "g":
+		v *= 1000 * 1000 * 1000
+	case "gb":
+		v *= 1024 * 1024 * 1024
+	}
+	return v, true
+}
+
 func yesnotoi(arg string) (bool, bool) {
 	if strings.EqualFold(arg, "yes") {
 		return true, true
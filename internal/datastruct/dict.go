@@ -0,0 +1,513 @@
+package datastruct
+
+import (
+	"hash/maphash"
+	"iter"
+	"math/bits"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// Dict is a hash table with chaining, like the dict of Redis. It has two
+// tables: when the table is resized, the new one is allocated and the
+// buckets of the old one are moved to it incrementally, by a step in every
+// operation and by Rehash, so that a big dict is never rehashed at once.
+//
+// Unlike a Go map, a random key is picked in O(1), and the dict can be
+// scanned by a cursor across resizes, see Scan.
+//
+// The keyspace itself is kept in tries, a Dict indexes the keys with an
+// expire or with field expires, which databasesCron samples and rehashes,
+// and it holds the fields of the big hashes, which HSCAN scans.
+type Dict[V any] struct {
+	ht [2]dictht[V]
+	// rehashidx is the next bucket of ht[0] to move to ht[1], or -1 if the
+	// dict is not rehashing.
+	rehashidx int
+	// pauserehash is the number of the iterations in progress, the dict is
+	// not rehashed by the operations during an iteration. It is atomic, so
+	// that a dict may be iterated by several readers at once.
+	pauserehash atomic.Int32
+	seed        maphash.Seed
+}
+
+type dictht[V any] struct {
+	table []*dictEntry[V]
+	used  int
+}
+
+type DictEntry[V any] struct {
+	Key string
+	Val V
+}
+
+type dictEntry[V any] struct {
+	DictEntry[V]
+	next *dictEntry[V]
+}
+
+const (
+	dictHtInitialSize = 4
+	// dictForceResizeRatio is the ratio of the elements to the buckets
+	// beyond which the dict is expanded even during an iteration.
+	dictForceResizeRatio = 5
+	// The dict is shrunk when less than dictMinFill percent of its buckets
+	// are used, see ResizeIfNeeded.
+	dictMinFill = 10
+)
+
+func NewDict[V any]() *Dict[V] {
+	return &Dict[V]{rehashidx: -1, seed: maphash.MakeSeed()}
+}
+
+func (ht *dictht[V]) mask() uint64 {
+	return uint64(len(ht.table) - 1)
+}
+
+func (d *Dict[V]) rehashing() bool {
+	return d.rehashidx != -1
+}
+
+func (d *Dict[V]) hash(key string) uint64 {
+	return maphash.String(d.seed, key)
+}
+
+// nextPower returns the size of the table for n elements.
+func nextPower(n int) int {
+	if n <= dictHtInitialSize {
+		return dictHtInitialSize
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// Expand creates a table of at least size buckets, if the dict is rehashing
+// or the table would not hold the elements, it does nothing.
+func (d *Dict[V]) Expand(size int) bool {
+	if d.rehashing() || d.ht[0].used > size {
+		return false
+	}
+	realsize := nextPower(size)
+	if realsize == len(d.ht[0].table) {
+		return false
+	}
+	n := dictht[V]{table: make([]*dictEntry[V], realsize)}
+	// The first initialization, there is nothing to rehash.
+	if d.ht[0].table == nil {
+		d.ht[0] = n
+		return true
+	}
+	d.ht[1] = n
+	d.rehashidx = 0
+	return true
+}
+
+func (d *Dict[V]) expandIfNeeded() {
+	if d.rehashing() {
+		return
+	}
+	if len(d.ht[0].table) == 0 {
+		d.Expand(dictHtInitialSize)
+		return
+	}
+	// The table is expanded when the elements reach the buckets. During an
+	// iteration it is only expanded if the chains become too long.
+	used, size := d.ht[0].used, len(d.ht[0].table)
+	if used >= size && (d.pauserehash.Load() == 0 || used/size > dictForceResizeRatio) {
+		d.Expand(used + 1)
+	}
+}
+
+// ResizeIfNeeded shrinks the table if less than 10% of the buckets are used,
+// so that the random keys are found in a few probes, it is called by the
+// databasesCron.
+func (d *Dict[V]) ResizeIfNeeded() bool {
+	size := len(d.ht[0].table)
+	if d.rehashing() || size <= dictHtInitialSize || d.ht[0].used*100/size >= dictMinFill {
+		return false
+	}
+	return d.Expand(d.ht[0].used)
+}
+
+// Rehash moves n buckets of ht[0] to ht[1], it returns true if there are
+// still buckets to move. To bound the time of a step, at most n*10 empty
+// buckets are visited.
+func (d *Dict[V]) Rehash(n int) bool {
+	emptyVisits := n * 10
+	if !d.rehashing() {
+		return false
+	}
+	for ; n > 0 && d.ht[0].used != 0; n-- {
+		for d.ht[0].table[d.rehashidx] == nil {
+			d.rehashidx++
+			emptyVisits--
+			if emptyVisits == 0 {
+				return true
+			}
+		}
+		de := d.ht[0].table[d.rehashidx]
+		for de != nil {
+			next := de.next
+			h := d.hash(de.Key) & d.ht[1].mask()
+			de.next = d.ht[1].table[h]
+			d.ht[1].table[h] = de
+			d.ht[0].used--
+			d.ht[1].used++
+			de = next
+		}
+		d.ht[0].table[d.rehashidx] = nil
+		d.rehashidx++
+	}
+	// The rehash is completed.
+	if d.ht[0].used == 0 {
+		d.ht[0] = d.ht[1]
+		d.ht[1] = dictht[V]{}
+		d.rehashidx = -1
+		return false
+	}
+	return true
+}
+
+// RehashFor rehashes for about timelimit, by steps of 100 buckets, it
+// returns the number of buckets moved.
+func (d *Dict[V]) RehashFor(timelimit time.Duration) int {
+	if d.pauserehash.Load() > 0 {
+		return 0
+	}
+	start := time.Now()
+	rehashes := 0
+	for d.Rehash(100) {
+		rehashes += 100
+		if time.Since(start) > timelimit {
+			break
+		}
+	}
+	return rehashes
+}
+
+// rehashStep performs a step of the rehash in the operations on the dict,
+// unless an iteration is in progress.
+func (d *Dict[V]) rehashStep() {
+	if d.pauserehash.Load() == 0 {
+		d.Rehash(1)
+	}
+}
+
+func (d *Dict[V]) find(key string) *dictEntry[V] {
+	if d.rehashing() {
+		d.rehashStep()
+	}
+	return d.lookup(key)
+}
+
+// lookup is find without the rehash step, it doesn't modify the dict.
+func (d *Dict[V]) lookup(key string) *dictEntry[V] {
+	if d.ht[0].used+d.ht[1].used == 0 {
+		return nil
+	}
+	h := d.hash(key)
+	for table := 0; table <= 1; table++ {
+		ht := &d.ht[table]
+		if len(ht.table) == 0 {
+			break
+		}
+		for de := ht.table[h&ht.mask()]; de != nil; de = de.next {
+			if de.Key == key {
+				return de
+			}
+		}
+		if !d.rehashing() {
+			break
+		}
+	}
+	return nil
+}
+
+func (d *Dict[V]) Add(key string, val V) bool {
+	if d.find(key) != nil {
+		return false
+	}
+	d.expandIfNeeded()
+	// The new entries go to the new table while rehashing.
+	ht := &d.ht[0]
+	if d.rehashing() {
+		ht = &d.ht[1]
+	}
+	h := d.hash(key) & ht.mask()
+	ht.table[h] = &dictEntry[V]{DictEntry: DictEntry[V]{Key: key, Val: val}, next: ht.table[h]}
+	ht.used++
+	return true
+}
+
+func (d *Dict[V]) Replace(key string, val V) bool {
+	if de := d.find(key); de != nil {
+		de.Val = val
+		return true
+	}
+	return d.Add(key, val)
+}
+
+func (d *Dict[V]) Del(key string) bool {
+	if d.ht[0].used+d.ht[1].used == 0 {
+		return false
+	}
+	if d.rehashing() {
+		d.rehashStep()
+	}
+	h := d.hash(key)
+	for table := 0; table <= 1; table++ {
+		ht := &d.ht[table]
+		if len(ht.table) == 0 {
+			break
+		}
+		idx := h & ht.mask()
+		var prev *dictEntry[V]
+		for de := ht.table[idx]; de != nil; de = de.next {
+			if de.Key == key {
+				if prev == nil {
+					ht.table[idx] = de.next
+				} else {
+					prev.next = de.next
+				}
+				ht.used--
+				return true
+			}
+			prev = de
+		}
+		if !d.rehashing() {
+			break
+		}
+	}
+	return false
+}
+
+func (d *Dict[V]) FetchValue(key string) (V, bool) {
+	if de := d.find(key); de != nil {
+		return de.Val, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Lookup is like FetchValue, but it doesn't perform a step of the rehash,
+// so that it may be called at once by several readers, along with Iterator
+// and Scan.
+func (d *Dict[V]) Lookup(key string) (V, bool) {
+	if de := d.lookup(key); de != nil {
+		return de.Val, true
+	}
+	var zero V
+	return zero, false
+}
+
+// GetRandomKey returns a random key, it probes random buckets until a used
+// one is found, then picks an element of its chain. Since the table is
+// expanded and shrunk to keep between 10% and 100% of the buckets used, a
+// few probes are needed.
+//
+// The elements of the longer chains are less likely to be returned, see
+// GetFairRandomKey.
+func (d *Dict[V]) GetRandomKey() DictEntry[V] {
+	if d.Used() == 0 {
+		return DictEntry[V]{}
+	}
+	if d.rehashing() {
+		d.rehashStep()
+	}
+	var de *dictEntry[V]
+	if d.rehashing() {
+		// The buckets of ht[0] before rehashidx are empty.
+		s0 := len(d.ht[0].table)
+		for de == nil {
+			h := d.rehashidx + rand.IntN(s0+len(d.ht[1].table)-d.rehashidx)
+			if h >= s0 {
+				de = d.ht[1].table[h-s0]
+			} else {
+				de = d.ht[0].table[h]
+			}
+		}
+	} else {
+		for de == nil {
+			de = d.ht[0].table[rand.Uint64()&d.ht[0].mask()]
+		}
+	}
+
+	listlen := 0
+	for e := de; e != nil; e = e.next {
+		listlen++
+	}
+	for n := rand.IntN(listlen); n > 0; n-- {
+		de = de.next
+	}
+	return de.DictEntry
+}
+
+// GetSomeKeys returns up to count elements from a random position of the
+// dict, they are not guaranteed to be distinct or to be count. It does at
+// most count*10 steps.
+func (d *Dict[V]) GetSomeKeys(count int) []DictEntry[V] {
+	if count > d.Used() {
+		count = d.Used()
+	}
+	if count == 0 {
+		return nil
+	}
+	maxsteps := count * 10
+	for j := 0; j < count && d.rehashing(); j++ {
+		d.rehashStep()
+	}
+	tables := 1
+	if d.rehashing() {
+		tables = 2
+	}
+	maxsizemask := d.ht[0].mask()
+	if tables > 1 && d.ht[1].mask() > maxsizemask {
+		maxsizemask = d.ht[1].mask()
+	}
+
+	entries := make([]DictEntry[V], 0, count)
+	i := rand.Uint64() & maxsizemask
+	emptylen := 0
+	for ; len(entries) < count && maxsteps > 0; maxsteps-- {
+		for j := 0; j < tables; j++ {
+			// The buckets of ht[0] before rehashidx are empty.
+			if tables == 2 && j == 0 && i < uint64(d.rehashidx) {
+				// If ht[1] is smaller too, skip to rehashidx in ht[0].
+				if i >= uint64(len(d.ht[1].table)) {
+					i = uint64(d.rehashidx)
+				} else {
+					continue
+				}
+			}
+			if i >= uint64(len(d.ht[j].table)) {
+				continue
+			}
+			de := d.ht[j].table[i]
+			if de == nil {
+				// Move to another position after a run of empty buckets.
+				emptylen++
+				if emptylen >= 5 && emptylen > count {
+					i = rand.Uint64() & maxsizemask
+					emptylen = 0
+				}
+				continue
+			}
+			emptylen = 0
+			for ; de != nil && len(entries) < count; de = de.next {
+				entries = append(entries, de.DictEntry)
+			}
+		}
+		i = (i + 1) & maxsizemask
+	}
+	return entries
+}
+
+// GetFairRandomKey returns a random key, every key is about as likely to
+// be returned, whatever the length of its chain, since the key is picked
+// among a sample of keys, instead of a bucket.
+func (d *Dict[V]) GetFairRandomKey() DictEntry[V] {
+	const sampleSize = 20
+	entries := d.GetSomeKeys(sampleSize)
+	if len(entries) == 0 {
+		return d.GetRandomKey()
+	}
+	return entries[rand.IntN(len(entries))]
+}
+
+func (d *Dict[V]) Used() int {
+	return d.ht[0].used + d.ht[1].used
+}
+
+// Size returns the number of the buckets.
+func (d *Dict[V]) Size() int {
+	return len(d.ht[0].table) + len(d.ht[1].table)
+}
+
+// Iterator returns the elements of the dict. The dict is not rehashed
+// during the iteration, and the current element may be deleted.
+func (d *Dict[V]) Iterator() iter.Seq[*DictEntry[V]] {
+	return func(yield func(*DictEntry[V]) bool) {
+		d.pauserehash.Add(1)
+		defer d.pauserehash.Add(-1)
+		for table := 0; table <= 1; table++ {
+			for i := 0; i < len(d.ht[table].table); i++ {
+				for de := d.ht[table].table[i]; de != nil; {
+					next := de.next
+					if !yield(&de.DictEntry) {
+						return
+					}
+					de = next
+				}
+			}
+			if !d.rehashing() {
+				return
+			}
+		}
+	}
+}
+
+// Scan calls fn for the elements of the bucket at cursor, and returns the
+// next cursor, 0 when the scan is completed. A scan started with cursor 0
+// returns all the elements that are in the dict from the start to the end of
+// the scan at least once, even if the dict is resized in the meantime, and
+// may return some elements more than once.
+//
+// The cursor is incremented on its reversed bits, so that the buckets of a
+// table of 2^n buckets are visited in the same order as the buckets of a
+// table of 2^m buckets they are split into, or merged from. When the dict is
+// rehashing, the bucket of the smaller table is visited with all the buckets
+// of the bigger table that it expands to.
+func (d *Dict[V]) Scan(cursor uint64, fn func(*DictEntry[V])) uint64 {
+	if d.Used() == 0 {
+		return 0
+	}
+	d.pauserehash.Add(1)
+	defer d.pauserehash.Add(-1)
+
+	emit := func(de *dictEntry[V]) {
+		for de != nil {
+			next := de.next
+			fn(&de.DictEntry)
+			de = next
+		}
+	}
+	var m0 uint64
+	if !d.rehashing() {
+		m0 = d.ht[0].mask()
+		emit(d.ht[0].table[cursor&m0])
+		return scanNextCursor(cursor, m0)
+	}
+
+	t0, t1 := &d.ht[0], &d.ht[1]
+	if len(t0.table) > len(t1.table) {
+		t0, t1 = t1, t0
+	}
+	m0, m1 := t0.mask(), t1.mask()
+	emit(t0.table[cursor&m0])
+	// The buckets of the bigger table that are the expansion of the bucket
+	// of the smaller one.
+	for {
+		emit(t1.table[cursor&m1])
+		cursor = scanNextCursor(cursor, m1)
+		if cursor&(m0^m1) == 0 {
+			break
+		}
+	}
+	return cursor
+}
+
+// scanNextCursor increments the reversed bits of the cursor, the bits above
+// mask are set so that the increment is carried into the masked bits.
+func scanNextCursor(cursor, mask uint64) uint64 {
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+func (d *Dict[V]) Empty() int {
+	n := d.Used()
+	d.ht[0], d.ht[1] = dictht[V]{}, dictht[V]{}
+	d.rehashidx = -1
+	return n
+}
@@ -0,0 +1,114 @@
+package datastruct
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDictRehash(t *testing.T) {
+	d := NewDict[string]()
+	const n = 10000
+	for i := range n {
+		d.Add(strconv.Itoa(i), strconv.Itoa(i))
+		// The keys are found while rehashing.
+		if i%100 == 0 {
+			if _, ok := d.FetchValue(strconv.Itoa(i / 2)); !ok {
+				t.Fatalf("key %d is not found, rehashing: %v", i/2, d.rehashing())
+			}
+		}
+	}
+	for d.RehashFor(time.Second) > 0 {
+	}
+	if d.rehashing() || d.Size() < n || d.Size() > 2*n {
+		t.Errorf("%d buckets for %d keys, rehashing: %v", d.Size(), n, d.rehashing())
+	}
+
+	for i := 100; i < n; i++ {
+		d.Del(strconv.Itoa(i))
+	}
+	if !d.ResizeIfNeeded() {
+		t.Fatalf("%d buckets for %d keys are not shrunk", d.Size(), d.Used())
+	}
+	for d.RehashFor(time.Second) > 0 {
+	}
+	if d.rehashing() || d.Size() != 128 || d.ResizeIfNeeded() {
+		t.Errorf("%d buckets for %d keys", d.Size(), d.Used())
+	}
+	for i := range 100 {
+		if v, ok := d.FetchValue(strconv.Itoa(i)); !ok || v != strconv.Itoa(i) {
+			t.Fatalf("key %d is lost", i)
+		}
+	}
+}
+
+func TestDictScan(t *testing.T) {
+	d := NewDict[string]()
+	for i := range 500 {
+		d.Add(strconv.Itoa(i), "v")
+	}
+	seen := make(map[string]bool)
+	cursor, calls := uint64(0), 0
+	for {
+		cursor = d.Scan(cursor, func(e *DictEntry[string]) { seen[e.Key] = true })
+		calls++
+		// The dict is expanded and then shrunk during the scan.
+		switch calls {
+		case 10:
+			for i := 500; i < 5000; i++ {
+				d.Add(strconv.Itoa(i), "v")
+			}
+		case 200:
+			for i := 500; i < 5000; i++ {
+				d.Del(strconv.Itoa(i))
+			}
+			d.ResizeIfNeeded()
+		}
+		d.Rehash(1)
+		if cursor == 0 {
+			break
+		}
+	}
+	// The keys in the dict for the whole scan are returned.
+	for i := range 500 {
+		if !seen[strconv.Itoa(i)] {
+			t.Errorf("key %d is not scanned, %d calls", i, calls)
+		}
+	}
+}
+
+func TestDictRandomKeys(t *testing.T) {
+	d := NewDict[string]()
+	const n = 100
+	for i := range n {
+		d.Add(strconv.Itoa(i), "v")
+	}
+	// The sampling starts in the middle of a rehash.
+	for d.Rehash(100) {
+	}
+	d.Expand(4096)
+	d.Rehash(10)
+	if !d.rehashing() {
+		t.Fatal("the dict is not rehashing")
+	}
+	counts := make(map[string]int)
+	const samples = 20000
+	for range samples {
+		e := d.GetFairRandomKey()
+		if _, ok := d.FetchValue(e.Key); !ok {
+			t.Fatalf("the random key %q is not in the dict", e.Key)
+		}
+		counts[e.Key]++
+	}
+	if len(counts) != n {
+		t.Errorf("%d keys of %d are sampled", len(counts), n)
+	}
+	for key, c := range counts {
+		if c < samples/n/4 || c > samples/n*4 {
+			t.Errorf("key %s sampled %d times, about %d expected", key, c, samples/n)
+		}
+	}
+	if entries := d.GetSomeKeys(200); len(entries) > n {
+		t.Errorf("%d keys are returned of %d", len(entries), n)
+	}
+}
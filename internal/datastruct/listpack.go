@@ -0,0 +1,505 @@
+package datastruct
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// <lpbytes> <lplen> <entry> <entry> ... <entry> <lpend>
+// uint32    uint16
+//
+// <encoding-type><element-data><element-tot-len>
+//
+// The element-tot-len is the size of the encoding and the data, stored from
+// right to left in 1 to 5 bytes with 7 bits each, so that the listpack can
+// be traversed backward.
+//
+// Unlike a ziplist, an entry doesn't store the size of the previous one, so
+// an insertion or a deletion never updates the next entries. The lplen
+// saturates at 65535, the number of the entries is then counted.
+//
+// The entries are referenced by their offset in the listpack, which is
+// invalidated by the insertions and the deletions before it.
+type Listpack []byte
+
+const (
+	ListpackHeaderSize = uint32(4 + 2)
+	ListpackEnd        = byte(255)
+)
+
+const (
+	lp7BitUint     = 0x00 // |0xxxxxxx|
+	lp6BitStr      = 0x80 // |10xxxxxx| <string>
+	lp13BitInt     = 0xc0 // |110xxxxx|yyyyyyyy|
+	lp12BitStr     = 0xe0 // |1110xxxx|yyyyyyyy| <string>
+	lp32BitStr     = 0xf0 // |11110000| <4 bytes len> <string>
+	lp16BitInt     = 0xf1
+	lp24BitInt     = 0xf2
+	lp32BitInt     = 0xf3
+	lp64BitInt     = 0xf4
+	lpEncodingMask = 0xff
+)
+
+func (lp Listpack) Bytes() uint32 {
+	return binary.LittleEndian.Uint32(lp[:4])
+}
+
+// Len returns the number of the entries.
+func (lp Listpack) Len() int {
+	if n := binary.LittleEndian.Uint16(lp[4:6]); n != math.MaxUint16 {
+		return int(n)
+	}
+	n := 0
+	for offset, ok := lp.First(); ok; offset, ok = lp.Next(offset) {
+		n++
+	}
+	return n
+}
+
+func NewListpack() *Listpack {
+	lp := make(Listpack, ListpackHeaderSize+1)
+	binary.LittleEndian.PutUint32(lp[:4], ListpackHeaderSize+1)
+	lp[ListpackHeaderSize] = ListpackEnd
+	return &lp
+}
+
+func (lp *Listpack) DeepCopy() *Listpack {
+	nlp := slices.Clone(*lp)
+	return &nlp
+}
+
+func (lp *Listpack) setBytes(n uint32) {
+	binary.LittleEndian.PutUint32((*lp)[:4], n)
+}
+
+// addLen adds n to the number of the entries, unless it is saturated.
+func (lp *Listpack) addLen(n int) {
+	cur := binary.LittleEndian.Uint16((*lp)[4:6])
+	if cur == math.MaxUint16 {
+		return
+	}
+	binary.LittleEndian.PutUint16((*lp)[4:6], uint16(min(int(cur)+n, math.MaxUint16)))
+}
+
+// end returns the offset of the end of the listpack.
+func (lp Listpack) end() uint32 {
+	return uint32(len(lp)) - 1
+}
+
+// First returns the offset of the first entry, false if it is empty.
+func (lp Listpack) First() (uint32, bool) {
+	return ListpackHeaderSize, lp.end() != ListpackHeaderSize
+}
+
+// Last returns the offset of the last entry, false if it is empty.
+func (lp Listpack) Last() (uint32, bool) {
+	return lp.Prev(lp.end())
+}
+
+// Next returns the offset of the entry after the one at offset, false if it
+// is the last.
+func (lp Listpack) Next(offset uint32) (uint32, bool) {
+	offset += lp.entrySize(offset)
+	return offset, offset != lp.end()
+}
+
+// Prev returns the offset of the entry before the one at offset, which may
+// be the end, false if it is the first.
+func (lp Listpack) Prev(offset uint32) (uint32, bool) {
+	if offset == ListpackHeaderSize {
+		return 0, false
+	}
+	// The back length is read from right to left.
+	i := offset - 1
+	for lp[i]&128 != 0 {
+		i--
+	}
+	size := lpDecodeBacklen(lp[i:offset])
+	return i - size, true
+}
+
+// Get returns the entry at offset, the integers are converted to strings.
+// The strings reference the listpack, so they are only valid until it is
+// modified.
+func (lp Listpack) Get(offset uint32) []byte {
+	entry, _, _ := lp.decodeEntry(offset, lp.end())
+	return entry
+}
+
+// Seek returns the offset of the entry at index, the negative indexes are
+// from the tail, -1 is the last entry.
+func (lp Listpack) Seek(index int) (uint32, bool) {
+	n := lp.Len()
+	if index < 0 {
+		index += n
+	}
+	if index < 0 || index >= n {
+		return 0, false
+	}
+	// Walk from the nearest end.
+	if index < n/2 {
+		offset, _ := lp.First()
+		for ; index > 0; index-- {
+			offset, _ = lp.Next(offset)
+		}
+		return offset, true
+	}
+	offset, _ := lp.Last()
+	for index = n - 1 - index; index > 0; index-- {
+		offset, _ = lp.Prev(offset)
+	}
+	return offset, true
+}
+
+// Find returns the offset of the first entry equal to entry, from offset,
+// skipping skip entries after every compared one, eg. the values of the
+// fields of a hash.
+func (lp Listpack) Find(offset uint32, entry []byte, skip int) (uint32, bool) {
+	num, isInt := lpStringToInt64(entry)
+	end := lp.end()
+	for offset != end {
+		enc := lp[offset]
+		if lpIsString(enc) {
+			if !isInt {
+				if v, _, _ := lp.decodeEntry(offset, end); bytes.Equal(v, entry) {
+					return offset, true
+				}
+			}
+		} else if isInt {
+			if v, ok := lp.decodeInt(offset); ok && v == num {
+				return offset, true
+			}
+		}
+		offset += lp.entrySize(offset)
+		for i := 0; i < skip && offset != end; i++ {
+			offset += lp.entrySize(offset)
+		}
+	}
+	return 0, false
+}
+
+// Append adds entry at the tail.
+func (lp *Listpack) Append(entry []byte) {
+	lp.Insert(lp.end(), entry)
+}
+
+// Prepend adds entry at the head.
+func (lp *Listpack) Prepend(entry []byte) {
+	lp.Insert(ListpackHeaderSize, entry)
+}
+
+// Insert adds entry before the entry at offset, or at the tail if offset is
+// the end.
+func (lp *Listpack) Insert(offset uint32, entry []byte) {
+	*lp = slices.Insert(*lp, int(offset), lpEncodeEntry(nil, entry)...)
+	lp.setBytes(uint32(len(*lp)))
+	lp.addLen(1)
+}
+
+// Replace replaces the entry at offset.
+func (lp *Listpack) Replace(offset uint32, entry []byte) {
+	size := lp.entrySize(offset)
+	*lp = slices.Replace(*lp, int(offset), int(offset+size), lpEncodeEntry(nil, entry)...)
+	lp.setBytes(uint32(len(*lp)))
+}
+
+// Delete deletes the entry at offset, the next entry is then at offset.
+func (lp *Listpack) Delete(offset uint32) {
+	lp.DeleteRange(offset, 1)
+}
+
+// DeleteRange deletes up to n entries from offset, and returns the number
+// of the deleted entries.
+func (lp *Listpack) DeleteRange(offset uint32, n int) int {
+	end, deleted := offset, 0
+	for ; deleted < n && end != lp.end(); deleted++ {
+		end += lp.entrySize(end)
+	}
+	*lp = slices.Delete(*lp, int(offset), int(end))
+	lp.setBytes(uint32(len(*lp)))
+	lp.addLen(-deleted)
+	return deleted
+}
+
+// ListpackEntrySize returns the number of bytes taken by entry in a
+// listpack.
+func ListpackEntrySize(entry []byte) uint32 {
+	var buf [16]byte
+	if _, ok := lpStringToInt64(entry); ok {
+		return uint32(len(lpEncodeEntry(buf[:0], entry)))
+	}
+	size := lpStringEncodingSize(len(entry)) + uint32(len(entry))
+	return size + lpBacklenSize(size)
+}
+
+// Validate returns false if the listpack is malformed.
+func (lp Listpack) Validate() bool {
+	_, ok := lp.Entries()
+	return ok
+}
+
+// Entries returns the entries of the listpack, the integers are converted
+// to strings. It returns false if the listpack is malformed, so that it can
+// be used on the listpacks coming from the outside, eg. a RDB file.
+func (lp Listpack) Entries() ([][]byte, bool) {
+	size := uint32(len(lp))
+	if size < ListpackHeaderSize+1 || lp.Bytes() != size || lp[size-1] != ListpackEnd {
+		return nil, false
+	}
+
+	end := size - 1
+	entries := make([][]byte, 0, binary.LittleEndian.Uint16(lp[4:6]))
+	for offset := ListpackHeaderSize; offset < end; {
+		entry, entrysize, ok := lp.decodeEntry(offset, end)
+		if !ok {
+			return nil, false
+		}
+		backlen := lpBacklenSize(entrysize)
+		if uint64(offset)+uint64(entrysize)+uint64(backlen) > uint64(end) ||
+			lpDecodeBacklen(lp[offset+entrysize:offset+entrysize+backlen]) != entrysize {
+			return nil, false
+		}
+		entries = append(entries, entry)
+		offset += entrysize + backlen
+	}
+	// The count saturates at UINT16_MAX, in which case it is not checked.
+	if n := binary.LittleEndian.Uint16(lp[4:6]); n != math.MaxUint16 && int(n) != len(entries) {
+		return nil, false
+	}
+	return entries, true
+}
+
+// decodeEntry decodes the entry at offset, and returns it with the size of
+// its encoding and data.
+func (lp Listpack) decodeEntry(offset, end uint32) ([]byte, uint32, bool) {
+	enc := lp[offset]
+	var hdrsize, ln uint32
+	var num int64
+	switch {
+	case enc&0x80 == lp7BitUint:
+		return strconv.AppendInt(nil, int64(enc&0x7f), 10), 1, true
+	case enc&0xc0 == lp6BitStr:
+		hdrsize, ln = 1, uint32(enc&0x3f)
+	case enc&0xe0 == lp13BitInt:
+		if offset+2 > end {
+			return nil, 0, false
+		}
+		// Extend the sign of the 13 bits integer.
+		num = int64(int16(uint16(enc&0x1f)<<8|uint16(lp[offset+1])) << 3 >> 3)
+		return strconv.AppendInt(nil, num, 10), 2, true
+	case enc&0xf0 == lp12BitStr:
+		if offset+2 > end {
+			return nil, 0, false
+		}
+		hdrsize, ln = 2, uint32(enc&0x0f)<<8|uint32(lp[offset+1])
+	case enc == lp32BitStr:
+		if offset+5 > end {
+			return nil, 0, false
+		}
+		hdrsize, ln = 5, binary.LittleEndian.Uint32(lp[offset+1:offset+5])
+	default:
+		var n uint32
+		switch enc & lpEncodingMask {
+		case lp16BitInt:
+			n = 2
+		case lp24BitInt:
+			n = 3
+		case lp32BitInt:
+			n = 4
+		case lp64BitInt:
+			n = 8
+		default:
+			return nil, 0, false
+		}
+		if offset+1+n > end {
+			return nil, 0, false
+		}
+		// Put the little endian integer at the top of an uint64 to extend the sign.
+		var v uint64
+		for i := uint32(0); i < n; i++ {
+			v |= uint64(lp[offset+1+i]) << (8 * (8 - n + i))
+		}
+		num = int64(v) >> (8 * (8 - n))
+		return strconv.AppendInt(nil, num, 10), 1 + n, true
+	}
+	if uint64(offset)+uint64(hdrsize)+uint64(ln) > uint64(end) {
+		return nil, 0, false
+	}
+	return lp[offset+hdrsize : offset+hdrsize+ln], hdrsize + ln, true
+}
+
+// lpBacklenSize returns the number of bytes used to store the entry size l.
+func lpBacklenSize(l uint32) uint32 {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// lpDecodeBacklen decodes the entry size stored in b, which is read from
+// right to left, and the most significant bit of each byte tells if the
+// previous byte is part of it.
+func lpDecodeBacklen(b []byte) uint32 {
+	var v uint32
+	var shift uint
+	for i := len(b) - 1; i >= 0; i-- {
+		v |= uint32(b[i]&127) << shift
+		if b[i]&128 == 0 {
+			break
+		}
+		shift += 7
+	}
+	return v
+}
+
+// entrySize returns the size of the entry at offset, with its back length.
+func (lp Listpack) entrySize(offset uint32) uint32 {
+	enc := lp[offset]
+	var size uint32
+	switch {
+	case enc&0x80 == lp7BitUint:
+		size = 1
+	case enc&0xc0 == lp6BitStr:
+		size = 1 + uint32(enc&0x3f)
+	case enc&0xe0 == lp13BitInt:
+		size = 2
+	case enc&0xf0 == lp12BitStr:
+		size = 2 + (uint32(enc&0x0f)<<8 | uint32(lp[offset+1]))
+	case enc == lp32BitStr:
+		size = 5 + binary.LittleEndian.Uint32(lp[offset+1:offset+5])
+	case enc == lp16BitInt:
+		size = 3
+	case enc == lp24BitInt:
+		size = 4
+	case enc == lp32BitInt:
+		size = 5
+	default:
+		size = 9
+	}
+	return size + lpBacklenSize(size)
+}
+
+func lpIsString(enc byte) bool {
+	return enc&0xc0 == lp6BitStr || enc&0xf0 == lp12BitStr || enc == lp32BitStr
+}
+
+// decodeInt decodes the integer entry at offset.
+func (lp Listpack) decodeInt(offset uint32) (int64, bool) {
+	entry, _, ok := lp.decodeEntry(offset, lp.end())
+	if !ok {
+		return 0, false
+	}
+	return lpStringToInt64(entry)
+}
+
+func lpStringEncodingSize(n int) uint32 {
+	switch {
+	case n < 64:
+		return 1
+	case n < 4096:
+		return 2
+	default:
+		return 5
+	}
+}
+
+// lpEncodeEntry appends the encoding, the data and the back length of
+// entry to buf. The strings which are integers are encoded as integers.
+func lpEncodeEntry(buf, entry []byte) []byte {
+	start := len(buf)
+	if v, ok := lpStringToInt64(entry); ok {
+		switch {
+		case v >= 0 && v <= 127:
+			buf = append(buf, byte(v))
+		case v >= -4096 && v <= 4095:
+			u := uint16(v) & 0x1fff
+			buf = append(buf, lp13BitInt|byte(u>>8), byte(u))
+		case v >= math.MinInt16 && v <= math.MaxInt16:
+			buf = append(buf, lp16BitInt, byte(v), byte(v>>8))
+		case v >= -1<<23 && v < 1<<23:
+			buf = append(buf, lp24BitInt, byte(v), byte(v>>8), byte(v>>16))
+		case v >= math.MinInt32 && v <= math.MaxInt32:
+			buf = append(buf, lp32BitInt)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(v))
+		default:
+			buf = append(buf, lp64BitInt)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(v))
+		}
+	} else {
+		n := len(entry)
+		switch lpStringEncodingSize(n) {
+		case 1:
+			buf = append(buf, lp6BitStr|byte(n))
+		case 2:
+			buf = append(buf, lp12BitStr|byte(n>>8), byte(n))
+		default:
+			buf = append(buf, lp32BitStr)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(n))
+		}
+		buf = append(buf, entry...)
+	}
+	return lpAppendBacklen(buf, uint32(len(buf)-start))
+}
+
+// lpAppendBacklen appends the back length l, which is read from right to
+// left, see lpDecodeBacklen.
+func lpAppendBacklen(buf []byte, l uint32) []byte {
+	n := lpBacklenSize(l)
+	for i := int(n) - 1; i >= 0; i-- {
+		b := byte(l>>(7*uint(i))) & 127
+		if i != int(n)-1 {
+			b |= 128
+		}
+		buf = append(buf, b)
+	}
+	return buf
+}
+
+// lpStringToInt64 returns the integer of s if s is the canonical form of an
+// int64, so that the integer is converted back to s.
+func lpStringToInt64(s []byte) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	neg := s[0] == '-'
+	digits := s
+	if neg {
+		digits = s[1:]
+	}
+	// No leading zeros, and no "-0".
+	if len(digits) == 0 || (digits[0] == '0' && (len(digits) > 1 || neg)) {
+		return 0, false
+	}
+	var v uint64
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		d := uint64(c - '0')
+		if v > (math.MaxUint64-d)/10 {
+			return 0, false
+		}
+		v = v*10 + d
+	}
+	if neg {
+		if v > 1<<63 {
+			return 0, false
+		}
+		return int64(-v), true
+	}
+	if v > math.MaxInt64 {
+		return 0, false
+	}
+	return int64(v), true
+}
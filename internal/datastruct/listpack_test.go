@@ -0,0 +1,118 @@
+package datastruct
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListpackEncoding(t *testing.T) {
+	testcases := []string{
+		"0", "127", "-1", "128", "-4096", "4095", "32767", "-32768", "8388607",
+		"-8388608", "2147483647", "-2147483648", "9223372036854775807",
+		"-9223372036854775808", "", "a", "007", "+1", "1.5",
+		strings.Repeat("x", 63), strings.Repeat("x", 64),
+		strings.Repeat("x", 4095), strings.Repeat("x", 4096),
+	}
+	lp := NewListpack()
+	for _, tc := range testcases {
+		lp.Append([]byte(tc))
+	}
+	if lp.Len() != len(testcases) || lp.Bytes() != uint32(len(*lp)) || !lp.Validate() {
+		t.Fatalf("%d entries in %d bytes", lp.Len(), lp.Bytes())
+	}
+	var size uint32
+	for _, tc := range testcases {
+		size += ListpackEntrySize([]byte(tc))
+	}
+	if size != lp.Bytes()-ListpackHeaderSize-1 {
+		t.Errorf("entries of %d bytes, %d expected", lp.Bytes()-ListpackHeaderSize-1, size)
+	}
+
+	// The entries are traversed forward and backward.
+	offset, ok := lp.First()
+	for i := 0; ok; i++ {
+		if got := string(lp.Get(offset)); got != testcases[i] {
+			t.Errorf("entry %d: %q, %q expected", i, got, testcases[i])
+		}
+		offset, ok = lp.Next(offset)
+	}
+	offset, ok = lp.Last()
+	for i := len(testcases) - 1; ok; i-- {
+		if got := string(lp.Get(offset)); got != testcases[i] {
+			t.Errorf("entry %d backward: %q, %q expected", i, got, testcases[i])
+		}
+		offset, ok = lp.Prev(offset)
+	}
+}
+
+func TestListpackModify(t *testing.T) {
+	lp := NewListpack()
+	for i := range 10 {
+		lp.Append([]byte(strconv.Itoa(i)))
+	}
+	lp.Prepend([]byte("head"))
+
+	offset, _ := lp.Seek(-1)
+	lp.Replace(offset, []byte(strings.Repeat("tail", 100)))
+	offset, _ = lp.Seek(1)
+	lp.Insert(offset, []byte("one"))
+	offset, _ = lp.Seek(3)
+	if n := lp.DeleteRange(offset, 3); n != 3 {
+		t.Errorf("%d entries deleted", n)
+	}
+
+	want := []string{"head", "one", "0", "4", "5", "6", "7", "8", strings.Repeat("tail", 100)}
+	entries, ok := lp.Entries()
+	if !ok || len(entries) != len(want) || lp.Len() != len(want) {
+		t.Fatalf("%d entries, %d expected", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		if string(entry) != want[i] {
+			t.Errorf("entry %d: %q, %q expected", i, entry, want[i])
+		}
+	}
+}
+
+func TestListpackFind(t *testing.T) {
+	lp := NewListpack()
+	for _, entry := range []string{"a", "1", "b", "a", "10", "c"} {
+		lp.Append([]byte(entry))
+	}
+	first, _ := lp.First()
+	// The values of the pairs are skipped.
+	if _, ok := lp.Find(first, []byte("1"), 1); ok {
+		t.Error("a skipped entry is found")
+	}
+	if offset, ok := lp.Find(first, []byte("10"), 1); !ok || string(lp.Get(offset)) != "10" {
+		t.Error("10 is not found")
+	}
+	offset, ok := lp.Find(first, []byte("1"), 0)
+	if next, _ := lp.Next(offset); !ok || string(lp.Get(next)) != "b" {
+		t.Error("1 is not found")
+	}
+	// The integers are compared by value, 01 is stored as a string.
+	if _, ok := lp.Find(first, []byte("01"), 0); ok {
+		t.Error("01 is found")
+	}
+}
+
+func TestListpackSaturatedLen(t *testing.T) {
+	lp := NewListpack()
+	n := math.MaxUint16 + 10
+	for i := range n {
+		lp.Append([]byte(strconv.Itoa(i % 100)))
+	}
+	if lp.Len() != n {
+		t.Errorf("%d entries, %d expected", lp.Len(), n)
+	}
+	first, _ := lp.First()
+	lp.DeleteRange(first, 20)
+	if lp.Len() != n-20 {
+		t.Errorf("%d entries, %d expected", lp.Len(), n-20)
+	}
+	if entries, ok := lp.Entries(); !ok || len(entries) != n-20 {
+		t.Errorf("%d entries decoded", len(entries))
+	}
+}
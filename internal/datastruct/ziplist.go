@@ -116,23 +116,9 @@ func (zl *Ziplist) DecodeEntry(offset uint32) (entry []byte, size uint32) {
 	if _type == strType {
 		entry = []byte(*zl)[conoffset : conoffset+ln]
 	} else {
-		if ln == 0 {
-			encoding := []byte(*zl)[offset+prevlensize : offset+prevlensize+1]
-			num := (encoding[0] & 0x0F) - 1
-			entry = []byte(strconv.FormatInt(int64(num), 10))
-		} else if ln == 1 {
-			num := []byte(*zl)[conoffset : conoffset+ln]
-			entry = []byte(strconv.FormatInt(int64(num[0]), 10))
-		} else if ln == 2 {
-			num := binary.LittleEndian.Uint16([]byte(*zl)[conoffset : conoffset+ln])
-			entry = []byte(strconv.FormatInt(int64(num), 10))
-		} else if ln == 4 {
-			num := binary.LittleEndian.Uint32([]byte(*zl)[conoffset : conoffset+ln])
-			entry = []byte(strconv.FormatInt(int64(num), 10))
-		} else if ln == 8 {
-			num := binary.LittleEndian.Uint64([]byte(*zl)[conoffset : conoffset+ln])
-			entry = []byte(strconv.FormatInt(int64(num), 10))
-		}
+		encoding := []byte(*zl)[offset+prevlensize]
+		content := []byte(*zl)[conoffset : conoffset+ln]
+		entry = strconv.AppendInt(nil, zipDecodeInt(encoding, content), 10)
 	}
 	size = prevlensize + lensize + ln
 	return
@@ -184,6 +170,8 @@ func zipIntSize(_type byte, _ []byte) (uint32, uint32) {
 		return 1, 1
 	case zipInt16b:
 		return 1, 2
+	case zipInt24b:
+		return 1, 3
 	case zipInt32b:
 		return 1, 4
 	case zipInt64b:
@@ -196,6 +184,91 @@ func zipIntSize(_type byte, _ []byte) (uint32, uint32) {
 	}
 }
 
+// zipDecodeInt decodes the signed integer stored with the encoding.
+func zipDecodeInt(encoding byte, content []byte) int64 {
+	switch encoding {
+	case zipInt8b:
+		return int64(int8(content[0]))
+	case zipInt16b:
+		return int64(int16(binary.LittleEndian.Uint16(content)))
+	case zipInt24b:
+		// Shift the 24 bits to the top of an int32 to extend the sign.
+		v := uint32(content[0])<<8 | uint32(content[1])<<16 | uint32(content[2])<<24
+		return int64(int32(v) >> 8)
+	case zipInt32b:
+		return int64(int32(binary.LittleEndian.Uint32(content)))
+	case zipInt64b:
+		return int64(binary.LittleEndian.Uint64(content))
+	default:
+		// |1111xxxx| - 4 bit integer, xxxx between 0001 and 1101 is 0 to 12.
+		return int64(encoding&0x0f) - 1
+	}
+}
+
+// Validate checks the ziplist is well formed, so that it can be accessed
+// safely when it comes from the outside, eg. a RDB file.
+func (zl *Ziplist) Validate() bool {
+	b := []byte(*zl)
+	size := uint32(len(b))
+	if size < ZiplistHeaderSize+ZiplistEndSize || zl.Bytes() != size || b[size-1] != ZiplistEnd {
+		return false
+	}
+
+	end := size - ZiplistEndSize
+	offset, tail := ZiplistHeaderSize, ZiplistHeaderSize
+	var prevlen, cnt uint32
+	for offset < end {
+		prevlensize, pl := uint32(1), uint32(b[offset])
+		if pl == 0xfe {
+			if offset+5 > end {
+				return false
+			}
+			prevlensize, pl = 5, binary.LittleEndian.Uint32(b[offset+1:offset+5])
+		} else if pl == 0xff {
+			return false
+		}
+		if pl != prevlen {
+			return false
+		}
+
+		start := offset + prevlensize
+		if start >= end {
+			return false
+		}
+		var lensize, ln uint32
+		if _type := b[start] & zipStrMask; _type < zipStrMask {
+			switch _type {
+			case zipStr06b:
+				lensize = 1
+			case zipStr14b:
+				lensize = 2
+			default:
+				lensize = 5
+			}
+			if start+lensize > end {
+				return false
+			}
+			_, ln = zipStrSize(_type, b[start:start+lensize])
+		} else {
+			lensize, ln = zipIntSize(b[start], nil)
+			if lensize == 0 {
+				return false
+			}
+		}
+
+		entrysize := prevlensize + lensize + ln
+		if uint64(offset)+uint64(entrysize) > uint64(end) {
+			return false
+		}
+		tail = offset
+		prevlen = entrysize
+		offset += entrysize
+		cnt++
+	}
+	// The count saturates at UINT16_MAX, in which case it is not checked.
+	return zl.TailOffset() == tail && (zl.Len() == math.MaxUint16 || uint32(zl.Len()) == cnt)
+}
+
 func (zl *Ziplist) EncodeEntry(prevlen uint32, content []byte) []byte {
 	entry := encodePrevLen(prevlen)
 	_type, _, encoded := zl.encodeEntryEncoding(content)
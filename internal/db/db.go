@@ -1,8 +1,6 @@
 package db
 
 import (
-	"fmt"
-	"log/slog"
 	"time"
 
 	"github.com/sunminx/RDB/internal/hash"
@@ -11,85 +9,165 @@ import (
 	"github.com/sunminx/RDB/internal/sds"
 )
 
-const sdbNum = 2
-
-const (
-	// InNormalState indicates that nothing is in ongoing.
-	InNormalState uint8 = 0
-	// InPersistState indicates that there is currently a coroutine performing persistence.
-	InPersistState uint8 = 1
-	// InMergeState indicates that is merging sdbs[1] to sdbs[0].
-	InMergeState uint8 = 2
-)
-
+// DB is the keyspace. The keys are kept in persistent tries, one for every
+// shard, see shard.go, so that the persistence reads a Snapshot of them while
+// the commands go on, see trie.go.
 type DB struct {
-	// Usually, the last sdb is always empty and
-	// will only be written when writing key-val during the redo of aof or rdb.
-	sdbs [sdbNum]*sdb
+	shards [Shards]shard
+	// expireShard is the shard where the next active expire cycle starts.
+	expireShard int
+	// fieldExpireShard is the shard where the next active field expire
+	// cycle starts.
+	fieldExpireShard int
+	// rehashShard is the shard where the next IncrementallyRehash starts.
+	rehashShard int
+	// slots is the index of the keys by hash slot, nil if the
+	// cluster mode is disabled.
+	slots *slotIndex
 
-	// Protected by the server.CmdLock.
-	state uint8
-}
+	// freeAsync releases a deleted value in background, see SetLazyfree.
+	freeAsync func(val *obj.Robj)
+	// lazyExpire and lazyServerDel tell whether the values deleted by the
+	// expiration, and the ones deleted or replaced as a side effect of the
+	// commands, are released by freeAsync.
+	lazyExpire    bool
+	lazyServerDel bool
 
-const (
-	// Redoing represents that aof or rdb is being redone.
-	// During this period, the data is written to tmpdb (sdbs[len(sdbs)-1]).
-	Redoing = (iota + 1) << 30
-)
+	// propagateDeletion propagates the deletion of the expired keys and
+	// fields, see SetExpirePropagation.
+	propagateDeletion func(argv [][]byte)
+	// replica is set when the keys are expired by our master, see
+	// SetReplica, and masterCommand while a command of our master is
+	// executed, see SetMasterCommand.
+	replica       bool
+	masterCommand bool
+}
 
 func New() *DB {
-	return &DB{sdbs: [sdbNum]*sdb{newSdb(0), newSdb(1)}}
+	db := &DB{}
+	for i := range db.shards {
+		db.shards[i].init()
+	}
+	return db
 }
 
+var emptyRobj = obj.Robj{}
+
 func (db *DB) LookupKeyRead(key string) (*obj.Robj, bool) {
-	_, val, ok := db.findForRead(key)
-	return val, ok
+	e := db.lookupKey(db.shardOf(key), key, false)
+	if e == nil {
+		return &emptyRobj, false
+	}
+	return e.val, true
 }
 
-func (db *DB) findForRead(key string) (*sdb, *obj.Robj, bool) {
-	var sdb *sdb
-	if db.state != InNormalState {
-		sdb := db.sdbs[1]
-		if val, ok := sdb.lookupKeyReadWithFlags(key); ok {
-			return sdb, val, ok
-		}
+// LookupKeyWrite returns the value of key to be modified in place. A value
+// shared with a snapshot is copied at first.
+func (db *DB) LookupKeyWrite(key string) (*obj.Robj, bool) {
+	sh := db.shardOf(key)
+	e := db.lookupKey(sh, key, true)
+	if e == nil {
+		return &emptyRobj, false
 	}
-	sdb = db.sdbs[0]
-	val, ok := sdb.lookupKeyReadWithFlags(key)
-	return sdb, val, ok
+	return sh.editValue(e).val, true
 }
 
-func (db *DB) LookupKeyWrite(key string) (*obj.Robj, bool) {
-	_, val, ok := db.findForWrite(key)
-	return val, ok
-}
-
-func (db *DB) findForWrite(key string) (*sdb, *obj.Robj, bool) {
-	var sdb *sdb
-	if db.state != InNormalState {
-		sdb = db.sdbs[1]
-		if val, ok := sdb.lookupKeyReadWithFlags(key); ok {
-			if db.state == InMergeState {
-				sdb.delKey(key)
-				sdb = db.sdbs[0]
-				sdb.setKey(key, val)
-
-				// Try moving part key-val pair in sdbs[1] to sdbs[0].
-				_ = db.MergeIfNeeded(20 * time.Millisecond)
-			}
-			return sdb, val, ok
+// editValue returns e if its value can be modified in place, otherwise a
+// new version of it with a copy of the value, which replaces it in the
+// keyspace.
+func (sh *shard) editValue(e *entry) *entry {
+	t := sh.keys
+	if t.mutable(e.valVer) {
+		return e
+	}
+	ne := *e
+	ne.val = deepcopy(e.val)
+	ne.ver, ne.valVer = t.epoch, t.epoch
+	t.set(&ne)
+	return &ne
+}
+
+// lookupKey returns the entry of key, the key is deleted if it's expired,
+// and so are the expired fields of a hash.
+//
+// On a replica the expired keys and fields are only missing for the reads,
+// they are deleted when our master propagates their deletion, or by the
+// writes if the replica is writable. They are valid for the commands of
+// our master.
+func (db *DB) lookupKey(sh *shard, key string, write bool) *entry {
+	e := sh.keys.find(key)
+	if e == nil || db.replica && db.masterCommand {
+		return e
+	}
+	now := time.Now().UnixMilli()
+	if e.expire != -1 && now > e.expire {
+		if !db.replica || write {
+			db.expireKey(sh, key)
+		}
+		return nil
+	}
+	if next := hash.NextExpire(e.val); next != hash.NoExpire && now >= next {
+		if db.replica && !write {
+			return withoutExpiredFields(e, now)
 		}
+		return db.expireFields(sh, e, now)
+	}
+	return e
+}
+
+// expireKey deletes the expired key, and propagates its deletion as a DEL,
+// or an UNLINK if the value is released in background.
+func (db *DB) expireKey(sh *shard, key string) bool {
+	if !db.delKey(sh, key, db.lazyExpire) {
+		return false
+	}
+	if db.lazyExpire {
+		db.propagate("UNLINK", key)
+	} else {
+		db.propagate("DEL", key)
+	}
+	return true
+}
+
+// expireFields deletes the fields of the hash of e expired at now, and the
+// key with its last field, their deletion is propagated as a HDEL. It
+// returns the entry of the key, nil if it is deleted.
+func (db *DB) expireFields(sh *shard, e *entry, now int64) *entry {
+	e = sh.editValue(e)
+	fields := hash.ExpireFields(e.val, now)
+	if len(fields) > 0 {
+		db.propagate("HDEL", e.key, fields...)
+	}
+	if hash.Len(e.val) == 0 {
+		db.delKey(sh, e.key, db.lazyExpire)
+		return nil
+	}
+	sh.trackFieldExpires(e.key, e.val)
+	return e
+}
+
+// withoutExpiredFields returns a copy of e without the fields of the hash
+// expired at now, which is read on a replica while the HDEL of our master
+// is awaited, nil if all the fields are expired.
+func withoutExpiredFields(e *entry, now int64) *entry {
+	ne := *e
+	ne.val = hash.DeepCopy(e.val)
+	hash.ExpireFields(ne.val, now)
+	if hash.Len(ne.val) == 0 {
+		return nil
 	}
+	return &ne
+}
 
-	sdb = db.sdbs[0]
-	val, ok := sdb.lookupKeyReadWithFlags(key)
-	// during the persistence process, the key-val to sdbs[1].
-	if ok && db.state == InPersistState {
-		sdb = db.sdbs[1]
-		val = deepcopy(val)
-		sdb.setKey(key, val)
+// propagate propagates the deletion of an expired key or of the expired
+// fields of a hash, so that the replicas and the AOF don't depend on their
+// clocks to expire them. A replica leaves it to our master.
+func (db *DB) propagate(name, key string, args ...[]byte) {
+	if db.propagateDeletion == nil || db.replica {
+		return
 	}
-	return sdb, val, ok
+	argv := append([][]byte{[]byte(name), []byte(key)}, args...)
+	db.propagateDeletion(argv)
 }
 
 func deepcopy(val *obj.Robj) *obj.Robj {
@@ -105,135 +183,354 @@ func deepcopy(val *obj.Robj) *obj.Robj {
 	}
 }
 
+// SetKey sets the value of key, the expire of an existing key is kept.
+// The value is owned by db from now on, it must not be shared with another key.
 func (db *DB) SetKey(key string, val *obj.Robj) {
-	_, robj, ok := db.findForWrite(key)
-	if ok {
-		robj.SetVal(val.Val())
-		robj.SetType(val.Type())
-		robj.SetEncoding(val.Encoding())
-	} else {
-		sdb := db.sdbs[0]
-		if db.state == InPersistState {
-			sdb = db.sdbs[1]
+	sds.TryObjectEncoding(val)
+
+	sh := db.shardOf(key)
+	t := sh.keys
+	e := db.lookupKey(sh, key, true)
+	if e == nil {
+		t.set(&entry{key: key, hash: trieHash(key), val: val, expire: -1,
+			ver: t.epoch, valVer: t.epoch})
+		if db.slots != nil {
+			db.slots.add(key)
 		}
-		sdb.setKey(key, val)
+		sh.trackFieldExpires(key, val)
+		return
+	}
+	e = sh.editEntry(e)
+	old := e.val
+	e.val = val
+	e.valVer = t.epoch
+	sh.trackFieldExpires(key, val)
+	if old != val && db.lazyServerDel && db.freeAsync != nil {
+		db.freeAsync(old)
+	}
+}
+
+// editEntry returns e if it can be modified in place, otherwise a new
+// version of it which replaces it in the keyspace.
+func (sh *shard) editEntry(e *entry) *entry {
+	t := sh.keys
+	if t.mutable(e.ver) {
+		return e
 	}
+	ne := *e
+	ne.ver = t.epoch
+	t.set(&ne)
+	return &ne
 }
 
+// SetExpire sets the expire of key, a unix time in milliseconds. The key is
+// not looked up, like in Redis, so that an already expired one is loaded by
+// a replica and is kept.
 func (db *DB) SetExpire(key string, expire time.Duration) {
-	sdb, _, ok := db.findForRead(key)
-	if ok {
-		sdb.setExpire(key, expire)
+	sh := db.shardOf(key)
+	e := sh.keys.find(key)
+	if e == nil {
+		return
 	}
+	e = sh.editEntry(e)
+	e.expire = int64(expire)
+	sh.expires.Replace(key, sds.NewRobj(int64(expire)))
 }
 
 func (db *DB) Expire(key string) time.Duration {
-	sdb, _, ok := db.findForRead(key)
-	if ok {
-		return sdb.expire(key)
+	e := db.lookupKey(db.shardOf(key), key, false)
+	if e == nil {
+		return -1
 	}
-	return -1
+	return time.Duration(e.expire)
 }
 
-func (db *DB) DelKey(key string) {
-	_, robj, ok := db.findForWrite(key)
-	if ok {
-		if db.state == InPersistState {
-			robj.SetDeleted(true)
-		} else {
-			sdb := db.sdbs[0]
-			sdb.delKey(key)
-		}
+// TrackFieldExpires updates the index of the hashes with field expires for
+// key, after the TTLs of its fields are set.
+func (db *DB) TrackFieldExpires(key string) {
+	sh := db.shardOf(key)
+	if e := sh.keys.find(key); e != nil {
+		sh.trackFieldExpires(key, e.val)
+	}
+}
+
+// trackFieldExpires indexes key by the next field expire of val, if it is
+// a hash with field expires, or removes it from the index.
+func (sh *shard) trackFieldExpires(key string, val *obj.Robj) {
+	if next := hash.NextExpire(val); next != hash.NoExpire {
+		sh.hexpires.Replace(key, sds.NewRobj(next))
+	} else if sh.hexpires.Used() > 0 {
+		_ = sh.hexpires.Del(key)
+	}
+}
+
+// SetLazyfree makes db release the deleted values by freeAsync, according
+// to lazyExpire and lazyServerDel, besides AsyncDelete.
+func (db *DB) SetLazyfree(freeAsync func(val *obj.Robj), lazyExpire, lazyServerDel bool) {
+	db.freeAsync = freeAsync
+	db.lazyExpire = lazyExpire
+	db.lazyServerDel = lazyServerDel
+}
+
+// SetExpirePropagation makes db propagate the deletion of the expired keys
+// and fields by propagate, as the DEL, UNLINK and HDEL commands.
+func (db *DB) SetExpirePropagation(propagate func(argv [][]byte)) {
+	db.propagateDeletion = propagate
+}
+
+// SetReplica tells whether db is the dataset of a replica, whose keys are
+// expired by its master, see lookupKey. The active expire cycles do nothing
+// on a replica.
+//
+// It should be called when holding the CmdLock exclusively.
+func (db *DB) SetReplica(replica bool) {
+	db.replica = replica
+}
+
+// SetMasterCommand is set while a command of our master is executed, for
+// which the expired keys and fields are valid.
+//
+// It should be called when holding the CmdLock exclusively.
+func (db *DB) SetMasterCommand(masterCommand bool) {
+	db.masterCommand = masterCommand
+}
+
+// DelKey deletes key as a side effect of a command, the value is released
+// in background if lazyServerDel is set. It reports whether key existed.
+func (db *DB) DelKey(key string) bool {
+	sh := db.shardOf(key)
+	return db.lookupKey(sh, key, true) != nil && db.delKey(sh, key, db.lazyServerDel)
+}
+
+// SyncDelete deletes key, as DEL does.
+func (db *DB) SyncDelete(key string) bool {
+	sh := db.shardOf(key)
+	return db.lookupKey(sh, key, true) != nil && db.delKey(sh, key, false)
+}
+
+// AsyncDelete deletes key and releases its value in background, as UNLINK does.
+func (db *DB) AsyncDelete(key string) bool {
+	sh := db.shardOf(key)
+	return db.lookupKey(sh, key, true) != nil && db.delKey(sh, key, true)
+}
+
+func (db *DB) delKey(sh *shard, key string, async bool) bool {
+	e := sh.keys.del(key)
+	if e == nil {
+		return false
+	}
+	if sh.expires.Used() > 0 {
+		_ = sh.expires.Del(key)
+	}
+	if sh.hexpires.Used() > 0 {
+		_ = sh.hexpires.Del(key)
+	}
+	if db.slots != nil {
+		db.slots.del(key)
 	}
+	if async && db.freeAsync != nil {
+		db.freeAsync(e.val)
+	}
+	return true
 }
 
+const (
+	activeExpireCycleLookupsPerLoop = 20
+)
+
+// ActiveExpireCycle deletes the expired keys for at most timelimit, the
+// shards are visited in turn from where the last cycle stopped. Every shard
+// is locked while its keys are expired, the caller holds the CmdLock shared.
 func (db *DB) ActiveExpireCycle(timelimit time.Duration) {
+	if db.replica {
+		return
+	}
 	start := time.Now()
-	exit := false
-	for i := 0; i < sdbNum; i++ {
-		sdb := db.sdbs[i]
-		for iteration := 0; !exit; iteration++ {
-			expired := 0
-			n := sdb.expires.Used()
-			if n > activeExpireCycleLookupsPerLoop {
-				n = activeExpireCycleLookupsPerLoop
-			}
+	for range Shards {
+		sh := &db.shards[db.expireShard]
+		sh.mu.Lock()
+		done := db.activeExpireShard(sh, start, timelimit)
+		sh.mu.Unlock()
+		if !done {
+			return
+		}
+		db.expireShard = (db.expireShard + 1) % Shards
+	}
+}
 
-			for ; n > 0; n-- {
-				e := sdb.expires.GetRandomKey()
-				if sdb.activeExpireCycleTryExpire(e, time.Now()) {
-					expired += 1
-				}
-			}
+// activeExpireShard expires the keys of sh, it returns false if the time
+// limit is reached.
+func (db *DB) activeExpireShard(sh *shard, start time.Time, timelimit time.Duration) bool {
+	for iteration := 0; ; iteration++ {
+		expired := 0
+		n := sh.expires.Used()
+		if n > activeExpireCycleLookupsPerLoop {
+			n = activeExpireCycleLookupsPerLoop
+		}
 
-			if iteration%16 == 0 {
-				elapsed := time.Now().Sub(start)
-				if elapsed > timelimit {
-					exit = true
-				}
+		for ; n > 0; n-- {
+			e := sh.expires.GetRandomKey()
+			if db.activeExpireCycleTryExpire(sh, e, time.Now()) {
+				expired += 1
 			}
+		}
 
-			if expired < activeExpireCycleLookupsPerLoop/4 {
-				exit = true
+		if iteration%16 == 0 {
+			elapsed := time.Now().Sub(start)
+			if elapsed > timelimit {
+				return false
 			}
 		}
-	}
-	return
-}
 
-func (db *DB) SetState(state uint8) {
-	db.state = state
+		if expired < activeExpireCycleLookupsPerLoop/4 {
+			return true
+		}
+	}
 }
 
-func (db *DB) InNormalState() bool {
-	return db.state == InNormalState
+func (db *DB) activeExpireCycleTryExpire(sh *shard, entry Entry, now time.Time) bool {
+	expire := timeDurationVal(entry)
+	// expired
+	if now.UnixMilli() > int64(expire) {
+		return db.expireKey(sh, entry.Key)
+	}
+	return false
 }
 
-const dbMergeBatchNum = 128
-
-func (db *DB) MergeIfNeeded(timeout time.Duration) error {
-	if db.state != InMergeState {
-		return nil
+// ActiveFieldExpireCycle deletes the expired fields of the hashes for at
+// most timelimit, and the keys of the hashes left empty, as
+// ActiveExpireCycle does for the keys.
+func (db *DB) ActiveFieldExpireCycle(timelimit time.Duration) {
+	if db.replica {
+		return
 	}
 	start := time.Now()
-	cnt := 0
-	for {
-		if db.sdbs[1].slen == 0 {
-			db.state = InNormalState
-			slog.Info("the merge of DB has finished")
-			break
+	for range Shards {
+		sh := &db.shards[db.fieldExpireShard]
+		sh.mu.Lock()
+		done := db.activeFieldExpireShard(sh, start, timelimit)
+		sh.mu.Unlock()
+		if !done {
+			return
 		}
-		timeused := time.Since(start)
-		if time.Since(start) >= timeout {
-			slog.Info(fmt.Sprintf("in db merge stage, %d key-val pair "+
-				"had merged, timecost: %v\n", cnt, timeused))
-			break
+		db.fieldExpireShard = (db.fieldExpireShard + 1) % Shards
+	}
+}
+
+// activeFieldExpireShard expires the fields of the hashes of sh, it returns
+// false if the time limit is reached.
+func (db *DB) activeFieldExpireShard(sh *shard, start time.Time, timelimit time.Duration) bool {
+	for iteration := 0; ; iteration++ {
+		expired := 0
+		n := min(sh.hexpires.Used(), activeExpireCycleLookupsPerLoop)
+		now := time.Now().UnixMilli()
+		for ; n > 0 && sh.hexpires.Used() > 0; n-- {
+			he := sh.hexpires.GetRandomKey()
+			if now < int64(timeDurationVal(he)) {
+				continue
+			}
+			expired += 1
+			// The index may be stale, eg. after the value of the key is
+			// replaced by a command.
+			if e := sh.keys.find(he.Key); e != nil && hash.NextExpire(e.val) != hash.NoExpire {
+				db.expireFields(sh, e, now)
+			} else {
+				_ = sh.hexpires.Del(he.Key)
+			}
 		}
 
-		num := 0
-		for e := range db.sdbs[1].Iterator() {
-			db.sdbs[0].setKey(e.Key, e.Val)
-			db.sdbs[1].delKey(e.Key)
-			num++
-			if num == dbMergeBatchNum {
-				break
+		if iteration%16 == 0 {
+			elapsed := time.Now().Sub(start)
+			if elapsed > timelimit {
+				return false
 			}
 		}
-		cnt += num
+
+		if expired < activeExpireCycleLookupsPerLoop/4 {
+			return true
+		}
 	}
-	return nil
 }
 
-func (db *DB) Iterator() <-chan DBEntry {
-	// The data is always in Database 0.
-	return db.sdbs[0].Iterator()
+// IncrementallyRehash shrinks the dicts that have too many buckets, and
+// rehashes them for about timelimit, the shards are visited in turn from
+// where the last call stopped. Every shard is locked while its dict is
+// rehashed, the caller holds the CmdLock shared.
+func (db *DB) IncrementallyRehash(timelimit time.Duration) {
+	start := time.Now()
+	for range Shards {
+		sh := &db.shards[db.rehashShard]
+		sh.mu.Lock()
+		for _, d := range []dictable{sh.expires, sh.hexpires} {
+			if d, ok := d.(rehashable); ok {
+				d.ResizeIfNeeded()
+				d.RehashFor(timelimit - time.Since(start))
+			}
+		}
+		sh.mu.Unlock()
+		if time.Since(start) > timelimit {
+			return
+		}
+		db.rehashShard = (db.rehashShard + 1) % Shards
+	}
 }
 
+// Empty removes all the keys, the snapshots already taken are not affected.
 func (db *DB) Empty() int {
-	if db.state != InNormalState {
-		slog.Warn("db is not in normal state while empty db is not allowed")
-		return 0
+	if db.slots != nil {
+		db.slots.empty()
+	}
+	n := 0
+	for i := range db.shards {
+		sh := &db.shards[i]
+		_ = sh.expires.Empty()
+		_ = sh.hexpires.Empty()
+		n += sh.keys.empty()
+	}
+	return n
+}
+
+// Detach moves the dataset of db to a new DB, which is returned, and leaves
+// db empty. It is used to release the whole dataset in background.
+func (db *DB) Detach() *DB {
+	old := &DB{slots: db.slots}
+	for i := range db.shards {
+		old.shards[i].keys, old.shards[i].expires = db.shards[i].keys, db.shards[i].expires
+		old.shards[i].hexpires = db.shards[i].hexpires
+		db.shards[i].init()
+	}
+	if db.slots != nil {
+		db.slots = newSlotIndex()
+	}
+	return old
+}
+
+// Len returns the number of keys in db.
+func (db *DB) Len() int {
+	n := 0
+	for i := range db.shards {
+		n += db.shards[i].keys.len
+	}
+	return n
+}
+
+// ExpiresLen returns the number of keys with an expire.
+func (db *DB) ExpiresLen() int {
+	n := 0
+	for i := range db.shards {
+		n += db.shards[i].expires.Used()
+	}
+	return n
+}
+
+// Swap exchanges the dataset of db with the one of other, it is
+// used to replace the dataset at once after a full synchronization.
+func (db *DB) Swap(other *DB) {
+	for i := range db.shards {
+		sh, osh := &db.shards[i], &other.shards[i]
+		sh.keys, osh.keys = osh.keys, sh.keys
+		sh.expires, osh.expires = osh.expires, sh.expires
+		sh.hexpires, osh.hexpires = osh.hexpires, sh.hexpires
 	}
-	_ = db.sdbs[0].expires.Empty()
-	return db.sdbs[0].dict.Empty()
+	db.slots, other.slots = other.slots, db.slots
 }
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sunminx/RDB/internal/hash"
+	obj "github.com/sunminx/RDB/internal/object"
+	"github.com/sunminx/RDB/internal/sds"
+)
+
+func TestLazyfree(t *testing.T) {
+	db := New()
+	var freed []string
+	db.SetLazyfree(func(val *obj.Robj) {
+		freed = append(freed, string(val.Val().(sds.SDS)))
+	}, true, false)
+	set := func(key, val string) {
+		db.SetKey(key, sds.NewRobj(sds.New([]byte(val))))
+	}
+
+	set("a", "one")
+	set("a", "two")
+	set("b", "three")
+	set("c", "four")
+	if !db.SyncDelete("a") || db.SyncDelete("a") || !db.AsyncDelete("b") || !db.DelKey("c") {
+		t.Fatal("the deletions don't report the existing keys")
+	}
+	// Only UNLINK and the expiration release lazily.
+	set("d", "five")
+	db.SetExpire("d", time.Duration(time.Now().UnixMilli()-1))
+	if _, ok := db.LookupKeyRead("d"); ok {
+		t.Fatal("the expired key is found")
+	}
+	if len(freed) != 2 || freed[0] != "three" || freed[1] != "five" {
+		t.Errorf("freed %v", freed)
+	}
+}
+
+func TestDetach(t *testing.T) {
+	db := New()
+	db.EnableSlotIndex()
+	db.SetKey("a", sds.NewRobj(sds.New([]byte("1"))))
+	db.SetExpire("a", time.Duration(time.Now().UnixMilli()+10000))
+	old := db.Detach()
+	if db.Len() != 0 || db.ExpiresLen() != 0 || db.CountKeysInSlot(15495) != 0 {
+		t.Fatalf("db is not empty, %d keys", db.Len())
+	}
+	if old.Len() != 1 || old.ExpiresLen() != 1 || old.CountKeysInSlot(15495) != 1 {
+		t.Errorf("the old dataset has %d keys", old.Len())
+	}
+}
+
+func TestIncrementallyRehash(t *testing.T) {
+	db := New()
+	const n = 64 * 100
+	for i := range n {
+		key := strconv.Itoa(i)
+		db.SetKey(key, newStr(key))
+		db.SetExpire(key, time.Duration(time.Now().UnixMilli()+100000))
+	}
+	buckets := func() int {
+		size := 0
+		for i := range db.shards {
+			size += db.shards[i].expires.Size()
+		}
+		return size
+	}
+	before := buckets()
+	for i := 100; i < n; i++ {
+		db.DelKey(strconv.Itoa(i))
+	}
+	// The first calls shrink the dicts, the next ones complete the rehash.
+	for range 3 {
+		db.IncrementallyRehash(time.Second)
+	}
+	if after := buckets(); after >= before/10 || db.ExpiresLen() != 100 {
+		t.Errorf("%d buckets before, %d after, %d expires", before, after, db.ExpiresLen())
+	}
+}
+
+func TestFieldExpire(t *testing.T) {
+	db := New()
+	now := time.Now().UnixMilli()
+	newHash := func(key string, fields ...string) *obj.Robj {
+		val := hash.NewRobj(hash.NewZipmap())
+		for _, field := range fields {
+			hash.Set(val, []byte(field), []byte("v"))
+		}
+		db.SetKey(key, val)
+		return val
+	}
+
+	// The expired fields are deleted on the lookup, the hashes shared with
+	// a snapshot are copied at first.
+	h := newHash("h", "a", "b")
+	hash.SetExpire(h, []byte("a"), now-1)
+	db.TrackFieldExpires("h")
+	snap := db.Snapshot()
+	val, ok := db.LookupKeyRead("h")
+	if !ok || hash.Len(val) != 1 || hash.Exists(val, []byte("a")) {
+		t.Fatalf("the expired field is found")
+	}
+	if hash.Len(h) != 2 {
+		t.Error("the hash of the snapshot is modified")
+	}
+	snap.Release()
+
+	// The key is deleted with its last field.
+	h = newHash("g", "a")
+	hash.SetExpire(h, []byte("a"), now-1)
+	db.TrackFieldExpires("g")
+	if _, ok := db.LookupKeyRead("g"); ok {
+		t.Error("the hash of expired fields is found")
+	}
+
+	// The active cycle deletes the expired fields of the hashes indexed.
+	const n = 100
+	for i := range n {
+		key := "k" + strconv.Itoa(i)
+		h := newHash(key, "a", "b")
+		hash.SetExpire(h, []byte("a"), now-1)
+		if i%2 == 0 {
+			hash.SetExpire(h, []byte("b"), now-1)
+		}
+		db.TrackFieldExpires(key)
+	}
+	db.ActiveFieldExpireCycle(time.Second)
+	if db.Len() != 1+n/2 {
+		t.Errorf("%d keys left", db.Len())
+	}
+	for i := range db.shards {
+		if used := db.shards[i].hexpires.Used(); used != 0 {
+			t.Fatalf("%d hashes are indexed in shard %d", used, i)
+		}
+	}
+}
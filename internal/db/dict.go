@@ -3,11 +3,36 @@ package db
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"iter"
+	"maps"
 	"time"
 
+	"github.com/sunminx/RDB/internal/datastruct"
 	obj "github.com/sunminx/RDB/internal/object"
 )
 
+// dictable is a dictionary of the keys, it is implemented by Dict, and by
+// MapDict, which is a Go map, kept for comparison.
+type dictable interface {
+	Add(string, *obj.Robj) bool
+	Replace(string, *obj.Robj) bool
+	Del(string) bool
+	FetchValue(string) (*obj.Robj, bool)
+	GetRandomKey() Entry
+	Used() int
+	Size() int
+	Iterator() iter.Seq[*Entry]
+	Scan(uint64, func(*Entry)) uint64
+	Empty() int
+}
+
+// rehashable is implemented by the dicts which are resized incrementally,
+// see DB.IncrementallyRehash.
+type rehashable interface {
+	ResizeIfNeeded() bool
+	RehashFor(timelimit time.Duration) int
+}
+
 type MapDict struct {
 	dict map[string]*obj.Robj
 }
@@ -18,12 +43,17 @@ func NewMap() *MapDict {
 	}
 }
 
-type Entry struct {
-	Key string
-	Val *obj.Robj
+// Dict is the dict of Redis, see datastruct.Dict.
+type Dict = datastruct.Dict[*obj.Robj]
+
+type Entry = datastruct.DictEntry[*obj.Robj]
+
+func NewDict() *Dict {
+	return datastruct.NewDict[*obj.Robj]()
 }
 
-func (e *Entry) TimeDurationVal() time.Duration {
+// timeDurationVal returns the expire held by the value of an entry.
+func timeDurationVal(e Entry) time.Duration {
 	t, ok := e.Val.Val().(int64)
 	if !ok {
 		return time.Duration(0)
@@ -66,7 +96,7 @@ func (d *MapDict) GetRandomKey() Entry {
 	n := 0
 	for key, val := range d.dict {
 		if n == times {
-			return Entry{key, val}
+			return Entry{Key: key, Val: val}
 		}
 		n++
 	}
@@ -94,15 +124,22 @@ func (d *MapDict) Size() int {
 	return 0
 }
 
-func (d *MapDict) Iterator() <-chan *Entry {
-	ch := make(chan *Entry)
-	go func() {
-		defer close(ch)
+func (d *MapDict) Iterator() iter.Seq[*Entry] {
+	return func(yield func(*Entry) bool) {
 		for k, v := range d.dict {
-			ch <- &Entry{k, v}
+			if !yield(&Entry{Key: k, Val: v}) {
+				return
+			}
 		}
-	}()
-	return ch
+	}
+}
+
+// Scan calls fn for all the elements at once, a map has no cursor.
+func (d *MapDict) Scan(cursor uint64, fn func(*Entry)) uint64 {
+	for k, v := range maps.Clone(d.dict) {
+		fn(&Entry{Key: k, Val: v})
+	}
+	return 0
 }
 
 func (d *MapDict) Empty() int {
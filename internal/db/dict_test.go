@@ -1,7 +1,67 @@
 package db
 
-import "testing"
+import (
+	"strconv"
+	"testing"
+
+	"github.com/sunminx/RDB/internal/sds"
+)
 
 func TestRandom(t *testing.T) {
 	t.Log(random())
 }
+
+func TestDictables(t *testing.T) {
+	for name, d := range map[string]dictable{"dict": NewDict(), "map": NewMap()} {
+		const n = 1000
+		for i := range n {
+			if !d.Add(strconv.Itoa(i), newStr("v")) {
+				t.Fatalf("%s: add %d", name, i)
+			}
+		}
+		if d.Add("1", newStr("w")) || !d.Replace("1", newStr("w")) || d.Used() != n {
+			t.Errorf("%s: the key is added twice, %d keys", name, d.Used())
+		}
+		if v, ok := d.FetchValue("1"); !ok || string(v.Val().(sds.SDS)) != "w" {
+			t.Errorf("%s: the key is not replaced", name)
+		}
+		for i := 0; i < n; i += 2 {
+			if !d.Del(strconv.Itoa(i)) || d.Del(strconv.Itoa(i)) {
+				t.Fatalf("%s: del %d", name, i)
+			}
+		}
+		seen := 0
+		for e := range d.Iterator() {
+			if i, _ := strconv.Atoi(e.Key); i%2 == 0 {
+				t.Errorf("%s: %s is deleted", name, e.Key)
+			}
+			seen++
+		}
+		if seen != n/2 || d.Used() != n/2 {
+			t.Errorf("%s: %d keys iterated, %d used", name, seen, d.Used())
+		}
+		if e := d.GetRandomKey(); e.Key == "" {
+			t.Errorf("%s: no random key", name)
+		} else if _, ok := d.FetchValue(e.Key); !ok {
+			t.Errorf("%s: the random key %s is not in the dict", name, e.Key)
+		}
+		if d.Empty() != n/2 || d.Used() != 0 {
+			t.Errorf("%s: %d keys after empty", name, d.Used())
+		}
+	}
+}
+
+// BenchmarkGetRandomKey compares the sampling of the keys of Dict and of
+// MapDict, which visits the map up to the random key.
+func BenchmarkGetRandomKey(b *testing.B) {
+	for name, d := range map[string]dictable{"dict": NewDict(), "map": NewMap()} {
+		for i := range 100000 {
+			d.Add(strconv.Itoa(i), newStr("v"))
+		}
+		b.Run(name, func(b *testing.B) {
+			for range b.N {
+				d.GetRandomKey()
+			}
+		})
+	}
+}
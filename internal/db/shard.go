@@ -0,0 +1,72 @@
+package db
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/sunminx/RDB/internal/cluster"
+)
+
+// Shards is the number of the shards of the keyspace. A key belongs to the
+// shard of its hash slot, so the keys with the same hash tag, and the keys
+// of a slot index, are always in the same shard.
+//
+// The commands on different shards run in parallel: a command locks the
+// shards of its keys by LockShards, while holding the CmdLock shared, and
+// the rest of the methods of DB don't lock, they expect the shards of the
+// keys locked or the CmdLock held exclusively by the caller.
+const Shards = 64
+
+type shard struct {
+	mu   sync.Mutex
+	keys *trie
+	// expires indexes the keys with an expire, for the active expire cycle.
+	// The expire itself is kept in the entry, so that the snapshots see it.
+	expires dictable
+	// hexpires indexes the hashes with field expires, for the active field
+	// expire cycle, by a time not after their earliest one, see
+	// hash.NextExpire.
+	hexpires dictable
+	// Pad the shards to separate cache lines, they are locked by different
+	// cores.
+	_ [32]byte
+}
+
+func (sh *shard) init() {
+	sh.keys, sh.expires, sh.hexpires = &trie{}, NewDict(), NewDict()
+}
+
+// ShardOfKey returns the shard of key.
+func ShardOfKey(key []byte) int {
+	return cluster.KeyHashSlot(key) % Shards
+}
+
+// ShardsOfKeys returns the shards of keys, sorted and without duplicates,
+// which is the order in which they are locked.
+func ShardsOfKeys(keys [][]byte) []int {
+	shards := make([]int, 0, len(keys))
+	for _, key := range keys {
+		shards = append(shards, ShardOfKey(key))
+	}
+	slices.Sort(shards)
+	return slices.Compact(shards)
+}
+
+func (db *DB) shardOf(key string) *shard {
+	return &db.shards[ShardOfKey([]byte(key))]
+}
+
+// LockShards locks the shards, which must be sorted, as ShardsOfKeys
+// returns them, so that two commands never wait for each other.
+func (db *DB) LockShards(shards []int) {
+	for _, i := range shards {
+		db.shards[i].mu.Lock()
+	}
+}
+
+// UnlockShards unlocks the shards locked by LockShards.
+func (db *DB) UnlockShards(shards []int) {
+	for _, i := range slices.Backward(shards) {
+		db.shards[i].mu.Unlock()
+	}
+}
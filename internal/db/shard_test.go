@@ -0,0 +1,66 @@
+package db
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardsOfKeys(t *testing.T) {
+	if ShardOfKey([]byte("{user1}.name")) != ShardOfKey([]byte("{user1}.age")) {
+		t.Error("the keys with the same hash tag are in different shards")
+	}
+	keys := [][]byte{[]byte("c"), []byte("a"), []byte("b"), []byte("a"), []byte("{a}.x")}
+	shards := ShardsOfKeys(keys)
+	if !slices.IsSorted(shards) || len(shards) != len(slices.Compact(slices.Clone(shards))) {
+		t.Errorf("shards %v are not sorted or have duplicates", shards)
+	}
+	if len(shards) > 3 || !slices.Contains(shards, ShardOfKey([]byte("a"))) {
+		t.Errorf("shards %v", shards)
+	}
+}
+
+func TestShardsParallel(t *testing.T) {
+	db := New()
+	const writers, keys = 8, 200
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range keys {
+				key := strconv.Itoa(i) + ":" + strconv.Itoa(j)
+				shards := ShardsOfKeys([][]byte{[]byte(key)})
+				db.LockShards(shards)
+				db.SetKey(key, newStr(key))
+				if j%2 == 0 {
+					db.SetExpire(key, time.Duration(time.Now().UnixMilli()-1))
+				}
+				db.UnlockShards(shards)
+			}
+		}()
+	}
+	// The active expire cycle locks the shards in turn.
+	for range 10 {
+		db.ActiveExpireCycle(time.Millisecond)
+	}
+	wg.Wait()
+
+	snap := db.Snapshot()
+	defer snap.Release()
+	n := 0
+	for range snap.Iterator() {
+		n++
+	}
+	if n != snap.Len() || db.Len() != snap.Len() {
+		t.Errorf("snapshot %d keys, iterated %d, db %d", snap.Len(), n, db.Len())
+	}
+	for db.ExpiresLen() > 0 {
+		db.ActiveExpireCycle(time.Millisecond)
+	}
+	if db.Len() != writers*keys/2 {
+		t.Errorf("%d keys want: %d", db.Len(), writers*keys/2)
+	}
+}
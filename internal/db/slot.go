@@ -0,0 +1,72 @@
+package db
+
+import (
+	"github.com/sunminx/RDB/internal/cluster"
+)
+
+// slotIndex keeps the keys of every hash slot, so that the keys of a slot
+// can be counted and listed quickly. It is only used in cluster mode. The
+// keys of a slot are in the same shard, so the map of a slot is only used
+// under the lock of its shard.
+type slotIndex struct {
+	keys [cluster.Slots]map[string]struct{}
+}
+
+func newSlotIndex() *slotIndex {
+	return &slotIndex{}
+}
+
+func (si *slotIndex) add(key string) {
+	slot := cluster.KeyHashSlot([]byte(key))
+	if si.keys[slot] == nil {
+		si.keys[slot] = make(map[string]struct{})
+	}
+	si.keys[slot][key] = struct{}{}
+}
+
+func (si *slotIndex) del(key string) {
+	slot := cluster.KeyHashSlot([]byte(key))
+	delete(si.keys[slot], key)
+}
+
+func (si *slotIndex) empty() {
+	clear(si.keys[:])
+}
+
+// EnableSlotIndex starts keeping the keys of every hash slot, the keys
+// already in db are indexed.
+func (db *DB) EnableSlotIndex() {
+	if db.slots != nil {
+		return
+	}
+	db.slots = newSlotIndex()
+	for i := range db.shards {
+		db.shards[i].keys.each(func(e *entry) bool {
+			db.slots.add(e.key)
+			return true
+		})
+	}
+}
+
+// CountKeysInSlot returns the number of keys in the hash slot.
+func (db *DB) CountKeysInSlot(slot int) int {
+	if db.slots == nil {
+		return 0
+	}
+	return len(db.slots.keys[slot])
+}
+
+// GetKeysInSlot returns at most count keys of the hash slot.
+func (db *DB) GetKeysInSlot(slot int, count int) []string {
+	if db.slots == nil {
+		return nil
+	}
+	keys := make([]string, 0)
+	for key := range db.slots.keys[slot] {
+		if len(keys) == count {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/sunminx/RDB/internal/cluster"
+	"github.com/sunminx/RDB/internal/sds"
+)
+
+func TestSlotIndex(t *testing.T) {
+	db := New()
+	db.SetKey("foo", sds.NewRobj(sds.New([]byte("1"))))
+	db.EnableSlotIndex()
+	db.SetKey("{foo}.a", sds.NewRobj(sds.New([]byte("2"))))
+	db.SetKey("{foo}.a", sds.NewRobj(sds.New([]byte("3"))))
+	db.SetKey("bar", sds.NewRobj(sds.New([]byte("4"))))
+
+	slot := cluster.KeyHashSlot([]byte("foo"))
+	if n := db.CountKeysInSlot(slot); n != 2 {
+		t.Errorf("CountKeysInSlot: %d want: %d", n, 2)
+	}
+	if keys := db.GetKeysInSlot(slot, 1); len(keys) != 1 {
+		t.Errorf("GetKeysInSlot: %v want 1 key", keys)
+	}
+
+	db.DelKey("foo")
+	if keys := db.GetKeysInSlot(slot, 10); len(keys) != 1 || keys[0] != "{foo}.a" {
+		t.Errorf("GetKeysInSlot: %v want: [{foo}.a]", keys)
+	}
+
+	db.Empty()
+	if n := db.CountKeysInSlot(cluster.KeyHashSlot([]byte("bar"))); n != 0 {
+		t.Errorf("CountKeysInSlot after Empty: %d want: %d", n, 0)
+	}
+}
@@ -0,0 +1,69 @@
+package db
+
+import "sync"
+
+// Snapshot is a consistent view of the keyspace at the time it was taken.
+// It can be read by another goroutine while the commands keep modifying
+// the keyspace, and any number of snapshots can be read at the same time.
+// A snapshot must be released once it is no longer read, until then the
+// writes copy the data shared with it.
+type Snapshot struct {
+	// roots and keys are the roots and the tries of the shards.
+	roots   [Shards]*trieNode
+	keys    [Shards]*trie
+	len     int
+	release sync.Once
+}
+
+// Snapshot takes a snapshot of db, the caller must hold the CmdLock
+// exclusively, so that the snapshot is consistent across the shards.
+func (db *DB) Snapshot() *Snapshot {
+	snap := &Snapshot{}
+	for i := range db.shards {
+		t := db.shards[i].keys
+		t.readers.Add(1)
+		snap.roots[i], snap.keys[i] = t.root, t
+		snap.len += t.len
+		// All that exists now belongs to the snapshot.
+		t.epoch++
+	}
+	return snap
+}
+
+// Release tells that the snapshot is no longer read.
+func (snap *Snapshot) Release() {
+	snap.release.Do(func() {
+		for _, t := range snap.keys {
+			t.readers.Add(-1)
+		}
+	})
+}
+
+// Len returns the number of keys in the snapshot.
+func (snap *Snapshot) Len() int {
+	return snap.len
+}
+
+type DBEntry struct {
+	*Entry
+	Expire int64
+}
+
+// Iterator returns the keys of the snapshot, which may include the keys
+// already expired when it was taken.
+func (snap *Snapshot) Iterator() <-chan DBEntry {
+	ch := make(chan DBEntry)
+	go func() {
+		defer close(ch)
+		for _, root := range snap.roots {
+			if root == nil {
+				continue
+			}
+			root.each(func(e *entry) bool {
+				ch <- DBEntry{&Entry{Key: e.key, Val: e.val}, e.expire}
+				return true
+			})
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"maps"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunminx/RDB/internal/list"
+	obj "github.com/sunminx/RDB/internal/object"
+	"github.com/sunminx/RDB/internal/sds"
+)
+
+func newStr(s string) *obj.Robj {
+	return sds.NewRobj(sds.New([]byte(s)))
+}
+
+func snapshotContent(snap *Snapshot) map[string]string {
+	m := make(map[string]string)
+	for e := range snap.Iterator() {
+		switch e.Val.Type() {
+		case obj.TypeString:
+			m[e.Key] = string(e.Val.Val().(sds.SDS))
+		case obj.TypeList:
+			m[e.Key] = strconv.Itoa(int(list.Cnt(e.Val)))
+		}
+		if e.Expire != -1 {
+			m[e.Key] += " expire " + strconv.FormatInt(e.Expire, 10)
+		}
+	}
+	return m
+}
+
+func TestSnapshot(t *testing.T) {
+	db := New()
+	db.SetKey("a", newStr("one"))
+	db.SetKey("b", newStr("two"))
+	l := list.NewRobj(list.NewQuicklist())
+	list.Push(l, []byte("x"))
+	db.SetKey("l", l)
+
+	snap := db.Snapshot()
+	expire := time.Now().Add(time.Hour).UnixMilli()
+	db.SetKey("a", newStr("ten"))
+	db.DelKey("b")
+	db.SetKey("c", newStr("three"))
+	db.SetExpire("c", time.Duration(expire))
+	val, _ := db.LookupKeyWrite("l")
+	list.Push(val, []byte("y"))
+
+	// The second snapshot sees the writes after the first one.
+	snap2 := db.Snapshot()
+	db.DelKey("l")
+
+	want := map[string]string{"a": "one", "b": "two", "l": "1"}
+	if got := snapshotContent(snap); !maps.Equal(got, want) || snap.Len() != 3 {
+		t.Errorf("snapshot: %v len %d want: %v", got, snap.Len(), want)
+	}
+	want2 := map[string]string{"a": "ten", "c": "three expire " + strconv.FormatInt(expire, 10), "l": "2"}
+	if got := snapshotContent(snap2); !maps.Equal(got, want2) {
+		t.Errorf("second snapshot: %v want: %v", got, want2)
+	}
+	snap.Release()
+	snap2.Release()
+
+	if db.Len() != 2 || db.Expire("c") != time.Duration(expire) {
+		t.Errorf("len: %d expire: %d", db.Len(), db.Expire("c"))
+	}
+	if val, ok := db.LookupKeyRead("l"); ok {
+		t.Errorf("deleted key found: %v", val)
+	}
+}
+
+func TestSnapshotEmpty(t *testing.T) {
+	db := New()
+	db.SetKey("a", newStr("one"))
+	snap := db.Snapshot()
+	defer snap.Release()
+	db.Empty()
+	if got := snapshotContent(snap); got["a"] != "one" || db.Len() != 0 {
+		t.Errorf("snapshot after Empty: %v len %d", got, db.Len())
+	}
+}
+
+// TestSnapshotConcurrentWrites is meant to be run with -race.
+func TestSnapshotConcurrentWrites(t *testing.T) {
+	db := New()
+	const n = 2000
+	for i := 0; i < n; i++ {
+		db.SetKey(strconv.Itoa(i), newStr("v"))
+	}
+	var wg sync.WaitGroup
+	snaps := []*Snapshot{db.Snapshot(), db.Snapshot()}
+	for _, snap := range snaps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer snap.Release()
+			cnt := 0
+			for e := range snap.Iterator() {
+				if string(e.Val.Val().(sds.SDS)) != "v" {
+					t.Errorf("key %s modified in the snapshot", e.Key)
+				}
+				cnt++
+			}
+			if cnt != n {
+				t.Errorf("snapshot keys: %d want: %d", cnt, n)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		if i%3 == 0 {
+			db.DelKey(key)
+		} else {
+			db.SetKey(key, newStr("w"))
+		}
+		db.SetKey("new"+key, newStr("w"))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,267 @@
+package db
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"slices"
+	"sync/atomic"
+
+	obj "github.com/sunminx/RDB/internal/object"
+)
+
+// The keyspace is a persistent hash array mapped trie. Every node and entry
+// is stamped with the epoch of the keyspace when it was created. A snapshot
+// starts a new epoch, from then on the nodes and the entries of the older
+// epochs are never modified, the writes copy the path from the root to the
+// modified entry instead. So a snapshot is just the root of the trie when it
+// was taken, and it can be read by any number of goroutines while the
+// keyspace keeps changing.
+
+const (
+	trieBits   = 5
+	trieFanout = 1 << trieBits
+	trieMask   = trieFanout - 1
+	// trieMaxShift is where the bits of the hash are exhausted, the node
+	// at this depth keeps the colliding entries in a list.
+	trieMaxShift = 64
+)
+
+var trieSeed = maphash.MakeSeed()
+
+func trieHash(key string) uint64 {
+	return maphash.String(trieSeed, key)
+}
+
+type entry struct {
+	key    string
+	hash   uint64
+	val    *obj.Robj
+	expire int64
+	// ver is the epoch when the entry was created, valVer the one when
+	// its value was created. A new version of the entry may share the
+	// value with the previous one, eg. when only the expire is changed.
+	ver    uint64
+	valVer uint64
+}
+
+type trieNode struct {
+	ver    uint64
+	bitmap uint32
+	// slots are the children by the bits of the hash set in bitmap,
+	// every slot is either an entry or a node.
+	slots []trieSlot
+}
+
+type trieSlot struct {
+	entry *entry
+	node  *trieNode
+}
+
+// trie is the writable side of the keys of a shard, it is only used by
+// the goroutine which holds the lock of the shard.
+type trie struct {
+	root  *trieNode
+	len   int
+	epoch uint64
+	// readers is the number of the snapshots not released yet, when there
+	// is none everything can be modified in place.
+	readers atomic.Int64
+}
+
+func (t *trie) mutable(ver uint64) bool {
+	return ver == t.epoch || t.readers.Load() == 0
+}
+
+// edit returns n if it can be modified in place, otherwise a copy of it
+// which belongs to the current epoch.
+func (t *trie) edit(n *trieNode) *trieNode {
+	if t.mutable(n.ver) {
+		return n
+	}
+	return &trieNode{ver: t.epoch, bitmap: n.bitmap, slots: slices.Clone(n.slots)}
+}
+
+func (n *trieNode) index(bit uint32) int {
+	return bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+// find returns the entry of key, nil if the key doesn't exist.
+func (n *trieNode) find(key string, hash uint64) *entry {
+	for shift := uint(0); n != nil; shift += trieBits {
+		if shift >= trieMaxShift {
+			for _, s := range n.slots {
+				if s.entry.key == key {
+					return s.entry
+				}
+			}
+			return nil
+		}
+		bit := uint32(1) << ((hash >> shift) & trieMask)
+		if n.bitmap&bit == 0 {
+			return nil
+		}
+		s := n.slots[n.index(bit)]
+		if s.node == nil {
+			if s.entry.key == key {
+				return s.entry
+			}
+			return nil
+		}
+		n = s.node
+	}
+	return nil
+}
+
+// each calls fn for all the entries under n until it returns false.
+func (n *trieNode) each(fn func(*entry) bool) bool {
+	for _, s := range n.slots {
+		if s.node != nil {
+			if !s.node.each(fn) {
+				return false
+			}
+		} else if !fn(s.entry) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *trie) find(key string) *entry {
+	if t.root == nil {
+		return nil
+	}
+	return t.root.find(key, trieHash(key))
+}
+
+// set adds or replaces the entry of e.key.
+func (t *trie) set(e *entry) {
+	root := t.root
+	if root == nil {
+		root = &trieNode{ver: t.epoch}
+	}
+	var added bool
+	t.root, added = t.insert(root, e, 0)
+	if added {
+		t.len++
+	}
+}
+
+func (t *trie) insert(n *trieNode, e *entry, shift uint) (*trieNode, bool) {
+	if shift >= trieMaxShift {
+		for i, s := range n.slots {
+			if s.entry.key == e.key {
+				n = t.edit(n)
+				n.slots[i].entry = e
+				return n, false
+			}
+		}
+		n = t.edit(n)
+		n.slots = append(n.slots, trieSlot{entry: e})
+		return n, true
+	}
+
+	bit := uint32(1) << ((e.hash >> shift) & trieMask)
+	idx := n.index(bit)
+	if n.bitmap&bit == 0 {
+		n = t.edit(n)
+		n.slots = slices.Insert(n.slots, idx, trieSlot{entry: e})
+		n.bitmap |= bit
+		return n, true
+	}
+	s := n.slots[idx]
+	if s.node != nil {
+		child, added := t.insert(s.node, e, shift+trieBits)
+		if child != s.node {
+			n = t.edit(n)
+			n.slots[idx].node = child
+		}
+		return n, added
+	}
+	if s.entry.key == e.key {
+		n = t.edit(n)
+		n.slots[idx].entry = e
+		return n, false
+	}
+	// Both the entries go down to a new node.
+	child := &trieNode{ver: t.epoch}
+	child, _ = t.insert(child, s.entry, shift+trieBits)
+	child, _ = t.insert(child, e, shift+trieBits)
+	n = t.edit(n)
+	n.slots[idx] = trieSlot{node: child}
+	return n, true
+}
+
+// del removes the entry of key, and returns it.
+func (t *trie) del(key string) *entry {
+	if t.root == nil {
+		return nil
+	}
+	root, old := t.remove(t.root, key, trieHash(key), 0)
+	if old != nil {
+		t.root = root
+		t.len--
+	}
+	return old
+}
+
+func (t *trie) remove(n *trieNode, key string, hash uint64, shift uint) (*trieNode, *entry) {
+	if shift >= trieMaxShift {
+		for i, s := range n.slots {
+			if s.entry.key == key {
+				n = t.edit(n)
+				n.slots = slices.Delete(n.slots, i, i+1)
+				return n, s.entry
+			}
+		}
+		return n, nil
+	}
+
+	bit := uint32(1) << ((hash >> shift) & trieMask)
+	if n.bitmap&bit == 0 {
+		return n, nil
+	}
+	idx := n.index(bit)
+	s := n.slots[idx]
+	if s.node == nil {
+		if s.entry.key != key {
+			return n, nil
+		}
+		n = t.edit(n)
+		n.slots = slices.Delete(n.slots, idx, idx+1)
+		n.bitmap &^= bit
+		return n, s.entry
+	}
+
+	child, old := t.remove(s.node, key, hash, shift+trieBits)
+	if old == nil {
+		return n, nil
+	}
+	n = t.edit(n)
+	switch {
+	case len(child.slots) == 0:
+		n.slots = slices.Delete(n.slots, idx, idx+1)
+		n.bitmap &^= bit
+	case len(child.slots) == 1 && child.slots[0].node == nil:
+		// A single entry doesn't need a node of its own.
+		n.slots[idx] = child.slots[0]
+	default:
+		n.slots[idx].node = child
+	}
+	return n, old
+}
+
+// each calls fn for all the entries until it returns false.
+func (t *trie) each(fn func(*entry) bool) {
+	if t.root != nil {
+		t.root.each(fn)
+	}
+}
+
+// empty removes all the entries. The nodes are left to the snapshots
+// still reading them.
+func (t *trie) empty() int {
+	n := t.len
+	t.root = nil
+	t.len = 0
+	return n
+}
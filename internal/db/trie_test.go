@@ -0,0 +1,64 @@
+package db
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/sunminx/RDB/internal/sds"
+)
+
+func TestTrie(t *testing.T) {
+	tr := &trie{}
+	const n = 10000
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		tr.set(&entry{key: key, hash: trieHash(key), val: sds.NewRobj(sds.New([]byte(key)))})
+	}
+	if tr.len != n {
+		t.Fatalf("len: %d want: %d", tr.len, n)
+	}
+	for i := 0; i < n; i += 2 {
+		if tr.del(strconv.Itoa(i)) == nil {
+			t.Fatalf("del %d: not found", i)
+		}
+	}
+	if tr.del("0") != nil {
+		t.Error("deleted twice")
+	}
+	for i := 0; i < n; i++ {
+		found := tr.find(strconv.Itoa(i)) != nil
+		if found != (i%2 == 1) {
+			t.Fatalf("find %d: %v", i, found)
+		}
+	}
+	cnt := 0
+	tr.each(func(*entry) bool {
+		cnt++
+		return true
+	})
+	if cnt != n/2 || tr.len != n/2 {
+		t.Errorf("each: %d len: %d want: %d", cnt, tr.len, n/2)
+	}
+}
+
+func TestTrieCollision(t *testing.T) {
+	tr := &trie{}
+	keys := []string{"a", "b", "c"}
+	for _, key := range keys {
+		// The same hash for all the keys.
+		tr.set(&entry{key: key, hash: 42})
+	}
+	for _, key := range keys {
+		if e := tr.root.find(key, 42); e == nil || e.key != key {
+			t.Errorf("find %s: %v", key, e)
+		}
+	}
+	if _, old := tr.remove(tr.root, "b", 42, 0); old == nil {
+		t.Fatal("remove b: not found")
+	}
+	root, _ := tr.remove(tr.root, "a", 42, 0)
+	// The last entry is moved up to the root.
+	if len(root.slots) != 1 || root.slots[0].entry == nil || root.slots[0].entry.key != "c" {
+		t.Errorf("root after remove: %+v", root.slots)
+	}
+}
@@ -86,9 +86,16 @@ func (aof *Aofer) closeFile() {
 	}
 }
 
-func (aof *Aofer) rewrite(ctx context.Context, timestamp int64) error {
+// rewrite writes the commands which rebuild the keys of snap. When timestamp
+// is not zero it is annotated before the commands, as the time of the snapshot.
+func (aof *Aofer) rewrite(ctx context.Context, snap *db.Snapshot, timestamp int64) error {
 	var err error
-	for e := range aof.db.Iterator() {
+	if timestamp > 0 {
+		if _, err = aof.wr.Write(networking.AofTimestampAnnotation(timestamp)); err != nil {
+			return errors.Join(err, errors.New("failed rewrite timestamp annotation"))
+		}
+	}
+	for e := range snap.Iterator() {
 		select {
 		case <-ctx.Done():
 			return errContextCanceled
@@ -111,8 +118,7 @@ func (aof *Aofer) rewrite(ctx context.Context, timestamp int64) error {
 			return errors.New("invalid type of robj in AOF file")
 		}
 
-		expire := aof.db.Expire(e.Key)
-		if expire != -1 {
+		if e.Expire != -1 {
 			cmd := "*3\r\n$9\r\nPEXPIREAT\r\n"
 			if _, err = aof.wr.Write([]byte(cmd)); err != nil {
 				return errors.Join(err, errors.New("failed rewrite expire for key "+e.Key))
@@ -120,11 +126,14 @@ func (aof *Aofer) rewrite(ctx context.Context, timestamp int64) error {
 			if !aof.writeBulkString([]byte(e.Key)) {
 				return errors.Join(err, errors.New("failed rewrite expire for key "+e.Key))
 			}
-			if !aof.writeBulkInt(int64(expire)) {
+			if !aof.writeBulkInt(e.Expire) {
 				return errors.Join(err, errors.New("failed rewrite expire for key "+e.Key))
 			}
 		}
 	}
+	if err = aof.wr.Flush(); err != nil {
+		return errors.Join(err, errors.New("failed flush rewritten AOF"))
+	}
 	return nil
 }
 
@@ -199,6 +208,31 @@ func (aof *Aofer) rewriteHashObject(key string, val *obj.Robj) bool {
 			batch = 0
 		}
 	}
+	return aof.rewriteHashFieldExpires(key, val)
+}
+
+// rewriteHashFieldExpires writes a HPEXPIREAT for every field of the hash
+// with a TTL, after the fields are set.
+func (aof *Aofer) rewriteHashFieldExpires(key string, val *obj.Robj) bool {
+	if hash.NextExpire(val) == hash.NoExpire {
+		return rewrited
+	}
+	for iter := hash.NewIterator(val); iter.HasNext(); {
+		field := iter.Next().(hash.KVPair)[0]
+		expire := hash.GetExpire(val, field)
+		if expire == hash.NoExpire {
+			continue
+		}
+		if !aof.writeMultibulkCount(6) ||
+			!aof.writeBulkString([]byte("HPEXPIREAT")) ||
+			!aof.writeBulkString([]byte(key)) ||
+			!aof.writeBulkInt(expire) ||
+			!aof.writeBulkString([]byte("FIELDS")) ||
+			!aof.writeBulkInt(1) ||
+			!aof.writeBulkString(field) {
+			return noRewrite
+		}
+	}
 	return rewrited
 }
 
@@ -212,18 +246,15 @@ func (aof *Aofer) writeBulkObject(robj *obj.Robj) bool {
 	return noRewrite
 }
 
+// writeBulkInt writes n as a bulk string, eg. $3\r\n100\r\n.
 func (aof *Aofer) writeBulkInt(n int64) bool {
-	bytes := Int64ToBytes(n)
-	aof.wr.Write([]byte{'$'})
-	aof.wr.Write(bytes)
-	aof.wr.Write([]byte("\r\n"))
-	return true
+	return aof.writeBulkString(Int64ToBytes(n))
 }
 
 func (aof *Aofer) writeBulkString(s []byte) bool {
 	ln := int64(len(s))
-	if !aof.writeBulkInt(ln) {
-		slog.Warn("failed write bulk string in rewrite aof")
+	if _, err := aof.wr.Write([]byte("$" + string(Int64ToBytes(ln)) + "\r\n")); err != nil {
+		slog.Warn("failed write bulk string in rewrite aof", "err", err)
 		return noRewrite
 	}
 	if ln > 0 {
@@ -312,10 +343,12 @@ func (aof *Aofer) loadSingleFile(filename string, server *networking.Server) int
 			// Since redis 7.x aof-chunking
 			slog.Info("reading RDB base file on AOF loading...")
 		}
-		rdber, err := newRdbSaver(aof.file, 'r', server.DB, newRdberInfo(server))
-		if err != nil {
-			slog.Warn("failed create rdber before loading", "filename", filename, "err", err)
-			return aofFailed
+		// The RDB part is read from the same reader of the AOF, so that
+		// the AOF tail is read from where the RDB part ends.
+		rdber := &Rdber{db: server.DB, info: newRdberInfo(server), rd: aof.rd}
+		rdber.progress = func(pos int64) {
+			loadingAbsProgress(server, pos-lastProgressReportSize)
+			lastProgressReportSize = pos
 		}
 		// Laoding RDB part firstly.
 		if err = rdber.load(); err != nil {
@@ -326,10 +359,7 @@ func (aof *Aofer) loadSingleFile(filename string, server *networking.Server) int
 			}
 			return aofFailed
 		} else {
-			pos := aof.rd.Tell()
-			// During the rdb loading stage, the progress is reported only once.
-			loadingAbsProgress(server, pos)
-			lastProgressReportSize = pos
+			rdber.progress(aof.rd.Tell())
 			if server.AofFilename == filename {
 				slog.Info("reading the remaining AOF tail...")
 			}
@@ -345,64 +375,25 @@ func (aof *Aofer) loadSingleFile(filename string, server *networking.Server) int
 			lastProgressReportSize += processDelta
 		}
 
-		p, isPrefix, err := aof.rd.ReadLine()
-		if err != nil || isPrefix {
-			if err == io.EOF {
-				break
-			}
-			slog.Warn("unrecoverable error reading the append only file", "filename", filename)
-			return aofFailed
-		}
-		if p[0] == '#' {
-			continue
+		argv, _, err := aof.readCommand()
+		if err == io.EOF {
+			break
 		}
-		if p[0] != '*' {
-			slog.Warn("invalid protocol, not found *")
-			return aofFailed
-		}
-		argc, err := strconv.ParseInt(string(p[1:]), 10, 64)
-		if err != nil || argc < 1 {
-			slog.Warn("invalid protocol, argc is less than 1")
+		if err != nil {
+			slog.Warn("bad file format reading the append only file, make a backup "+
+				"of your AOF file, then use rdb-check aof --fix <filename.manifest>",
+				"filename", filename, "err", err)
 			return aofFailed
 		}
-
-		argv := make([][]byte, argc, argc)
-		for i := int64(0); i < argc; i++ {
-			p, isPrefix, err := aof.rd.ReadLine()
-			if isPrefix || err != nil {
-				slog.Warn("unrecoverable error reading the append only file", "filename", filename)
-				return aofFailed
-			}
-			if p[0] != '$' {
-				slog.Warn("Bad file format reading the append only file make a backup "+
-					"of your AOF file, then use ./redis-check-aof --fix <filename.manifest>",
-					"filename", filename)
-				return aofFailed
-			}
-			ln, err := strconv.ParseInt(string(p[1:]), 10, 64)
-			if err != nil || ln < 1 {
-				slog.Warn("invalid protocol, invalid bulk len")
-				return aofFailed
-			}
-			p, err = aof.readRaw(int(ln))
-			if err != nil {
-				slog.Warn("failed read bulk")
-				return aofFailed
-			}
-
-			argv[i] = p
-
-			// Discard "CRLF"
-			_, err = aof.readRaw(2)
-			if err != nil {
-				slog.Warn(`failed discard \r\n`)
-				return aofFailed
-			}
+		// Skip the annotations, eg. the timestamps.
+		if argv == nil {
+			continue
 		}
+		argc := len(argv)
 
 		aof.fakeCli.SetArgument(argv)
 		name := strings.ToLower(string(argv[0]))
-		command, err := aof.lookupCommand(name, int(argc))
+		command, err := aof.lookupCommand(name, argc)
 		if err != nil {
 			slog.Warn("failed exec command when loading AOF file", "err", err)
 			return aofFailed
@@ -410,6 +401,7 @@ func (aof *Aofer) loadSingleFile(filename string, server *networking.Server) int
 		if server.AofLoadTruncated {
 			validBeforeMulti = validUpTo
 		}
+		aof.fakeCli.SetCommand(command)
 		if aof.fakeCli.Multi() && command.Name != "exec" {
 			aof.fakeCli.QueueMultiCommand()
 		} else {
@@ -441,7 +433,7 @@ func (aof *Aofer) loadSingleFile(filename string, server *networking.Server) int
 			}
 		}
 		slog.Warn("Unexpected end of file reading the append only file . You can: " +
-			"1) Make a backup of your AOF file, then use ./redis-check-aof --fix <filename.manifest>. " +
+			"1) Make a backup of your AOF file, then use rdb-check aof --fix <filename.manifest>. " +
 			"2) Alternatively you can set the 'aof-load-truncated' configuration option to yes and restart the server.")
 		return aofFailed
 	}
@@ -451,6 +443,56 @@ func (aof *Aofer) loadSingleFile(filename string, server *networking.Server) int
 	return ret
 }
 
+// readCommand reads a command in the RESP format, or an annotation which
+// is a line starting with '#', eg. "#TS:1700000000". io.EOF is returned
+// only when the file ends before a new command.
+func (aof *Aofer) readCommand() ([][]byte, []byte, error) {
+	p, isPrefix, err := aof.rd.ReadLine()
+	if err != nil {
+		return nil, nil, err
+	}
+	if isPrefix {
+		return nil, nil, errors.New("line too long")
+	}
+	if len(p) > 0 && p[0] == '#' {
+		return nil, p, nil
+	}
+	if len(p) == 0 || p[0] != '*' {
+		return nil, nil, errors.New("invalid protocol, not found *")
+	}
+	argc, err := strconv.ParseInt(string(p[1:]), 10, 64)
+	if err != nil || argc < 1 {
+		return nil, nil, errors.New("invalid protocol, argc is less than 1")
+	}
+
+	argv := make([][]byte, argc, argc)
+	for i := int64(0); i < argc; i++ {
+		p, isPrefix, err := aof.rd.ReadLine()
+		if err != nil {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		if isPrefix {
+			return nil, nil, errors.New("line too long")
+		}
+		if len(p) == 0 || p[0] != '$' {
+			return nil, nil, errors.New("invalid protocol, not found $")
+		}
+		ln, err := strconv.ParseInt(string(p[1:]), 10, 64)
+		if err != nil || ln < 0 {
+			return nil, nil, errors.New("invalid protocol, invalid bulk len")
+		}
+		p, err = aof.readRaw(int(ln) + 2)
+		if err != nil {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		if p[ln] != '\r' || p[ln+1] != '\n' {
+			return nil, nil, errors.New(`invalid protocol, bulk not terminated by \r\n`)
+		}
+		argv[i] = p[:ln]
+	}
+	return argv, nil, nil
+}
+
 func (aof *Aofer) lookupCommand(name string, argc int) (cmd.Command, error) {
 	command, found := aof.fakeCli.Server.LookupCommand(name)
 	if found {
@@ -466,7 +508,7 @@ func (aof *Aofer) lookupCommand(name string, argc int) (cmd.Command, error) {
 
 func (aof *Aofer) readRaw(n int) ([]byte, error) {
 	p := make([]byte, n, n)
-	if _, err := aof.rd.Read(p); err != nil {
+	if _, err := io.ReadFull(aof.rd, p); err != nil {
 		return nil, err
 	}
 	return p, nil
@@ -727,13 +769,43 @@ func (am *aofManifest) persist(server *networking.Server) error {
 	return nil
 }
 
+// deleteAofHistFiles removes the hist files in background, and drops them
+// from the manifest.
 func (am *aofManifest) deleteAofHistFiles(server *networking.Server) {
 	for _, ai := range am.histAofInfos {
-		filepath := makePath(server.AofDirname, ai.name)
-		if err := os.Remove(filepath); err != nil {
-			slog.Warn("failed delete AOF hist file", "filepath", filepath, "err", err)
-		}
+		server.BioCreateUnlinkJob(makePath(server.AofDirname, ai.name))
+	}
+	am.histAofInfos = nil
+}
+
+// loadAofManifest reads the manifest of the AOF.
+func loadAofManifest(server *networking.Server) (*aofManifest, error) {
+	file, err := os.Open(makePath(server.AofDirname, aofManifestFilename(server.AofFilename)))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return createAofManifest(file)
+}
+
+// aofOpenNewIncrFile opens a new incr file, where the writes are appended
+// once it is recorded in the manifest.
+func aofOpenNewIncrFile(server *networking.Server) error {
+	am, err := loadAofManifest(server)
+	if err != nil {
+		return err
 	}
+	filepath := makePath(server.AofDirname, am.nextIncrAofName(server))
+	file, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if err := server.SwitchAofFile(file, func() error { return am.persist(server) }); err != nil {
+		file.Close()
+		os.Remove(filepath)
+		return err
+	}
+	return nil
 }
 
 func write(file *os.File, p []byte) error {
@@ -1,8 +1,11 @@
 package dump
 
 import (
+	"context"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sunminx/RDB/internal/hash"
 	"github.com/sunminx/RDB/internal/list"
@@ -17,6 +20,7 @@ func newMockAof(t *testing.T) *Aofer {
 	if err != nil {
 		t.Error(err)
 	}
+	t.Cleanup(func() { os.Remove("aof.file") })
 	wr, err := rio.NewWriter(file)
 	if err != nil {
 		t.Error(err)
@@ -50,6 +54,9 @@ func TestAofRewriteLoadStringObject(t *testing.T) {
 	if !aof.rewriteStringObject(key, val) {
 		t.Error("failed rewrite string object")
 	}
+	if err := aof.wr.Flush(); err != nil {
+		t.Error(err)
+	}
 	srv := aof.fakeCli.Server
 	ret := aof.loadSingleFile("./aof.file", srv)
 	if ret != aofOk && ret != aofTruncated {
@@ -62,6 +69,25 @@ func TestAofRewriteLoadStringObject(t *testing.T) {
 	t.Log(string(robj.Val().(sds.SDS)))
 }
 
+func TestAofRewriteLoadIntObject(t *testing.T) {
+	aof := newMockAof(t)
+	val := obj.New(int64(100), obj.TypeString, obj.EncodingInt)
+	if !aof.rewriteStringObject("key1", val) {
+		t.Error("failed rewrite int object")
+	}
+	if err := aof.wr.Flush(); err != nil {
+		t.Error(err)
+	}
+	srv := aof.fakeCli.Server
+	ret := aof.loadSingleFile("./aof.file", srv)
+	if ret != aofOk && ret != aofTruncated {
+		t.Error("failed load AOF file")
+	}
+	if _, found := aof.db.LookupKeyRead("key1"); !found {
+		t.Error("failed read key-val")
+	}
+}
+
 func TestAofRewriteLoadListObject(t *testing.T) {
 	aof := newMockAof(t)
 	key := "key2"
@@ -71,6 +97,9 @@ func TestAofRewriteLoadListObject(t *testing.T) {
 	if !aof.rewriteListObject(key, val) {
 		t.Error("failed rewrite string object")
 	}
+	if err := aof.wr.Flush(); err != nil {
+		t.Error(err)
+	}
 	srv := aof.fakeCli.Server
 	ret := aof.loadSingleFile("./aof.file", srv)
 	if ret != aofOk && ret != aofTruncated {
@@ -96,6 +125,9 @@ func TestAofRewriteLoadHashObject(t *testing.T) {
 	if !aof.rewriteHashObject(key, val) {
 		t.Error("failed rewrite string object")
 	}
+	if err := aof.wr.Flush(); err != nil {
+		t.Error(err)
+	}
 	srv := aof.fakeCli.Server
 	ret := aof.loadSingleFile("./aof.file", srv)
 	if ret != aofOk && ret != aofTruncated {
@@ -108,3 +140,58 @@ func TestAofRewriteLoadHashObject(t *testing.T) {
 	v, _ := hash.Get(robj, []byte("key"))
 	t.Log(string(v))
 }
+
+func TestAofRewriteHashFieldExpires(t *testing.T) {
+	aof := newMockAof(t)
+	val := hash.NewRobj(hash.NewZipmap())
+	hash.Set(val, []byte("a"), []byte("1"))
+	hash.Set(val, []byte("b"), []byte("2"))
+	expire := time.Now().UnixMilli() + 100000
+	hash.SetExpire(val, []byte("a"), expire)
+	if !aof.rewriteHashObject("key4", val) {
+		t.Fatal("failed rewrite hash object")
+	}
+	if err := aof.wr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ret := aof.loadSingleFile("./aof.file", aof.fakeCli.Server)
+	if ret != aofOk && ret != aofTruncated {
+		t.Fatal("failed load AOF file")
+	}
+	robj, found := aof.db.LookupKeyRead("key4")
+	if !found || hash.Len(robj) != 2 {
+		t.Fatal("failed read the hash")
+	}
+	if got := hash.GetExpire(robj, []byte("a")); got != expire {
+		t.Errorf("field a expires at %d, %d expected", got, expire)
+	}
+	if got := hash.GetExpire(robj, []byte("b")); got != hash.NoExpire {
+		t.Errorf("field b expires at %d", got)
+	}
+}
+
+func TestAofRewriteTimestamp(t *testing.T) {
+	aof := newMockAof(t)
+	snap := aof.db.Snapshot()
+	defer snap.Release()
+	if err := aof.rewrite(context.Background(), snap, 1700000000); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile("aof.file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(content), "#TS:1700000000\r\n*3\r\n") {
+		t.Fatalf("rewritten %q", content)
+	}
+
+	// The annotation is skipped on loading.
+	aof.db.DelKey("key1")
+	ret := aof.loadSingleFile("./aof.file", aof.fakeCli.Server)
+	if ret != aofOk {
+		t.Error("failed load AOF file")
+	}
+	if _, found := aof.db.LookupKeyRead("key1"); !found {
+		t.Error("failed read key-val")
+	}
+}
@@ -0,0 +1,328 @@
+package dump
+
+// The offline verification of the RDB and AOF files, used by cmd/rdb-check.
+// The files are read by the same code which loads them at startup, but the
+// values are only validated and counted, nothing is added to a db.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sunminx/RDB/internal/rio"
+	. "github.com/sunminx/RDB/pkg/util"
+)
+
+// CksumStatus is the result of the verification of the RDB checksum.
+type CksumStatus int
+
+const (
+	// CksumNone means that the file ends before the checksum, or that it
+	// is a version before 5, which has no checksum.
+	CksumNone CksumStatus = iota
+	// CksumDisabled means that the file was saved with rdbchecksum no.
+	CksumDisabled
+	CksumOK
+	CksumMismatch
+)
+
+func (s CksumStatus) String() string {
+	switch s {
+	case CksumDisabled:
+		return "disabled"
+	case CksumOK:
+		return "ok"
+	case CksumMismatch:
+		return "mismatch"
+	}
+	return "none"
+}
+
+// RdbCheckReport is the result of CheckRdb.
+type RdbCheckReport struct {
+	Version int
+	Aux     [][2]string
+	// Keys is the number of keys of every type.
+	Keys map[string]int
+	// Expires is the number of keys with an expire, Expired is the number
+	// of them which are already expired.
+	Expires int
+	Expired int
+	Cksum   CksumStatus
+	// RecordOffset is the offset of the last record read, that is the
+	// record which is corrupted when Err is set.
+	RecordOffset int64
+	// Offset is where the reading stopped.
+	Offset int64
+	Err    error
+}
+
+func newRdbCheckReport() *RdbCheckReport {
+	return &RdbCheckReport{Keys: make(map[string]int)}
+}
+
+// TotalKeys returns the number of keys of all the types.
+func (r *RdbCheckReport) TotalKeys() int {
+	var n int
+	for _, cnt := range r.Keys {
+		n += cnt
+	}
+	return n
+}
+
+func (r *RdbCheckReport) countKey(typ uint8, expireTime, now int64) {
+	r.Keys[rdbTypeName(typ)]++
+	if expireTime != -1 {
+		r.Expires++
+		if expireTime < now {
+			r.Expired++
+		}
+	}
+}
+
+func (rdb *Rdber) setCheckCksum(s CksumStatus) {
+	if rdb.check != nil {
+		rdb.check.Cksum = s
+	}
+}
+
+// rdbTypeName returns the name of the data type saved with typ.
+func rdbTypeName(typ uint8) string {
+	switch typ {
+	case rdbTypeString:
+		return "string"
+	case rdbTypeList, rdbTypeListZiplist, rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return "list"
+	case rdbTypeSet, rdbTypeSetIntset, rdbTypeSetListpack:
+		return "set"
+	case rdbTypeZset, rdbTypeZset2, rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		return "zset"
+	case rdbTypeHash, rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack,
+		rdbTypeHashMetadataPreGA, rdbTypeHashListpackExPreGA, rdbTypeHashMetadata, rdbTypeHashListpackEx:
+		return "hash"
+	}
+	return fmt.Sprintf("type %d", typ)
+}
+
+// CheckRdb validates the RDB file opcode by opcode. The error is returned
+// only when the file can't be opened, the corruption is reported by Err.
+func CheckRdb(filename string) (*RdbCheckReport, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rd, err := rio.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	return checkRdbReader(rd), nil
+}
+
+func checkRdbReader(rd *rio.Reader) *RdbCheckReport {
+	report := newRdbCheckReport()
+	rdber := &Rdber{rd: rd, info: rdberInfo{cksum: true}, check: report}
+	report.Err = rdber.load()
+	report.Offset = rd.Tell()
+	return report
+}
+
+// AofFileReport is the result of the verification of a file of the AOF.
+type AofFileReport struct {
+	Name string
+	Type string
+	Size int64
+	// Rdb is set when the file starts with a RDB, eg. the base file.
+	Rdb *RdbCheckReport
+	// Commands is the number of the valid commands.
+	Commands int
+	// ValidUpTo is the offset after the last valid command, which is not
+	// in a MULTI/EXEC block left open.
+	ValidUpTo int64
+	// TimestampOffset is the offset of the first timestamp annotation after
+	// the timestamp to truncate to, -1 if there is none. The file is not
+	// checked after it.
+	TimestampOffset int64
+	Err             error
+}
+
+// AofCheckOptions tells how CheckAof repairs the AOF.
+type AofCheckOptions struct {
+	// Fix truncates the last incr file to its last valid command.
+	Fix bool
+	// TruncateToTimestamp, when not zero, truncates the last incr file
+	// before the commands written after this unix time.
+	TruncateToTimestamp int64
+}
+
+// AofCheckReport is the result of CheckAof.
+type AofCheckReport struct {
+	Files []*AofFileReport
+	// Fixed is set when the last incr file was truncated by Fix.
+	Fixed bool
+	// Truncated is set when the last incr file was truncated by
+	// TruncateToTimestamp.
+	Truncated bool
+}
+
+// Ok tells if all the files are valid.
+func (r *AofCheckReport) Ok() bool {
+	for _, f := range r.Files {
+		if f.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckAof validates the manifest and the base and incr files listed in it.
+// Only the last incr file can be repaired by the options, the corruption
+// of the other files can't be fixed.
+func CheckAof(manifest string, opts AofCheckOptions) (*AofCheckReport, error) {
+	file, err := os.Open(manifest)
+	if err != nil {
+		return nil, err
+	}
+	am, err := createAofManifest(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if am.fileNum() == 0 {
+		return nil, errors.New("invalid manifest: no base or incr files")
+	}
+
+	dir := filepath.Dir(manifest)
+	report := &AofCheckReport{}
+	timestamp := opts.TruncateToTimestamp
+	if am.baseAofInfo != nil {
+		report.Files = append(report.Files, checkAofFile(dir, am.baseAofInfo.name, "base", timestamp))
+	}
+	for _, ai := range am.incrAofInfos {
+		report.Files = append(report.Files, checkAofFile(dir, ai.name, "incr", timestamp))
+	}
+
+	last := report.Files[len(report.Files)-1]
+	for _, f := range report.Files {
+		canTruncate := f == last && f.Type == "incr"
+		if f.TimestampOffset != -1 && !canTruncate {
+			return report, fmt.Errorf("can't truncate %s to timestamp %d, "+
+				"only the last incr file can be truncated", f.Name, timestamp)
+		}
+		if f.Err != nil && opts.Fix && (!canTruncate || f.ValidUpTo < 0) {
+			return report, fmt.Errorf("can't fix %s, only the last incr file can be truncated", f.Name)
+		}
+	}
+
+	switch {
+	case last.TimestampOffset != -1:
+		if err := os.Truncate(filepath.Join(dir, last.Name), last.TimestampOffset); err != nil {
+			return report, err
+		}
+		report.Truncated = true
+	case last.Err != nil && opts.Fix:
+		if err := os.Truncate(filepath.Join(dir, last.Name), last.ValidUpTo); err != nil {
+			return report, err
+		}
+		report.Fixed = true
+	}
+	return report, nil
+}
+
+// checkAofFile reads the file like Aofer.loadSingleFile, a RDB preamble
+// is checked at first, then the commands which follow it. When timestamp
+// is not zero the check stops at the first annotation after it.
+func checkAofFile(dir, name, typ string, timestamp int64) *AofFileReport {
+	report := &AofFileReport{Name: name, Type: typ, ValidUpTo: -1, TimestampOffset: -1}
+	file, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		report.Err = err
+		return report
+	}
+	defer file.Close()
+	report.Size = getAppendOnlyFileSize(file)
+
+	aof := &Aofer{}
+	if report.Err = aof.setFile(file, 'r'); report.Err != nil {
+		return report
+	}
+	p, err := aof.readRaw(5)
+	preambleMode := err == nil && string(p) == "REDIS"
+	if report.Err = aof.rd.Reset(); report.Err != nil {
+		return report
+	}
+	if preambleMode {
+		report.Rdb = checkRdbReader(aof.rd)
+		if report.Err = report.Rdb.Err; report.Err != nil {
+			return report
+		}
+	}
+
+	var (
+		multi            bool
+		validBeforeMulti int64
+	)
+	report.ValidUpTo = aof.rd.Tell()
+	for {
+		pos := aof.rd.Tell()
+		argv, annotation, err := aof.readCommand()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			report.Err = fmt.Errorf("at offset %d: %w", pos, err)
+			break
+		}
+		if annotation != nil {
+			if timestamp != 0 && annotationTimestamp(annotation) > timestamp {
+				// The commands of a transaction are kept or dropped together.
+				report.TimestampOffset = Cond(multi, validBeforeMulti, pos)
+				return report
+			}
+			continue
+		}
+		report.Commands++
+		switch strings.ToLower(string(argv[0])) {
+		case "multi":
+			if multi {
+				report.Err = fmt.Errorf("at offset %d: MULTI calls can not be nested", pos)
+			}
+			multi = true
+			validBeforeMulti = pos
+		case "exec":
+			if !multi {
+				report.Err = fmt.Errorf("at offset %d: EXEC without MULTI", pos)
+			}
+			multi = false
+		}
+		if report.Err != nil {
+			break
+		}
+		if !multi {
+			report.ValidUpTo = aof.rd.Tell()
+		}
+	}
+	if report.Err == nil && multi {
+		report.Err = fmt.Errorf("at offset %d: MULTI without EXEC", validBeforeMulti)
+	}
+	return report
+}
+
+// annotationTimestamp returns the unix time of a "#TS:<unix>" annotation,
+// or -1 if it is not a timestamp annotation.
+func annotationTimestamp(annotation []byte) int64 {
+	p, found := bytes.CutPrefix(annotation, []byte("#TS:"))
+	if !found {
+		return -1
+	}
+	timestamp, err := strconv.ParseInt(string(p), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return timestamp
+}
@@ -0,0 +1,182 @@
+package dump
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckRdb(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	report, err := CheckRdb("testdata/v11-listpack.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Err != nil || report.Version != 11 || report.Cksum != CksumOK {
+		t.Fatalf("err %v version %d checksum %s", report.Err, report.Version, report.Cksum)
+	}
+	keys := map[string]int{"string": 7, "list": 1, "hash": 1, "set": 2, "zset": 1}
+	for typ, n := range keys {
+		if report.Keys[typ] != n {
+			t.Errorf("%s keys %d want: %d", typ, report.Keys[typ], n)
+		}
+	}
+	if report.Expires != 2 || report.Expired != 1 {
+		t.Errorf("expires %d expired %d", report.Expires, report.Expired)
+	}
+
+	report, err = CheckRdb("testdata/legacy.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Err != nil || report.Cksum != CksumDisabled {
+		t.Errorf("err %v checksum %s", report.Err, report.Cksum)
+	}
+
+	content, err := os.ReadFile("testdata/v9-ziplist.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "dump.rdb")
+	if err = os.WriteFile(filename, content[:300], 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = CheckRdb(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Err == nil || report.Offset != 300 || report.RecordOffset >= 300 {
+		t.Errorf("err %v offset %d record offset %d", report.Err, report.Offset, report.RecordOffset)
+	}
+}
+
+func TestCheckAof(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	base, err := os.ReadFile("testdata/v11-listpack.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n" +
+		"#TS:1700000000\r\n" +
+		"*1\r\n$5\r\nmulti\r\n*2\r\n$4\r\nincr\r\n$1\r\nn\r\n*1\r\n$4\r\nexec\r\n"
+	manifest := "file appendonly.aof.1.base.rdb seq 1 type b\n" +
+		"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+		"file appendonly.aof.2.incr.aof seq 2 type i\n"
+
+	testcases := []struct {
+		name  string
+		incr1 string
+		incr2 string
+		err   string
+		fixed bool
+	}{
+		{name: "valid", incr1: valid, incr2: valid},
+		{name: "truncated", incr1: valid, incr2: valid + "*2\r\n$3\r\nget", fixed: true},
+		{name: "open multi", incr1: valid, incr2: valid + "*1\r\n$5\r\nmulti\r\n", fixed: true},
+		{name: "not last", incr1: valid + "*2\r\n", incr2: valid, err: "can't fix appendonly.aof.1.incr.aof"},
+	}
+
+	for _, tc := range testcases {
+		dir := t.TempDir()
+		files := map[string]string{
+			"appendonly.aof.manifest":   manifest,
+			"appendonly.aof.1.base.rdb": string(base),
+			"appendonly.aof.1.incr.aof": tc.incr1,
+			"appendonly.aof.2.incr.aof": tc.incr2,
+		}
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		report, err := CheckAof(filepath.Join(dir, "appendonly.aof.manifest"), AofCheckOptions{Fix: true})
+		if (err == nil) != (tc.err == "") || (err != nil && !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: err %v want: %s", tc.name, err, tc.err)
+			continue
+		}
+		if report.Fixed != tc.fixed || len(report.Files) != 3 || report.Files[0].Rdb == nil {
+			t.Errorf("%s: fixed %v files %d", tc.name, report.Fixed, len(report.Files))
+			continue
+		}
+		if report.Files[1].Commands != 4 || report.Files[0].Rdb.TotalKeys() != 12 {
+			t.Errorf("%s: commands %d keys %d", tc.name, report.Files[1].Commands, report.Files[0].Rdb.TotalKeys())
+		}
+		if !tc.fixed {
+			continue
+		}
+		// The fixed file is valid.
+		report, err = CheckAof(filepath.Join(dir, "appendonly.aof.manifest"), AofCheckOptions{})
+		if err != nil || !report.Ok() {
+			t.Errorf("%s: not fixed, err %v", tc.name, err)
+		}
+		if incr, _ := os.ReadFile(filepath.Join(dir, "appendonly.aof.2.incr.aof")); string(incr) != valid {
+			t.Errorf("%s: truncated to %q", tc.name, incr)
+		}
+	}
+
+	if _, err := CheckAof(filepath.Join(t.TempDir(), "appendonly.aof.manifest"), AofCheckOptions{}); err == nil {
+		t.Error("checked a missing manifest")
+	}
+}
+
+func TestCheckAofTruncateToTimestamp(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	set := "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	multi := "*1\r\n$5\r\nmulti\r\n"
+	exec := "*1\r\n$4\r\nexec\r\n"
+	incr1 := "#TS:100\r\n" + set + "#TS:200\r\n" + set
+	incr2 := "#TS:300\r\n" + set + multi + set + "#TS:400\r\n" + set + exec + "#TS:500\r\n" + set
+	manifest := "file appendonly.aof.1.base.aof seq 1 type b\n" +
+		"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+		"file appendonly.aof.2.incr.aof seq 2 type i\n"
+
+	testcases := []struct {
+		timestamp int64
+		incr2     string
+		err       string
+	}{
+		{timestamp: 300, incr2: "#TS:300\r\n" + set},
+		// The transaction is dropped as a whole.
+		{timestamp: 350, incr2: "#TS:300\r\n" + set},
+		{timestamp: 450, incr2: "#TS:300\r\n" + set + multi + set + "#TS:400\r\n" + set + exec},
+		{timestamp: 500, incr2: incr2},
+		{timestamp: 150, incr2: incr2, err: "can't truncate appendonly.aof.1.incr.aof to timestamp 150"},
+		{timestamp: 50, incr2: incr2, err: "can't truncate appendonly.aof.1.base.aof to timestamp 50"},
+	}
+
+	for _, tc := range testcases {
+		dir := t.TempDir()
+		files := map[string]string{
+			"appendonly.aof.manifest":   manifest,
+			"appendonly.aof.1.base.aof": "#TS:90\r\n" + set,
+			"appendonly.aof.1.incr.aof": incr1,
+			"appendonly.aof.2.incr.aof": incr2,
+		}
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		opts := AofCheckOptions{TruncateToTimestamp: tc.timestamp}
+		report, err := CheckAof(filepath.Join(dir, "appendonly.aof.manifest"), opts)
+		if (err == nil) != (tc.err == "") || (err != nil && !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%d: err %v want: %s", tc.timestamp, err, tc.err)
+			continue
+		}
+		if report.Truncated != (tc.incr2 != incr2) {
+			t.Errorf("%d: truncated %v", tc.timestamp, report.Truncated)
+		}
+		if incr, _ := os.ReadFile(filepath.Join(dir, "appendonly.aof.2.incr.aof")); string(incr) != tc.incr2 {
+			t.Errorf("%d: truncated to %q", tc.timestamp, incr)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package dump
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"strings"
@@ -11,6 +15,8 @@ import (
 
 	"github.com/sunminx/RDB/internal/db"
 	"github.com/sunminx/RDB/internal/networking"
+	obj "github.com/sunminx/RDB/internal/object"
+	"github.com/sunminx/RDB/internal/rio"
 	. "github.com/sunminx/RDB/pkg/util"
 )
 
@@ -21,30 +27,14 @@ const (
 	nosave = false
 )
 
-type Dumper struct {
-	// waitResetDBState indicates that both persistence and done-handler of persistence
-	// have been completed, and it is waiting to reset the persisting state of DB.
-	waitResetDBState bool
-}
-
-const (
-	waiting = true
-	notWait = false
-)
+type Dumper struct{}
 
 func New() Dumper {
-	return Dumper{waitResetDBState: notWait}
+	return Dumper{}
 }
 
 var errContextCanceled = errors.New("quit because of cancel signal")
 
-// RDB active child save type.
-const (
-	rdbChildTypeNone   = 0
-	rdbChildTypeDisk   = 1 // rdb is written to disk.
-	rdbChildTypeSocket = 2 // rdb is written to slave socket.
-)
-
 func (_ Dumper) RdbLoad(server *networking.Server) bool {
 	filename := server.RdbFilename
 	file, err := os.Open(filename)
@@ -58,15 +48,107 @@ func (_ Dumper) RdbLoad(server *networking.Server) bool {
 		slog.Warn("can't create rdber for load", "err", err)
 		return false
 	}
+	server.LoadingTotalBytes.Store(loadingTotalBytes(filename))
+	var reported int64
+	rdber.progress = func(pos int64) {
+		loadingAbsProgress(server, pos-reported)
+		reported = pos
+	}
 	if err := rdber.load(); err != nil {
 		slog.Warn("failed load RDB file", "err", err)
 		return false
 	}
+	rdber.progress(rdber.rd.Tell())
 	slog.Info("load RDB file success")
 	return true
 }
 
-func (d Dumper) RdbSaveBackground(server *networking.Server) bool {
+// RdbLoadStream loads the RDB from a stream into db, it is used by the
+// replicas to load the RDB from the socket of the master.
+func (_ Dumper) RdbLoadStream(server *networking.Server, rd io.Reader, db *db.DB) bool {
+	rdber, err := newRdbStreamer(rd, nil, db, newRdberInfo(server))
+	if err != nil {
+		slog.Warn("can't create rdber for load", "err", err)
+		return false
+	}
+	if err := rdber.load(); err != nil {
+		slog.Warn("failed load RDB from stream", "err", err)
+		return false
+	}
+	return true
+}
+
+// DumpObject serializes val as the payload of DUMP: the type and the value
+// in the RDB format, followed by the RDB version and the CRC64 of all that.
+func (_ Dumper) DumpObject(server *networking.Server, val *obj.Robj) []byte {
+	var buf bytes.Buffer
+	rdber, err := newRdbStreamer(nil, &buf, nil, newRdberInfo(server))
+	if err != nil || !rdber.saveObjectType(val) || !rdber.saveObject(val) ||
+		rdber.wr.Flush() != nil {
+		return nil
+	}
+	payload := binary.LittleEndian.AppendUint16(buf.Bytes(), uint16(rdber.info.version))
+	return binary.LittleEndian.AppendUint64(payload, rio.Crc64(0, payload))
+}
+
+var (
+	errDumpPayload    = errors.New("DUMP payload version or checksum are wrong")
+	errBadDumpPayload = errors.New("Bad data format")
+)
+
+// RestoreObject deserializes the payload of DUMP, after verifying its
+// version and checksum.
+func (_ Dumper) RestoreObject(server *networking.Server, payload []byte) (*obj.Robj, error) {
+	if len(payload) < 10 {
+		return nil, errDumpPayload
+	}
+	n := len(payload) - 10
+	ver := binary.LittleEndian.Uint16(payload[n:])
+	if ver > rdbMaxLoadVersion ||
+		rio.Crc64(0, payload[:n+2]) != binary.LittleEndian.Uint64(payload[n+2:]) {
+		return nil, errDumpPayload
+	}
+	rdber, err := newRdbStreamer(bytes.NewReader(payload[:n]), nil, nil, newRdberInfo(server))
+	if err != nil {
+		return nil, err
+	}
+	val, err := rdber.loadObject(rdber.loadType())
+	// The whole payload is a single value.
+	if err != nil || rdber.readRaw(make([]byte, 1)) != 0 {
+		return nil, errBadDumpPayload
+	}
+	return val, nil
+}
+
+func (_ Dumper) RdbSaveBackground(server *networking.Server) bool {
+	return rdbSaveBackground(server, networking.RdbChildTypeDisk, rdbSaveSnapshot)
+}
+
+// RdbSaveToSlavesSockets saves the RDB in background to wr, which writes
+// to the sockets of the replicas.
+func (_ Dumper) RdbSaveToSlavesSockets(server *networking.Server, wr io.Writer) bool {
+	return rdbSaveBackground(server, networking.RdbChildTypeSocket,
+		func(server *networking.Server, snap *db.Snapshot) bool {
+			return rdbSaveStream(server, snap, wr)
+		})
+}
+
+// RdbSaveBackgroundLocked is like RdbSaveBackground, it is used by BGSAVE,
+// so that the file has the DB at the time of the command.
+//
+// It should be called when holding the CmdLock.
+func (_ Dumper) RdbSaveBackgroundLocked(server *networking.Server) bool {
+	if !server.RdbChildRunning.CompareAndSwap(
+		networking.ChildNotInRunning, networking.ChildInRunning) {
+		return nosave
+	}
+	rdbSaveBackgroundLocked(server, networking.RdbChildTypeDisk, rdbSaveSnapshot)
+	return saved
+}
+
+// rdbSaveBackground saves a snapshot of the DB in background by save.
+func rdbSaveBackground(server *networking.Server, childType int,
+	save func(*networking.Server, *db.Snapshot) bool) bool {
 	if !server.RdbChildRunning.CompareAndSwap(
 		networking.ChildNotInRunning, networking.ChildInRunning) {
 		return nosave
@@ -74,24 +156,61 @@ func (d Dumper) RdbSaveBackground(server *networking.Server) bool {
 	locked := TryLockWithTimeout(server.CmdLock, 100*time.Millisecond)
 	if !locked {
 		slog.Warn("exit bgsave RDB file because of db can't locked")
+		server.RdbChildRunning.Store(networking.ChildNotInRunning)
 		return nosave
 	}
-	server.DB.SetState(db.InPersistState)
+	rdbSaveBackgroundLocked(server, childType, save)
 	server.CmdLock.Unlock()
+	return saved
+}
+
+// rdbSaveBackgroundLocked takes the snapshot and starts the save, once the
+// RDB child is marked as running.
+//
+// It should be called when holding the CmdLock.
+func rdbSaveBackgroundLocked(server *networking.Server, childType int,
+	save func(*networking.Server, *db.Snapshot) bool) {
+	snap := server.DB.Snapshot()
+	server.RdbSaveKeys = snap.Len()
+	// The replicas attached to this BGSAVE need the writes performed after this point.
+	server.RdbSaveOffset = server.CurrentReplOffset()
 	now := time.Now()
-	go d.RdbSave(server)
+	go func() {
+		defer snap.Release()
+		// The status is published by the channel to the done-handler.
+		server.RdbLastBgsaveOk = save(server, snap)
+		server.BackgroundDoneChan <- networking.DoneRdbBgsave
+	}()
 	slog.Info("background saving started")
 	server.DirtyBeforeBgsave = server.Dirty
 	server.RdbSaveTimeStart = now.UnixMilli()
-	server.RdbChildType = rdbChildTypeDisk
-	return saved
+	server.RdbChildType = childType
 }
 
 type rdberInfo struct {
 	version int
+	// redisVer is saved in the redis-ver aux field.
+	redisVer string
+	// cksum tells if the CRC64 checksum is computed on save and verified on load.
+	cksum bool
+	// compression tells if the strings are compressed by LZF on save.
+	compression bool
+	// skipUnsupported tells if the keys of the types not supported are
+	// skipped on load, instead of failing it.
+	skipUnsupported bool
+	// keepExpired tells if the expired keys and fields are loaded, as
+	// done by a replica, since its master propagates their deletion.
+	keepExpired bool
 }
 
+// RdbSave saves the RDB file in the foreground.
 func (_ Dumper) RdbSave(server *networking.Server) bool {
+	snap := server.DB.Snapshot()
+	defer snap.Release()
+	return rdbSaveSnapshot(server, snap)
+}
+
+func rdbSaveSnapshot(server *networking.Server, snap *db.Snapshot) bool {
 	filename := server.RdbFilename
 	tempfile := fmt.Sprintf("temp-%d.rdb", os.Getgid())
 	file, err := os.Create(tempfile)
@@ -107,8 +226,9 @@ func (_ Dumper) RdbSave(server *networking.Server) bool {
 		slog.Warn("can't create rdber for save", "err", err)
 		return nosave
 	}
-	ctx, _ := context.WithCancel(server.Ctx)
-	if err = rdber.save(ctx); err != nil {
+	ctx, cancel := context.WithCancel(server.Ctx)
+	defer cancel()
+	if err = rdber.save(ctx, snap); err != nil {
 		slog.Warn("failed save db by rdber", "err", err)
 		return nosave
 	}
@@ -129,42 +249,85 @@ func (_ Dumper) RdbSave(server *networking.Server) bool {
 		return nosave
 	}
 	slog.Info("DB saved on disk")
-	server.BackgroundDoneChan <- networking.DoneRdbBgsave
+	return saved
+}
+
+func rdbSaveStream(server *networking.Server, snap *db.Snapshot, wr io.Writer) bool {
+	rdber, err := newRdbStreamer(nil, wr, server.DB, newRdberInfo(server))
+	if err != nil {
+		slog.Warn("can't create rdber for save", "err", err)
+		return nosave
+	}
+	ctx, cancel := context.WithCancel(server.Ctx)
+	defer cancel()
+	if err = rdber.save(ctx, snap); err != nil {
+		slog.Warn("failed save db to the replicas sockets", "err", err)
+		return nosave
+	}
 	return saved
 }
 
 func newRdberInfo(server *networking.Server) rdberInfo {
 	return rdberInfo{
-		version: server.RdbVersion,
+		version:         server.RdbVersion,
+		redisVer:        server.Version,
+		cksum:           server.RdbChecksum,
+		compression:     server.RdbCompression,
+		skipUnsupported: server.RdbSkipUnsupported,
+		keepExpired:     server.MasterHost != "",
 	}
 }
 
 func (d Dumper) RdbSaveBackgroundDoneHandler(server *networking.Server) {
-	if d.waitResetDBState {
-		switch server.RdbChildType {
-		case rdbChildTypeDisk:
-			rdbBgsaveDoneHandlerDisk(server)
-		default:
-		}
-	}
 	locked := TryLockWithTimeout(server.CmdLock, 100*time.Millisecond)
 	if !locked {
-		d.waitResetDBState = waiting
+		// Try again in the next cron loop.
+		select {
+		case server.BackgroundDoneChan <- networking.DoneRdbBgsave:
+		default:
+		}
 		return
 	}
-	d.waitResetDBState = notWait
-	server.DB.SetState(db.InMergeState)
-	server.LastSave = time.Now().UnixMilli()
-	server.Dirty -= server.DirtyBeforeBgsave
+	defer server.CmdLock.Unlock()
+
+	ok, childType := server.RdbLastBgsaveOk, server.RdbChildType
+	switch childType {
+	case networking.RdbChildTypeDisk:
+		rdbBgsaveDoneHandlerDisk(server, ok)
+	case networking.RdbChildTypeSocket:
+		rdbBgsaveDoneHandlerSocket(server, ok)
+	default:
+	}
 	server.RdbChildRunning.Store(networking.ChildNotInRunning)
-	server.CmdLock.Unlock()
+	// Transfer the RDB file to the replicas waiting for it, or
+	// finish the transfer for diskless replication.
+	server.UpdateSlavesWaitingBgsave(ok, childType)
 }
 
-func rdbBgsaveDoneHandlerDisk(server *networking.Server) {
+func rdbBgsaveDoneHandlerDisk(server *networking.Server, ok bool) {
 	now := time.Now()
-	server.RdbChildType = rdbChildTypeNone
-	server.LastSave = now.UnixMilli()
-	server.RdbSaveTimeUsed = server.LastSave - server.RdbSaveTimeStart
+	if ok {
+		slog.Info("background saving terminated with success")
+		server.Dirty -= server.DirtyBeforeBgsave
+		server.LastSave = now.UnixMilli()
+	} else {
+		slog.Warn("background saving error")
+	}
+	server.RdbChildType = networking.RdbChildTypeNone
+	server.RdbSaveTimeUsed = now.UnixMilli() - server.RdbSaveTimeStart
+	if ok {
+		server.BackupRdbIfNeeded(server.RdbSaveTimeStart, server.RdbSaveTimeUsed, server.RdbSaveKeys)
+	}
+	server.RdbSaveTimeStart = -1
+}
+
+func rdbBgsaveDoneHandlerSocket(server *networking.Server, ok bool) {
+	if ok {
+		slog.Info("background RDB transfer terminated with success")
+	} else {
+		slog.Warn("background transfer error")
+	}
+	server.RdbChildType = networking.RdbChildTypeNone
 	server.RdbSaveTimeStart = -1
 }
 
@@ -195,7 +358,18 @@ func (_ Dumper) AofLoad(server *networking.Server) bool {
 }
 
 func loadingAbsProgress(server *networking.Server, pos int64) {
-	server.LoadingLoadedBytes += pos
+	server.LoadingProgress(pos)
+}
+
+// loadingTotalBytes returns the total size of the files to load.
+func loadingTotalBytes(filenames ...string) int64 {
+	var total int64
+	for _, filename := range filenames {
+		if fi, err := os.Stat(filename); err == nil {
+			total += fi.Size()
+		}
+	}
+	return total
 }
 
 // aofLoadChunkMode load aof file stored by chunk mode (since redis 7.x).
@@ -213,6 +387,12 @@ func aofLoadChunkMode(am *aofManifest, server *networking.Server) bool {
 		err         error
 	)
 
+	filenames := []string{am.baseAofInfo.name}
+	for _, incrAofInfo := range am.incrAofInfos {
+		filenames = append(filenames, incrAofInfo.name)
+	}
+	server.LoadingTotalBytes.Store(loadingTotalBytes(filenames...))
+
 	aof := newAofer(server.DB)
 	aof.fakeCli.Server = server
 	if am.baseAofInfo != nil {
@@ -288,6 +468,7 @@ func aofLoadChunkMode(am *aofManifest, server *networking.Server) bool {
 func aofLoadUnChunkMode(server *networking.Server) bool {
 	aof := newAofer(server.DB)
 	filename := server.AofFilename
+	server.LoadingTotalBytes.Store(loadingTotalBytes(filename))
 	file, err := os.Create(filename)
 	if err != nil {
 		slog.Warn("failed create temp aof file", "err", err)
@@ -315,18 +496,38 @@ func (_ Dumper) AofRewriteBackground(server *networking.Server) bool {
 	locked := TryLockWithTimeout(server.CmdLock, 100*time.Millisecond)
 	if !locked {
 		slog.Warn("exit rewrite AOF file because of db can't locked")
+		server.AofChildRunning.Store(networking.ChildNotInRunning)
 		return false
 	}
-	server.DB.SetState(db.InPersistState)
+	snap := server.DB.Snapshot()
+	// The writes from now on are appended to a new incr file, so the base
+	// rewritten from snap replaces the incr files before it.
+	if server.AofState == networking.AofOn {
+		if err := aofOpenNewIncrFile(server); err != nil {
+			server.CmdLock.Unlock()
+			snap.Release()
+			server.AofChildRunning.Store(networking.ChildNotInRunning)
+			slog.Warn("can't open a new AOF incr file for rewrite", "err", err)
+			return false
+		}
+	}
 	server.CmdLock.Unlock()
 	now := time.Now()
-	go aofRewrite("", server)
+	go func() {
+		defer snap.Release()
+		// On success the rewrite is installed by the done-handler.
+		if !aofRewrite("", server, snap) {
+			server.AofChildRunning.Store(networking.ChildNotInRunning)
+		}
+	}()
 	slog.Info("background saving started")
 	server.AofRewriteTimeStart = now.UnixMilli()
 	return true
 }
 
-func aofRewrite(filepath string, server *networking.Server) bool {
+// aofRewrite rewrites the AOF from snap into filepath, or into a temp file
+// which is installed by the done-handler when filepath is empty.
+func aofRewrite(filepath string, server *networking.Server, snap *db.Snapshot) bool {
 	tempFilename := fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid())
 	tempFilepath := makePath(server.AofDirname, tempFilename)
 	file, err := os.Create(tempFilepath)
@@ -335,14 +536,15 @@ func aofRewrite(filepath string, server *networking.Server) bool {
 	}
 	defer file.Close()
 
-	ctx, _ := context.WithCancel(server.Ctx)
+	ctx, cancel := context.WithCancel(server.Ctx)
+	defer cancel()
 	if server.AofUseRdbPreamble {
 		rdber, err := newRdbSaver(file, 'w', server.DB, newRdberInfo(server))
 		if err != nil {
 			slog.Warn("cannot create rdber for saving")
 			return false
 		}
-		if err = rdber.save(ctx); err != nil {
+		if err = rdber.save(ctx, snap); err != nil {
 			slog.Warn("failed save db by rdber", "err", err)
 			return false
 		}
@@ -352,7 +554,8 @@ func aofRewrite(filepath string, server *networking.Server) bool {
 			slog.Warn("failed init aofer", "err", err)
 			return false
 		}
-		if err := aofer.rewrite(ctx, 0); err != nil {
+		timestamp := Cond(server.AofTimestampEnabled, time.Now().Unix(), int64(0))
+		if err := aofer.rewrite(ctx, snap, timestamp); err != nil {
 			slog.Warn("failed rewrite aof", "err", err)
 			return false
 		}
@@ -373,79 +576,72 @@ func aofRewrite(filepath string, server *networking.Server) bool {
 	return true
 }
 
-func (d Dumper) AofRewriteBackgroundDoneHandler(server *networking.Server) {
-	if !d.waitResetDBState {
-		filepath := makePath(
-			server.AofDirname,
-			aofManifestFilename(server.AofFilename),
-		)
-		file, err := os.Open(filepath)
-		if err != nil {
-			slog.Warn("failed open AOF manifest file",
-				"filepath", filepath, "err", err)
-		}
-		defer file.Close()
+func (_ Dumper) AofRewriteBackgroundDoneHandler(server *networking.Server) {
+	defer server.AofChildRunning.Store(networking.ChildNotInRunning)
 
-		am, err := createAofManifest(file)
-		if err != nil {
-			slog.Warn("failed create aofManifest instance", "err", err)
-			return
-		}
+	am, err := loadAofManifest(server)
+	if errors.Is(err, fs.ErrNotExist) {
+		// BGREWRITEAOF with AOF off, and the AOF was never on.
+		am, err = newAofManifest(), nil
+	}
+	if err != nil {
+		slog.Warn("failed create aofManifest instance", "err", err)
+		return
+	}
 
-		tempBaseFilename := fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid())
-		baseFilename := am.nextBaseAofName(server)
-		baseFilepath := makePath(server.AofDirname, baseFilename)
-		if err := os.Rename(tempBaseFilename, baseFilepath); err != nil {
-			slog.Warn("failed trying to rename temporary AOF base file", "err", err)
-			return
-		}
+	tempBaseFilename := fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid())
+	baseFilename := am.nextBaseAofName(server)
+	baseFilepath := makePath(server.AofDirname, baseFilename)
+	if err := os.Rename(makePath(server.AofDirname, tempBaseFilename), baseFilepath); err != nil {
+		slog.Warn("failed trying to rename temporary AOF base file", "err", err)
+		return
+	}
 
-		baseFile, err := os.Open(baseFilepath)
+	baseFile, err := os.Open(baseFilepath)
+	if err != nil {
+		slog.Warn("can't open AOF base file for refresh rewrite_base_size", "err", err)
+	} else {
+		baseFileInfo, err := baseFile.Stat()
 		if err != nil {
-			slog.Warn("can't open AOF base file for refresh rewrite_base_size", "err", err)
+			slog.Warn("can't call to stat function on AOF base file for refresh rewrite_base_size",
+				"err", err)
 		} else {
-			baseFileInfo, err := baseFile.Stat()
-			if err != nil {
-				slog.Warn("can't call to stat function on AOF base file for refresh rewrite_base_size",
-					"err", err)
-			} else {
-				server.AofRewriteBaseSize = baseFileInfo.Size()
-			}
-			baseFile.Close()
+			server.AofRewriteBaseSize = baseFileInfo.Size()
 		}
+		baseFile.Close()
+	}
 
-		if server.AofState == networking.AofWaitRewrite {
-			tempIncrFilename := tempIncrAofName(server.AofFilename)
-			incrFilename := am.nextIncrAofName(server)
-			if err := os.Rename(
-				makePath(server.AofDirname, tempIncrFilename),
-				makePath(server.AofDirname, incrFilename)); err != nil {
-				slog.Warn("failed trying to rename tempory AOF incr file", "err", err)
-				return
-			}
-
-		}
-
-		am.moveIncrAofToHist()
-
-		if err := am.persist(server); err != nil {
-			slog.Warn("failed persist new AOF manifest file", "err", err)
+	if server.AofState == networking.AofWaitRewrite {
+		tempIncrFilename := tempIncrAofName(server.AofFilename)
+		incrFilename := am.nextIncrAofName(server)
+		if err := os.Rename(
+			makePath(server.AofDirname, tempIncrFilename),
+			makePath(server.AofDirname, incrFilename)); err != nil {
+			slog.Warn("failed trying to rename tempory AOF incr file", "err", err)
 			return
 		}
 
-		am.deleteAofHistFiles(server)
 	}
 
-	locked := TryLockWithTimeout(server.CmdLock, 100*time.Millisecond)
-	if !locked {
-		d.waitResetDBState = waiting
+	if server.AofState == networking.AofOff {
+		// No incr file is written with AOF off, the base has the whole DB.
+		am.histAofInfos = append(am.histAofInfos, am.incrAofInfos...)
+		am.incrAofInfos = am.incrAofInfos[:0]
+	} else {
+		am.moveIncrAofToHist()
+	}
+
+	if err := am.persist(server); err != nil {
+		slog.Warn("failed persist new AOF manifest file", "err", err)
 		return
 	}
-	d.waitResetDBState = notWait
-	server.DB.SetState(db.InMergeState)
-	server.AofChildRunning.Store(networking.ChildNotInRunning)
+
+	am.deleteAofHistFiles(server)
+	if err := am.persist(server); err != nil {
+		slog.Warn("failed persist AOF manifest file after deleting the hist files", "err", err)
+	}
+
 	slog.Info("Background AOF rewrite signal handler done")
-	server.CmdLock.Unlock()
 }
 
 func (_ Dumper) AofOpenOnServerStart(server *networking.Server) {
@@ -472,16 +668,18 @@ func (_ Dumper) AofOpenOnServerStart(server *networking.Server) {
 	if am.baseAofInfo == nil {
 		aofBaseFilename := am.nextBaseAofName(server)
 		aofBaseFilepath := makePath(server.AofDirname, aofBaseFilename)
-		if !aofRewrite(aofBaseFilepath, server) {
+		snap := server.DB.Snapshot()
+		ok := aofRewrite(aofBaseFilepath, server, snap)
+		snap.Release()
+		if !ok {
 			slog.Error("failed rewrite AOF file when database is empty")
 			os.Exit(1)
 		}
 	}
 
 	var aofIncrFilename string
-	if am.currIncrFileSeq != 0 {
-		idx := am.currIncrFileSeq - 1
-		aofIncrFilename = am.incrAofInfos[idx].name
+	if n := len(am.incrAofInfos); n != 0 {
+		aofIncrFilename = am.incrAofInfos[n-1].name
 	} else {
 		aofIncrFilename = am.nextIncrAofName(server)
 	}
@@ -2,12 +2,16 @@ package dump
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"math"
 	"os"
+	"slices"
 	"strconv"
 	"time"
 	"unsafe"
@@ -19,17 +23,29 @@ import (
 	obj "github.com/sunminx/RDB/internal/object"
 	"github.com/sunminx/RDB/internal/rio"
 	"github.com/sunminx/RDB/internal/sds"
+	"github.com/sunminx/RDB/pkg/lzf"
 	. "github.com/sunminx/RDB/pkg/util"
 )
 
 type Rdber struct {
-	rd    *rio.Reader
-	wr    *rio.Writer
-	cksum int64
-	db    *db.DB
-	info  rdberInfo
+	rd   *rio.Reader
+	wr   *rio.Writer
+	db   *db.DB
+	info rdberInfo
+	// legacy is set when loading a file written by an old version, which
+	// used the types of the linked lists and the hashes for its quicklists
+	// and ziplist encoded hashes.
+	legacy bool
+	// check is set by the offline checker, the values are only
+	// validated and counted but not added to the db.
+	check *RdbCheckReport
+	// progress is called with the position of the reader every
+	// rdbLoadProgressKeys keys during the loading.
+	progress func(pos int64)
 }
 
+const rdbLoadProgressKeys = 1024
+
 func newRdbSaver(file *os.File, mode byte, db *db.DB, rdberInfo rdberInfo) (*Rdber, error) {
 	rdber := Rdber{db: db, info: rdberInfo}
 	if mode == 'r' {
@@ -50,7 +66,31 @@ func newRdbSaver(file *os.File, mode byte, db *db.DB, rdberInfo rdberInfo) (*Rdb
 	return nil, errors.New("invalide mode")
 }
 
-func (rdb *Rdber) save(ctx context.Context) error {
+// newRdbStreamer creates a Rdber which reads or writes the RDB on a stream, eg. a socket.
+func newRdbStreamer(rd io.Reader, wr io.Writer, db *db.DB, rdberInfo rdberInfo) (*Rdber, error) {
+	rdber := Rdber{db: db, info: rdberInfo}
+	if rd != nil {
+		r, err := rio.NewStreamReader(rd)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("can't create rio reader"))
+		}
+		rdber.rd = r
+	}
+	if wr != nil {
+		w, err := rio.NewStreamWriter(wr)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("can't create rio writer"))
+		}
+		rdber.wr = w
+	}
+	return &rdber, nil
+}
+
+// save writes the keys of snap.
+func (rdb *Rdber) save(ctx context.Context, snap *db.Snapshot) error {
+	if rdb.info.cksum {
+		rdb.wr.EnableCksum()
+	}
 	if !rdb.writeRaw([]byte(fmt.Sprintf("REDIS%04d", rdb.info.version))) {
 		return errors.New("write rdb version error")
 	}
@@ -62,7 +102,7 @@ func (rdb *Rdber) save(ctx context.Context) error {
 		return errors.New("save select db num error")
 	}
 
-	for e := range rdb.db.Iterator() {
+	for e := range snap.Iterator() {
 		select {
 		case <-ctx.Done():
 			return errContextCanceled
@@ -80,18 +120,24 @@ func (rdb *Rdber) save(ctx context.Context) error {
 	if !rdb.saveCksum() {
 		return errors.New("save checksum error")
 	}
+	if err := rdb.wr.Flush(); err != nil {
+		return errors.Join(err, errors.New("flush rdb file error"))
+	}
 	return nil
 }
 
 const (
-	rdbOpcodeModuleAux    uint8 = iota + 247 /* module auxiliary data. */
-	rdbOpcodeIdle                            /* lru idle time. */
-	rdbOpcodeFreq                            /* lfu frequency. */
-	rdbOpcodeAux                             /* rdb aux field. */
-	rdbOpcodeResizedb                        /* hash table resize hint. */
-	rdbOpcodeExpiretimeMs                    /* expire time in milliseconds. */
-	rdbOpcodeExpiretime                      /* old expire time in seconds. */
-	rdbOpcodeSelectdb                        /* db number of the following keys. */
+	rdbOpcodeSlotInfo      uint8 = iota + 244 /* slot info of the cluster. */
+	rdbOpcodeFunction2                        /* function library data. */
+	rdbOpcodeFunctionPreGA                    /* old function library data for 7.0 rc1 and rc2. */
+	rdbOpcodeModuleAux                        /* module auxiliary data. */
+	rdbOpcodeIdle                             /* lru idle time. */
+	rdbOpcodeFreq                             /* lfu frequency. */
+	rdbOpcodeAux                              /* rdb aux field. */
+	rdbOpcodeResizedb                         /* hash table resize hint. */
+	rdbOpcodeExpiretimeMs                     /* expire time in milliseconds. */
+	rdbOpcodeExpiretime                       /* old expire time in seconds. */
+	rdbOpcodeSelectdb                         /* db number of the following keys. */
 	rdbOpcodeEOF
 )
 
@@ -102,25 +148,31 @@ func (rdb *Rdber) saveSelectDBNum(num uint64) bool {
 	return rdb.saveLen(num)
 }
 
-func (rdb *Rdber) loadSelectDBNum() uint64 {
-	return rdb.loadLen(nil)
-}
-
 func (rdb *Rdber) saveAuxFields() bool {
 	var saved bool = true
-	saved = saved && rdb.saveAuxFieldStrStr("redis-ver", "9")
+	saved = saved && rdb.saveAuxFieldStrStr("redis-ver", rdb.info.redisVer)
 	saved = saved && rdb.saveAuxFieldStrInt("redis-bits", Cond(unsafe.Sizeof(uintptr(0)) == 4, int64(32), int64(64)))
 	saved = saved && rdb.saveAuxFieldStrInt("ctime", time.Now().Unix())
 	saved = saved && rdb.saveAuxFieldStrInt("used-mem", 0)
 	return saved
 }
 
-func (rdb *Rdber) loadAuxField() (string, any) {
-	key := rdb.genericLoadStringObject()
-	val := rdb.genericLoadStringObject()
-	return string(key.([]byte)), val
+func (rdb *Rdber) loadAuxField() (string, string, bool) {
+	key, ok := rdb.loadStringBytes()
+	if !ok {
+		return "", "", false
+	}
+	val, ok := rdb.loadStringBytes()
+	if !ok {
+		return "", "", false
+	}
+	return string(key), string(val), true
 }
 
+// The redis-ver aux field written by the old versions, whose lists and hashes
+// are saved with the types of the linked lists and the hashes.
+const legacyRedisVer = "9"
+
 func (rdb *Rdber) saveAuxFieldStrStr(key, val string) bool {
 	return rdb.saveAuxField(key, val)
 }
@@ -146,15 +198,18 @@ const (
 	rdb_64bitlen = 0x81
 )
 
+// saveCksum writes the CRC64 of the whole file in little endian. It is zero
+// when rdbchecksum is disabled, which tells the loader to skip the check.
 func (rdb *Rdber) saveCksum() bool {
-	sz := unsafe.Sizeof(rdb.cksum)
-	buf := make([]byte, sz)
-	*(*int64)(unsafe.Pointer(&buf[0])) = rdb.cksum
-	rdb.writeRaw(buf)
-	return true
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, rdb.wr.Cksum())
+	return rdb.writeRaw(buf)
 }
 
 func (rdb *Rdber) load() error {
+	if rdb.info.cksum {
+		rdb.rd.EnableCksum()
+	}
 	p := make([]byte, 9, 9)
 	if rdb.readRaw(p) != 9 {
 		return errors.New("read magic number error")
@@ -166,109 +221,730 @@ func (rdb *Rdber) load() error {
 	if err != nil {
 		return errors.New("RDB format version not found")
 	}
-	if ver < 1 || ver > rdb.info.version {
+	if ver < 1 || ver > rdbMaxLoadVersion {
 		return fmt.Errorf("can't handle RDB format version %d", ver)
 	}
+	if rdb.check != nil {
+		rdb.check.Version = ver
+	}
 
 	var expireTime int64 = -1
-	var now = time.Now().UnixMilli()
+	var now = rdb.expireTime()
+	var skipped, empty, keys int
 loop:
 	for {
-		loadOpcode := true
+		if rdb.check != nil {
+			rdb.check.RecordOffset = rdb.rd.Tell()
+		}
 		typ := rdb.loadType()
 		switch typ {
 		case rdbOpcodeExpiretime:
+			// EXPIRETIME: load an expire time in seconds, used by RDB versions before 3.
+			t := rdb.loadTime()
+			if t == -1 {
+				return errors.New("unexpected EOF reading expire time")
+			}
+			expireTime = int64(t) * 1000
+			continue
+		case rdbOpcodeExpiretimeMs:
+			// EXPIRETIME_MS: milliseconds precision expire times introduced with RDB v3.
+			if expireTime = rdb.loadMillisecondTime(); expireTime == -1 {
+				return errors.New("unexpected EOF reading expire time")
+			}
+			continue
+		case rdbOpcodeFreq:
+			// FREQ: LFU frequency, we have no eviction policy to use it.
+			if rdb.readRaw(make([]byte, 1)) != 1 {
+				return errors.New("unexpected EOF reading LFU frequency")
+			}
+			continue
+		case rdbOpcodeIdle:
+			// IDLE: LRU idle time, we have no eviction policy to use it.
+			if rdb.loadLen(nil) == rdbLenErr {
+				return errors.New("unexpected EOF reading LRU idle time")
+			}
+			continue
 		case rdbOpcodeAux:
-			_, _ = rdb.loadAuxField()
+			// AUX: generic string-string fields, only the ones we understand
+			// are used, the others are ignored as expected by the format.
+			key, val, ok := rdb.loadAuxField()
+			if !ok {
+				return errors.New("failed load aux field in RDB file")
+			}
+			if key == "redis-ver" {
+				rdb.legacy = val == legacyRedisVer
+				slog.Info("loading RDB produced by version " + val)
+			}
+			if rdb.check != nil {
+				rdb.check.Aux = append(rdb.check.Aux, [2]string{key, val})
+			}
+			continue
 		case rdbOpcodeSelectdb:
-			_ = rdb.loadSelectDBNum()
-		case rdbOpcodeEOF:
-			break loop
-		default:
-			loadOpcode = false
-		}
-
-		if !loadOpcode {
-			o := rdb.genericLoadStringObject()
-			if o == nil {
-				return errors.New("failed load key in RDB file")
+			// SELECTDB: there is only one db, the keys of the other dbs are
+			// loaded into it.
+			dbid := rdb.loadLen(nil)
+			if dbid == rdbLenErr {
+				return errors.New("unexpected EOF reading db number")
 			}
-			key := string(o.([]byte))
-			val := rdb.loadObject(typ)
-			if val == nil {
-				return errors.New("failed load val in RDB file")
+			if dbid != 0 {
+				slog.Warn("the keys of DB are loaded into DB 0, since there is only one", "db", dbid)
 			}
-			if expireTime != -1 && expireTime < now {
-				continue
+			continue
+		case rdbOpcodeResizedb:
+			// RESIZEDB: hint about the size of the keys in the currently
+			// selected data base, in order to avoid useless rehashing.
+			if rdb.loadLen(nil) == rdbLenErr || rdb.loadLen(nil) == rdbLenErr {
+				return errors.New("unexpected EOF reading resize hint")
 			}
-			rdb.db.SetKey(key, val)
-			if expireTime != -1 {
-				rdb.db.SetExpire(key, time.Duration(expireTime))
+			continue
+		case rdbOpcodeSlotInfo:
+			// SLOT_INFO: the slot id, the slot size and the expires slot size.
+			for i := 0; i < 3; i++ {
+				if rdb.loadLen(nil) == rdbLenErr {
+					return errors.New("unexpected EOF reading slot info")
+				}
 			}
+			continue
+		case rdbOpcodeModuleAux:
+			// MODULE_AUX: we have no modules to load the data, but the
+			// data is self-described so it can be skipped.
+			if err := rdb.skipModuleAux(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeFunction2:
+			// FUNCTION2: the code of a function library, there is no
+			// scripting engine to run it.
+			if _, ok := rdb.loadStringBytes(); !ok {
+				return errors.New("failed load function library in RDB file")
+			}
+			slog.Warn("skipping function library, functions are not supported")
+			continue
+		case rdbOpcodeFunctionPreGA:
+			return errors.New("pre-GA function format not supported")
+		case rdbOpcodeEOF:
+			// The checksum follows the EOF since RDB version 5.
+			if ver >= 5 {
+				expected := rdb.rd.Cksum()
+				p := make([]byte, 8)
+				if rdb.readRaw(p) != 8 {
+					return errors.New("unexpected EOF reading RDB checksum")
+				}
+				if rdb.info.cksum {
+					cksum := binary.LittleEndian.Uint64(p)
+					if cksum == 0 {
+						slog.Warn("RDB file was saved with checksum disabled: no check performed.")
+						rdb.setCheckCksum(CksumDisabled)
+					} else if cksum != expected {
+						rdb.setCheckCksum(CksumMismatch)
+						return fmt.Errorf("wrong RDB checksum expected: (%x) got (%x)", expected, cksum)
+					} else {
+						rdb.setCheckCksum(CksumOK)
+					}
+				}
+			}
+			break loop
+		}
+
+		if keys++; rdb.progress != nil && keys%rdbLoadProgressKeys == 0 {
+			rdb.progress(rdb.rd.Tell())
+		}
+
+		// Read key-value pair.
+		key, ok := rdb.loadStringBytes()
+		if !ok {
+			return errors.New("failed load key in RDB file")
+		}
+		val, err := rdb.loadObject(typ)
+		if errors.Is(err, errTypeNotSupported) && rdb.check == nil && !rdb.info.skipUnsupported {
+			return fmt.Errorf("key %q is a %s, which is not supported, "+
+				"use rdb-skip-unsupported-types yes to skip such keys", key, rdbTypeName(typ))
+		}
+		if err != nil && !errors.Is(err, errTypeNotSupported) {
+			return fmt.Errorf("failed load key %q in RDB file: %w", key, err)
+		}
+		if rdb.check != nil {
+			rdb.check.countKey(typ, expireTime, now)
+			expireTime = -1
+			continue
+		}
+		if err != nil {
+			skipped++
+			expireTime = -1
+			continue
+		}
+		if expireTime != -1 && expireTime < now {
+			expireTime = -1
+			continue
+		}
+		// Empty lists and hashes may be left by the old versions of Redis.
+		if (val.CheckType(obj.TypeList) && list.Cnt(val) == 0) ||
+			(val.CheckType(obj.TypeHash) && hash.Len(val) == 0) {
+			empty++
 			expireTime = -1
+			continue
+		}
+		rdb.db.SetKey(string(key), val)
+		if expireTime != -1 {
+			rdb.db.SetExpire(string(key), time.Duration(expireTime))
 		}
+		expireTime = -1
+	}
+	if empty > 0 {
+		slog.Warn("skipped the empty keys", "keys", empty)
+	}
+	if skipped > 0 {
+		slog.Warn("skipped the sets and the sorted sets, which are not supported", "keys", skipped)
 	}
 	return nil
 }
 
+// rdbMaxLoadVersion is the newest RDB version we are able to load, the
+// version of the files of Redis 7.4.
+const rdbMaxLoadVersion = 12
+
 const (
 	rdbTypeString uint8 = iota
 	rdbTypeList
 	rdbTypeSet
 	rdbTypeZset
 	rdbTypeHash
-	rdbTypeZset_2 /* zset version 2 with doubles stored in binary. */
-	rdbTypeModule
-
-	rdbTypeHashZipmap = 9
+	rdbTypeZset2 /* zset version 2 with doubles stored in binary. */
+	rdbTypeModulePreGA
+	rdbTypeModule2
+	_
+	rdbTypeHashZipmap
 	rdbTypeListZiplist
 	rdbTypeSetIntset
 	rdbTypeZsetZiplist
 	rdbTypeHashZiplist
 	rdbTypeListQuicklist
 	rdbTypeStreamListpacks
+	rdbTypeHashListpack
+	rdbTypeZsetListpack
+	rdbTypeListQuicklist2
+	rdbTypeStreamListpacks2
+	rdbTypeSetListpack
+	rdbTypeStreamListpacks3
+	rdbTypeHashMetadataPreGA
+	rdbTypeHashListpackExPreGA
+	rdbTypeHashMetadata
+	rdbTypeHashListpackEx
+)
+
+// The containers of the quicklist nodes since RDB version 10.
+const (
+	quicklistNodeContainerPlain  = 1
+	quicklistNodeContainerPacked = 2
 )
 
-func (rdb *Rdber) loadObject(typ uint8) *obj.Robj {
+// errTypeNotSupported is returned for the types of which we have no data
+// type, the load fails unless the keys are skipped, see
+// rdberInfo.skipUnsupported.
+var errTypeNotSupported = errors.New("type not supported")
+
+func (rdb *Rdber) loadObject(typ uint8) (*obj.Robj, error) {
+	var o *obj.Robj
 	switch typ {
 	case rdbTypeString:
-		return rdb.loadStringObject()
+		o = rdb.loadStringObject()
 	case rdbTypeList:
-		return rdb.loadListObject()
+		if rdb.legacy {
+			o = rdb.loadListObject()
+		} else {
+			return rdb.loadLinkedListObject()
+		}
+	case rdbTypeListZiplist:
+		return rdb.loadListZiplistObject()
+	case rdbTypeListQuicklist:
+		o = rdb.loadListObject()
+	case rdbTypeListQuicklist2:
+		return rdb.loadListQuicklist2Object()
 	case rdbTypeHash:
-		return rdb.loadHashObject()
+		if rdb.legacy {
+			if rdb.loadLen(nil) == rdbLenErr {
+				return nil, io.ErrUnexpectedEOF
+			}
+			o = rdb.loadHashObject()
+		} else {
+			return rdb.loadHashTableObject()
+		}
+	case rdbTypeHashZipmap, rdbTypeHashListpack:
+		return rdb.loadHashEncodedObject(typ)
+	case rdbTypeHashZiplist:
+		o = rdb.loadHashObject()
+	case rdbTypeSet, rdbTypeSetIntset, rdbTypeSetListpack,
+		rdbTypeZset, rdbTypeZset2, rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		if err := rdb.skipObject(typ); err != nil {
+			return nil, err
+		}
+		return nil, errTypeNotSupported
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return nil, errors.New("streams are not supported")
+	case rdbTypeModulePreGA, rdbTypeModule2:
+		return nil, errors.New("module types are not supported")
+	case rdbTypeHashMetadataPreGA, rdbTypeHashMetadata:
+		return rdb.loadHashMetadataObject(typ)
+	case rdbTypeHashListpackExPreGA, rdbTypeHashListpackEx:
+		return rdb.loadHashListpackExObject(typ)
 	default:
-		return nil
+		return nil, fmt.Errorf("unknown RDB encoding type %d", typ)
+	}
+	if o == nil {
+		return nil, errors.New("bad encoded value")
 	}
+	return o, nil
 }
 
+// loadHashObject loads a hash encoded as a ziplist, which is converted to
+// a listpack.
 func (rdb *Rdber) loadHashObject() *obj.Robj {
+	v, ok := rdb.loadStringBytes()
+	if !ok {
+		return nil
+	}
+	zl := ds.Ziplist(v)
+	if !zl.Validate() {
+		return nil
+	}
+	entries := make([][]byte, 0, zl.Len())
+	for iter := ds.NewZiplistIterator(&zl); iter.HasNext(); {
+		entries = append(entries, iter.Next())
+	}
+	o, err := newHashFromEntries(entries)
+	if err != nil {
+		return nil
+	}
+	return o
+}
+
+// loadHashTableObject loads a hash saved as its fields and values.
+func (rdb *Rdber) loadHashTableObject() (*obj.Robj, error) {
+	ln := rdb.loadLen(nil)
+	if ln == rdbLenErr {
+		return nil, io.ErrUnexpectedEOF
+	}
+	entries := make([][]byte, 0, min(ln*2, 1024))
+	for i := uint64(0); i < ln*2; i++ {
+		v, ok := rdb.loadStringBytes()
+		if !ok {
+			return nil, io.ErrUnexpectedEOF
+		}
+		entries = append(entries, v)
+	}
+	return newHashFromEntries(entries)
+}
+
+// loadHashEncodedObject loads a hash encoded as a zipmap or a listpack.
+func (rdb *Rdber) loadHashEncodedObject(typ uint8) (*obj.Robj, error) {
+	v, ok := rdb.loadStringBytes()
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var entries [][]byte
+	if typ == rdbTypeHashZipmap {
+		entries, ok = zipmapEntries(v)
+	} else {
+		entries, ok = ds.Listpack(v).Entries()
+	}
+	if !ok {
+		return nil, errors.New("bad encoded hash")
+	}
+	return newHashFromEntries(entries)
+}
+
+// loadHashMetadataObject loads a hashtable with field expires. Every field
+// is saved with its expire, 0 if none, before its value, the expires are
+// relative to the earliest one saved before the fields, except in the
+// pre-GA format.
+func (rdb *Rdber) loadHashMetadataObject(typ uint8) (*obj.Robj, error) {
+	var minExpire int64
+	if typ == rdbTypeHashMetadata {
+		if minExpire = rdb.loadMillisecondTime(); minExpire == -1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
 	ln := rdb.loadLen(nil)
 	if ln == rdbLenErr {
+		return nil, io.ErrUnexpectedEOF
+	}
+	o := hash.NewRobj(hash.NewZipmap())
+	now := rdb.expireTime()
+	for range ln {
+		ttl := rdb.loadLen(nil)
+		if ttl == rdbLenErr {
+			return nil, io.ErrUnexpectedEOF
+		}
+		field, ok := rdb.loadStringBytes()
+		if !ok {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v, ok := rdb.loadStringBytes()
+		if !ok {
+			return nil, io.ErrUnexpectedEOF
+		}
+		expire := hash.NoExpire
+		if ttl != 0 {
+			expire = int64(ttl)
+			if typ == rdbTypeHashMetadata {
+				expire += minExpire - 1
+			}
+		}
+		if err := addHashField(o, field, v, expire, now); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// loadHashListpackExObject loads a small hash with field expires, encoded
+// as a listpack of the fields, the values and the expires, 0 if none. The
+// earliest expire is saved before it, except in the pre-GA format.
+func (rdb *Rdber) loadHashListpackExObject(typ uint8) (*obj.Robj, error) {
+	if typ == rdbTypeHashListpackEx && rdb.loadMillisecondTime() == -1 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	v, ok := rdb.loadStringBytes()
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	entries, ok := ds.Listpack(v).Entries()
+	if !ok || len(entries)%3 != 0 {
+		return nil, errors.New("bad encoded hash")
+	}
+	o := hash.NewRobj(hash.NewZipmap())
+	now := rdb.expireTime()
+	for i := 0; i < len(entries); i += 3 {
+		expire, err := strconv.ParseInt(string(entries[i+2]), 10, 64)
+		if err != nil || expire < 0 {
+			return nil, fmt.Errorf("bad expire of hash field %q", entries[i])
+		}
+		if expire == 0 {
+			expire = hash.NoExpire
+		}
+		if err := addHashField(o, entries[i], entries[i+1], expire, now); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// expireTime returns the time at which the loaded keys and fields are
+// expired, and skipped. None is expired if the info tells to keep them.
+func (rdb *Rdber) expireTime() int64 {
+	if rdb.info.keepExpired {
+		return 0
+	}
+	return time.Now().UnixMilli()
+}
+
+// newHashFromEntries creates a hash from the fields and the values, it is
+// converted to a hashtable if it is too big for a listpack.
+func newHashFromEntries(entries [][]byte) (*obj.Robj, error) {
+	if len(entries)%2 != 0 {
+		return nil, fmt.Errorf("can't load hash of %d fields and values", len(entries))
+	}
+	o := hash.NewRobj(hash.NewZipmap())
+	for i := 0; i < len(entries); i += 2 {
+		if err := addHashField(o, entries[i], entries[i+1], hash.NoExpire, 0); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// addHashField adds a loaded field to the hash, with its expire. The field
+// is skipped if it is already expired at now, as the expired keys are.
+func addHashField(o *obj.Robj, field, val []byte, expire, now int64) error {
+	if hash.Exists(o, field) {
+		return fmt.Errorf("duplicate hash field %q", field)
+	}
+	if expire != hash.NoExpire && expire <= now {
 		return nil
 	}
-	v := rdb.genericLoadStringObject()
-	zl := ds.Ziplist(v.([]byte))
-	zm := &hash.Zipmap{Ziplist: &zl}
-	return obj.New(zm, obj.TypeHash, obj.EncodingZipmap)
+	hash.Set(o, field, val)
+	if expire != hash.NoExpire {
+		hash.SetExpire(o, field, expire)
+	}
+	return nil
+}
+
+// zipmapEntries decodes the fields and the values of a zipmap, the encoding
+// of the small hashes before Redis 2.6.
+//
+// <zmlen><len>"foo"<len><free>"bar"<len>"hello"<len><free>"world"<end>
+//
+// zmlen is the number of pairs if lower than 254, len is one byte, or 254
+// followed by a four bytes length, free is the number of unused bytes after
+// the value, and end is 255.
+func zipmapEntries(b []byte) ([][]byte, bool) {
+	if len(b) < 2 {
+		return nil, false
+	}
+	var entries [][]byte
+	offset := 1
+	for {
+		if offset >= len(b) {
+			return nil, false
+		}
+		if b[offset] == 255 {
+			break
+		}
+		field, n, ok := zipmapEntry(b[offset:], false)
+		if !ok {
+			return nil, false
+		}
+		offset += n
+		val, n, ok := zipmapEntry(b[offset:], true)
+		if !ok {
+			return nil, false
+		}
+		offset += n
+		entries = append(entries, field, val)
+	}
+	if offset != len(b)-1 || (b[0] < 254 && int(b[0]) != len(entries)/2) {
+		return nil, false
+	}
+	return entries, true
+}
+
+// zipmapEntry decodes a zipmap entry, and returns it with its size.
+func zipmapEntry(b []byte, hasFree bool) ([]byte, int, bool) {
+	if len(b) == 0 || b[0] == 255 {
+		return nil, 0, false
+	}
+	n, ln := 1, int(b[0])
+	if b[0] == 254 {
+		if len(b) < 5 {
+			return nil, 0, false
+		}
+		n, ln = 5, int(binary.LittleEndian.Uint32(b[1:5]))
+	}
+	free := 0
+	if hasFree {
+		if len(b) < n+1 {
+			return nil, 0, false
+		}
+		free = int(b[n])
+		n++
+	}
+	if len(b) < n+ln+free {
+		return nil, 0, false
+	}
+	return b[n : n+ln], n + ln + free, true
 }
 
+// loadListObject loads a quicklist whose nodes are ziplists, each one is
+// converted to a listpack.
 func (rdb *Rdber) loadListObject() *obj.Robj {
 	ln := rdb.loadLen(nil)
 	if ln == rdbLenErr {
 		return nil
 	}
 	ql := list.NewQuicklist()
-	for ln > 0 {
-		v := rdb.genericLoadStringObject()
-		zl := ds.Ziplist(v.([]byte))
-		node := list.CreateQuicklistNode(&zl)
-		ql.Link(node)
-		ln--
+	for ; ln > 0; ln-- {
+		v, ok := rdb.loadStringBytes()
+		if !ok {
+			return nil
+		}
+		zl := ds.Ziplist(v)
+		if !zl.Validate() {
+			return nil
+		}
+		// Silently skip the empty ziplists, we'll not need them.
+		if zl.Len() == 0 {
+			continue
+		}
+		lp := ds.NewListpack()
+		for iter := ds.NewZiplistIterator(&zl); iter.HasNext(); {
+			lp.Append(iter.Next())
+		}
+		ql.Link(list.CreateQuicklistNode(lp))
 	}
 	return obj.New(ql, obj.TypeList, obj.EncodingQuicklist)
 }
 
+// loadLinkedListObject loads a list saved as its elements.
+func (rdb *Rdber) loadLinkedListObject() (*obj.Robj, error) {
+	ln := rdb.loadLen(nil)
+	if ln == rdbLenErr {
+		return nil, io.ErrUnexpectedEOF
+	}
+	ql := list.NewQuicklist()
+	for ; ln > 0; ln-- {
+		v, ok := rdb.loadStringBytes()
+		if !ok {
+			return nil, io.ErrUnexpectedEOF
+		}
+		ql.Push(v)
+	}
+	return obj.New(ql, obj.TypeList, obj.EncodingQuicklist), nil
+}
+
+// loadListZiplistObject loads a list encoded as a single ziplist.
+func (rdb *Rdber) loadListZiplistObject() (*obj.Robj, error) {
+	v, ok := rdb.loadStringBytes()
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	zl := ds.Ziplist(v)
+	if !zl.Validate() {
+		return nil, errors.New("bad encoded ziplist")
+	}
+	ql := list.NewQuicklist()
+	for iter := ds.NewZiplistIterator(&zl); iter.HasNext(); {
+		ql.Push(iter.Next())
+	}
+	return obj.New(ql, obj.TypeList, obj.EncodingQuicklist), nil
+}
+
+// loadListQuicklist2Object loads a quicklist whose nodes are listpacks, or
+// plain elements too large to be packed.
+func (rdb *Rdber) loadListQuicklist2Object() (*obj.Robj, error) {
+	ln := rdb.loadLen(nil)
+	if ln == rdbLenErr {
+		return nil, io.ErrUnexpectedEOF
+	}
+	ql := list.NewQuicklist()
+	for ; ln > 0; ln-- {
+		container := rdb.loadLen(nil)
+		if container == rdbLenErr {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v, ok := rdb.loadStringBytes()
+		if !ok {
+			return nil, io.ErrUnexpectedEOF
+		}
+		switch container {
+		case quicklistNodeContainerPlain:
+			ql.Push(v)
+		case quicklistNodeContainerPacked:
+			lp := ds.Listpack(v)
+			if !lp.Validate() {
+				return nil, errors.New("bad encoded listpack")
+			}
+			// The listpack is linked as is, unless it has more entries than
+			// a node can count.
+			n := lp.Len()
+			if n == 0 {
+				continue
+			} else if n <= math.MaxUint16 {
+				ql.Link(list.CreateQuicklistNode(&lp))
+				continue
+			}
+			entries, _ := lp.Entries()
+			for _, entry := range entries {
+				ql.Push(entry)
+			}
+		default:
+			return nil, fmt.Errorf("quicklist container %d is not supported", container)
+		}
+	}
+	return obj.New(ql, obj.TypeList, obj.EncodingQuicklist), nil
+}
+
+// skipObject reads a value of the types we don't support.
+func (rdb *Rdber) skipObject(typ uint8) error {
+	switch typ {
+	case rdbTypeSetIntset, rdbTypeSetListpack, rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		if _, ok := rdb.loadStringBytes(); !ok {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+
+	ln := rdb.loadLen(nil)
+	if ln == rdbLenErr {
+		return io.ErrUnexpectedEOF
+	}
+	for ; ln > 0; ln-- {
+		if _, ok := rdb.loadStringBytes(); !ok {
+			return io.ErrUnexpectedEOF
+		}
+		switch typ {
+		case rdbTypeZset:
+			// The score is saved as a string, whose length is 253 for NaN,
+			// 254 for +inf and 255 for -inf.
+			p := make([]byte, 1)
+			if rdb.readRaw(p) != 1 {
+				return io.ErrUnexpectedEOF
+			}
+			if p[0] < 253 && rdb.readRaw(make([]byte, p[0])) != int(p[0]) {
+				return io.ErrUnexpectedEOF
+			}
+		case rdbTypeZset2:
+			// The score is saved as a binary double.
+			if rdb.readRaw(make([]byte, 8)) != 8 {
+				return io.ErrUnexpectedEOF
+			}
+		}
+	}
+	return nil
+}
+
+// The opcodes of the values serialized by the modules.
+const (
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeSint   = 1
+	rdbModuleOpcodeUint   = 2
+	rdbModuleOpcodeFloat  = 3
+	rdbModuleOpcodeDouble = 4
+	rdbModuleOpcodeString = 5
+)
+
+// skipModuleAux reads the aux data of a module, which is made of values
+// preceded by their opcodes until the EOF opcode.
+func (rdb *Rdber) skipModuleAux() error {
+	moduleid := rdb.loadLen(nil)
+	whenOpcode := rdb.loadLen(nil)
+	when := rdb.loadLen(nil)
+	if moduleid == rdbLenErr || whenOpcode == rdbLenErr || when == rdbLenErr {
+		return errors.New("unexpected EOF reading module aux data")
+	}
+	if whenOpcode != rdbModuleOpcodeUint {
+		return fmt.Errorf("bad when opcode %d of module aux data", whenOpcode)
+	}
+	slog.Warn("skipping the aux data of module, modules are not supported", "module", moduleTypeName(moduleid))
+
+	for {
+		opcode := rdb.loadLen(nil)
+		switch opcode {
+		case rdbModuleOpcodeEOF:
+			return nil
+		case rdbModuleOpcodeSint, rdbModuleOpcodeUint:
+			if rdb.loadLen(nil) == rdbLenErr {
+				return errors.New("unexpected EOF reading module aux data")
+			}
+		case rdbModuleOpcodeFloat:
+			if rdb.readRaw(make([]byte, 4)) != 4 {
+				return errors.New("unexpected EOF reading module aux data")
+			}
+		case rdbModuleOpcodeDouble:
+			if rdb.readRaw(make([]byte, 8)) != 8 {
+				return errors.New("unexpected EOF reading module aux data")
+			}
+		case rdbModuleOpcodeString:
+			if _, ok := rdb.loadStringBytes(); !ok {
+				return errors.New("unexpected EOF reading module aux data")
+			}
+		default:
+			return fmt.Errorf("unknown module opcode %d in module aux data", opcode)
+		}
+	}
+}
+
+// moduleTypeName returns the name of the module type from its id, which is
+// made of 9 characters of 6 bits, followed by 10 bits of version.
+func moduleTypeName(moduleid uint64) string {
+	const cset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	name := make([]byte, 9)
+	moduleid >>= 10
+	for j := range name {
+		name[j] = cset[(moduleid>>(6*(8-j)))&63]
+	}
+	return string(name)
+}
+
 func (rdb *Rdber) loadStringObject() *obj.Robj {
 	v := rdb.genericLoadStringObject()
 	if v == nil {
@@ -284,12 +960,31 @@ func (rdb *Rdber) loadStringObject() *obj.Robj {
 	}
 }
 
+// loadStringBytes loads a string, the integer encoded ones are converted.
+func (rdb *Rdber) loadStringBytes() ([]byte, bool) {
+	switch v := rdb.genericLoadStringObject().(type) {
+	case []byte:
+		return v, true
+	case int64:
+		return strconv.AppendInt(nil, v, 10), true
+	default:
+		return nil, false
+	}
+}
+
 func (rdb *Rdber) genericLoadStringObject() any {
 	var isEncoded bool
-	ln := int(rdb.loadLen(&isEncoded))
+	_len := rdb.loadLen(&isEncoded)
+	if _len == rdbLenErr {
+		return nil
+	}
+	ln := int(_len)
 	if isEncoded {
-		v := rdb.loadStringIntObject(uint8(ln))
-		if v == -1 {
+		if ln == rdbEncLzf {
+			return rdb.loadLzfStringObject()
+		}
+		v, ok := rdb.loadStringIntObject(uint8(ln))
+		if !ok {
 			return nil
 		}
 		return v
@@ -302,31 +997,55 @@ func (rdb *Rdber) genericLoadStringObject() any {
 	}
 }
 
+// loadLzfStringObject loads a LZF compressed string, which is saved as the
+// compressed length, the original length, and the compressed bytes.
+func (rdb *Rdber) loadLzfStringObject() any {
+	clen := rdb.loadLen(nil)
+	if clen == rdbLenErr {
+		return nil
+	}
+	ln := rdb.loadLen(nil)
+	if ln == rdbLenErr {
+		return nil
+	}
+	c := make([]byte, clen)
+	if uint64(rdb.readRaw(c)) != clen {
+		return nil
+	}
+	p := make([]byte, ln)
+	if n, err := lzf.Decompress(c, p); err != nil || uint64(n) != ln {
+		return nil
+	}
+	return p
+}
+
 // loadStringIntObject is the inverse operation of encodeInt.
-func (rdb *Rdber) loadStringIntObject(typ uint8) int64 {
+func (rdb *Rdber) loadStringIntObject(typ uint8) (int64, bool) {
 	var n int64
 	var p []byte
 	if typ == rdbEncInt8 {
 		p = make([]byte, 1, 1)
 		if rdb.readRaw(p) != 1 {
-			return -1
+			return 0, false
 		}
-		n = int64(p[0])
+		n = int64(int8(p[0]))
 	} else if typ == rdbEncInt16 {
 		p = make([]byte, 2, 2)
 		if rdb.readRaw(p) != 2 {
-			return -1
+			return 0, false
 		}
-		n = int64(p[1]) | int64(p[2])<<8
+		n = int64(int16(uint16(p[0]) | uint16(p[1])<<8))
 	} else if typ == rdbEncInt32 {
 		p = make([]byte, 4, 4)
 		if rdb.readRaw(p) != 4 {
-			return -1
+			return 0, false
 		}
 		v := uint32(p[0]) | uint32(p[1])<<8 | uint32(p[2])<<16 | uint32(p[3])<<24
-		n = int64(v)
+		n = int64(int32(v))
+	} else {
+		return 0, false
 	}
-	return n
+	return n, true
 }
 
 func (rdb *Rdber) saveKeyValPair(key string, val *obj.Robj, expire int64) bool {
@@ -347,14 +1066,20 @@ func (rdb *Rdber) saveObjectType(val *obj.Robj) bool {
 		return saved
 	case obj.TypeList:
 		if val.CheckEncoding(obj.EncodingQuicklist) {
-			rdb.saveType(rdbTypeList)
+			return rdb.saveType(rdbTypeListQuicklist2)
 		}
-		return saved
+		return nosave
 	case obj.TypeHash:
+		// The hashes with field expires are saved in the formats of
+		// Redis 7.4, the others as before, so that the older versions
+		// load them.
+		withExpires := hash.NextExpire(val) != hash.NoExpire
 		if val.CheckEncoding(obj.EncodingZipmap) {
-			rdb.saveType(rdbTypeHash)
+			return rdb.saveType(Cond(withExpires, rdbTypeHashListpackEx, rdbTypeHashListpack))
+		} else if val.CheckEncoding(obj.EncodingHashtable) {
+			return rdb.saveType(Cond(withExpires, rdbTypeHashMetadata, rdbTypeHash))
 		}
-		return saved
+		return nosave
 	default:
 		return nosave
 	}
@@ -378,7 +1103,8 @@ func (rdb *Rdber) saveStringObject(val *obj.Robj) bool {
 		n := val.Val().(int64)
 		enc := encodeInt(n)
 		if len(enc) == 0 {
-			enc = Int64ToBytes(n)
+			// Too large to be encoded as integer, saved as string.
+			return rdb.saveBytes(Int64ToBytes(n))
 		}
 		return rdb.writeRaw(enc)
 	} else if val.CheckEncoding(obj.EncodingRaw) {
@@ -428,12 +1154,15 @@ func (rdb *Rdber) saveListObject(val *obj.Robj) bool {
 		rdb.saveLen(uint64(ql.Len()))
 		node := ql.Head()
 		for node != nil {
-			li := node.List()
-			ln := li.Bytes()
-			if !rdb.saveLen(uint64(ln)) {
+			if !rdb.saveLen(quicklistNodeContainerPacked) {
 				return nosave
 			}
-			if !rdb.writeRaw([]byte(*li)[:ln]) {
+			// The compressed nodes are written as they are, as LZF strings.
+			if c, sz, ok := node.Compressed(); ok {
+				if !rdb.saveLzfBlob(c, uint64(sz)) {
+					return nosave
+				}
+			} else if !rdb.saveBytes(*node.List()) {
 				return nosave
 			}
 			node = node.Next()
@@ -444,24 +1173,101 @@ func (rdb *Rdber) saveListObject(val *obj.Robj) bool {
 }
 
 func (rdb *Rdber) saveHashObject(val *obj.Robj) bool {
+	if minExpire := hash.MinExpire(val); minExpire != hash.NoExpire {
+		return rdb.saveHashObjectWithExpires(val, minExpire)
+	}
 	if val.CheckEncoding(obj.EncodingZipmap) {
 		zm := val.Val().(*hash.Zipmap)
-		if !rdb.saveLen(uint64(zm.Len())) {
+		return rdb.saveBytes(*zm.Listpack)
+	} else if val.CheckEncoding(obj.EncodingHashtable) {
+		if !rdb.saveLen(uint64(hash.Len(val))) {
 			return nosave
 		}
-		if !rdb.saveLen(uint64(zm.Bytes())) {
+		for iter := hash.NewIterator(val); iter.HasNext(); {
+			kv := iter.Next().(hash.KVPair)
+			if !rdb.saveBytes(kv[0]) || !rdb.saveBytes(kv[1]) {
+				return nosave
+			}
+		}
+		return saved
+	}
+	return nosave
+}
+
+// saveHashObjectWithExpires saves a hash with field expires, see
+// loadHashListpackExObject and loadHashMetadataObject, the expires of a
+// hashtable are saved relative to minExpire, the earliest one.
+func (rdb *Rdber) saveHashObjectWithExpires(val *obj.Robj, minExpire int64) bool {
+	if !rdb.saveRawMillisecondTime(minExpire) {
+		return nosave
+	}
+	if val.CheckEncoding(obj.EncodingZipmap) {
+		return rdb.saveBytes(*listpackEx(val))
+	} else if val.CheckEncoding(obj.EncodingHashtable) {
+		if !rdb.saveLen(uint64(hash.Len(val))) {
 			return nosave
 		}
-		return rdb.writeRaw([]byte(*zm.Ziplist))
+		for iter := hash.NewIterator(val); iter.HasNext(); {
+			kv := iter.Next().(hash.KVPair)
+			var ttl uint64
+			if expire := hash.GetExpire(val, kv[0]); expire != hash.NoExpire {
+				ttl = uint64(expire-minExpire) + 1
+			}
+			if !rdb.saveLen(ttl) || !rdb.saveBytes(kv[0]) || !rdb.saveBytes(kv[1]) {
+				return nosave
+			}
+		}
+		return saved
 	}
 	return nosave
 }
 
+// listpackEx returns the listpack of the fields, the values and the expires
+// of a zipmap, the fields with a TTL come first by expire, as Redis keeps
+// them.
+func listpackEx(val *obj.Robj) *ds.Listpack {
+	type fieldEx struct {
+		kv     hash.KVPair
+		expire int64
+	}
+	fields := make([]fieldEx, 0, hash.Len(val))
+	for iter := hash.NewIterator(val); iter.HasNext(); {
+		kv := iter.Next().(hash.KVPair)
+		fields = append(fields, fieldEx{kv, hash.GetExpire(val, kv[0])})
+	}
+	slices.SortStableFunc(fields, func(a, b fieldEx) int {
+		switch {
+		case a.expire == b.expire:
+			return 0
+		case a.expire == hash.NoExpire:
+			return 1
+		case b.expire == hash.NoExpire:
+			return -1
+		}
+		return cmp.Compare(a.expire, b.expire)
+	})
+	lp := ds.NewListpack()
+	for _, f := range fields {
+		lp.Append(f.kv[0])
+		lp.Append(f.kv[1])
+		lp.Append(strconv.AppendInt(nil, max(f.expire, 0), 10))
+	}
+	return lp
+}
+
 func (rdb *Rdber) saveString(str string) bool {
 	return rdb.saveBytes([]byte(str))
 }
 
 func (rdb *Rdber) saveBytes(b []byte) bool {
+	// Try LZF compression, only for strings long enough to be worth it.
+	if rdb.info.compression && len(b) > 20 {
+		if n, ok := rdb.saveLzfBytes(b); !ok {
+			return nosave
+		} else if n > 0 {
+			return saved
+		}
+	}
 	_len := uint64(len(b))
 	if !rdb.saveLen(_len) {
 		return nosave
@@ -469,6 +1275,32 @@ func (rdb *Rdber) saveBytes(b []byte) bool {
 	return rdb.writeRaw(b)
 }
 
+// saveLzfBytes saves b compressed by LZF and returns the length of the
+// compressed data, which is zero if b is not compressible enough.
+func (rdb *Rdber) saveLzfBytes(b []byte) (int, bool) {
+	// We require at least four bytes compression for this to be worth it.
+	if len(b) <= 4 {
+		return 0, saved
+	}
+	out := make([]byte, len(b)-4)
+	n := lzf.Compress(b, out)
+	if n == 0 {
+		return 0, saved
+	}
+	return n, rdb.saveLzfBlob(out[:n], uint64(len(b)))
+}
+
+// saveLzfBlob saves the LZF compressed data c of a string of ln bytes.
+func (rdb *Rdber) saveLzfBlob(c []byte, ln uint64) bool {
+	if !rdb.writeRaw([]byte{rdbEncval<<6 | rdbEncLzf}) {
+		return nosave
+	}
+	if !rdb.saveLen(uint64(len(c))) || !rdb.saveLen(ln) {
+		return nosave
+	}
+	return rdb.writeRaw(c)
+}
+
 const rdbLenErr = math.MaxUint64
 
 func (rdb *Rdber) loadLen(isEncoded *bool) uint64 {
@@ -570,6 +1402,12 @@ func (rdb *Rdber) saveMillisencondTime(t int64) bool {
 	return saved
 }
 
+// saveRawMillisecondTime saves t without the EXPIRETIME_MS opcode, as the
+// earliest expire of a hash with field expires.
+func (rdb *Rdber) saveRawMillisecondTime(t int64) bool {
+	return rdb.writeRaw(binary.LittleEndian.AppendUint64(nil, uint64(t)))
+}
+
 func (rdb *Rdber) loadType() uint8 {
 	p := make([]byte, 1, 1)
 	return Cond(rdb.readRaw(p) != 1, 0, p[0])
@@ -580,7 +1418,7 @@ func (rdb *Rdber) saveType(t uint8) bool {
 }
 
 func (rdb *Rdber) readRaw(p []byte) int {
-	n, _ := rdb.rd.Read(p)
+	n, _ := io.ReadFull(rdb.rd, p)
 	return n
 }
 
@@ -1,9 +1,18 @@
 package dump
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/sunminx/RDB/internal/db"
 	"github.com/sunminx/RDB/internal/hash"
@@ -38,6 +47,7 @@ func newMockRdb(t *testing.T) *Rdber {
 	if err != nil {
 		t.Error("cannot create rdb.file")
 	}
+	t.Cleanup(func() { os.Remove("rdb.file") })
 	wr, err := rio.NewWriter(file)
 	if err != nil {
 		t.Error(err)
@@ -59,6 +69,12 @@ func newMockRdb(t *testing.T) *Rdber {
 	}
 }
 
+func flush(t *testing.T, rdb *Rdber) {
+	if err := rdb.wr.Flush(); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestSaveLoadLen(t *testing.T) {
 	rdb := newMockRdb(t)
 	testcases := []uint64{10, 100, 1000, 10000, 1000000, 100000000, 10000000000}
@@ -66,6 +82,7 @@ func TestSaveLoadLen(t *testing.T) {
 		if !rdb.saveLen(tc) {
 			t.Error("save len error")
 		}
+		flush(t, rdb)
 		n := rdb.loadLen(nil)
 		if tc != n {
 			t.Errorf("test saveLen & loadLen failed, "+
@@ -78,9 +95,10 @@ func TestSaveLoadRawString(t *testing.T) {
 	rdb := newMockRdb(t)
 	testcases := []string{"hello", "100"}
 	for _, tc := range testcases {
-		if !rdb.saveRawString(tc) {
+		if !rdb.saveString(tc) {
 			t.Error("save raw string error")
 		}
+		flush(t, rdb)
 		v := rdb.genericLoadStringObject()
 		s, ok := v.([]byte)
 		if !ok {
@@ -94,12 +112,13 @@ func TestSaveLoadRawString(t *testing.T) {
 
 func TestSaveLoadStringObject(t *testing.T) {
 	rdb := newMockRdb(t)
-	testcases := []int64{100000}
+	testcases := []int64{-1, 1, 127, -128, 300, -300, 100000, -100000}
 	for _, tc := range testcases {
 		robj := obj.New(tc, obj.TypeString, obj.EncodingInt)
 		if !rdb.saveStringObject(robj) {
 			t.Error("save string object error")
 		}
+		flush(t, rdb)
 		rrobj := rdb.loadStringObject()
 		if !rrobj.CheckType(robj.Type()) {
 			t.Error("type")
@@ -118,22 +137,67 @@ func TestSaveLoadListObject(t *testing.T) {
 	rdb := newMockRdb(t)
 	li := list.NewQuicklist()
 	li.Push([]byte("hello"))
+	// Enough entries for several listpack nodes.
+	for i := range 2000 {
+		li.Push([]byte(strconv.Itoa(i)))
+	}
 	robj := obj.New(li, obj.TypeList, obj.EncodingQuicklist)
 	if !rdb.saveListObject(robj) {
 		t.Error("save quicklist error")
 	}
-	rrobj := rdb.loadListObject()
-	if rrobj == nil {
-		t.Error("load quicklist error")
+	flush(t, rdb)
+	rrobj, err := rdb.loadListQuicklist2Object()
+	if err != nil {
+		t.Fatal(err)
 	}
 	v, ok := rrobj.Val().(*list.Quicklist)
 	if !ok {
-		t.Error("load quicklist error")
+		t.Fatal("load quicklist error")
+	}
+	if v.Cnt() != li.Cnt() || v.Len() != li.Len() {
+		t.Errorf("%d entries in %d nodes loaded, want %d in %d", v.Cnt(), v.Len(), li.Cnt(), li.Len())
 	}
 	item, _ := v.Index(0)
 	if string(item) != "hello" {
 		t.Error("load quicklist error")
 	}
+	if item, _ := v.Index(2000); string(item) != "1999" {
+		t.Errorf("last entry %q", item)
+	}
+}
+
+func TestSaveLoadCompressedListObject(t *testing.T) {
+	defer func(depth int) { list.CompressDepth = depth }(list.CompressDepth)
+	list.CompressDepth = 1
+	rdb := newMockRdb(t)
+	li := list.NewQuicklist()
+	for i := range 5000 {
+		li.Push([]byte("entry" + strconv.Itoa(i)))
+	}
+	if _, _, ok := li.Head().Next().Compressed(); !ok {
+		t.Fatal("the inner nodes are not compressed")
+	}
+	robj := obj.New(li, obj.TypeList, obj.EncodingQuicklist)
+	if !rdb.saveListObject(robj) {
+		t.Fatal("save quicklist error")
+	}
+	flush(t, rdb)
+	rrobj, err := rdb.loadListQuicklist2Object()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := rrobj.Val().(*list.Quicklist)
+	if v.Cnt() != li.Cnt() || v.Len() != li.Len() {
+		t.Fatalf("%d entries in %d nodes loaded, want %d in %d", v.Cnt(), v.Len(), li.Cnt(), li.Len())
+	}
+	if _, _, ok := v.Head().Next().Compressed(); !ok {
+		t.Error("the loaded inner nodes are not compressed")
+	}
+	for _, i := range []uint64{0, 2500, 4999} {
+		if item, _ := v.Index(i); string(item) != "entry"+strconv.Itoa(int(i)) {
+			t.Errorf("entry %d: %q", i, item)
+		}
+	}
 }
 
 func TestSaveLoadHashObject(t *testing.T) {
@@ -145,9 +209,10 @@ func TestSaveLoadHashObject(t *testing.T) {
 	if !rdb.saveHashObject(hmap) {
 		t.Error("save hash object error 1")
 	}
-	robj := rdb.loadHashObject()
-	if robj == nil {
-		t.Error("load hash object error 2")
+	flush(t, rdb)
+	robj, err := rdb.loadHashEncodedObject(rdbTypeHashListpack)
+	if err != nil {
+		t.Fatal(err)
 	}
 	val, ok := hash.Get(robj, []byte("key"))
 	if !ok {
@@ -158,3 +223,399 @@ func TestSaveLoadHashObject(t *testing.T) {
 		t.Error("load hash object error 3")
 	}
 }
+
+func TestSaveLoadHashtableObject(t *testing.T) {
+	rdb := newMockRdb(t)
+
+	hmap := hash.NewRobj(hash.NewZipmap())
+	for i := range 1000 {
+		hash.Set(hmap, []byte(strconv.Itoa(i)), []byte(strconv.Itoa(i*2)))
+	}
+	if !hmap.CheckEncoding(obj.EncodingHashtable) {
+		t.Fatal("the hash is not a hashtable")
+	}
+	if !rdb.saveObjectType(hmap) || !rdb.saveHashObject(hmap) {
+		t.Fatal("save hashtable error")
+	}
+	flush(t, rdb)
+	if typ := rdb.loadType(); typ != rdbTypeHash {
+		t.Fatalf("saved as type %d", typ)
+	}
+	robj, err := rdb.loadHashTableObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !robj.CheckEncoding(obj.EncodingHashtable) || hash.Len(robj) != 1000 {
+		t.Fatalf("encoding %d, %d fields", robj.Encoding(), hash.Len(robj))
+	}
+	if val, _ := hash.Get(robj, []byte("999")); string(val) != "1998" {
+		t.Errorf("field 999 is %q", val)
+	}
+}
+
+// TestSaveLoadHashFieldExpires saves the hashes with field expires in the
+// formats of Redis 7.4, the fields already expired are not loaded.
+func TestSaveLoadHashFieldExpires(t *testing.T) {
+	now := time.Now().UnixMilli()
+	for _, tc := range []struct {
+		fields int
+		typ    uint8
+	}{
+		{3, rdbTypeHashListpackEx},
+		{1000, rdbTypeHashMetadata},
+	} {
+		rdb := newMockRdb(t)
+		hmap := hash.NewRobj(hash.NewZipmap())
+		for i := range tc.fields {
+			hash.Set(hmap, []byte(strconv.Itoa(i)), []byte("v"))
+		}
+		hash.SetExpire(hmap, []byte("1"), now+20000)
+		hash.SetExpire(hmap, []byte("2"), now+10000)
+		hash.SetExpire(hmap, []byte("0"), now-1)
+		if !rdb.saveObjectType(hmap) || !rdb.saveHashObject(hmap) {
+			t.Fatal("save hash error")
+		}
+		flush(t, rdb)
+		if typ := rdb.loadType(); typ != tc.typ {
+			t.Fatalf("saved as type %d, %d expected", typ, tc.typ)
+		}
+		robj, err := rdb.loadObject(tc.typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash.Len(robj) != int64(tc.fields-1) || hash.Exists(robj, []byte("0")) {
+			t.Errorf("type %d: %d fields loaded", tc.typ, hash.Len(robj))
+		}
+		if hash.GetExpire(robj, []byte("1")) != now+20000 || hash.GetExpire(robj, []byte("2")) != now+10000 {
+			t.Errorf("type %d: expires %d and %d", tc.typ,
+				hash.GetExpire(robj, []byte("1")), hash.GetExpire(robj, []byte("2")))
+		}
+		if v, _ := hash.Get(robj, []byte("2")); string(v) != "v" || hash.GetExpire(robj, []byte("3")) != hash.NoExpire {
+			t.Errorf("type %d: field 2 is %q", tc.typ, v)
+		}
+	}
+}
+
+func TestSaveLoadCksum(t *testing.T) {
+	rdb := newMockRdb(t)
+	snap := rdb.db.Snapshot()
+	defer snap.Release()
+	if err := rdb.save(context.Background(), snap); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile("rdb.file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cksum := binary.LittleEndian.Uint64(content[len(content)-8:]); cksum != rio.Crc64(0, content[:len(content)-8]) {
+		t.Errorf("saved cksum: %x want: %x", cksum, rio.Crc64(0, content[:len(content)-8]))
+	}
+
+	load := func(content []byte, cksum bool) error {
+		rd, err := rio.NewStreamReader(bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := rdb.info
+		info.cksum = cksum
+		return (&Rdber{rd: rd, db: db.New(), info: info}).load()
+	}
+	if err := load(content, true); err != nil {
+		t.Errorf("load: %v", err)
+	}
+
+	// Corrupt the value of key1.
+	corrupted := bytes.Replace(content, []byte("val1"), []byte("val2"), 1)
+	if err := load(corrupted, true); err == nil {
+		t.Error("corrupted RDB loaded")
+	}
+	if err := load(corrupted, false); err != nil {
+		t.Errorf("load with rdbchecksum no: %v", err)
+	}
+}
+
+func TestSaveLoadLzfString(t *testing.T) {
+	testcases := []struct {
+		str        string
+		compressed bool
+	}{
+		{str: strings.Repeat("a", 20), compressed: false},
+		{str: strings.Repeat("hello", 20), compressed: true},
+		{str: "abcdefghijklmnopqrstuvwxyz", compressed: false},
+	}
+	for _, tc := range testcases {
+		rdb := newMockRdb(t)
+		if !rdb.saveString(tc.str) {
+			t.Fatal("save string error")
+		}
+		flush(t, rdb)
+		content, err := os.ReadFile("rdb.file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := content[0] == rdbEncval<<6|rdbEncLzf; compressed != tc.compressed {
+			t.Errorf("%q compressed: %v want: %v", tc.str, compressed, tc.compressed)
+		}
+		v, ok := rdb.genericLoadStringObject().([]byte)
+		if !ok || string(v) != tc.str {
+			t.Errorf("load string: %q want: %q", v, tc.str)
+		}
+	}
+}
+
+// loadFixture loads a RDB file of testdata in a new db, the sets and the
+// sorted sets are skipped.
+func loadFixture(t *testing.T, name string) (*db.DB, error) {
+	file, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	mdb := db.New()
+	info := newRdberInfo(networking.NewServer())
+	info.skipUnsupported = true
+	rdb, err := newRdbSaver(file, 'r', mdb, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mdb, rdb.load()
+}
+
+// dumpValue returns the elements of a list, the fields and values of a hash,
+// or the value of a string.
+func dumpValue(val *obj.Robj) []string {
+	var res []string
+	switch val.Type() {
+	case obj.TypeString:
+		if val.CheckEncoding(obj.EncodingInt) {
+			return []string{strconv.FormatInt(val.Val().(int64), 10)}
+		}
+		return []string{string(val.Val().(sds.SDS))}
+	case obj.TypeList:
+		for iter := list.NewIterator(val); iter.HasNext(); {
+			res = append(res, string(iter.Next().([]byte)))
+		}
+	case obj.TypeHash:
+		for iter := hash.NewIterator(val); iter.HasNext(); {
+			kv := iter.Next().(hash.KVPair)
+			res = append(res, string(kv[0]), string(kv[1]))
+		}
+	}
+	return res
+}
+
+func TestLoadRdbFixtures(t *testing.T) {
+	testcases := []struct {
+		fixture string
+		keys    map[string][]string
+		missing []string
+		expires []string
+	}{
+		{
+			fixture: "v11-listpack.rdb",
+			keys: map[string][]string{
+				"str":    {"hello"},
+				"int":    {"12345"},
+				"lzf":    {strings.Repeat("abc", 10)},
+				"expire": {"v"},
+				"idle":   {"v"},
+				"freq":   {"v"},
+				"list": {"a", "1", "-2", "300", "-5000", "70000", "hello world",
+					"1099511627776", "-1099511627776", "plain"},
+				"hash": {"f1", "v1", "f2", "2"},
+			},
+			missing: []string{"expired", "set", "intset", "zset"},
+			expires: []string{"expire"},
+		},
+		{
+			fixture: "v9-ziplist.rdb",
+			keys: map[string][]string{
+				"list":       {"x", "7", "-1", "-300", "100000", "-100000", "3000000000", "-5000000000"},
+				"hash":       {"f1", "v1", "f2", "10"},
+				"hashtable":  {"a", "1", "b", "2"},
+				"linkedlist": {"a", "b"},
+				"ziplist":    {"p", "q"},
+				"zipmap":     {"a", "b", "cc", "dd"},
+				"expiresec":  {"v"},
+				"db1":        {"v"},
+			},
+			missing: []string{"zset", "intset", "oldzset", "zset2", "oldset"},
+			expires: []string{"expiresec"},
+		},
+		{
+			fixture: "legacy.rdb",
+			keys: map[string][]string{
+				"list": {"a", "b", "3"},
+				"hash": {"f", "v"},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		mdb, err := loadFixture(t, tc.fixture)
+		if err != nil {
+			t.Errorf("load %s: %v", tc.fixture, err)
+			continue
+		}
+		for key, want := range tc.keys {
+			val, ok := mdb.LookupKeyRead(key)
+			if !ok {
+				t.Errorf("%s: key %q not loaded", tc.fixture, key)
+				continue
+			}
+			if got := dumpValue(val); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: key %q: %q want: %q", tc.fixture, key, got, want)
+			}
+		}
+		for _, key := range tc.missing {
+			if _, ok := mdb.LookupKeyRead(key); ok {
+				t.Errorf("%s: key %q should not be loaded", tc.fixture, key)
+			}
+		}
+		for _, key := range tc.expires {
+			if mdb.Expire(key) <= 0 {
+				t.Errorf("%s: key %q has no expire", tc.fixture, key)
+			}
+		}
+	}
+}
+
+func TestLoadRdbErrors(t *testing.T) {
+	content, err := os.ReadFile("testdata/v11-listpack.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The header, the aux fields and the select of the db.
+	header := content[:bytes.Index(content, []byte("\x00\x03str"))]
+	withCksum := func(p []byte) []byte {
+		p = append(p, rdbOpcodeEOF)
+		return binary.LittleEndian.AppendUint64(p, rio.Crc64(0, p))
+	}
+
+	testcases := []struct {
+		name    string
+		content []byte
+		err     string
+		// strict fails the load on the sets and the sorted sets.
+		strict bool
+	}{
+		{
+			name:    "set",
+			content: withCksum(append(bytes.Clone(header), rdbTypeSet, 1, 's', 1, 1, 'a')),
+			err:     `key "s" is a set, which is not supported`,
+			strict:  true,
+		},
+		{
+			name:    "version",
+			content: []byte("REDIS0099"),
+			err:     "can't handle RDB format version 99",
+		},
+		{
+			name:    "checksum",
+			content: bytes.Replace(content, []byte("hello"), []byte("hellO"), 1),
+			err:     "wrong RDB checksum",
+		},
+		{
+			name:    "stream",
+			content: withCksum(append(bytes.Clone(header), rdbTypeStreamListpacks3, 1, 's')),
+			err:     "streams are not supported",
+		},
+		{
+			name:    "module",
+			content: withCksum(append(bytes.Clone(header), rdbTypeModule2, 1, 'm')),
+			err:     "module types are not supported",
+		},
+		{
+			name:    "unknown type",
+			content: withCksum(append(bytes.Clone(header), 100, 1, 'u')),
+			err:     "unknown RDB encoding type 100",
+		},
+		{
+			name:    "bad listpack",
+			content: withCksum(append(bytes.Clone(header), rdbTypeHashListpack, 1, 'h', 3, 1, 2, 3)),
+			err:     "bad encoded hash",
+		},
+		{
+			// Whatever was being read when the file ends.
+			name:    "truncated",
+			content: content[:len(content)/2],
+			err:     "",
+		},
+	}
+
+	for _, tc := range testcases {
+		rd, err := rio.NewStreamReader(bytes.NewReader(tc.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := newRdberInfo(networking.NewServer())
+		info.skipUnsupported = !tc.strict
+		err = (&Rdber{rd: rd, db: db.New(), info: info}).load()
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: err %v want: %s", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestLoadTruncatedRdb(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	for _, fixture := range []string{"v11-listpack.rdb", "v9-ziplist.rdb", "legacy.rdb"} {
+		content, err := os.ReadFile("testdata/" + fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < len(content); n++ {
+			rd, err := rio.NewStreamReader(bytes.NewReader(content[:n]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := newRdberInfo(networking.NewServer())
+			info.skipUnsupported = true
+			if err = (&Rdber{rd: rd, db: db.New(), info: info}).load(); err == nil {
+				t.Errorf("%s truncated at %d bytes loaded", fixture, n)
+			}
+		}
+	}
+}
+
+func TestDumpRestoreObject(t *testing.T) {
+	srv := networking.NewServer()
+	d := New()
+	l := list.NewRobj(list.NewQuicklist())
+	list.Push(l, []byte("a"))
+	list.Push(l, []byte("b"))
+	h := hash.NewRobj(hash.NewZipmap())
+	hash.Set(h, []byte("field"), []byte("value"))
+	for _, val := range []*obj.Robj{sds.NewRobj(sds.New([]byte("hello"))), sds.NewRobj(int64(42)), l, h} {
+		payload := d.DumpObject(srv, val)
+		restored, err := d.RestoreObject(srv, payload)
+		if err != nil {
+			t.Fatalf("restore %v: %v", dumpValue(val), err)
+		}
+		if !reflect.DeepEqual(dumpValue(restored), dumpValue(val)) {
+			t.Errorf("restored %v want: %v", dumpValue(restored), dumpValue(val))
+		}
+	}
+
+	payload := d.DumpObject(srv, sds.NewRobj(sds.New([]byte("hello"))))
+	corrupted := bytes.Clone(payload)
+	corrupted[2]++
+	if _, err := d.RestoreObject(srv, corrupted); err != errDumpPayload {
+		t.Errorf("corrupted payload: %v", err)
+	}
+	newer := bytes.Clone(payload)
+	binary.LittleEndian.PutUint16(newer[len(newer)-10:], rdbMaxLoadVersion+1)
+	binary.LittleEndian.PutUint64(newer[len(newer)-8:], rio.Crc64(0, newer[:len(newer)-8]))
+	if _, err := d.RestoreObject(srv, newer); err != errDumpPayload {
+		t.Errorf("payload of a newer version: %v", err)
+	}
+	// A payload with trailing data after the value.
+	trailing := append(bytes.Clone(payload[:len(payload)-10]), 'x')
+	trailing = binary.LittleEndian.AppendUint16(trailing, 9)
+	trailing = binary.LittleEndian.AppendUint64(trailing, rio.Crc64(0, trailing))
+	if _, err := d.RestoreObject(srv, trailing); err != errBadDumpPayload {
+		t.Errorf("payload with trailing data: %v", err)
+	}
+}
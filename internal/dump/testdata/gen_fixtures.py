@@ -0,0 +1,194 @@
+#!/usr/bin/env python3
+"""Generates the RDB fixtures of the loading tests.
+
+The files are encoded by hand after the description of the RDB format, of
+version 9 (ziplists) and 11 (listpacks), and of the old versions of RDB. They
+are not dumps of redis-server, so they only check that the loader follows our
+reading of the format, not the compatibility with the files of Redis.
+Run it from this directory: python3 gen_fixtures.py
+"""
+import struct
+
+POLY = 0x95AC9329AC4BC9B5
+
+
+def crc64(data):
+    crc = 0
+    for b in data:
+        crc ^= b
+        for _ in range(8):
+            crc = (crc >> 1) ^ POLY if crc & 1 else crc >> 1
+    return crc
+
+
+assert crc64(b"123456789") == 0xE9C6D914C4B8D9CA
+
+
+def rdb_len(n):
+    if n < 1 << 6:
+        return bytes([n])
+    if n < 1 << 14:
+        return bytes([0x40 | n >> 8, n & 0xFF])
+    if n <= 0xFFFFFFFF:
+        return b"\x80" + struct.pack(">I", n)
+    return b"\x81" + struct.pack(">Q", n)
+
+
+def rdb_str(s):
+    if isinstance(s, int):
+        if -(1 << 7) <= s < 1 << 7:
+            return b"\xc0" + struct.pack("<b", s)
+        if -(1 << 15) <= s < 1 << 15:
+            return b"\xc1" + struct.pack("<h", s)
+        return b"\xc2" + struct.pack("<i", s)
+    if isinstance(s, str):
+        s = s.encode()
+    return rdb_len(len(s)) + s
+
+
+def rdb_lzf(s, compressed):
+    return b"\xc3" + rdb_len(len(compressed)) + rdb_len(len(s)) + compressed
+
+
+def aux(k, v):
+    return b"\xfa" + rdb_str(k) + rdb_str(v)
+
+
+def ziplist(entries):
+    body, prevlen, tail = b"", 0, 10
+    for e in entries:
+        pl = bytes([prevlen]) if prevlen < 254 else b"\xfe" + struct.pack("<I", prevlen)
+        if isinstance(e, int):
+            if 0 <= e <= 12:
+                enc = bytes([0xF1 + e])
+            elif -(1 << 7) <= e < 1 << 7:
+                enc = b"\xfe" + struct.pack("<b", e)
+            elif -(1 << 15) <= e < 1 << 15:
+                enc = b"\xc0" + struct.pack("<h", e)
+            elif -(1 << 23) <= e < 1 << 23:
+                enc = b"\xf0" + struct.pack("<i", e)[:3]
+            elif -(1 << 31) <= e < 1 << 31:
+                enc = b"\xd0" + struct.pack("<i", e)
+            else:
+                enc = b"\xe0" + struct.pack("<q", e)
+        else:
+            e = e.encode()
+            if len(e) <= 0x3F:
+                enc = bytes([len(e)]) + e
+            elif len(e) <= 0x3FFF:
+                enc = bytes([0x40 | len(e) >> 8, len(e) & 0xFF]) + e
+            else:
+                enc = b"\x80" + struct.pack(">I", len(e)) + e
+        tail = 10 + len(body)
+        entry = pl + enc
+        body += entry
+        prevlen = len(entry)
+    return struct.pack("<IIH", 10 + len(body) + 1, tail, len(entries)) + body + b"\xff"
+
+
+def backlen(l):
+    if l <= 127:
+        return bytes([l])
+    if l < 16383:
+        return bytes([l >> 7, (l & 127) | 128])
+    return bytes([l >> 14, ((l >> 7) & 127) | 128, (l & 127) | 128])
+
+
+def listpack(entries):
+    body = b""
+    for e in entries:
+        if isinstance(e, int):
+            if 0 <= e <= 127:
+                enc = bytes([e])
+            elif -4096 <= e <= 4095:
+                u = e & 0x1FFF
+                enc = bytes([0xC0 | u >> 8, u & 0xFF])
+            elif -(1 << 15) <= e < 1 << 15:
+                enc = b"\xf1" + struct.pack("<h", e)
+            elif -(1 << 23) <= e < 1 << 23:
+                enc = b"\xf2" + struct.pack("<i", e)[:3]
+            elif -(1 << 31) <= e < 1 << 31:
+                enc = b"\xf3" + struct.pack("<i", e)
+            else:
+                enc = b"\xf4" + struct.pack("<q", e)
+        else:
+            e = e.encode()
+            if len(e) < 64:
+                enc = bytes([0x80 | len(e)]) + e
+            elif len(e) < 4096:
+                enc = bytes([0xE0 | len(e) >> 8, len(e) & 0xFF]) + e
+            else:
+                enc = b"\xf0" + struct.pack("<I", len(e)) + e
+        body += enc + backlen(len(enc))
+    return struct.pack("<IH", 6 + len(body) + 1, len(entries)) + body + b"\xff"
+
+
+def intset(values):
+    return struct.pack("<II", 2, len(values)) + b"".join(struct.pack("<h", v) for v in values)
+
+
+def finish(name, data, cksum=True):
+    data += b"\xff"
+    data += struct.pack("<Q", crc64(data) if cksum else 0)
+    with open(name, "wb") as f:
+        f.write(data)
+
+
+FUTURE_MS = 4102444800000  # 2100-01-01
+PAST_MS = 946684800000  # 2000-01-01
+FUTURE_S = 2000000000  # 2033-05-18
+
+# Version 11: listpacks, quicklist2, functions and module aux data.
+d = b"REDIS0011"
+d += aux("redis-ver", "7.2.4") + aux("redis-bits", 64) + aux("ctime", 1700000000)
+d += aux("used-mem", 1000000) + aux("aof-base", 0)
+d += b"\xf5" + rdb_str("#!lua name=mylib\nredis.register_function('f', function() return 1 end)")
+d += b"\xf7" + b"\x81" + struct.pack(">Q", 0x1234567890ABC00) + rdb_len(2) + rdb_len(2)
+d += rdb_len(2) + rdb_len(42) + rdb_len(5) + rdb_str("x") + rdb_len(4) + struct.pack("<d", 1.5) + rdb_len(0)
+d += b"\xfe" + rdb_len(0) + b"\xfb" + rdb_len(10) + rdb_len(2)
+d += b"\x00" + rdb_str("str") + rdb_str("hello")
+d += b"\x00" + rdb_str("int") + rdb_str(12345)
+# "abc" * 10: the literal "abc", then 27 bytes at offset 3.
+d += b"\x00" + rdb_str("lzf") + rdb_lzf(b"abc" * 10, b"\x02abc\xe0\x12\x02")
+d += b"\xfc" + struct.pack("<q", FUTURE_MS) + b"\x00" + rdb_str("expire") + rdb_str("v")
+d += b"\xfc" + struct.pack("<q", PAST_MS) + b"\x00" + rdb_str("expired") + rdb_str("v")
+d += b"\xf8" + rdb_len(100) + b"\x00" + rdb_str("idle") + rdb_str("v")
+d += b"\xf9" + b"\x05" + b"\x00" + rdb_str("freq") + rdb_str("v")
+d += b"\x12" + rdb_str("list") + rdb_len(2)
+d += rdb_len(2) + rdb_str(listpack(["a", 1, -2, 300, -5000, 70000, "hello world", 1 << 40, -(1 << 40)]))
+d += rdb_len(1) + rdb_str("plain")
+d += b"\x10" + rdb_str("hash") + rdb_str(listpack(["f1", "v1", "f2", 2]))
+d += b"\x14" + rdb_str("set") + rdb_str(listpack(["a", "b"]))
+d += b"\x0b" + rdb_str("intset") + rdb_str(intset([1, 2, 3]))
+d += b"\x11" + rdb_str("zset") + rdb_str(listpack(["m", 1]))
+finish("v11-listpack.rdb", d)
+
+# Version 9: ziplists and quicklists, and the types of the older versions.
+d = b"REDIS0009"
+d += aux("redis-ver", "6.2.6") + aux("redis-bits", 64)
+d += b"\xfe" + rdb_len(0) + b"\xfb" + rdb_len(12) + rdb_len(1)
+d += b"\x0e" + rdb_str("list") + rdb_len(1)
+d += rdb_str(ziplist(["x", 7, -1, -300, 100000, -100000, 3000000000, -5000000000]))
+d += b"\x0d" + rdb_str("hash") + rdb_str(ziplist(["f1", "v1", "f2", 10]))
+d += b"\x0c" + rdb_str("zset") + rdb_str(ziplist(["m", 1]))
+d += b"\x0b" + rdb_str("intset") + rdb_str(intset([1, 2]))
+d += b"\x04" + rdb_str("hashtable") + rdb_len(2) + rdb_str("a") + rdb_str("1") + rdb_str("b") + rdb_str("2")
+d += b"\x01" + rdb_str("linkedlist") + rdb_len(2) + rdb_str("a") + rdb_str("b")
+d += b"\x03" + rdb_str("oldzset") + rdb_len(2) + rdb_str("m") + rdb_str("1.5") + rdb_str("n") + b"\xfe"
+d += b"\x05" + rdb_str("zset2") + rdb_len(1) + rdb_str("m") + struct.pack("<d", 2.5)
+d += b"\x02" + rdb_str("oldset") + rdb_len(2) + rdb_str("a") + rdb_str("b")
+d += b"\x0a" + rdb_str("ziplist") + rdb_str(ziplist(["p", "q"]))
+zipmap = b"\x02" + b"\x01a\x01\x00b" + b"\x02cc\x02\x02dd\x00\x00" + b"\xff"
+d += b"\x09" + rdb_str("zipmap") + rdb_str(zipmap)
+d += b"\xfd" + struct.pack("<i", FUTURE_S) + b"\x00" + rdb_str("expiresec") + rdb_str("v")
+d += b"\xfe" + rdb_len(1) + b"\x00" + rdb_str("db1") + rdb_str("v")
+finish("v9-ziplist.rdb", d)
+
+# The old versions of RDB: quicklists saved as lists, and ziplist hashes saved
+# as hashes preceded by their number of entries, without checksum.
+d = b"REDIS0009"
+d += aux("redis-ver", "9") + aux("redis-bits", "64")
+d += b"\xfe" + rdb_len(0)
+d += b"\x01" + rdb_str("list") + rdb_len(1) + rdb_str(ziplist(["a", "b", 3]))
+d += b"\x04" + rdb_str("hash") + rdb_len(2) + rdb_str(ziplist(["f", "v"]))
+finish("legacy.rdb", d, cksum=False)
@@ -0,0 +1,135 @@
+package hash
+
+import (
+	"maps"
+	"math"
+
+	obj "github.com/sunminx/RDB/internal/object"
+)
+
+// NoExpire is the expire of the fields without a TTL.
+const NoExpire int64 = -1
+
+// fieldExpires is the expires of the fields of a hash, as unix times in
+// milliseconds. The fields without a TTL aren't in m, which is nil while no
+// field has one.
+type fieldExpires struct {
+	m map[string]int64
+	// next is never after the earliest expire, so that no field expires
+	// before it. It is lowered as the expires are set, and it is moved to
+	// the earliest expire when the expired fields are deleted.
+	next int64
+}
+
+func (fe *fieldExpires) deepcopy() fieldExpires {
+	return fieldExpires{m: maps.Clone(fe.m), next: fe.next}
+}
+
+func (fe *fieldExpires) set(field []byte, when int64) {
+	if fe.m == nil {
+		fe.m = make(map[string]int64)
+		fe.next = when
+	}
+	fe.m[string(field)] = when
+	fe.next = min(fe.next, when)
+}
+
+func (fe *fieldExpires) get(field []byte) int64 {
+	if when, ok := fe.m[string(field)]; ok {
+		return when
+	}
+	return NoExpire
+}
+
+func (fe *fieldExpires) del(field []byte) bool {
+	if _, ok := fe.m[string(field)]; !ok {
+		return false
+	}
+	delete(fe.m, string(field))
+	if len(fe.m) == 0 {
+		fe.m = nil
+	}
+	return true
+}
+
+func expiresOf(robj *obj.Robj) *fieldExpires {
+	if robj.CheckEncoding(obj.EncodingZipmap) {
+		return &unwrap(robj).expires
+	} else if robj.CheckEncoding(obj.EncodingHashtable) {
+		return &unwrapHashtable(robj).expires
+	}
+	return nil
+}
+
+// SetExpire sets the expire of field, which must exist, as a unix time in
+// milliseconds.
+func SetExpire(robj *obj.Robj, field []byte, when int64) {
+	if fe := expiresOf(robj); fe != nil {
+		fe.set(field, when)
+	}
+}
+
+// GetExpire returns the expire of field, NoExpire if it has no TTL.
+func GetExpire(robj *obj.Robj, field []byte) int64 {
+	if fe := expiresOf(robj); fe != nil {
+		return fe.get(field)
+	}
+	return NoExpire
+}
+
+// Persist removes the TTL of field, and reports whether it had one.
+func Persist(robj *obj.Robj, field []byte) bool {
+	if fe := expiresOf(robj); fe != nil {
+		return fe.del(field)
+	}
+	return false
+}
+
+// NextExpire returns a time not after the earliest expire of the fields,
+// NoExpire if no field has a TTL. Any value may be passed, so that the
+// keyspace tells the hashes with field expires cheaply.
+func NextExpire(robj *obj.Robj) int64 {
+	if fe := expiresOf(robj); fe != nil && fe.m != nil {
+		return fe.next
+	}
+	return NoExpire
+}
+
+// MinExpire returns the earliest expire of the fields, NoExpire if no field
+// has a TTL.
+func MinExpire(robj *obj.Robj) int64 {
+	fe := expiresOf(robj)
+	if fe == nil || fe.m == nil {
+		return NoExpire
+	}
+	earliest := int64(math.MaxInt64)
+	for _, when := range fe.m {
+		earliest = min(earliest, when)
+	}
+	return earliest
+}
+
+// ExpireFields deletes the fields expired at now, a unix time in
+// milliseconds, and returns them, so that their deletion is propagated. The
+// hash is left empty if all its fields are expired, it is up to the caller to
+// delete its key.
+func ExpireFields(robj *obj.Robj, now int64) [][]byte {
+	fe := expiresOf(robj)
+	if fe == nil || fe.m == nil || now < fe.next {
+		return nil
+	}
+	var expired [][]byte
+	next := int64(math.MaxInt64)
+	for field, when := range fe.m {
+		if when <= now {
+			Del(robj, []byte(field))
+			expired = append(expired, []byte(field))
+		} else {
+			next = min(next, when)
+		}
+	}
+	if fe.m != nil {
+		fe.next = next
+	}
+	return expired
+}
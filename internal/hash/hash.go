@@ -12,7 +12,19 @@ type hash interface {
 	Exists(*obj.Robj, []byte) bool
 }
 
+// A hash is a Zipmap while it has up to MaxListpackEntries fields, whose
+// fields and values are up to MaxListpackValue bytes. Past them it is
+// converted to a Hashtable, and is never converted back. They are set by
+// the hash-max-listpack-entries and hash-max-listpack-value directives.
+var (
+	MaxListpackEntries = 512
+	MaxListpackValue   = 64
+)
+
 func NewRobj(val any) *obj.Robj {
+	if _, ok := val.(*Hashtable); ok {
+		return obj.New(val, obj.TypeHash, obj.EncodingHashtable)
+	}
 	return obj.New(val, obj.TypeHash, obj.EncodingZipmap)
 }
 
@@ -20,34 +32,78 @@ func DeepCopy(robj *obj.Robj) *obj.Robj {
 	if robj.CheckEncoding(obj.EncodingZipmap) {
 		nzm := unwrap(robj).deepcopy()
 		return NewRobj(nzm)
+	} else if robj.CheckEncoding(obj.EncodingHashtable) {
+		return NewRobj(unwrapHashtable(robj).deepcopy())
 	}
 	return nil
 }
 
+// Set sets the value of field, the TTL of the field is removed, as a new
+// value is set.
 func Set(robj *obj.Robj, field, val []byte) {
+	SetKeepExpire(robj, field, val)
+	Persist(robj, field)
+}
+
+// SetKeepExpire sets the value of field and keeps its TTL, as the value
+// is updated, eg. by HINCRBY.
+func SetKeepExpire(robj *obj.Robj, field, val []byte) {
 	if robj.CheckEncoding(obj.EncodingZipmap) {
-		unwrap(robj).set(field, val)
+		if len(field) <= MaxListpackValue && len(val) <= MaxListpackValue {
+			zm := unwrap(robj)
+			zm.set(field, val)
+			if zm.HLen() > MaxListpackEntries {
+				convert(robj)
+			}
+			return
+		}
+		convert(robj)
+	}
+	if robj.CheckEncoding(obj.EncodingHashtable) {
+		unwrapHashtable(robj).set(field, val)
+	}
+}
+
+// convert converts a Zipmap to a Hashtable.
+func convert(robj *obj.Robj) {
+	zm := unwrap(robj)
+	ht := newHashtableWithSize(zm.HLen())
+	for iter := newZipmapIterator(zm); iter.HasNext(); {
+		kv := iter.next()
+		ht.set(kv[0], kv[1])
 	}
-	return
+	ht.expires = zm.expires
+	robj.SetVal(ht)
+	robj.SetEncoding(obj.EncodingHashtable)
 }
 
 func Get(robj *obj.Robj, field []byte) ([]byte, bool) {
 	if robj.CheckEncoding(obj.EncodingZipmap) {
-		return unwrap(robj).get(field), true
+		return unwrap(robj).get(field)
+	} else if robj.CheckEncoding(obj.EncodingHashtable) {
+		return unwrapHashtable(robj).get(field)
 	}
 	return nil, false
 }
 
-func Del(robj *obj.Robj, field []byte) {
+func Del(robj *obj.Robj, field []byte) bool {
+	deleted := false
 	if robj.CheckEncoding(obj.EncodingZipmap) {
-		unwrap(robj).del(field)
+		deleted = unwrap(robj).del(field)
+	} else if robj.CheckEncoding(obj.EncodingHashtable) {
+		deleted = unwrapHashtable(robj).del(field)
 	}
-	return
+	if deleted {
+		Persist(robj, field)
+	}
+	return deleted
 }
 
 func Len(robj *obj.Robj) int64 {
 	if robj.CheckEncoding(obj.EncodingZipmap) {
 		return int64(unwrap(robj).HLen())
+	} else if robj.CheckEncoding(obj.EncodingHashtable) {
+		return int64(unwrapHashtable(robj).HLen())
 	}
 	return 0
 }
@@ -55,20 +111,42 @@ func Len(robj *obj.Robj) int64 {
 func Exists(robj *obj.Robj, field []byte) bool {
 	if robj.CheckEncoding(obj.EncodingZipmap) {
 		return unwrap(robj).exists(field)
+	} else if robj.CheckEncoding(obj.EncodingHashtable) {
+		return unwrapHashtable(robj).exists(field)
 	}
 	return false
 }
 
+// Scan calls fn for the fields of the hash from cursor, and returns the
+// cursor of the next call, 0 once all the fields are scanned. count is the
+// number of the fields to scan, a zipmap is scanned all at once.
+func Scan(robj *obj.Robj, cursor uint64, count int, fn func(KVPair)) uint64 {
+	if robj.CheckEncoding(obj.EncodingZipmap) {
+		for iter := NewIterator(robj); iter.HasNext(); {
+			fn(iter.Next().(KVPair))
+		}
+	} else if robj.CheckEncoding(obj.EncodingHashtable) {
+		return unwrapHashtable(robj).scan(cursor, count, fn)
+	}
+	return 0
+}
+
 func unwrap(robj *obj.Robj) *Zipmap {
 	return robj.Val().(*Zipmap)
 }
 
+func unwrapHashtable(robj *obj.Robj) *Hashtable {
+	return robj.Val().(*Hashtable)
+}
+
 type KVPair [2][]byte
 
 func NewIterator(robj *obj.Robj) obj.Iterator {
 	if robj.CheckEncoding(obj.EncodingZipmap) {
 		zm := robj.Val().(*Zipmap)
 		return newZipmapIterator(zm)
+	} else if robj.CheckEncoding(obj.EncodingHashtable) {
+		return newHashtableIterator(unwrapHashtable(robj))
 	}
 	return nil
 }
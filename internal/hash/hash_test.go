@@ -0,0 +1,150 @@
+package hash
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	obj "github.com/sunminx/RDB/internal/object"
+)
+
+func TestConvertToHashtable(t *testing.T) {
+	o := NewRobj(NewZipmap())
+	for i := range MaxListpackEntries {
+		Set(o, []byte(strconv.Itoa(i)), []byte("v"))
+	}
+	if !o.CheckEncoding(obj.EncodingZipmap) {
+		t.Fatal("the hash is converted before its limit")
+	}
+	Set(o, []byte("1"), []byte("updated"))
+	Set(o, []byte("big"), []byte("v"))
+	if !o.CheckEncoding(obj.EncodingHashtable) || Len(o) != int64(MaxListpackEntries+1) {
+		t.Fatalf("encoding %d, %d fields", o.Encoding(), Len(o))
+	}
+	if v, ok := Get(o, []byte("1")); !ok || string(v) != "updated" {
+		t.Errorf("field 1 is %q", v)
+	}
+	if !Del(o, []byte("big")) || Del(o, []byte("big")) || Exists(o, []byte("big")) {
+		t.Error("field big is not deleted")
+	}
+
+	// The copy is not modified with the hash.
+	cp := DeepCopy(o)
+	Set(o, []byte("0"), []byte("w"))
+	if v, _ := Get(cp, []byte("0")); string(v) != "v" {
+		t.Errorf("the copy is modified, %q", v)
+	}
+	n := 0
+	for iter := NewIterator(cp); iter.HasNext(); {
+		kv := iter.Next().(KVPair)
+		if v, _ := Get(cp, kv[0]); string(v) != string(kv[1]) {
+			t.Errorf("field %s is %q, iterated %q", kv[0], v, kv[1])
+		}
+		n++
+	}
+	if n != MaxListpackEntries {
+		t.Errorf("%d fields iterated", n)
+	}
+}
+
+func TestConvertBigValue(t *testing.T) {
+	o := NewRobj(NewZipmap())
+	Set(o, []byte("a"), []byte("1"))
+	Set(o, []byte("b"), []byte(strings.Repeat("x", MaxListpackValue+1)))
+	if !o.CheckEncoding(obj.EncodingHashtable) || Len(o) != 2 {
+		t.Fatalf("encoding %d, %d fields", o.Encoding(), Len(o))
+	}
+	if v, _ := Get(o, []byte("a")); string(v) != "1" {
+		t.Errorf("field a is %q", v)
+	}
+}
+
+func TestScanHashtable(t *testing.T) {
+	o := NewRobj(NewZipmap())
+	const n = 1000
+	for i := range n {
+		Set(o, []byte(strconv.Itoa(i)), []byte("v"))
+	}
+	seen := make(map[string]bool)
+	cursor, calls := uint64(0), 0
+	for {
+		cursor = Scan(o, cursor, 10, func(kv KVPair) { seen[string(kv[0])] = true })
+		calls++
+		// The table is expanded and then shrunk during the scan.
+		switch calls {
+		case 5:
+			for i := n; i < 10*n; i++ {
+				Set(o, []byte(strconv.Itoa(i)), []byte("v"))
+			}
+		case 50:
+			for i := n; i < 10*n; i++ {
+				Del(o, []byte(strconv.Itoa(i)))
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	// The fields in the hash for the whole scan are returned.
+	for i := range n {
+		if !seen[strconv.Itoa(i)] {
+			t.Errorf("field %d is not scanned, %d calls", i, calls)
+		}
+	}
+	if calls < n/10/2 {
+		t.Errorf("the scan took %d calls, the count is not followed", calls)
+	}
+}
+
+func TestFieldExpires(t *testing.T) {
+	o := NewRobj(NewZipmap())
+	Set(o, []byte("a"), []byte("1"))
+	Set(o, []byte("b"), []byte("2"))
+	Set(o, []byte("c"), []byte("3"))
+	SetExpire(o, []byte("a"), 100)
+	SetExpire(o, []byte("b"), 200)
+	SetExpire(o, []byte("c"), 300)
+	if GetExpire(o, []byte("a")) != 100 || NextExpire(o) != 100 {
+		t.Fatalf("expire %d, next %d", GetExpire(o, []byte("a")), NextExpire(o))
+	}
+
+	// A new value removes the TTL, an updated one keeps it.
+	Set(o, []byte("c"), []byte("4"))
+	SetKeepExpire(o, []byte("b"), []byte("5"))
+	if GetExpire(o, []byte("c")) != NoExpire || GetExpire(o, []byte("b")) != 200 {
+		t.Errorf("expires %d and %d", GetExpire(o, []byte("c")), GetExpire(o, []byte("b")))
+	}
+	// The next expire may be before the earliest one.
+	if !Persist(o, []byte("a")) || Persist(o, []byte("a")) || NextExpire(o) != 100 || MinExpire(o) != 200 {
+		t.Errorf("next %d, min %d", NextExpire(o), MinExpire(o))
+	}
+
+	// The expires are copied with the hash, and kept by the conversion.
+	cp := DeepCopy(o)
+	Set(o, []byte("big"), []byte(strings.Repeat("x", MaxListpackValue+1)))
+	SetExpire(o, []byte("big"), 150)
+	if !o.CheckEncoding(obj.EncodingHashtable) || GetExpire(o, []byte("b")) != 200 {
+		t.Fatalf("encoding %d, expire %d", o.Encoding(), GetExpire(o, []byte("b")))
+	}
+	if GetExpire(cp, []byte("big")) != NoExpire || GetExpire(cp, []byte("b")) != 200 {
+		t.Error("the copy is modified")
+	}
+
+	if fields := ExpireFields(o, 99); len(fields) != 0 {
+		t.Errorf("%q expired at 99", fields)
+	}
+	fields := ExpireFields(o, 200)
+	slices.SortFunc(fields, bytes.Compare)
+	if len(fields) != 2 || string(fields[0]) != "b" || string(fields[1]) != "big" ||
+		Len(o) != 2 || Exists(o, []byte("b")) {
+		t.Errorf("%q expired at 200, %d left", fields, Len(o))
+	}
+	if NextExpire(o) != NoExpire || len(ExpireFields(o, 1000)) != 0 {
+		t.Errorf("next expire %d", NextExpire(o))
+	}
+	if fields := ExpireFields(cp, 1000); len(fields) != 1 || Len(cp) != 2 {
+		t.Errorf("%q of the copy expired, %d left", fields, Len(cp))
+	}
+}
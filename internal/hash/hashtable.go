@@ -0,0 +1,126 @@
+package hash
+
+import (
+	"bytes"
+
+	"github.com/sunminx/RDB/internal/datastruct"
+)
+
+// Hashtable is the encoding of the hashes too big to be a Zipmap, see
+// MaxListpackEntries and MaxListpackValue.
+type Hashtable struct {
+	d       *datastruct.Dict[[]byte]
+	expires fieldExpires
+}
+
+func NewHashtable() *Hashtable {
+	return &Hashtable{d: datastruct.NewDict[[]byte]()}
+}
+
+// newHashtableWithSize returns a hashtable with the buckets for size fields.
+func newHashtableWithSize(size int) *Hashtable {
+	ht := NewHashtable()
+	ht.d.Expand(size)
+	return ht
+}
+
+func (ht *Hashtable) deepcopy() *Hashtable {
+	nht := newHashtableWithSize(ht.HLen())
+	nht.expires = ht.expires.deepcopy()
+	for e := range ht.d.Iterator() {
+		nht.d.Add(e.Key, bytes.Clone(e.Val))
+	}
+	return nht
+}
+
+// set copies val, which may reference the query of a client.
+func (ht *Hashtable) set(field, val []byte) {
+	ht.d.Replace(string(field), bytes.Clone(val))
+}
+
+func (ht *Hashtable) get(field []byte) ([]byte, bool) {
+	return ht.d.Lookup(string(field))
+}
+
+// del shrinks the table once most of the buckets are empty, like Redis
+// does after HDEL.
+func (ht *Hashtable) del(field []byte) bool {
+	if !ht.d.Del(string(field)) {
+		return false
+	}
+	ht.d.ResizeIfNeeded()
+	return true
+}
+
+func (ht *Hashtable) exists(field []byte) bool {
+	_, ok := ht.d.Lookup(string(field))
+	return ok
+}
+
+func (ht *Hashtable) HLen() int {
+	return ht.d.Used()
+}
+
+// HashtableIterator iterates the fields of the hashtable at its creation, the
+// fields deleted after it are skipped.
+type HashtableIterator struct {
+	ht     *Hashtable
+	fields []string
+	idx    int
+}
+
+func newHashtableIterator(ht *Hashtable) *HashtableIterator {
+	fields := make([]string, 0, ht.HLen())
+	for e := range ht.d.Iterator() {
+		fields = append(fields, e.Key)
+	}
+	iter := &HashtableIterator{ht: ht, fields: fields}
+	iter.skipDeleted()
+	return iter
+}
+
+func (iter *HashtableIterator) skipDeleted() {
+	for iter.idx < len(iter.fields) {
+		if _, ok := iter.ht.d.Lookup(iter.fields[iter.idx]); ok {
+			return
+		}
+		iter.idx++
+	}
+}
+
+func (iter *HashtableIterator) HasNext() bool {
+	return iter.idx < len(iter.fields)
+}
+
+func (iter *HashtableIterator) Next() any {
+	return iter.next()
+}
+
+func (iter *HashtableIterator) next() KVPair {
+	field := iter.fields[iter.idx]
+	val, _ := iter.ht.d.Lookup(field)
+	kv := KVPair([2][]byte{[]byte(field), val})
+	iter.idx++
+	iter.skipDeleted()
+	return kv
+}
+
+// scan calls fn for the fields of the buckets from cursor, until count
+// fields are scanned or count*10 buckets are visited, and returns the cursor
+// of the next call, 0 once the scan is completed. Like SCAN in Redis, the
+// fields in the hashtable for the whole scan are returned at least once, see
+// datastruct.Dict.Scan.
+func (ht *Hashtable) scan(cursor uint64, count int, fn func(KVPair)) uint64 {
+	count = max(count, 1)
+	scanned := 0
+	for maxVisits := count * 10; maxVisits > 0 && scanned < count; maxVisits-- {
+		cursor = ht.d.Scan(cursor, func(e *datastruct.DictEntry[[]byte]) {
+			fn(KVPair([2][]byte{[]byte(e.Key), e.Val}))
+			scanned++
+		})
+		if cursor == 0 {
+			break
+		}
+	}
+	return cursor
+}
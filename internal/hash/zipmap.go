@@ -1,98 +1,86 @@
 package hash
 
 import (
-	"slices"
-
 	ds "github.com/sunminx/RDB/internal/datastruct"
 )
 
+// Zipmap is a small hash encoded in a listpack, the fields and the values
+// are stored next to each other: <field> <value> <field> <value> ...
 type Zipmap struct {
-	*ds.Ziplist
+	*ds.Listpack
+	expires fieldExpires
 }
 
 func NewZipmap() *Zipmap {
-	return &Zipmap{ds.NewZiplist()}
-}
-
-func (zp *Zipmap) deepcopy() *Zipmap {
-	zl := zp.Ziplist
-	nzl := zl.DeepCopy()
-	return &Zipmap{nzl}
+	return &Zipmap{Listpack: ds.NewListpack()}
 }
 
-func (zp *Zipmap) set(field, val []byte) {
-	var update bool
-	n := zp.Len()
-	if n > 0 {
-		idx, _ := zp.find(field)
-		if idx < n { // update
-			update = true
-			zp.ReplaceAtIndex(idx, val)
-		}
-	}
-
-	if !update {
-		zp.Push(field)
-		zp.Push(val)
-	}
+func (zm *Zipmap) deepcopy() *Zipmap {
+	return &Zipmap{Listpack: zm.Listpack.DeepCopy(), expires: zm.expires.deepcopy()}
 }
 
-func (zp *Zipmap) get(field []byte) (val []byte) {
-	n := zp.Len()
-	if n == 0 {
+func (zm *Zipmap) set(field, val []byte) {
+	if offset, ok := zm.find(field); ok {
+		offset, _ = zm.Next(offset)
+		zm.Replace(offset, val)
 		return
 	}
-	idx, offset := zp.find(field)
-	if idx >= n {
-		return
-	}
-	val, _ = zp.DecodeEntry(offset)
-	return val
+	zm.Append(field)
+	zm.Append(val)
 }
 
-func (zp *Zipmap) del(field []byte) {
-	if zp.Len() == 0 {
-		return
+// get returns the value of field, which references the zipmap, so it is
+// only valid until the zipmap is modified.
+func (zm *Zipmap) get(field []byte) ([]byte, bool) {
+	offset, ok := zm.find(field)
+	if !ok {
+		return nil, false
 	}
-	idx, _ := zp.find(field)
-	zp.RemoveHead(2, idx-1)
-	return
+	offset, _ = zm.Next(offset)
+	return zm.Get(offset), true
 }
 
-func (zp *Zipmap) exists(field []byte) bool {
-	n := zp.Len()
-	if n == 0 {
+func (zm *Zipmap) del(field []byte) bool {
+	offset, ok := zm.find(field)
+	if !ok {
 		return false
 	}
-	idx, _ := zp.find(field)
-	return idx < n
+	zm.DeleteRange(offset, 2)
+	return true
+}
+
+func (zm *Zipmap) exists(field []byte) bool {
+	_, ok := zm.find(field)
+	return ok
 }
 
-func (zp *Zipmap) HLen() uint16 {
-	return zp.Len() / 2
+func (zm *Zipmap) HLen() int {
+	return zm.Len() / 2
 }
 
-func (zp *Zipmap) find(field []byte) (uint16, uint32) {
-	iter := ds.NewZiplistIterator(zp.Ziplist)
-	for iter.HasNext() {
-		entry := iter.Next()
-		if slices.Compare(entry, field) == 0 {
-			break
-		}
+// find returns the offset of field, the values are skipped so that a value
+// equal to field isn't matched.
+func (zm *Zipmap) find(field []byte) (uint32, bool) {
+	offset, ok := zm.First()
+	if !ok {
+		return 0, false
 	}
-	return iter.Index(), iter.Offset()
+	return zm.Find(offset, field, 1)
 }
 
 type ZipmapIterator struct {
-	zlIter *ds.ZiplistIterator
+	zm     *Zipmap
+	offset uint32
+	more   bool
 }
 
 func newZipmapIterator(zm *Zipmap) *ZipmapIterator {
-	return &ZipmapIterator{ds.NewZiplistIterator(zm.Ziplist)}
+	offset, ok := zm.First()
+	return &ZipmapIterator{zm: zm, offset: offset, more: ok}
 }
 
 func (iter *ZipmapIterator) HasNext() bool {
-	return iter.zlIter.HasNext()
+	return iter.more
 }
 
 func (iter *ZipmapIterator) Next() any {
@@ -100,6 +88,9 @@ func (iter *ZipmapIterator) Next() any {
 }
 
 func (iter *ZipmapIterator) next() KVPair {
-	k, v := iter.zlIter.Next(), iter.zlIter.Next()
+	k := iter.zm.Get(iter.offset)
+	offset, _ := iter.zm.Next(iter.offset)
+	v := iter.zm.Get(offset)
+	iter.offset, iter.more = iter.zm.Next(offset)
 	return KVPair([2][]byte{k, v})
 }
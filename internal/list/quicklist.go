@@ -1,43 +1,56 @@
 package list
 
 import (
+	"bytes"
 	"math"
 
 	ds "github.com/sunminx/RDB/internal/datastruct"
-	. "github.com/sunminx/RDB/pkg/util"
+	"github.com/sunminx/RDB/pkg/lzf"
 )
 
+// The settings of the new quicklists, set by the list-max-listpack-size and
+// list-compress-depth directives.
+var (
+	// MaxListpackSize is the fill of the nodes: a positive number is the
+	// maximum number of entries of a node, -1 to -5 is the maximum size of
+	// its listpack, from 4 Kb to 64 Kb.
+	MaxListpackSize = -2
+	// CompressDepth is the number of the nodes at each end of a list which
+	// are never compressed, 0 disables the compression.
+	CompressDepth = 0
+)
+
+const (
+	// FillMax is the maximum number of entries of a node.
+	FillMax = 1 << 15
+	// CompressMax is the maximum compress depth.
+	CompressMax = 1<<16 - 1
+)
+
+// Quicklist is a linked list of listpacks. The nodes are never empty, a node
+// is unlinked when its last entry is removed.
+//
+// The nodes farther than compress from the head and the tail are kept LZF
+// compressed, since the lists are mostly accessed at their ends. They are
+// decompressed when they are accessed, see QuicklistNode.listpack.
 type Quicklist struct {
-	head *QuicklistNode
-	tail *QuicklistNode
-	cnt  uint64 // total count of all entries in all ziplists
-	ln   uint64 // number of quicklistNodes
+	head     *QuicklistNode
+	tail     *QuicklistNode
+	cnt      uint64 // total count of all entries in all listpacks
+	ln       uint64 // number of quicklistNodes
+	fill     int
+	compress int
 }
 
 func NewQuicklist() *Quicklist {
-	return &Quicklist{}
+	return &Quicklist{fill: MaxListpackSize, compress: CompressDepth}
 }
 
 func (ql *Quicklist) deepcopy() *Quicklist {
-	var head, prev, cur *QuicklistNode
-	nql := Quicklist{}
-	node := ql.head
-	for node != nil {
-		cur := node.deepcopy()
-		if head == nil {
-			head = cur
-		}
-		if prev != nil {
-			prev.next = cur
-			cur.prev = prev
-		}
-		prev = cur
-		node = node.next
+	nql := Quicklist{fill: ql.fill, compress: ql.compress}
+	for node := ql.head; node != nil; node = node.next {
+		nql.Link(node.deepcopy())
 	}
-	nql.head = head
-	nql.tail = cur
-	nql.cnt = ql.cnt
-	nql.ln = ql.ln
 	return &nql
 }
 
@@ -58,207 +71,286 @@ const (
 	quicklistTail = 1
 )
 
-func (ql *Quicklist) ReplaceAtIndex(index uint64, entry []byte) {
-	if index < 0 {
-		index = 0
-	}
+// seek returns the node of the entry at index, the listpack of the node,
+// see QuicklistNode.listpack, and the offset of the entry in it.
+func (ql *Quicklist) seek(index uint64) (*QuicklistNode, *ds.Listpack, uint32, bool) {
 	if index >= ql.cnt {
-		index = ql.cnt - 1
+		return nil, nil, 0, false
 	}
-
 	node := ql.head
-	for {
-		var step = Cond(index > math.MaxInt16, math.MaxInt16, index)
-		if uint16(step) < node.cnt {
-			break
-		}
-		index -= step
+	for index >= uint64(node.cnt) {
+		index -= uint64(node.cnt)
 		node = node.next
 	}
-	node.zl.ReplaceAtIndex(uint16(index), entry)
-	return
+	lp := node.listpack()
+	offset, ok := lp.Seek(int(index))
+	return node, lp, offset, ok
+}
+
+func (ql *Quicklist) ReplaceAtIndex(index uint64, entry []byte) {
+	if ql.cnt == 0 {
+		return
+	}
+	if index >= ql.cnt {
+		index = ql.cnt - 1
+	}
+	node, _, offset, _ := ql.seek(index)
+	node.decompressForUse()
+	node.lp.Replace(offset, entry)
+	node.update()
+	ql.recompressOnly(node)
 }
 
 func (ql *Quicklist) PushLeft(entry []byte) {
 	ql.insert(entry, quicklistHead)
-	return
 }
 
 func (ql *Quicklist) Push(entry []byte) {
 	ql.insert(entry, quicklistTail)
-	return
 }
 
 func (ql *Quicklist) insert(entry []byte, where int8) {
-	node := ql.getNodeOrCreateIfNeeded(uint32(len(entry)), where)
+	node := ql.getNodeOrCreateIfNeeded(entry, where)
+	node.decompressForUse()
 	node.insert(entry, where)
+	ql.recompressOnly(node)
 	ql.cnt++
-	return
 }
 
-func (ql *Quicklist) getNodeOrCreateIfNeeded(entrylen uint32, where int8) *QuicklistNode {
-	var node *QuicklistNode
-	if ql.ln == 0 {
-		node = newQuicklistNode()
-		ql.ln++
-		ql.head = node
-		ql.tail = node
+// getNodeOrCreateIfNeeded returns the node at where, or a new one linked at
+// where if the entry doesn't fit in it.
+func (ql *Quicklist) getNodeOrCreateIfNeeded(entry []byte, where int8) *QuicklistNode {
+	node := ql.tail
+	if where == quicklistHead {
+		node = ql.head
+	}
+	if node != nil && node.insertAllowed(entry, ql.fill) {
 		return node
 	}
 
-	if where == quicklistHead {
-		node = ql.head
-		if node == nil || !node.insertAllowed(entrylen) {
-			node = newQuicklistNode()
-			if ql.head == nil {
-				ql.head = node
-			} else {
-				head := ql.head
-				ql.head = node
-				head.prev = node
-				node.next = head
-			}
-			ql.ln++
-		}
-	} else if where == quicklistTail {
-		node = ql.tail
-		if node == nil || !node.insertAllowed(entrylen) {
-			node = newQuicklistNode()
-			if ql.tail == nil {
-				ql.tail = node
-			} else {
-				tail := ql.tail
-				ql.tail = node
-				node.prev = tail
-				tail.next = node
-			}
-			ql.ln++
-		}
+	node = newQuicklistNode()
+	if ql.head == nil {
+		ql.head, ql.tail = node, node
+	} else if where == quicklistHead {
+		node.next = ql.head
+		ql.head.prev = node
+		ql.head = node
+	} else {
+		node.prev = ql.tail
+		ql.tail.next = node
+		ql.tail = node
 	}
+	ql.ln++
+	ql.compressAround(node)
 	return node
 }
 
+// Link appends node at the tail.
 func (ql *Quicklist) Link(node *QuicklistNode) {
 	if ql.tail == nil {
-		ql.tail = node
-	} else {
-		tail := ql.tail
-		ql.tail = node
-		tail.next = node
-		node.prev = tail
-	}
-	if ql.head == nil {
 		ql.head = node
+	} else {
+		ql.tail.next = node
+		node.prev = ql.tail
 	}
+	ql.tail = node
 	ql.ln += 1
 	ql.cnt += uint64(node.cnt)
+	ql.compressAround(node)
+}
+
+func (ql *Quicklist) unlink(node *QuicklistNode) {
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		ql.head = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		ql.tail = node.prev
+	}
+	node.prev, node.next = nil, nil
+	ql.ln--
+	// The nodes beyond the depth may now be at the ends.
+	ql.compressAround(nil)
+}
+
+// compressAround keeps the nodes within the compress depth of the ends
+// decompressed, and compresses node, and the nodes just beyond the depth,
+// which may have been moved there by an insertion or a deletion.
+func (ql *Quicklist) compressAround(node *QuicklistNode) {
+	if ql.compress == 0 || ql.ln < uint64(ql.compress*2) {
+		return
+	}
+	forward, reverse := ql.head, ql.tail
+	inDepth := false
+	for depth := 0; depth < ql.compress; depth++ {
+		forward.decompress()
+		reverse.decompress()
+		if forward == node || reverse == node {
+			inDepth = true
+		}
+		// The depths of the two ends met, all the nodes are in depth.
+		if forward == reverse || forward.next == reverse {
+			return
+		}
+		forward, reverse = forward.next, reverse.prev
+	}
+	if node != nil && !inDepth {
+		node.compress()
+	}
+	forward.compress()
+	reverse.compress()
+}
+
+// recompressOnly compresses node again if it was decompressed to be
+// modified, see QuicklistNode.decompressForUse.
+func (ql *Quicklist) recompressOnly(node *QuicklistNode) {
+	if node.recompress {
+		node.compress()
+	}
 }
 
 type QuicklistNode struct {
-	prev    *QuicklistNode
-	next    *QuicklistNode
-	zl      *ds.Ziplist
-	zlbytes uint32 // ziplist size in bytes
-	cnt     uint16 // cnt of items in ziplist
-	fill    uint16
+	prev *QuicklistNode
+	next *QuicklistNode
+	lp   *ds.Listpack // nil if the node is compressed
+	// lzf is the compressed listpack.
+	lzf []byte
+	sz  uint32 // listpack size in bytes
+	cnt uint16 // cnt of items in listpack
+	// recompress is set when the node was decompressed to be modified.
+	recompress bool
 }
 
 func newQuicklistNode() *QuicklistNode {
-	zl := ds.NewZiplist()
-	return &QuicklistNode{
-		zl:      zl,
-		zlbytes: zl.Bytes(),
-		cnt:     zl.Len(),
-		fill:    2,
-	}
+	return CreateQuicklistNode(ds.NewListpack())
 }
 
-func CreateQuicklistNode(zl *ds.Ziplist) *QuicklistNode {
-	node := newQuicklistNode()
-	node.zl = zl
-	node.zlbytes = zl.Bytes()
-	node.cnt = zl.Len()
+// CreateQuicklistNode creates a node of the entries of lp.
+func CreateQuicklistNode(lp *ds.Listpack) *QuicklistNode {
+	node := &QuicklistNode{lp: lp}
+	node.update()
 	return node
 }
 
 func (n *QuicklistNode) deepcopy() *QuicklistNode {
-	zl := n.zl
-	nzl := zl.DeepCopy()
-	return CreateQuicklistNode(nzl)
+	if n.lp == nil {
+		return &QuicklistNode{lzf: bytes.Clone(n.lzf), sz: n.sz, cnt: n.cnt}
+	}
+	return CreateQuicklistNode(n.lp.DeepCopy())
 }
 
-func (n *QuicklistNode) List() *ds.Ziplist {
-	return n.zl
+// List returns the listpack of the node, a compressed node is decompressed
+// in a copy, so it is only read.
+func (n *QuicklistNode) List() *ds.Listpack {
+	return n.listpack()
 }
 
-func (n *QuicklistNode) Next() *QuicklistNode {
-	return n.next
+// Compressed returns the LZF compressed listpack of the node, and the size
+// of the listpack, false if the node is not compressed.
+func (n *QuicklistNode) Compressed() ([]byte, uint32, bool) {
+	return n.lzf, n.sz, n.lp == nil
 }
 
-func (n *QuicklistNode) insert(entry []byte, where int8) {
-	if where == quicklistHead {
-		n.zl.PushLeft(entry)
-	} else if where == quicklistTail {
-		n.zl.Push(entry)
+// Don't compress the listpacks smaller than minCompressBytes, nor keep a
+// compression which saves less than minCompressImprove bytes.
+const (
+	minCompressBytes   = 48
+	minCompressImprove = 8
+)
+
+// compress compresses the listpack, it is kept decompressed if it isn't
+// worth it.
+func (n *QuicklistNode) compress() {
+	n.recompress = false
+	if n.lp == nil || n.sz < minCompressBytes {
+		return
 	}
-	n.zlbytes = n.zl.Bytes()
-	n.cnt = n.zl.Len()
-	return
+	out := make([]byte, n.sz-minCompressImprove)
+	size := lzf.Compress(*n.lp, out)
+	if size == 0 {
+		return
+	}
+	n.lzf, n.lp = out[:size:size], nil
 }
 
-func (n *QuicklistNode) insertAllowed(_len uint32) bool {
-	elen := ds.ZiplistEntryEncodeLen(_len)
-	nzlbytes := n.zlbytes + elen
-	return quicklistNodeMeetsOptimizationLevel(nzlbytes, n.fill)
+func (n *QuicklistNode) decompress() {
+	if n.lp != nil {
+		return
+	}
+	n.lp = n.listpack()
+	n.lzf = nil
 }
 
-func (n *QuicklistNode) mergeNeeded(neighborNode *QuicklistNode) bool {
-	if neighborNode == nil {
-		return false
+// decompressForUse decompresses the node to be modified, it is compressed
+// again after it, see Quicklist.recompressOnly.
+func (n *QuicklistNode) decompressForUse() {
+	if n.lp == nil {
+		n.decompress()
+		n.recompress = true
 	}
+}
 
-	mergeLen := n.zlbytes + neighborNode.zlbytes - 11
-	if quicklistNodeMeetsOptimizationLevel(mergeLen, n.fill) {
-		return true
-	} else if !quicklistNodeMeetsSafetyLimit(mergeLen) {
-		return false
-	} else if n.cnt+neighborNode.cnt < n.fill {
-		return true
-	} else {
-		return false
+// listpack returns the listpack of the node, which is decompressed in a new
+// listpack if the node is compressed. Only the node's own listpack can be
+// modified.
+func (n *QuicklistNode) listpack() *ds.Listpack {
+	if n.lp != nil {
+		return n.lp
+	}
+	lp := make(ds.Listpack, n.sz)
+	if size, err := lzf.Decompress(n.lzf, lp); err != nil || size != int(n.sz) {
+		// The compressed data are only produced by compress.
+		panic("quicklist: corrupted compressed node")
 	}
+	return &lp
 }
 
-var optimizationLevel = []uint32{4096, 8192, 16384, 32768, 65536}
-
-// var optimizationLevel = []int32{16, 64, 128, 512, 1024}
-
-func quicklistNodeMeetsOptimizationLevel(_len uint32, fill uint16) bool {
-	return _len < optimizationLevel[fill]
+func (n *QuicklistNode) Next() *QuicklistNode {
+	return n.next
 }
 
-const safetyLimit = uint32(8192)
-
-// const safetyLimit int32 = 64
-
-func quicklistNodeMeetsSafetyLimit(_len uint32) bool {
-	return _len < safetyLimit
+// update updates the size and the count of the node after its listpack is
+// modified.
+func (n *QuicklistNode) update() {
+	n.sz = n.lp.Bytes()
+	n.cnt = uint16(n.lp.Len())
 }
 
-func (n *QuicklistNode) insertEncoded(offset uint32, encoded []byte, _len uint16, headprevlen, tailLen uint32) {
-	n.zl.InsertEncoded(offset, encoded, _len, headprevlen, tailLen)
+func (n *QuicklistNode) insert(entry []byte, where int8) {
+	if where == quicklistHead {
+		n.lp.Prepend(entry)
+	} else if where == quicklistTail {
+		n.lp.Append(entry)
+	}
+	n.update()
 }
 
-func (n *QuicklistNode) extractEncoded() ([]byte, uint16, uint32, uint32) {
-	return n.zl.ExtractEncoded()
+func (n *QuicklistNode) insertAllowed(entry []byte, fill int) bool {
+	if n.cnt == math.MaxUint16 {
+		return false
+	}
+	return !quicklistNodeExceedsLimit(fill, n.sz+ds.ListpackEntrySize(entry), int(n.cnt)+1)
 }
 
-func (n *QuicklistNode) headOffset() uint32 {
-	return n.zl.HeadOffset()
-}
+// optimizationLevel is the maximum size of a listpack for the fills -1 to
+// -5.
+var optimizationLevel = []uint32{4096, 8192, 16384, 32768, 65536}
+
+// sizeSafetyLimit is the maximum size of a listpack when the fill is a
+// number of entries, so that the big entries don't make huge nodes.
+const sizeSafetyLimit = 8192
 
-func (n *QuicklistNode) endOffset() uint32 {
-	return n.zl.Bytes()
+// quicklistNodeExceedsLimit tells whether a node of sz bytes and count
+// entries exceeds the fill.
+func quicklistNodeExceedsLimit(fill int, sz uint32, count int) bool {
+	if fill < 0 {
+		level := min(-fill, len(optimizationLevel)) - 1
+		return sz > optimizationLevel[level]
+	}
+	return count > fill || sz > sizeSafetyLimit
 }
 
 func (ql *Quicklist) PopLeft() [][]byte {
@@ -269,176 +361,101 @@ func (ql *Quicklist) Pop() [][]byte {
 	return ql.remove(quicklistTail, 1, 0)
 }
 
+// remove removes num entries from where, after skipping skipnum entries, and
+// returns them.
 func (ql *Quicklist) remove(where int8, num, skipnum uint64) [][]byte {
-	if ql.cnt == 0 {
+	if skipnum >= ql.cnt {
 		return nil
 	}
-	var node, neighborNode *QuicklistNode
-	var removenum, skipenum, skipednum uint16
-	var pass bool
+	num = min(num, ql.cnt-skipnum)
 	if where == quicklistHead {
-		node = ql.head
-	} else if where == quicklistTail {
-		node = ql.tail
-	}
-	removeSlice := make([][]byte, 0)
-	for num > 0 {
-		var removes [][]byte
-		removenum = uint16(Cond(num > math.MaxInt16, math.MaxInt16, num))
-		skipenum = uint16(Cond(skipnum > math.MaxInt16, math.MaxInt16, skipnum))
-		if where == quicklistHead {
-			neighborNode = node.next
-			removes, skipednum, pass = node.zl.RemoveHead(removenum, skipenum)
-			if pass {
-				if skipednum == 0 {
-					ql.ln--
-					ql.head = neighborNode
-					node = ql.head
-				} else {
-					node = neighborNode
-				}
-			}
-		} else if where == quicklistTail {
-			neighborNode = node.prev
-			removes, skipednum, pass = node.zl.RemoveTail(removenum, skipenum)
-			if pass {
-				if skipednum == 0 {
-					ql.ln--
-					ql.tail = neighborNode
-				} else {
-					node = neighborNode
-				}
-			}
-		}
-		removedNum := uint64(0)
-		if removes != nil {
-			removedNum = uint64(len(removes))
-			removeSlice = append(removeSlice, removes...)
-		}
-		num -= removedNum
-		skipnum -= uint64(skipednum)
-		ql.cnt -= removedNum
-		if neighborNode == nil {
-			break
-		}
-	}
-
-	if node.mergeNeeded(neighborNode) {
-		if where == quicklistHead {
-			node = ql.unlinkHeadNode()
-			offset := node.headOffset()
-			encoded, ln, headprevlen, taillen := node.extractEncoded()
-			ql.head.insertEncoded(offset, encoded, ln, headprevlen, taillen)
-		} else if where == quicklistTail {
-			node = ql.unlinkTailNode()
-			offset := node.endOffset()
-			encoded, ln, headprevlen, taillen := node.extractEncoded()
-			ql.tail.insertEncoded(offset, encoded, ln, headprevlen, taillen)
-		}
+		return ql.delRange(skipnum, num)
 	}
-	return removeSlice
+	return ql.delRange(ql.cnt-skipnum-num, num)
 }
 
-func (ql *Quicklist) unlinkHeadNode() *QuicklistNode {
+// delRange removes count entries from the index start, and returns them.
+func (ql *Quicklist) delRange(start, count uint64) [][]byte {
 	node := ql.head
-	if node != nil {
-		ql.head = node.next
+	for node != nil && start >= uint64(node.cnt) {
+		start -= uint64(node.cnt)
+		node = node.next
 	}
-	return node
-}
-
-func (ql *Quicklist) unlinkTailNode() *QuicklistNode {
-	node := ql.tail
-	if node != nil {
-		ql.tail = node.prev
+	removed := make([][]byte, 0, min(count, ql.cnt))
+	for node != nil && count > 0 {
+		next := node.next
+		n := min(count, uint64(node.cnt)-start)
+		node.decompressForUse()
+		offset, _ := node.lp.Seek(int(start))
+		// The entries reference the listpack, they are copied before it is
+		// modified.
+		for i, off := uint64(0), offset; i < n; i++ {
+			removed = append(removed, bytes.Clone(node.lp.Get(off)))
+			off, _ = node.lp.Next(off)
+		}
+		node.lp.DeleteRange(offset, int(n))
+		node.update()
+		if node.cnt == 0 {
+			ql.unlink(node)
+		} else {
+			ql.recompressOnly(node)
+		}
+		ql.cnt -= n
+		count -= n
+		start = 0
+		node = next
 	}
-	return node
+	return removed
 }
 
+// Index returns the entry at idx, which references the list, so it is only
+// valid until the list is modified.
 func (ql *Quicklist) Index(idx uint64) ([]byte, bool) {
-	if idx >= ql.cnt {
+	_, lp, offset, ok := ql.seek(idx)
+	if !ok {
 		return nil, false
 	}
-	var entry []byte
-	iter := newQuicklistIterator(ql)
-	for iter.HasNext() {
-		entry = iter.next()
-		if idx == 0 {
-			break
-		}
-		idx--
-	}
-	return entry, true
+	return lp.Get(offset), true
 }
 
+// Range returns the entries from start to end, excluded.
 func (ql *Quicklist) Range(start, end uint64) (entrys [][]byte) {
+	end = min(end, ql.cnt)
 	if start >= end {
 		return
 	}
-	if start < 0 {
-		start = 0
-	}
-	if end > ql.cnt {
-		end = ql.cnt
-	}
-
-	var entry []byte
-	iter := newQuicklistIterator(ql)
-	for iter.HasNext() {
-		entry = iter.next()
-		if start < iter.idx {
-			entrys = append(entrys, entry)
-		}
-		if end <= iter.idx {
-			break
-		}
+	iter := ql.iteratorAt(start)
+	for iter.idx < end {
+		entrys = append(entrys, iter.next())
 	}
 	return
 }
 
+// Trim keeps the entries from start to end, excluded.
 func (ql *Quicklist) Trim(start, end uint64) {
-	if start >= end {
-		return
-	}
-	if start < 0 {
-		start = 0
-	}
-	if end > ql.cnt {
-		end = ql.cnt
-	}
-
-	removenum := start
-	ql.remove(quicklistHead, removenum, 0)
-	removenum = ql.cnt - end
-	ql.remove(quicklistTail, removenum, 0)
-	return
-}
-
-type quicklistNodeIterator struct {
-	*ds.ZiplistIterator
-}
-
-func newQuicklistNodeIterator(node *QuicklistNode) *quicklistNodeIterator {
-	return &quicklistNodeIterator{
-		ZiplistIterator: ds.NewZiplistIterator(node.zl),
-	}
+	end = min(end, ql.cnt)
+	start = min(start, end)
+	ql.delRange(end, ql.cnt-end)
+	ql.delRange(0, start)
 }
 
 type quicklistIterator struct {
-	list     *Quicklist
-	node     *QuicklistNode
-	nodeIter *quicklistNodeIterator
-	idx      uint64
+	list *Quicklist
+	node *QuicklistNode
+	// lp is the listpack of node, decompressed once for all its entries.
+	lp     *ds.Listpack
+	offset uint32
+	idx    uint64
 }
 
 func newQuicklistIterator(list *Quicklist) *quicklistIterator {
-	node := list.head
-	return &quicklistIterator{
-		list:     list,
-		node:     node,
-		nodeIter: newQuicklistNodeIterator(node),
-		idx:      0,
-	}
+	return list.iteratorAt(0)
+}
+
+// iteratorAt returns an iterator from the entry at index.
+func (ql *Quicklist) iteratorAt(index uint64) *quicklistIterator {
+	node, lp, offset, _ := ql.seek(index)
+	return &quicklistIterator{list: ql, node: node, lp: lp, offset: offset, idx: index}
 }
 
 func (iter *quicklistIterator) HasNext() bool {
@@ -450,10 +467,13 @@ func (iter *quicklistIterator) Next() any {
 }
 
 func (iter *quicklistIterator) next() []byte {
-	if !iter.nodeIter.HasNext() {
-		iter.node = iter.node.next
-		iter.nodeIter = newQuicklistNodeIterator(iter.node)
-	}
+	entry := iter.lp.Get(iter.offset)
 	iter.idx++
-	return iter.nodeIter.Next()
+	if offset, ok := iter.lp.Next(iter.offset); ok {
+		iter.offset = offset
+	} else if iter.node = iter.node.next; iter.node != nil {
+		iter.lp = iter.node.listpack()
+		iter.offset, _ = iter.lp.First()
+	}
+	return entry
 }
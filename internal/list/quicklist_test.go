@@ -1,6 +1,7 @@
 package list
 
 import (
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -25,7 +26,7 @@ func TestQuicklistPushWithCreateNewNode(t *testing.T) {
 	list.Push([]byte(strings.Repeat("eeeee", 6)))
 
 	for i := 0; i < 6; i++ {
-		entry, ok := list.Index(int64(i))
+		entry, ok := list.Index(uint64(i))
 		if ok {
 			//t.Log(string(entry.([]byte)))
 			t.Log(entry)
@@ -52,7 +53,7 @@ func TestQuicklistPop(t *testing.T) {
 	list.Pop()
 	t.Log(list.cnt)
 	for i := 0; i < 3; i++ {
-		entry, ok := list.Index(int64(i))
+		entry, ok := list.Index(uint64(i))
 		if ok {
 			//t.Log(string(entry.([]byte)))
 			t.Log(entry)
@@ -93,3 +94,131 @@ func TestQuicklistReplaceAtIndex(t *testing.T) {
 	entry, _ := list.Index(2)
 	t.Log(string(entry))
 }
+
+func TestQuicklistLarge(t *testing.T) {
+	list := NewQuicklist()
+	const n = 5000
+	for i := range n {
+		list.Push([]byte(strconv.Itoa(i)))
+		list.PushLeft([]byte(strings.Repeat("x", i%100)))
+	}
+	if list.Cnt() != 2*n || list.Len() < 2 {
+		t.Fatalf("%d entries in %d nodes", list.Cnt(), list.Len())
+	}
+	if entry, _ := list.Index(2*n - 1); string(entry) != strconv.Itoa(n-1) {
+		t.Errorf("last entry %q", entry)
+	}
+	list.ReplaceAtIndex(n, []byte("replaced"))
+	if entry, _ := list.Index(n); string(entry) != "replaced" {
+		t.Errorf("replaced entry %q", entry)
+	}
+
+	// Keep the entries 0 to n-1 of the tail.
+	list.Trim(n, 2*n)
+	if list.Cnt() != n {
+		t.Fatalf("%d entries after trim", list.Cnt())
+	}
+	popped := list.PopLeft()
+	if len(popped) != 1 || string(popped[0]) != "replaced" {
+		t.Errorf("popped %q", popped)
+	}
+	entries := list.Range(0, n)
+	if len(entries) != n-1 {
+		t.Fatalf("%d entries in range", len(entries))
+	}
+	for i, entry := range entries {
+		if string(entry) != strconv.Itoa(i+1) {
+			t.Fatalf("entry %d: %q", i, entry)
+		}
+	}
+	for list.Cnt() > 0 {
+		list.Pop()
+	}
+	if list.Len() != 0 || list.Head() != nil {
+		t.Errorf("%d nodes left", list.Len())
+	}
+}
+
+// compressedNodes returns the number of the compressed nodes, and fails if
+// a node within the depth is compressed.
+func compressedNodes(t *testing.T, ql *Quicklist) int {
+	t.Helper()
+	n, i := 0, uint64(0)
+	for node := ql.head; node != nil; node, i = node.next, i+1 {
+		if _, _, ok := node.Compressed(); ok {
+			if i < uint64(ql.compress) || i >= ql.ln-uint64(ql.compress) {
+				t.Fatalf("node %d of %d is compressed, depth %d", i, ql.ln, ql.compress)
+			}
+			n++
+		}
+	}
+	return n
+}
+
+func TestQuicklistCompress(t *testing.T) {
+	ql := &Quicklist{fill: 16, compress: 2}
+	const n = 2000
+	for i := range n {
+		if i%2 == 0 {
+			ql.Push([]byte("entry" + strconv.Itoa(i)))
+		} else {
+			ql.PushLeft([]byte("entry" + strconv.Itoa(i)))
+		}
+	}
+	if ql.ln != n/16 {
+		t.Errorf("%d nodes of 16 entries, %d expected", ql.ln, n/16)
+	}
+	if c := compressedNodes(t, ql); c != int(ql.ln)-4 {
+		t.Errorf("%d nodes of %d are compressed", c, ql.ln)
+	}
+
+	// The compressed nodes are read and modified transparently.
+	want := ql.deepcopy().Range(0, n)
+	if got, _ := ql.Index(n / 2); string(got) != string(want[n/2]) {
+		t.Errorf("entry %d: %q, %q expected", n/2, got, want[n/2])
+	}
+	ql.ReplaceAtIndex(n/2, []byte("replaced"))
+	want[n/2] = []byte("replaced")
+	ql.Trim(100, n-100)
+	want = want[100 : n-100]
+	entries := ql.Range(0, ql.Cnt())
+	if len(entries) != len(want) {
+		t.Fatalf("%d entries, %d expected", len(entries), len(want))
+	}
+	for i := range want {
+		if string(entries[i]) != string(want[i]) {
+			t.Fatalf("entry %d: %q, %q expected", i, entries[i], want[i])
+		}
+	}
+	compressedNodes(t, ql)
+
+	// The nodes are decompressed as the list shrinks.
+	for ql.Cnt() > 40 {
+		ql.Pop()
+	}
+	if c := compressedNodes(t, ql); c != 0 {
+		t.Errorf("%d nodes of %d are compressed", c, ql.ln)
+	}
+}
+
+func TestQuicklistFill(t *testing.T) {
+	for _, tc := range []struct {
+		fill  int
+		entry string
+		nodes uint64
+	}{
+		{fill: 100, entry: "x", nodes: 10},
+		{fill: -1, entry: strings.Repeat("x", 100), nodes: 26},
+		{fill: -5, entry: strings.Repeat("x", 100), nodes: 2},
+		// The nodes of a number of entries are limited in size too.
+		{fill: 1000, entry: strings.Repeat("x", 100), nodes: 13},
+	} {
+		ql := &Quicklist{fill: tc.fill}
+		for range 1000 {
+			ql.Push([]byte(tc.entry))
+		}
+		if ql.ln != tc.nodes {
+			t.Errorf("fill %d: %d nodes, %d expected", tc.fill, ql.ln, tc.nodes)
+		}
+	}
+}
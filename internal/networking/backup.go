@@ -0,0 +1,307 @@
+package networking
+
+// The backups of the RDB file. After a successful BGSAVE the RDB file is
+// linked, or copied when it can't be linked, into the backup-dir with the
+// time of the save in its name, next to a JSON file with its metadata.
+// A backup is complete once its metadata is written, so only the backups
+// with metadata are listed and restored.
+//
+// A backup is restored at startup: BACKUP RESTORE records its name in the
+// backup-dir, and the next startup copies it over the RDB file before
+// loading it.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// backupRestoreFile is the file in the backup-dir with the name of the
+// backup to restore at the next startup.
+const backupRestoreFile = "restore"
+
+// Backup is the metadata of a backup.
+type Backup struct {
+	Name string `json:"name"`
+	// Time is the unix time in milliseconds when the save started.
+	Time int64 `json:"time"`
+	Keys int   `json:"keys"`
+	Size int64 `json:"size"`
+	// Checksum is the SHA-256 of the RDB file.
+	Checksum string `json:"checksum"`
+	// Duration is the time in milliseconds taken by the save.
+	Duration int64 `json:"duration"`
+}
+
+func backupRdbPath(dir, name string) string {
+	return filepath.Join(dir, name+".rdb")
+}
+
+func backupMetaPath(dir, name string) string {
+	return filepath.Join(dir, name+".json")
+}
+
+// BackupRdbIfNeeded backs up the RDB file saved by the BGSAVE started at
+// start, according to backup-dir and backup-interval. The RDB file is
+// linked or opened before returning, so the next save can replace it at
+// any time, the rest is done in background.
+func (s *Server) BackupRdbIfNeeded(start, duration int64, keys int) {
+	if s.BackupDir == "" ||
+		(s.lastBackup != 0 && s.UnixTime-s.lastBackup < int64(s.BackupInterval)*1000) {
+		return
+	}
+	if err := os.MkdirAll(s.BackupDir, 0755); err != nil {
+		slog.Warn("can't create the backup dir", "dir", s.BackupDir, "err", err)
+		return
+	}
+	base := filepath.Base(s.RdbFilename)
+	meta := &Backup{
+		Name:     strings.TrimSuffix(base, filepath.Ext(base)) + "-" + time.UnixMilli(start).Format("20060102-150405.000"),
+		Time:     start,
+		Keys:     keys,
+		Duration: duration,
+	}
+	path := backupRdbPath(s.BackupDir, meta.Name)
+	src, err := os.Open(s.RdbFilename)
+	if err != nil {
+		slog.Warn("can't open the RDB file for backup", "err", err)
+		return
+	}
+	linked := os.Link(s.RdbFilename, path) == nil
+	s.lastBackup = s.UnixTime
+
+	dir, keep := s.BackupDir, s.BackupKeep
+	go func() {
+		defer src.Close()
+		if err := writeBackup(dir, src, linked, meta); err != nil {
+			slog.Warn("failed backup of the RDB file", "name", meta.Name, "err", err)
+			os.Remove(path)
+			return
+		}
+		slog.Info("RDB file backed up", "name", meta.Name)
+		if err := pruneBackups(dir, keep); err != nil {
+			slog.Warn("failed pruning the old backups", "err", err)
+		}
+	}()
+}
+
+// writeBackup copies src into the backup of meta, unless it is already
+// linked, and writes the metadata.
+func writeBackup(dir string, src *os.File, linked bool, meta *Backup) error {
+	h := sha256.New()
+	var err error
+	if linked {
+		meta.Size, err = io.Copy(h, src)
+	} else {
+		meta.Size, err = copyFile(backupRdbPath(dir, meta.Name), io.TeeReader(src, h))
+	}
+	if err != nil {
+		return err
+	}
+	meta.Checksum = hex.EncodeToString(h.Sum(nil))
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = copyFile(backupMetaPath(dir, meta.Name), bytes.NewReader(append(data, '\n')))
+	return err
+}
+
+// copyFile writes the content of src to a temp file, which is renamed
+// to path once it is synced.
+func copyFile(path string, src io.Reader) (int64, error) {
+	tempfile := path + ".tmp"
+	file, err := os.Create(tempfile)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(file, src)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tempfile, path)
+	}
+	if err != nil {
+		os.Remove(tempfile)
+		return 0, err
+	}
+	return n, nil
+}
+
+// listBackups returns the complete backups in dir, from the oldest.
+func listBackups(dir string) ([]*Backup, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]*Backup, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		meta := &Backup{}
+		if err := json.Unmarshal(data, meta); err != nil {
+			return nil, fmt.Errorf("invalid backup metadata %s: %w", name, err)
+		}
+		backups = append(backups, meta)
+	}
+	slices.SortFunc(backups, func(a, b *Backup) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return backups, nil
+}
+
+// pruneBackups removes the oldest backups in dir but the last keep ones,
+// keep is 0 means that all the backups are kept.
+func pruneBackups(dir string, keep int) error {
+	if keep == 0 {
+		return nil
+	}
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		name := backups[0].Name
+		// The metadata at first, so that a partially removed backup
+		// is not listed.
+		if err := os.Remove(backupMetaPath(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.Remove(backupRdbPath(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		slog.Info("old backup removed", "name", name)
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// findBackup returns the metadata of the backup, and verifies its checksum.
+func findBackup(dir, name string) (*Backup, error) {
+	if name == "" || filepath.Base(name) != name {
+		return nil, errors.New("invalid backup name")
+	}
+	backups, err := listBackups(dir)
+	if err != nil {
+		return nil, err
+	}
+	idx := slices.IndexFunc(backups, func(b *Backup) bool { return b.Name == name })
+	if idx == -1 {
+		return nil, fmt.Errorf("no such backup '%s'", name)
+	}
+	file, err := os.Open(backupRdbPath(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != backups[idx].Checksum {
+		return nil, fmt.Errorf("the checksum of the backup '%s' doesn't match", name)
+	}
+	return backups[idx], nil
+}
+
+// BackupList is the implementation of the BACKUP LIST command, every backup
+// is replied as the list of its metadata fields and values.
+func (c *Client) BackupList() error {
+	s := c.Server
+	if s.BackupDir == "" {
+		return errors.New("backup is disabled, set backup-dir to enable it")
+	}
+	backups, err := listBackups(s.BackupDir)
+	if err != nil {
+		return err
+	}
+	c.AddReplyMultibulkLen(int64(len(backups)))
+	for _, b := range backups {
+		c.AddReplyMultibulkLen(12)
+		c.addReplyBulkString("name")
+		c.addReplyBulkString(b.Name)
+		c.addReplyBulkString("time")
+		c.AddReplyInt64(b.Time)
+		c.addReplyBulkString("keys")
+		c.AddReplyInt64(int64(b.Keys))
+		c.addReplyBulkString("size")
+		c.AddReplyInt64(b.Size)
+		c.addReplyBulkString("checksum")
+		c.addReplyBulkString(b.Checksum)
+		c.addReplyBulkString("duration")
+		c.AddReplyInt64(b.Duration)
+	}
+	return nil
+}
+
+// BackupRestore is the implementation of the BACKUP RESTORE command, the
+// backup is restored at the next startup.
+func (c *Client) BackupRestore(name string) error {
+	s := c.Server
+	if s.BackupDir == "" {
+		return errors.New("backup is disabled, set backup-dir to enable it")
+	}
+	// The RDB file is not loaded at startup when the AOF is enabled.
+	if s.AofState != AofOff {
+		return errors.New("BACKUP RESTORE requires appendonly no")
+	}
+	if _, err := findBackup(s.BackupDir, name); err != nil {
+		return err
+	}
+	if _, err := copyFile(filepath.Join(s.BackupDir, backupRestoreFile), strings.NewReader(name+"\n")); err != nil {
+		return err
+	}
+	slog.Warn("backup will be restored at the next startup", "name", name)
+	return nil
+}
+
+// restoreBackupIfNeeded copies the backup recorded by BACKUP RESTORE over
+// the RDB file, it is called at startup before loading the RDB file.
+func (s *Server) restoreBackupIfNeeded() error {
+	if s.BackupDir == "" {
+		return nil
+	}
+	restoreFile := filepath.Join(s.BackupDir, backupRestoreFile)
+	data, err := os.ReadFile(restoreFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSpace(string(data))
+	meta, err := findBackup(s.BackupDir, name)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(backupRdbPath(s.BackupDir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := copyFile(s.RdbFilename, file); err != nil {
+		return err
+	}
+	if err := os.Remove(restoreFile); err != nil {
+		return err
+	}
+	slog.Info("backup restored", "name", name, "keys", meta.Keys,
+		"time", time.UnixMilli(meta.Time).Format(time.DateTime))
+	return nil
+}
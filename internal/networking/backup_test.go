@@ -0,0 +1,81 @@
+package networking
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestBackup(t *testing.T, dir, name, content string) {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := os.WriteFile(src, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := writeBackup(dir, file, false, &Backup{Name: name, Keys: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupPrune(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"dump-20240101-000000.000", "dump-20240102-000000.000", "dump-20240103-000000.000"} {
+		writeTestBackup(t, dir, name, name)
+	}
+	backups, err := listBackups(dir)
+	if err != nil || len(backups) != 3 || backups[0].Size != int64(len(backups[0].Name)) {
+		t.Fatalf("backups %+v err %v", backups, err)
+	}
+
+	if err := pruneBackups(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	backups, _ = listBackups(dir)
+	if len(backups) != 2 || backups[0].Name != "dump-20240102-000000.000" {
+		t.Errorf("backups after prune %+v", backups)
+	}
+	if _, err := os.Stat(backupRdbPath(dir, "dump-20240101-000000.000")); !os.IsNotExist(err) {
+		t.Errorf("the RDB file of the pruned backup is left: %v", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	c := NewMockClient(nil)
+	s := c.Server
+	s.BackupDir = t.TempDir()
+	s.RdbFilename = filepath.Join(t.TempDir(), "dump.rdb")
+	writeTestBackup(t, s.BackupDir, "dump-a", "backup")
+
+	if err := c.BackupRestore("../dump-a"); err == nil {
+		t.Error("invalid name accepted")
+	}
+	if err := c.BackupRestore("dump-b"); err == nil {
+		t.Error("missing backup accepted")
+	}
+	if err := c.BackupRestore("dump-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.restoreBackupIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(s.RdbFilename); err != nil || string(content) != "backup" {
+		t.Errorf("restored %q err %v", content, err)
+	}
+	// The backup is restored once.
+	if _, err := os.Stat(filepath.Join(s.BackupDir, backupRestoreFile)); !os.IsNotExist(err) {
+		t.Errorf("restore file left: %v", err)
+	}
+
+	// A corrupted backup is not restored.
+	if err := os.WriteFile(backupRdbPath(s.BackupDir, "dump-a"), []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BackupRestore("dump-a"); err == nil {
+		t.Error("corrupted backup accepted")
+	}
+}
@@ -0,0 +1,100 @@
+package networking
+
+// The background I/O workers, like the bio of Redis. The system calls which
+// may block for a long time, as the fsync of the AOF and the close and
+// unlink of the big files, are done by a dedicated goroutine for every kind
+// of job, in the order the jobs are created, so that the event loop is not
+// blocked.
+
+import (
+	"log/slog"
+	"os"
+)
+
+const (
+	// bioCloseFile closes and unlinks the files.
+	bioCloseFile = iota
+	// bioAofFsync fsyncs and closes the AOF files, the jobs on the same AOF
+	// file are done by one worker, so the file is never closed while an
+	// fsync on it is in progress.
+	bioAofFsync
+	// bioLazyFree releases the values deleted lazily, see lazyfree.go.
+	bioLazyFree
+	bioNumOps
+)
+
+// bioQueueSize is the max number of pending jobs of a worker, creating a
+// job blocks until the worker catches up beyond it.
+const bioQueueSize = 1024
+
+type bioJob func()
+
+// bioInit starts the workers, it is called by Init.
+func (s *Server) bioInit() {
+	for op := range bioNumOps {
+		s.bioJobs[op] = make(chan bioJob, bioQueueSize)
+		go s.bioProcessBackgroundJobs(op)
+	}
+}
+
+func (s *Server) bioProcessBackgroundJobs(op int) {
+	for job := range s.bioJobs[op] {
+		job()
+		s.bioPending[op].Add(-1)
+	}
+}
+
+func (s *Server) bioSubmitJob(op int, job bioJob) {
+	s.bioPending[op].Add(1)
+	s.bioJobs[op] <- job
+}
+
+// bioPendingJobsOfType returns the number of the jobs of op not yet done,
+// including the one in progress.
+func (s *Server) bioPendingJobsOfType(op int) int64 {
+	return s.bioPending[op].Load()
+}
+
+// bioCreateFsyncJob fsyncs the AOF file in background, reploff is the
+// replication offset made durable by the fsync.
+func (s *Server) bioCreateFsyncJob(file *os.File, reploff int64) {
+	s.bioSubmitJob(bioAofFsync, func() {
+		s.aofBioFsync(file, reploff)
+	})
+}
+
+// bioCreateCloseAofJob fsyncs and closes the AOF file which is no longer
+// written, in background.
+func (s *Server) bioCreateCloseAofJob(file *os.File, reploff int64) {
+	s.bioSubmitJob(bioAofFsync, func() {
+		s.aofBioFsync(file, reploff)
+		if err := file.Close(); err != nil {
+			slog.Warn("failed closing the AOF file", "file", file.Name(), "err", err)
+		}
+	})
+}
+
+// aofBioFsync records the failure of the fsync, so that INFO reports the
+// AOF write status as err until an fsync succeeds.
+func (s *Server) aofBioFsync(file *os.File, reploff int64) {
+	if err := file.Sync(); err != nil {
+		if !s.aofBioFsyncFailed.Swap(true) {
+			slog.Warn("failed fsync of the AOF file in background", "file", file.Name(), "err", err)
+		}
+		return
+	}
+	if s.aofBioFsyncFailed.Swap(false) {
+		slog.Info("AOF fsync error looks solved, the AOF file is fsynced again")
+	}
+	s.updateFsyncedReplOff(reploff)
+}
+
+// BioCreateUnlinkJob removes the file in background, the removal of a big
+// file may take a long time, since its blocks are freed by the unlink.
+func (s *Server) BioCreateUnlinkJob(path string) {
+	s.bioSubmitJob(bioCloseFile, func() {
+		if err := os.Remove(path); err != nil {
+			slog.Warn("failed removing the file", "file", path, "err", err)
+		}
+	})
+}
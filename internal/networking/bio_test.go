@@ -0,0 +1,104 @@
+package networking
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitBioJobs(t *testing.T, s *Server, op int) {
+	t.Helper()
+	for i := 0; s.bioPendingJobsOfType(op) != 0; i++ {
+		if i == 1000 {
+			t.Fatal("the background jobs are not done")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlushAppendOnlyFilePostponed(t *testing.T) {
+	s := NewServer()
+	s.Init()
+	s.AofState = AofOn
+	file, err := os.Create(filepath.Join(t.TempDir(), "appendonly.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AofFile = file
+	s.UnixTime = 10000
+
+	// A slow fsync in progress.
+	release := make(chan struct{})
+	s.bioSubmitJob(bioAofFsync, func() { <-release })
+	s.AofBuf = append(s.AofBuf, "*1\r\n$4\r\nPING\r\n"...)
+	s.flushAppendOnlyFile(false)
+	if len(s.AofBuf) == 0 || s.AofFsyncPostponedStart != 10000 {
+		t.Fatalf("the write is not postponed, buffer %d postponed start %d",
+			len(s.AofBuf), s.AofFsyncPostponedStart)
+	}
+	s.UnixTime += 1000
+	s.flushAppendOnlyFile(false)
+	if len(s.AofBuf) == 0 {
+		t.Fatal("the write is not postponed for 2 seconds")
+	}
+	s.UnixTime += 1000
+	s.flushAppendOnlyFile(false)
+	if len(s.AofBuf) != 0 || s.AofDelayedFsync != 1 || s.AofFsyncPostponedStart != 0 {
+		t.Fatalf("buffer %d delayed fsync %d", len(s.AofBuf), s.AofDelayedFsync)
+	}
+	// The fsync is skipped while the other one is in progress.
+	if n := s.bioPendingJobsOfType(bioAofFsync); n != 1 {
+		t.Fatalf("%d pending fsync jobs", n)
+	}
+	close(release)
+	waitBioJobs(t, s, bioAofFsync)
+
+	// No fsync during a rewrite with no-appendfsync-on-rewrite.
+	s.AofNoFsyncOnRewrite = true
+	s.AofChildRunning.Store(ChildInRunning)
+	s.UnixTime += 1000
+	s.MasterReplOffset = 100
+	s.flushAppendOnlyFile(false)
+	if s.AofLastFsync == s.UnixTime || s.fsyncedReplOff.Load() == 100 {
+		t.Fatal("fsynced during the rewrite")
+	}
+	s.AofChildRunning.Store(ChildNotInRunning)
+	s.flushAppendOnlyFile(false)
+	waitBioJobs(t, s, bioAofFsync)
+	if s.fsyncedReplOff.Load() != 100 {
+		t.Errorf("fsynced offset %d", s.fsyncedReplOff.Load())
+	}
+}
+
+func TestSwitchAofFile(t *testing.T) {
+	s := NewServer()
+	s.Init()
+	s.AofState = AofOn
+	dir := t.TempDir()
+	old, err := os.Create(filepath.Join(dir, "appendonly.aof.1.incr.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AofFile = old
+	file, err := os.Create(filepath.Join(dir, "appendonly.aof.2.incr.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.AofBuf = append(s.AofBuf, "*1\r\n$4\r\nPING\r\n"...)
+	if err := s.SwitchAofFile(file, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if s.AofFile != file || s.AofLastIncrSize != 0 {
+		t.Fatalf("the AOF file is not switched")
+	}
+	waitBioJobs(t, s, bioAofFsync)
+	// The buffered writes go to the old file, which is closed.
+	if data, _ := os.ReadFile(old.Name()); string(data) != "*1\r\n$4\r\nPING\r\n" {
+		t.Errorf("old file %q", data)
+	}
+	if _, err := old.Write([]byte("x")); err == nil {
+		t.Error("the old file is not closed")
+	}
+}
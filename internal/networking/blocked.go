@@ -0,0 +1,215 @@
+package networking
+
+import (
+	"slices"
+	"time"
+
+	. "github.com/sunminx/RDB/pkg/util"
+)
+
+// Blocking operations.
+//
+// A client blocked by WAIT or WAITAOF doesn't get a reply immediately, and
+// the commands it sends after are kept in the query buffer. The client is
+// unblocked by the event that satisfies the condition (an ACK received from
+// a replica or a fsync of the AOF), or by the timeout, then the reply is
+// written and the pending commands are processed.
+
+// blockingState is the state of a client blocked on the replication.
+type blockingState struct {
+	// timeout is the unix time in milliseconds when the client is
+	// unblocked anyway, 0 means no timeout.
+	timeout int64
+	// reploff is the replication offset the client waits for.
+	reploff     int64
+	numreplicas int
+	numlocal    int
+	// waitaof indicates the client waits for the AOF fsync (WAITAOF)
+	// instead of the acknowledgement of replicas (WAIT).
+	waitaof bool
+}
+
+// Wait is the implementation of the WAIT command.
+func (c *Client) Wait(numreplicas int, timeout int64) {
+	s := c.Server
+	if s.MasterHost != "" {
+		c.AddReplyError([]byte("WAIT cannot be used with replica instances. " +
+			"Please also note that writes to replicas are just local and are not propagated."))
+		return
+	}
+
+	ackreplicas := s.replicationCountAcksByOffset(c.woff)
+	// A client in transaction can't be blocked.
+	if ackreplicas >= numreplicas || c.checkFlag(multi) {
+		c.AddReplyInt64(int64(ackreplicas))
+		return
+	}
+	c.blockForReplication(timeout, blockingState{
+		reploff:     c.woff,
+		numreplicas: numreplicas,
+	})
+}
+
+// WaitAof is the implementation of the WAITAOF command.
+func (c *Client) WaitAof(numlocal, numreplicas int, timeout int64) {
+	s := c.Server
+	if s.MasterHost != "" {
+		c.AddReplyError([]byte("WAITAOF cannot be used with replica instances. " +
+			"Please also note that writes to replicas are just local and are not propagated."))
+		return
+	}
+	if numlocal > 0 && s.AofState == AofOff {
+		c.AddReplyError([]byte("WAITAOF cannot be used when numlocal is set but appendonly is disabled."))
+		return
+	}
+
+	acklocal := s.countLocalAofAckByOffset(c.woff)
+	ackreplicas := s.replicationCountAofAcksByOffset(c.woff)
+	if (acklocal >= numlocal && ackreplicas >= numreplicas) || c.checkFlag(multi) {
+		c.addReplyWaitAof(acklocal, ackreplicas)
+		return
+	}
+	c.blockForReplication(timeout, blockingState{
+		reploff:     c.woff,
+		numreplicas: numreplicas,
+		numlocal:    numlocal,
+		waitaof:     true,
+	})
+}
+
+func (c *Client) addReplyWaitAof(acklocal, ackreplicas int) {
+	c.AddReplyMultibulkLen(2)
+	c.AddReplyInt64(int64(acklocal))
+	c.AddReplyInt64(int64(ackreplicas))
+}
+
+// blockForReplication blocks the client until the condition in bstate is met.
+func (c *Client) blockForReplication(timeout int64, bstate blockingState) {
+	s := c.Server
+	if timeout > 0 {
+		bstate.timeout = time.Now().UnixMilli() + timeout
+	}
+	c.bstate = bstate
+	c.setFlag(blocked)
+	s.waitingClients = append(s.waitingClients, c)
+	// Ask the replicas for an ACK as soon as possible.
+	if c.bstate.numreplicas > 0 {
+		s.getAckFromSlaves = true
+	}
+}
+
+// unblockClient stops waiting, the reply is written and the commands that
+// were sent in the meantime are processed by the next traffic event.
+func (c *Client) unblockClient() {
+	s := c.Server
+	for i, cli := range s.waitingClients {
+		if cli == c {
+			s.waitingClients = append(s.waitingClients[:i], s.waitingClients[i+1:]...)
+			break
+		}
+	}
+	c.flag &= ^blocked
+	c.bstate = blockingState{}
+	if c.Conn != nil && c.fd != -1 {
+		_ = c.Conn.Wake(nil)
+	}
+}
+
+// replyToBlockedClient replies to the client with the current state of the
+// acknowledgements, it returns true if the condition is met.
+func (c *Client) replyToBlockedClient(timedout bool) bool {
+	s := c.Server
+	reploff := c.bstate.reploff
+	if c.bstate.waitaof {
+		acklocal := s.countLocalAofAckByOffset(reploff)
+		ackreplicas := s.replicationCountAofAcksByOffset(reploff)
+		if !timedout && (acklocal < c.bstate.numlocal || ackreplicas < c.bstate.numreplicas) {
+			return false
+		}
+		c.addReplyWaitAof(acklocal, ackreplicas)
+		return true
+	}
+
+	ackreplicas := s.replicationCountAcksByOffset(reploff)
+	if !timedout && ackreplicas < c.bstate.numreplicas {
+		return false
+	}
+	c.AddReplyInt64(int64(ackreplicas))
+	return true
+}
+
+// processClientsWaitingReplicas unblocks the clients whose condition is met,
+// it is called when a replica sends an ACK and when the AOF is fsynced.
+func (s *Server) processClientsWaitingReplicas() {
+	for _, c := range slices.Clone(s.waitingClients) {
+		if c.replyToBlockedClient(false) {
+			c.unblockClient()
+		}
+	}
+}
+
+// handleBlockedClientsTimeout unblocks the clients whose timeout is reached.
+func (s *Server) handleBlockedClientsTimeout() {
+	now := time.Now().UnixMilli()
+	for _, c := range slices.Clone(s.waitingClients) {
+		if c.bstate.timeout != 0 && now >= c.bstate.timeout {
+			c.replyToBlockedClient(true)
+			c.unblockClient()
+		}
+	}
+}
+
+// blockedClientsCron is called by the cron in order to serve the blocked clients.
+func (s *Server) blockedClientsCron() {
+	if !TryLockWithTimeout(s.CmdLock, 10*time.Millisecond) {
+		return
+	}
+	defer s.CmdLock.Unlock()
+	if len(s.waitingClients) == 0 {
+		return
+	}
+	// Sending the GETACK is delayed until here, so that multiple clients
+	// blocked in the same loop produce a single request.
+	if s.getAckFromSlaves {
+		argv := [][]byte{[]byte("REPLCONF"), []byte("GETACK"), []byte("*")}
+		s.propagateMu.Lock()
+		s.replicationFeedSlaves(catCommand(argv))
+		s.propagateMu.Unlock()
+		s.getAckFromSlaves = false
+	}
+	s.processClientsWaitingReplicas()
+	s.handleBlockedClientsTimeout()
+}
+
+// replicationCountAcksByOffset returns the number of the replicas which
+// acknowledged the replication offset.
+func (s *Server) replicationCountAcksByOffset(offset int64) int {
+	count := 0
+	for _, slave := range s.slaves {
+		if slave.replState == slaveStateOnline && slave.replAckOff >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// replicationCountAofAcksByOffset returns the number of the replicas which
+// fsynced the replication offset to the AOF.
+func (s *Server) replicationCountAofAcksByOffset(offset int64) int {
+	count := 0
+	for _, slave := range s.slaves {
+		if slave.replState == slaveStateOnline && slave.replAofOff >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// countLocalAofAckByOffset returns 1 if the replication offset is fsynced
+// to the local AOF.
+func (s *Server) countLocalAofAckByOffset(offset int64) int {
+	if s.AofState == AofOn && s.fsyncedReplOff.Load() >= offset {
+		return 1
+	}
+	return 0
+}
@@ -5,7 +5,8 @@ import (
 	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/panjf2000/gnet/v2"
 	"github.com/sunminx/RDB/internal/cmd"
@@ -21,13 +22,16 @@ type flag int
 const (
 	Save flag = 1 << iota
 	master
+	slave
 	monitor
 	multi
 	blocked
 	dirtyCas
 	closeAfterReply
 	closeASAP
-	queueCall
+	preventProp
+	asking
+	pubsub
 	none = 0
 )
 
@@ -61,9 +65,47 @@ type Client struct {
 	cmd             cmd.Command
 	multiState      *multiState
 	reply           []byte
-	lastInteraction int64
-	cmdLock         *sync.RWMutex
+	lastInteraction atomic.Int64
 	state           int
+
+	// pending are the commands parsed from the query and not executed yet,
+	// see processPendingCommands.
+	pending []pendingCommand
+	// replies are the replies recorded by the commands, serialized in reply
+	// by serializeReplies. Their data is in replyArena.
+	replies    []replyItem
+	replyArena []byte
+
+	// dirty is the number of changes of the command in execution, which
+	// are added to the Dirty of the server after the command, see call.
+	dirty int
+
+	// woff is the replication offset after the last write of the client,
+	// it is what WAIT and WAITAOF wait for.
+	woff int64
+
+	// bstate is the state of the client when it is blocked.
+	bstate blockingState
+
+	// Fields used when the client is a replica.
+	replState          int
+	replAckOff         int64
+	replAckTime        int64
+	replAofOff         int64
+	replListeningPort  int
+	replCapa           int
+	psyncInitialOffset int64
+	psyncFullResync    bool
+	replPending        []byte
+	// replEofMark is the mark terminating the RDB streamed to the replica
+	// by a diskless transfer.
+	replEofMark string
+	// replStartStreamOnAck delays the replication stream until the replica
+	// loaded the RDB received by a diskless transfer.
+	replStartStreamOnAck bool
+
+	// pubsubChannels are the channels the client subscribed to.
+	pubsubChannels map[string]struct{}
 }
 
 type multiState struct {
@@ -131,6 +173,11 @@ func (c *Client) SetArgument(argv [][]byte) {
 	c.argc = len(argv)
 }
 
+// SetCommand sets the command to be executed, or queued in a transaction.
+func (c *Client) SetCommand(command cmd.Command) {
+	c.cmd = command
+}
+
 func (c *Client) Multi() bool {
 	return c.checkFlag(multi)
 }
@@ -151,14 +198,14 @@ var (
 	ProtoInlineMaxSize = 1024 * 64
 )
 
-const (
-	execed  = true
-	nonExec = false
-)
-
-// processInputBuffer process the query buffer for client 'c'.
-func (c *Client) processInputBuffer() bool {
+// processInputBuffer parses the query buffer of client 'c' into its pending
+// commands, which are executed by processPendingCommands.
+func (c *Client) processInputBuffer() {
 	for len(c.querybuf) > 0 {
+		// Nothing is parsed after a protocol error, the client is closed.
+		if c.checkFlag(closeAfterReply) {
+			break
+		}
 		if c.reqtype == reqNone {
 			if c.querybuf[0] == '*' {
 				c.reqtype = reqMultibulk
@@ -183,20 +230,15 @@ func (c *Client) processInputBuffer() bool {
 			panic("unknown request type")
 		}
 
-		if c.argc == 0 {
-			c.argv = make([][]byte, 0)
-			c.multibulklen = 0
-			c.bulklen = -1
-			c.reqtype = reqNone
-		} else {
-			// As long as the execution of one command is terminated, it is considered that the execution
-			// conditions of the subsequent commands of this client are not met, and the execution is stopped.
-			if !c.processCommand() {
-				return nonExec
-			}
+		if c.argc > 0 {
+			c.pending = append(c.pending, pendingCommand{argv: c.argv[:c.argc]})
 		}
+		c.argv = nil
+		c.argc = 0
+		c.multibulklen = 0
+		c.bulklen = -1
+		c.reqtype = reqNone
 	}
-	return execed
 }
 
 // processInlineBuffer
@@ -208,15 +250,13 @@ func (c *Client) processInlineBuffer() bool {
 	}
 	if line == nil {
 		if len(c.querybuf) > ProtoInlineMaxSize {
-			c.AddReplyError([]byte("Protocol error: too big mbulk count string"))
-			c.setProtocolError()
+			c.setProtocolError([]byte("Protocol error: too big mbulk count string"))
 		}
 		return false
 	}
 	c.argv = splitArgs(line, ' ')
 	if len(c.argv) == 0 {
-		c.AddReplyError([]byte("Protocol error: unbalanced quotes in request"))
-		c.setProtocolError()
+		c.setProtocolError([]byte("Protocol error: unbalanced quotes in request"))
 	}
 	c.argc = len(c.argv)
 	return true
@@ -238,8 +278,7 @@ func (c *Client) processMultibulkBuffer() bool {
 		}
 		if line == nil {
 			if len(c.querybuf) > ProtoInlineMaxSize {
-				c.AddReplyError([]byte("Protocol error: too big mbulk count string"))
-				c.setProtocolError()
+				c.setProtocolError([]byte("Protocol error: too big mbulk count string"))
 			}
 			return false
 		}
@@ -250,14 +289,12 @@ func (c *Client) processMultibulkBuffer() bool {
 
 		ll, err := strconv.Atoi(string(line[1:]))
 		if err != nil || ll > 1024*1024 {
-			c.AddReplyError([]byte("Protocol error: invalid multibulk length"))
-			c.setProtocolError()
+			c.setProtocolError([]byte("Protocol error: invalid multibulk length"))
 			return false
 		}
 
 		if ll > maxMulitbulksWhileUnauth && c.Server.Requirepass && !c.authenticated {
-			c.AddReplyError([]byte("Protocol error: unauthenticated multibulk length"))
-			c.setProtocolError()
+			c.setProtocolError([]byte("Protocol error: unauthenticated multibulk length"))
 			return false
 		}
 
@@ -278,8 +315,7 @@ func (c *Client) processMultibulkBuffer() bool {
 			}
 			if line == nil {
 				if len(c.querybuf) > ProtoInlineMaxSize {
-					c.AddReplyError([]byte("Protocol error: too big mbulk count string"))
-					c.setProtocolError()
+					c.setProtocolError([]byte("Protocol error: too big mbulk count string"))
 					return false
 				}
 				break
@@ -287,19 +323,17 @@ func (c *Client) processMultibulkBuffer() bool {
 
 			// in request, only bulk string in multibulk allowed
 			if line[0] != '$' {
-				c.AddReplyError([]byte(fmt.Sprintf(`Protocol error: expected '$', got '%c'`, line[0])))
-				c.setProtocolError()
+				c.setProtocolError([]byte(fmt.Sprintf(`Protocol error: expected '$', got '%c'`, line[0])))
 				return false
 			}
 			ll, err := strconv.Atoi(string(line[1:]))
 			if err != nil || ll > protoMaxBulkLen {
-				c.AddReplyError([]byte("Protocol error: invalid bulk length"))
-				c.setProtocolError()
+				c.setProtocolError([]byte("Protocol error: invalid bulk length"))
 				return false
 			}
 			if ll > maxBulksWhileUnauth && c.Server.Requirepass && !c.authenticated {
-				c.AddReplyError([]byte("Protocol error: unauthenticated bulk length"))
-				c.setProtocolError()
+				c.setProtocolError([]byte("Protocol error: unauthenticated bulk length"))
+				return false
 			}
 
 			c.bulklen = ll
@@ -314,8 +348,7 @@ func (c *Client) processMultibulkBuffer() bool {
 		var arg []byte
 		arg, c.querybuf = splitLine(c.querybuf)
 		if len(arg) != c.bulklen {
-			c.AddReplyError([]byte("Protocol error: incorrect bulk length"))
-			c.setProtocolError()
+			c.setProtocolError([]byte("Protocol error: incorrect bulk length"))
 			return false
 		}
 
@@ -354,16 +387,19 @@ func splitArgs(bytes []byte, sep byte) [][]byte {
 	return res
 }
 
-func (c *Client) setProtocolError() {
+// setProtocolError queues the error after the commands parsed so far and
+// closes the client after the reply.
+func (c *Client) setProtocolError(err []byte) {
+	c.pending = append(c.pending, pendingCommand{err: err})
 	c.flag |= closeAfterReply
 }
 
-func (c *Client) processCommand() bool {
+func (c *Client) processCommand() {
 	name := c.argvByIdx(0)
 	name = strings.ToLower(name)
 	if name == "quit" {
 		c.flag |= closeASAP
-		return true
+		return
 	}
 	command, ok := c.Server.LookupCommand(name)
 	if !ok {
@@ -378,26 +414,49 @@ func (c *Client) processCommand() bool {
 		c.AddReplyErrorFormat(`unknown command %q, with args beginning with: %s`,
 			name, args)
 		c.argc = 0
-		return execed
+		return
 	} else if (command.Arity > 0 && command.Arity != c.argc) || (c.argc < -command.Arity) {
 		c.AddReplyErrorFormat(`wrong number of arguments for %q command`, name)
 		c.argc = 0
-		return execed
+		return
+	}
+
+	// Don't accept write commands if this is a read only replica. But
+	// accept write commands if this is our master.
+	if c.Server.MasterHost != "" && c.Server.ReplicaReadOnly &&
+		!c.checkFlag(master) && strings.ContainsRune(command.SFlags, 'w') {
+		c.AddReplyError(common.Shared["roslaveerr"])
+		c.argc = 0
+		return
+	}
+
+	// Loading DB? Return an error if the command has not the 'l' flag.
+	// With async-loading the read commands are served by the keys loaded
+	// so far.
+	if c.Server.Loading.Load() && !strings.ContainsRune(command.SFlags, 'l') &&
+		!(c.Server.AsyncLoading && strings.ContainsRune(command.SFlags, 'r')) {
+		c.AddReplyError(common.Shared["loadingerr"])
+		c.argc = 0
+		return
+	}
+
+	// Only allow a subset of commands in the context of Pub/Sub.
+	if c.checkFlag(pubsub) && command.Name != "ping" && command.Name != "subscribe" &&
+		command.Name != "unsubscribe" {
+		c.AddReplyErrorFormat("Can't execute '%s': only (P|S)SUBSCRIBE / "+
+			"(P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", name)
+		c.argc = 0
+		return
 	}
 
 	c.cmd = command
 	if c.flag&multi != 0 && c.cmd.Name != "exec" {
 		c.QueueMultiCommand()
 		c.AddReplyRaw([]byte("+QUEUED\r\n"))
-		return execed
-	} else {
-		if !c.call() {
-			return nonExec
-		}
+		return
 	}
-
+	c.call()
 	c.argc = 0
-	return execed
 }
 
 func (c *Client) QueueMultiCommand() {
@@ -414,57 +473,200 @@ func (c *Client) QueueMultiCommand() {
 
 func (c *Client) MultiExec() {
 	multiState := c.multiState
-	c.addReplyMultibulkLen(int64(multiState.cnt))
+	if multiState == nil {
+		multiState = newMultiState()
+	}
+	c.AddReplyMultibulkLen(int64(multiState.cnt))
+	// The write commands of the transaction are propagated one by one,
+	// wrapped in MULTI/EXEC so that they are applied atomically.
+	var writes [][][]byte
 	for i := int64(0); i < multiState.cnt; i++ {
 		multiCmd := multiState.commands[i]
 		c.argc = multiCmd.argc
 		c.argv = multiCmd.argv
+		dirty := c.dirty
 		multiCmd.cmd.Proc(c)
+		if c.dirty > dirty {
+			writes = append(writes, c.argv)
+		}
 	}
+	if len(writes) > 0 {
+		// The commands on the other shards may be propagated in the
+		// meantime, so the transaction is propagated at once.
+		c.Server.propagateMu.Lock()
+		c.propagate([][]byte{[]byte("MULTI")}, propagateAof|propagateRepl)
+		for _, argv := range writes {
+			c.propagate(argv, propagateAof|propagateRepl)
+		}
+		c.propagate([][]byte{[]byte("EXEC")}, propagateAof|propagateRepl)
+		c.Server.propagateMu.Unlock()
+	}
+	// EXEC itself must not be propagated, since the commands were.
+	c.flag |= preventProp
 	c.multiState = nil
 	c.flag &= ^multi
 }
 
-func (c *Client) call() bool {
-	if !c.cmdLock.TryLock() {
-		c.flag |= queueCall
-		c.Server.RunnableClientCh <- c
-		return nonExec
+// call executes the command. The commands with keys, see commandShards,
+// hold the CmdLock shared and lock the shards of their keys, so that the
+// commands on different shards run in parallel. The other commands hold
+// the CmdLock exclusively, as they may access the whole keyspace and the
+// state of the server.
+func (c *Client) call() {
+	s := c.Server
+	shards, exclusive := c.commandShards()
+	if exclusive {
+		s.CmdLock.Lock()
+	} else {
+		s.CmdLock.RLock()
+		c.DB.LockShards(shards)
 	}
 
-	dirty := c.Server.Dirty
-	_ = c.cmd.Proc(c)
-	dirty = c.Server.Dirty - dirty
+	c.dirty = 0
+	// In cluster mode the command is only executed if we serve its keys,
+	// otherwise the client is redirected.
+	if !s.ClusterEnabled || c.clusterRedirectIfNeeded() {
+		_ = c.cmd.Proc(c)
+	}
+	// The ASKING flag is only valid for the next command.
+	if c.cmd.Name != "asking" {
+		c.flag &= ^asking
+	}
 
-	if dirty > 0 {
-		c.afterCommand()
+	// The command is propagated before the shards are unlocked, so that
+	// the writes on the same key are propagated in the order they are done.
+	if c.dirty > 0 {
+		s.propagateMu.Lock()
+		s.Dirty += c.dirty
+		if c.flag&preventProp == 0 {
+			c.afterCommand()
+		}
+		s.propagateMu.Unlock()
 	}
+	c.flag &= ^preventProp
 
-	c.flag &= ^queueCall
-	c.cmdLock.Unlock()
-	c.Server.UnlockNotice <- struct{}{}
-	return execed
+	if exclusive {
+		s.CmdLock.Unlock()
+	} else {
+		c.DB.UnlockShards(shards)
+		s.CmdLock.RUnlock()
+	}
 }
 
+// commandShards returns the shards of the keys of the command, in the order
+// they are locked, or exclusive if the command must hold the CmdLock
+// exclusively: the commands without keys and the ones with the 'x' flag. A
+// transaction locks the shards of the keys of all its commands, so that it
+// is atomic.
+func (c *Client) commandShards() (shards []int, exclusive bool) {
+	var keys [][]byte
+	if c.cmd.Name == "exec" {
+		if c.multiState == nil {
+			return nil, true
+		}
+		for _, mc := range c.multiState.commands {
+			k := getKeysFromCommand(mc.cmd, mc.argv[:mc.argc])
+			if len(k) == 0 || strings.ContainsRune(mc.cmd.SFlags, 'x') {
+				return nil, true
+			}
+			keys = append(keys, k...)
+		}
+	} else {
+		keys = getKeysFromCommand(c.cmd, c.argv[:c.argc])
+		if len(keys) == 0 || strings.ContainsRune(c.cmd.SFlags, 'x') {
+			return nil, true
+		}
+	}
+	return db.ShardsOfKeys(keys), false
+}
+
+// Command propagation targets.
+const (
+	propagateNone = 0
+	propagateAof  = 1
+	propagateRepl = 2
+)
+
 func (c *Client) afterCommand() {
-	c.propagateNow(0)
+	c.propagateNow(propagateAof | propagateRepl)
 }
 
 func (c *Client) propagateNow(target int) {
-	if c.Server.AofState != AofOff {
-		c.feedAppendOnlyFile()
+	c.propagate(c.argv[:c.argc], target)
+}
+
+// propagate feeds the command to the AOF and to the replicas.
+//
+// It should be called when holding the propagateMu.
+func (c *Client) propagate(argv [][]byte, target int) {
+	// The commands received from our master are propagated to our own
+	// replicas as they are, in processCommandFromMaster.
+	if c.checkFlag(master) {
+		target &= ^propagateRepl
+	}
+	if c.Server.propagate(argv, target) && target&propagateRepl != 0 {
+		c.woff = c.Server.MasterReplOffset
+	}
+}
+
+// propagate feeds the command to the AOF and to the replicas, it reports
+// whether it is propagated.
+//
+// It should be called when holding the propagateMu.
+func (s *Server) propagate(argv [][]byte, target int) bool {
+	// Nothing is propagated while loading the dataset, eg. the transactions
+	// of the AOF are already in it.
+	if target == propagateNone || s.Loading.Load() {
+		return false
+	}
+	buf := catCommand(argv)
+	if target&propagateAof != 0 && s.AofState != AofOff {
+		s.feedAppendOnlyFile(buf)
+	}
+	if target&propagateRepl != 0 {
+		s.replicationFeedSlaves(buf)
+	}
+	return true
+}
+
+// propagateExpire propagates the deletion of an expired key or of the
+// expired fields of a hash, see db.SetExpirePropagation. It is called by
+// the lookups and the active expire cycles, which hold the lock of the
+// shard of the key.
+func (s *Server) propagateExpire(argv [][]byte) {
+	s.propagateMu.Lock()
+	s.propagate(argv, propagateAof|propagateRepl)
+	s.propagateMu.Unlock()
+}
+
+func (s *Server) feedAppendOnlyFile(buf []byte) {
+	if s.AofTimestampEnabled {
+		// An annotation is written before the first command of every second,
+		// so that the AOF can be truncated to a point in time.
+		if now := time.Now().Unix(); now > s.AofCurTimestamp {
+			s.AofBuf = append(s.AofBuf, AofTimestampAnnotation(now)...)
+			s.AofCurTimestamp = now
+		}
 	}
+	s.AofBuf = append(s.AofBuf, buf...)
+}
+
+// AofTimestampAnnotation returns the annotation of the timestamp in the AOF,
+// which is skipped on loading.
+func AofTimestampAnnotation(timestamp int64) []byte {
+	return []byte("#TS:" + strconv.FormatInt(timestamp, 10) + "\r\n")
 }
 
-func (c *Client) feedAppendOnlyFile() {
+// catCommand encodes argv as a multibulk request.
+func catCommand(argv [][]byte) []byte {
 	buf := make([]byte, 0)
 
-	s := strconv.Itoa(c.argc)
+	s := strconv.Itoa(len(argv))
 	buf = append(buf, '*')
 	buf = append(buf, []byte(s)...)
 	buf = append(buf, []byte("\r\n")...)
 
-	for _, arg := range c.argv {
+	for _, arg := range argv {
 		s = strconv.Itoa(len(arg))
 		buf = append(buf, '$')
 		buf = append(buf, []byte(s)...)
@@ -472,17 +674,11 @@ func (c *Client) feedAppendOnlyFile() {
 		buf = append(buf, arg...)
 		buf = append(buf, []byte("\r\n")...)
 	}
-
-	c.Server.AofBuf = append(c.Server.AofBuf, buf...)
-}
-
-func (c *Client) Wake() {
-	// Wake triggers a OnTraffic event for the current connection.
-	c.Conn.Wake(nil)
+	return buf
 }
 
 func (c *Client) AddDirty(n int) {
-	c.Server.Dirty += n
+	c.dirty += n
 }
 
 // AddReply output the complete value to client.
@@ -490,14 +686,11 @@ func (c *Client) AddReply(robj *obj.Robj) {
 	switch robj.Type() {
 	case obj.TypeString:
 		{
-			var reply []byte
 			if robj.CheckEncoding(obj.EncodingRaw) {
-				reply = robj.Val().(sds.SDS)
+				c.AddReplyStatus(robj.Val().(sds.SDS))
 			} else if robj.CheckEncoding(obj.EncodingInt) {
-				num := robj.Val().(int64)
-				reply = []byte(strconv.FormatInt(num, 10))
+				c.AddReplyStatus(strconv.AppendInt(nil, robj.Val().(int64), 10))
 			}
-			c.AddReplyStatus(reply)
 		}
 	case obj.TypeList:
 	case obj.TypeHash:
@@ -507,17 +700,12 @@ func (c *Client) AddReply(robj *obj.Robj) {
 
 // AddReply output a byte slices to client. You need to complete the encode in advance.
 func (c *Client) AddReplyRaw(bytes []byte) {
-	c.reply = append(c.reply, bytes...)
+	c.addReplyItem(replyRaw, 0, bytes)
 }
 
 // AddReplyError output simple errors to client. eg: "-Err message\r\n".
 func (c *Client) AddReplyError(err []byte) {
-	if len(err) == 0 || err[0] != '-' {
-		c.reply = append(c.reply, []byte("-ERR ")...)
-	}
-
-	c.reply = append(c.reply, err...)
-	c.reply = append(c.reply, []byte("\r\n")...)
+	c.addReplyItem(replyError, 0, err)
 }
 
 func (c *Client) AddReplyErrorFormat(format string, args ...any) {
@@ -527,32 +715,16 @@ func (c *Client) AddReplyErrorFormat(format string, args ...any) {
 
 // AddReplyStatus output simple strings to client. eg: "+OK\r\n".
 func (c *Client) AddReplyStatus(status []byte) {
-	c.reply = append(c.reply, '+')
-	c.reply = append(c.reply, status...)
-	c.reply = append(c.reply, []byte("\r\n")...)
+	c.addReplyItem(replyStatus, 0, status)
 }
 
 // AddReplyInt64 output a signed, base-10, 64-bit integer to client. eg: ":0\r\n".
 func (c *Client) AddReplyInt64(n int64) {
-	if n == 0 {
-		c.AddReplyRaw(common.Shared["czero"])
-	} else if n == 1 {
-		c.AddReplyRaw(common.Shared["cone"])
-	} else {
-		s := ":" + strconv.FormatInt(n, 10) + "\r\n"
-		c.AddReplyRaw([]byte(s))
-	}
+	c.addReplyItem(replyInt, n, nil)
 }
 
 func (c *Client) AddReplyUint64(n uint64) {
-	if n == 0 {
-		c.AddReplyRaw(common.Shared["czero"])
-	} else if n == 1 {
-		c.AddReplyRaw(common.Shared["cone"])
-	} else {
-		s := ":" + strconv.FormatUint(n, 10) + "\r\n"
-		c.AddReplyRaw([]byte(s))
-	}
+	c.addReplyItem(replyUint, int64(n), nil)
 }
 
 // AddReplyBulk output bulk strings to client. bulk strings represents a single binary
@@ -560,41 +732,40 @@ func (c *Client) AddReplyUint64(n uint64) {
 func (c *Client) AddReplyBulk(robj *obj.Robj) {
 	if robj.CheckEncoding(obj.EncodingRaw) {
 		s := robj.Val().(sds.SDS)
-		c.AddReplyRaw([]byte("$" + strconv.Itoa(s.Len()) + "\r\n"))
-		c.AddReplyRaw(s.Bytes())
+		c.addReplyItem(replyBulk, 0, s.Bytes())
 	} else {
-		val := robj.Val().(int64)
-		n := val
-		ln := 1
-		if n < 0 {
-			ln += 1
-			n = -n
-		}
-
-		for n = n / 10; n != 0; n = n / 10 {
-			ln += 1
-		}
-		c.AddReplyRaw([]byte("$" + strconv.Itoa(ln) + "\r\n"))
-		c.AddReplyRaw([]byte(strconv.FormatInt(val, 10)))
+		c.addReplyItem(replyBulkInt, robj.Val().(int64), nil)
 	}
-	c.AddReplyRaw(common.Shared["crlf"])
 }
 
 // AddReplyMultibulk output arrays to client. eg: "*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n".
 func (c *Client) AddReplyMultibulk(robjs []*obj.Robj) {
-	c.addReplyMultibulkLen(int64(len(robjs)))
+	c.AddReplyMultibulkLen(int64(len(robjs)))
 	for _, robj := range robjs {
 		c.AddReplyBulk(robj)
 	}
 	return
 }
 
-func (c *Client) addReplyMultibulkLen(ln int64) {
-	c.AddReplyRaw([]byte(fmt.Sprintf("*%d\r\n", ln)))
+// AddReplyMultibulkLen outputs the header of an array, the elements follow.
+func (c *Client) AddReplyMultibulkLen(ln int64) {
+	c.addReplyItem(replyArrayLen, ln, nil)
+}
+
+func (c *Client) addReplyBulkString(s string) {
+	c.addReplyItem(replyBulk, 0, []byte(s))
 }
 
 func (c *Client) handleTimeout(now int64) bool {
-	timeouted := c.Server.MaxIdleTime > 0 && (now-c.lastInteraction) > c.Server.MaxIdleTime
+	// The replicas are checked by the replicationCron, using the REPLCONF ACK.
+	if c.checkFlag(slave) {
+		return false
+	}
+	// The blocked clients are checked by the handleBlockedClientsTimeout.
+	if c.checkFlag(blocked) {
+		return false
+	}
+	timeouted := c.Server.MaxIdleTime > 0 && (now-c.lastInteraction.Load()) > c.Server.MaxIdleTime
 	if timeouted {
 		c.free()
 		c.Server.delClient(c.fd)
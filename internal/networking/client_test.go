@@ -1,9 +1,17 @@
 package networking
 
 import (
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
+	"github.com/sunminx/RDB/internal/db"
 	obj "github.com/sunminx/RDB/internal/object"
+	"github.com/sunminx/RDB/internal/sds"
 )
 
 func NewMockClient(buf []byte) *Client {
@@ -64,3 +72,176 @@ func TestProcessMultibulkBuffer(t *testing.T) {
 		}
 	}
 }
+
+func TestFeedAppendOnlyFileTimestamp(t *testing.T) {
+	client := NewMockClient(nil)
+	client.Server.AofTimestampEnabled = true
+	cmd := catCommand([][]byte{[]byte("set"), []byte("k"), []byte("v")})
+
+	// The second is already annotated.
+	client.Server.AofCurTimestamp = math.MaxInt64
+	client.Server.feedAppendOnlyFile(cmd)
+	if got := string(client.Server.AofBuf); got != string(cmd) {
+		t.Errorf("aof buf %q", got)
+	}
+
+	client.Server.AofBuf = nil
+	client.Server.AofCurTimestamp = 0
+	client.Server.feedAppendOnlyFile(cmd)
+	want := "#TS:" + strconv.FormatInt(client.Server.AofCurTimestamp, 10) + "\r\n" + string(cmd)
+	if got := string(client.Server.AofBuf); client.Server.AofCurTimestamp == 0 || got != want {
+		t.Errorf("aof buf %q want: %q", got, want)
+	}
+}
+
+// newParallelClient returns a client of s, which is initialized, so that
+// the commands of multiple clients can be run in parallel.
+func newParallelClient(s *Server) *Client {
+	c := NewClient(nil, s.DB)
+	c.Server = s
+	return c
+}
+
+func TestCallParallel(t *testing.T) {
+	s := NewServer()
+	s.Init()
+	s.DB = db.New()
+	s.AofState = AofOn
+
+	const clients, calls = 8, 500
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := newParallelClient(s)
+			for j := range calls {
+				// The clients share the keys, and the transactions span
+				// two shards.
+				key := "list" + strconv.Itoa(j%50)
+				runMockCommand(c, "rpush", key, strconv.Itoa(i))
+				if j%50 == 0 {
+					runMockCommand(c, "multi")
+					runMockCommand(c, "rpush", "{tx}a", "x")
+					runMockCommand(c, "rpush", "{tx}b", "x")
+					runMockCommand(c, "exec")
+				}
+				runMockCommand(c, "get", "string"+strconv.Itoa(j))
+			}
+		}()
+	}
+	wg.Wait()
+
+	c := newParallelClient(s)
+	total := 0
+	for j := range 50 {
+		reply := runMockCommand(c, "llen", "list"+strconv.Itoa(j))
+		n, _ := strconv.Atoi(strings.TrimSpace(reply[1:]))
+		total += n
+	}
+	txs := clients * calls / 50
+	if total != clients*calls || s.Dirty != total+2*txs {
+		t.Errorf("%d elements, %d changes, want: %d", total, s.Dirty, clients*calls)
+	}
+	aof := string(s.AofBuf)
+	if n := strings.Count(aof, "rpush"); n != total+2*txs {
+		t.Errorf("%d commands propagated, want: %d", n, total+2*txs)
+	}
+	// The transactions are not interleaved with the other commands.
+	if n := strings.Count(aof, "$5\r\nMULTI\r\n*3\r\n$5\r\nrpush\r\n$5\r\n{tx}a\r\n$1\r\nx\r\n"+
+		"*3\r\n$5\r\nrpush\r\n$5\r\n{tx}b\r\n$1\r\nx\r\n*1\r\n$4\r\nEXEC"); n != txs {
+		t.Errorf("%d transactions propagated, want: %d", n, txs)
+	}
+}
+
+func TestPipelinedCommands(t *testing.T) {
+	s := NewServer()
+	s.Init()
+	s.DB = db.New()
+	c := newParallelClient(s)
+
+	// The last command is not complete yet.
+	c.querybuf = []byte("*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n*2\r\n$3\r\nget\r\n$1\r\nk\r\n" +
+		"*4\r\n$5\r\nrpush\r\n$1\r\nl\r\n$1\r\na\r\n$1\r\nb\r\n*2\r\n$4\r\nllen\r\n$1\r\nl\r\n" +
+		"*2\r\n$3\r\nget\r\n$1\r\n")
+	c.processInputBuffer()
+	if len(c.pending) != 4 {
+		t.Fatalf("%d pending commands, want: 4", len(c.pending))
+	}
+	c.processPendingCommands()
+	c.serializeReplies()
+	if got, want := string(c.reply), "+OK\r\n$1\r\nv\r\n:2\r\n:2\r\n"; got != want {
+		t.Errorf("reply %q want: %q", got, want)
+	}
+	c.discardReplies()
+
+	// The protocol error is replied after the commands before it, and the
+	// commands after it are not executed.
+	c.querybuf = append(c.querybuf, "k\r\n*1\r\n$x\r\n*1\r\n$4\r\nping\r\n"...)
+	c.processInputBuffer()
+	c.processPendingCommands()
+	c.serializeReplies()
+	if got, want := string(c.reply), "$1\r\nv\r\n-ERR Protocol error: invalid bulk length\r\n"; got != want {
+		t.Errorf("reply %q want: %q", got, want)
+	}
+	if !c.checkFlag(closeAfterReply) || len(c.pending) != 0 {
+		t.Errorf("flag %d, %d pending commands", c.flag, len(c.pending))
+	}
+}
+
+func TestSerializeReplies(t *testing.T) {
+	c := NewClient(nil, nil)
+	status := []byte("OK")
+	c.AddReplyStatus(status)
+	// The replies don't reference the memory of the values.
+	status[0] = 'K'
+	c.AddReplyError([]byte("bad"))
+	c.AddReplyError([]byte("-WRONGTYPE bad"))
+	c.AddReplyInt64(-12)
+	c.AddReplyUint64(math.MaxUint64)
+	c.AddReplyMultibulkLen(3)
+	c.AddReplyBulk(obj.New(sds.New([]byte("foo")), obj.TypeString, obj.EncodingRaw))
+	c.AddReplyBulk(obj.New(int64(-100), obj.TypeString, obj.EncodingInt))
+	c.addReplyBulkString("")
+	c.AddReplyRaw([]byte("+QUEUED\r\n"))
+	c.serializeReplies()
+
+	want := "+OK\r\n-ERR bad\r\n-WRONGTYPE bad\r\n:-12\r\n:18446744073709551615\r\n" +
+		"*3\r\n$3\r\nfoo\r\n$4\r\n-100\r\n$0\r\n\r\n+QUEUED\r\n"
+	if got := string(c.reply); got != want {
+		t.Errorf("reply %q want: %q", got, want)
+	}
+	if len(c.replies) != 0 || len(c.replyArena) != 0 {
+		t.Errorf("%d replies and %d bytes are left", len(c.replies), len(c.replyArena))
+	}
+}
+
+// BenchmarkCallParallel runs SET and GET on random keys by a client for
+// every goroutine, run it with -cpu 1,2,4,8 to see the scaling with cores.
+// Every goroutine has its own sequence of keys, so that the goroutines don't
+// run on the same shard in lockstep.
+func BenchmarkCallParallel(b *testing.B) {
+	s := NewServer()
+	s.Init()
+	s.DB = db.New()
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+
+	var goroutines atomic.Uint64
+	b.RunParallel(func(pb *testing.PB) {
+		c := newParallelClient(s)
+		rnd := rand.New(rand.NewPCG(goroutines.Add(1), 0))
+		i := 0
+		for pb.Next() {
+			key := keys[rnd.IntN(len(keys))]
+			if i%2 == 0 {
+				runMockCommand(c, "set", key, "value")
+			} else {
+				runMockCommand(c, "get", key)
+			}
+			i++
+		}
+	})
+}
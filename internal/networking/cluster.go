@@ -0,0 +1,1082 @@
+package networking
+
+// Redis Cluster.
+//
+// The keyspace is split in 16384 hash slots, every master serves a subset of
+// the slots. The nodes know the owner of every slot thanks to the cluster bus,
+// a TCP link between every pair of nodes which is used to exchange PING/PONG
+// messages with the configuration of the sender and gossip about the other
+// nodes (see cluster_bus.go).
+//
+// The clients send the commands to any node, if the keys of the command are
+// not served by the node, the client is redirected to the right node with a
+// -MOVED error. While a slot is migrated, the keys of the slot which are not
+// found in the source node are redirected to the target with an -ASK error.
+//
+// The state of the cluster is protected by the CmdLock.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sunminx/RDB/internal/cluster"
+	"github.com/sunminx/RDB/internal/cmd"
+	. "github.com/sunminx/RDB/pkg/util"
+)
+
+const (
+	defClusterConfigFile  = "nodes.conf"
+	defClusterNodeTimeout = 15000
+	// The cluster bus port is the client port plus this offset,
+	// unless it's configured with cluster-port.
+	clusterPortIncr = 10000
+)
+
+// Flags of a cluster node.
+const (
+	clusterNodeMaster    = 1 << iota // The node is a master.
+	clusterNodeSlave                 // The node is a replica.
+	clusterNodePfail                 // Failure? Need acknowledge.
+	clusterNodeFail                  // The node is believed to be malfunctioning.
+	clusterNodeMyself                // This node is myself.
+	clusterNodeHandshake             // We have still to exchange the first ping.
+	clusterNodeNoAddr                // We don't know the address of this node.
+	clusterNodeMeet                  // Send a MEET message to this node.
+)
+
+var clusterNodeFlagsTable = []struct {
+	flag int
+	name string
+}{
+	{clusterNodeMyself, "myself"},
+	{clusterNodeMaster, "master"},
+	{clusterNodeSlave, "slave"},
+	{clusterNodePfail, "fail?"},
+	{clusterNodeFail, "fail"},
+	{clusterNodeHandshake, "handshake"},
+	{clusterNodeNoAddr, "noaddr"},
+}
+
+// States of the cluster.
+const (
+	clusterOk   = 0 // Everything looks ok.
+	clusterFail = 1 // The cluster can't work.
+)
+
+// Results of getNodeByQuery.
+const (
+	clusterRedirNone        = iota // Node can serve the request.
+	clusterRedirCrossSlot          // -CROSSSLOT request.
+	clusterRedirUnstable           // -TRYAGAIN redirection required.
+	clusterRedirAsk                // -ASK redirection required.
+	clusterRedirMoved              // -MOVED redirection required.
+	clusterRedirDownState          // -CLUSTERDOWN, global state.
+	clusterRedirDownUnbound        // -CLUSTERDOWN, unbound slot.
+)
+
+// slotBitmap is a set of hash slots.
+type slotBitmap [cluster.Slots / 8]byte
+
+func (b *slotBitmap) has(slot int) bool {
+	return b[slot/8]&(1<<(slot&7)) != 0
+}
+
+func (b *slotBitmap) set(slot int) {
+	b[slot/8] |= 1 << (slot & 7)
+}
+
+func (b *slotBitmap) clear(slot int) {
+	b[slot/8] &= ^(1 << (slot & 7))
+}
+
+type clusterNode struct {
+	name  string
+	flags int
+	ctime int64 // Node object creation time.
+	ip    string
+	port  int
+	cport int // The port of the cluster bus.
+
+	configEpoch uint64
+	slots       slotBitmap
+	numslots    int
+
+	pingSent     int64 // Unix time we sent latest ping, 0 if the pong was received.
+	pongReceived int64 // Unix time we received the pong.
+	failTime     int64 // Unix time when FAIL flag was set.
+	// failReports are the other masters which reported the node as failing,
+	// with the time of the latest report.
+	failReports map[string]int64
+
+	link        *clusterLink // Link with the node, initiated by us.
+	inboundLink *clusterLink // Link with the node, initiated by the node.
+	connecting  bool         // The link is being created.
+}
+
+func newClusterNode(name string, flags int) *clusterNode {
+	if name == "" {
+		name = genRunId()
+	}
+	return &clusterNode{
+		name:        name,
+		flags:       flags,
+		ctime:       time.Now().UnixMilli(),
+		failReports: make(map[string]int64),
+	}
+}
+
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.port))
+}
+
+func (n *clusterNode) busAddr() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.cport))
+}
+
+func (n *clusterNode) isMaster() bool {
+	return n.flags&clusterNodeMaster != 0
+}
+
+func (n *clusterNode) inHandshake() bool {
+	return n.flags&clusterNodeHandshake != 0
+}
+
+func (n *clusterNode) timedOut() bool {
+	return n.flags&clusterNodePfail != 0
+}
+
+func (n *clusterNode) failed() bool {
+	return n.flags&clusterNodeFail != 0
+}
+
+type clusterState struct {
+	myself       *clusterNode
+	currentEpoch uint64
+	state        int
+	// size is the number of masters serving at least one slot.
+	size  int
+	nodes map[string]*clusterNode
+
+	slots              [cluster.Slots]*clusterNode
+	migratingSlotsTo   [cluster.Slots]*clusterNode
+	importingSlotsFrom [cluster.Slots]*clusterNode
+
+	statsMessagesSent     [clusterMsgTypeCount]int64
+	statsMessagesReceived [clusterMsgTypeCount]int64
+
+	// The work to do in the next clusterCron.
+	todoSaveConfig  bool
+	todoUpdateState bool
+
+	listener net.Listener
+}
+
+func newClusterState() *clusterState {
+	return &clusterState{
+		state: clusterFail,
+		nodes: make(map[string]*clusterNode),
+	}
+}
+
+// ClusterInit initializes the cluster state when the cluster mode is enabled,
+// the configuration of the node is loaded from the cluster config file, or a
+// new node is created if the file doesn't exist. Then the cluster bus starts
+// listening.
+func (s *Server) ClusterInit() error {
+	if !s.ClusterEnabled {
+		return nil
+	}
+	if s.MasterHost != "" {
+		return errors.New("replicaof directive not allowed in cluster mode")
+	}
+
+	s.cluster = newClusterState()
+	loaded, err := s.clusterLoadConfig(s.ClusterConfigFile)
+	if err != nil {
+		return fmt.Errorf("loading the cluster config file %s: %w", s.ClusterConfigFile, err)
+	}
+	if !loaded {
+		// No configuration found, we are a new node.
+		myself := newClusterNode("", clusterNodeMyself|clusterNodeMaster)
+		s.cluster.myself = myself
+		s.clusterAddNode(myself)
+		slog.Info("no cluster configuration found, I'm " + myself.name)
+	}
+	myself := s.cluster.myself
+	if s.Ip != "0.0.0.0" && s.Ip != "::" {
+		myself.ip = s.Ip
+	}
+	myself.port = s.Port
+	myself.cport = s.ClusterPort
+	if myself.cport == 0 {
+		myself.cport = s.Port + clusterPortIncr
+	}
+	if err = s.clusterSaveConfig(); err != nil {
+		return err
+	}
+
+	// The keys of the hash slots are needed by GETKEYSINSLOT, COUNTKEYSINSLOT
+	// and SETSLOT.
+	s.DB.EnableSlotIndex()
+
+	if err = s.clusterListen(); err != nil {
+		return err
+	}
+	s.clusterUpdateState()
+	return nil
+}
+
+func (s *Server) clusterLookupNode(name string) *clusterNode {
+	return s.cluster.nodes[name]
+}
+
+func (s *Server) clusterAddNode(node *clusterNode) {
+	s.cluster.nodes[node.name] = node
+}
+
+// clusterDelNode removes the node from the cluster, the slots served by the
+// node become unassigned.
+func (s *Server) clusterDelNode(node *clusterNode) {
+	c := s.cluster
+	for j := 0; j < cluster.Slots; j++ {
+		if c.importingSlotsFrom[j] == node {
+			c.importingSlotsFrom[j] = nil
+		}
+		if c.migratingSlotsTo[j] == node {
+			c.migratingSlotsTo[j] = nil
+		}
+		if c.slots[j] == node {
+			s.clusterDelSlot(j)
+		}
+	}
+	// The failure reports sent by the node are no longer valid.
+	for _, n := range c.nodes {
+		delete(n.failReports, node.name)
+	}
+	s.freeClusterLink(node.link)
+	s.freeClusterLink(node.inboundLink)
+	delete(c.nodes, node.name)
+}
+
+// clusterRenameNode is used when the real name of a node is learned,
+// after the handshake.
+func (s *Server) clusterRenameNode(node *clusterNode, name string) {
+	slog.Info("renaming node", "from", node.name, "to", name)
+	delete(s.cluster.nodes, node.name)
+	node.name = name
+	s.clusterAddNode(node)
+}
+
+// clusterStartHandshake starts a handshake with the node at ip:port, the
+// node is added with a random name, which is replaced by the real one when
+// the node replies.
+func (s *Server) clusterStartHandshake(ip string, port, cport int) bool {
+	if net.ParseIP(ip) == nil || port <= 0 || port > 65535 || cport <= 0 || cport > 65535 {
+		return false
+	}
+	// Don't start a handshake with the same node twice.
+	for _, n := range s.cluster.nodes {
+		if n.inHandshake() && n.ip == ip && n.port == port && n.cport == cport {
+			return false
+		}
+	}
+	node := newClusterNode("", clusterNodeHandshake|clusterNodeMeet)
+	node.ip, node.port, node.cport = ip, port, cport
+	s.clusterAddNode(node)
+	return true
+}
+
+func (s *Server) clusterAddSlot(node *clusterNode, slot int) bool {
+	if s.cluster.slots[slot] != nil {
+		return false
+	}
+	node.slots.set(slot)
+	node.numslots++
+	s.cluster.slots[slot] = node
+	return true
+}
+
+func (s *Server) clusterDelSlot(slot int) bool {
+	node := s.cluster.slots[slot]
+	if node == nil {
+		return false
+	}
+	node.slots.clear(slot)
+	node.numslots--
+	s.cluster.slots[slot] = nil
+	return true
+}
+
+// clusterUpdateState updates the state of the cluster, which fails if a slot
+// is not served, or if we are in the minority partition.
+func (s *Server) clusterUpdateState() {
+	c := s.cluster
+	c.todoUpdateState = false
+
+	newState := clusterOk
+	if s.ClusterRequireFullCoverage {
+		for j := 0; j < cluster.Slots; j++ {
+			if c.slots[j] == nil || c.slots[j].failed() {
+				newState = clusterFail
+				break
+			}
+		}
+	}
+
+	// Compute the cluster size, that is the number of masters serving at
+	// least a single slot, and the number of the reachable ones.
+	size, reachable := 0, 0
+	for _, node := range c.nodes {
+		if node.isMaster() && node.numslots > 0 {
+			size++
+			if node.flags&(clusterNodeFail|clusterNodePfail) == 0 {
+				reachable++
+			}
+		}
+	}
+	c.size = size
+	// If we are in a minority partition, change the cluster state to FAIL.
+	if reachable < size/2+1 {
+		newState = clusterFail
+	}
+
+	if newState != c.state {
+		slog.Info("cluster state changed", "state", Cond(newState == clusterOk, "ok", "fail"))
+		c.state = newState
+	}
+}
+
+// clusterUpdateSlotsConfigWith is called when the sender claims the slots with
+// a config epoch, the slots are rebound to the sender if our configuration is
+// older. The keys of the slots we lose are deleted, since they are stale.
+func (s *Server) clusterUpdateSlotsConfigWith(sender *clusterNode, senderConfigEpoch uint64, slots *slotBitmap) {
+	c := s.cluster
+	if sender == c.myself {
+		slog.Warn("discarding UPDATE message about myself")
+		return
+	}
+
+	var dirtySlots []int
+	for j := 0; j < cluster.Slots; j++ {
+		if !slots.has(j) || c.slots[j] == sender {
+			continue
+		}
+		// The slot we are importing is assigned to us with SETSLOT NODE.
+		if c.importingSlotsFrom[j] != nil {
+			continue
+		}
+		if c.slots[j] == nil || c.slots[j].configEpoch < senderConfigEpoch {
+			if c.slots[j] == c.myself && s.DB.CountKeysInSlot(j) > 0 && sender != c.myself {
+				dirtySlots = append(dirtySlots, j)
+			}
+			if c.slots[j] == c.myself {
+				c.migratingSlotsTo[j] = nil
+			}
+			s.clusterDelSlot(j)
+			s.clusterAddSlot(sender, j)
+			c.todoSaveConfig = true
+			c.todoUpdateState = true
+		}
+	}
+
+	for _, slot := range dirtySlots {
+		slog.Warn("deleting the keys of the slot lost to another node", "slot", slot, "node", sender.name)
+		for _, key := range s.DB.GetKeysInSlot(slot, -1) {
+			s.DB.DelKey(key)
+		}
+	}
+}
+
+// clusterHandleConfigEpochCollision is called when two masters have the same
+// config epoch, the one with the smaller name takes a new epoch, so that
+// eventually every master has a different one.
+func (s *Server) clusterHandleConfigEpochCollision(sender *clusterNode) {
+	c := s.cluster
+	if sender.configEpoch != c.myself.configEpoch || !sender.isMaster() || !c.myself.isMaster() {
+		return
+	}
+	// Don't act if the colliding node has a smaller name.
+	if sender.name <= c.myself.name {
+		return
+	}
+	c.currentEpoch++
+	c.myself.configEpoch = c.currentEpoch
+	c.todoSaveConfig = true
+	slog.Warn("configEpoch collision with node, configEpoch set", "node", sender.name, "epoch", c.currentEpoch)
+}
+
+// clusterBumpConfigEpochWithoutConsensus makes our config epoch the greatest
+// one, so that our configuration wins. It is used when a slot is imported,
+// which is an operation explicitly requested by the administrator.
+func (s *Server) clusterBumpConfigEpochWithoutConsensus() bool {
+	c := s.cluster
+	maxEpoch := c.currentEpoch
+	for _, node := range c.nodes {
+		maxEpoch = max(maxEpoch, node.configEpoch)
+	}
+	if c.myself.configEpoch == 0 || c.myself.configEpoch != maxEpoch {
+		c.currentEpoch++
+		c.myself.configEpoch = c.currentEpoch
+		c.todoSaveConfig = true
+		return true
+	}
+	return false
+}
+
+// getKeysFromCommand returns the keys of the command, described
+// by FirstKey, LastKey and KeyStep.
+func getKeysFromCommand(command cmd.Command, argv [][]byte) [][]byte {
+	if command.FirstKey == 0 {
+		return nil
+	}
+	if command.Name == "migrate" {
+		return cmd.MigrateGetKeys(argv)
+	}
+	last := command.LastKey
+	if last < 0 {
+		last = len(argv) + last
+	}
+	var keys [][]byte
+	for j := command.FirstKey; j <= last && j < len(argv); j += command.KeyStep {
+		keys = append(keys, argv[j])
+	}
+	return keys
+}
+
+// getNodeByQuery returns the node which is able to serve the commands, with
+// the slot of their keys. If the commands can't be served, the node is nil
+// and the redirection code tells why.
+//
+// The commands are served by us if they don't have keys.
+func (s *Server) getNodeByQuery(c *Client, cmds []multiCmd) (*clusterNode, int, int) {
+	cs := s.cluster
+	var (
+		n                         *clusterNode
+		firstKey                  []byte
+		slot                      int
+		multipleKeys              bool
+		migrating, importing      bool
+		missingKeys, existingKeys int
+	)
+
+	for _, mc := range cmds {
+		for _, key := range getKeysFromCommand(mc.cmd, mc.argv[:mc.argc]) {
+			thisSlot := cluster.KeyHashSlot(key)
+			if firstKey == nil {
+				firstKey, slot = key, thisSlot
+				n = cs.slots[slot]
+				// Error: If a slot is not served, we are in "cluster down"
+				// state. However the state is yet to be updated, so this was
+				// not trapped earlier in processCommand.
+				if n == nil {
+					return nil, clusterRedirDownUnbound, slot
+				}
+				// If we are migrating or importing this slot, we need to check
+				// if we have all the keys in the request (the only way we can
+				// safely serve the request, otherwise we return a TRYAGAIN
+				// error).
+				if n == cs.myself && cs.migratingSlotsTo[slot] != nil {
+					migrating = true
+				} else if cs.importingSlotsFrom[slot] != nil {
+					importing = true
+				}
+			} else if !bytes.Equal(key, firstKey) {
+				// If it is not the first key, make sure it is exactly
+				// the same key as the first we saw.
+				if thisSlot != slot {
+					return nil, clusterRedirCrossSlot, slot
+				}
+				multipleKeys = true
+			}
+			if _, ok := s.DB.LookupKeyRead(string(key)); ok {
+				existingKeys++
+			} else {
+				missingKeys++
+			}
+		}
+	}
+
+	// No key at all in command? then we can serve the request
+	// without redirections or errors in all the cases.
+	if n == nil {
+		return cs.myself, clusterRedirNone, slot
+	}
+	if cs.state != clusterOk {
+		return nil, clusterRedirDownState, slot
+	}
+
+	// If we don't have all the keys and we are migrating the slot, send
+	// an ASK redirection, or TRYAGAIN if we have a part of the keys.
+	if migrating && missingKeys > 0 {
+		if existingKeys > 0 {
+			return nil, clusterRedirUnstable, slot
+		}
+		return cs.migratingSlotsTo[slot], clusterRedirAsk, slot
+	}
+
+	// If we are receiving the slot, and the client correctly flagged the
+	// request as "ASKING", or the command is an implicit ASKING like
+	// RESTORE-ASKING, we can serve the request. However if the request
+	// involves multiple keys and we don't have them all, the only option is
+	// to send a TRYAGAIN error.
+	if importing && (c.checkFlag(asking) || strings.ContainsRune(c.cmd.SFlags, 'k')) {
+		if multipleKeys && missingKeys > 0 {
+			return nil, clusterRedirUnstable, slot
+		}
+		return cs.myself, clusterRedirNone, slot
+	}
+
+	if n != cs.myself {
+		return n, clusterRedirMoved, slot
+	}
+	return n, clusterRedirNone, slot
+}
+
+// clusterRedirectIfNeeded checks if the command can be served by us,
+// otherwise it replies with the redirection and returns false.
+//
+// It should be called when holding the CmdLock.
+func (c *Client) clusterRedirectIfNeeded() bool {
+	s := c.Server
+	// The commands of our master are always accepted.
+	if c.checkFlag(master) {
+		return true
+	}
+
+	var cmds []multiCmd
+	if c.cmd.Name == "exec" {
+		if c.multiState == nil {
+			return true
+		}
+		cmds = c.multiState.commands
+	} else {
+		cmds = []multiCmd{{c.cmd, c.argc, c.argv}}
+	}
+
+	n, code, slot := s.getNodeByQuery(c, cmds)
+	if code == clusterRedirNone {
+		return true
+	}
+	// The transaction is discarded, since it can't be served.
+	if c.cmd.Name == "exec" {
+		c.multiState = nil
+		c.flag &= ^multi
+	}
+	switch code {
+	case clusterRedirCrossSlot:
+		c.AddReplyError([]byte("-CROSSSLOT Keys in request don't hash to the same slot"))
+	case clusterRedirUnstable:
+		c.AddReplyError([]byte("-TRYAGAIN Multiple keys request during rehashing of slot"))
+	case clusterRedirDownState:
+		c.AddReplyError([]byte("-CLUSTERDOWN The cluster is down"))
+	case clusterRedirDownUnbound:
+		c.AddReplyError([]byte("-CLUSTERDOWN Hash slot not served"))
+	case clusterRedirMoved, clusterRedirAsk:
+		c.AddReplyErrorFormat("-%s %d %s", Cond(code == clusterRedirAsk, "ASK", "MOVED"), slot, n.addr())
+	}
+	return false
+}
+
+// ClusterEnabled returns true if the cluster mode is enabled.
+func (c *Client) ClusterEnabled() bool {
+	return c.Server.ClusterEnabled
+}
+
+// Asking flags the client, so that the next command can be served
+// by the node importing the slot.
+func (c *Client) Asking() {
+	c.setFlag(asking)
+}
+
+// ClusterMyId replies with the name of our node.
+func (c *Client) ClusterMyId() {
+	c.addReplyBulkString(c.Server.cluster.myself.name)
+}
+
+// ClusterInfo replies with the state of the cluster.
+func (c *Client) ClusterInfo() {
+	cs := c.Server.cluster
+	var assigned, ok, pfail, fail int
+	for j := 0; j < cluster.Slots; j++ {
+		n := cs.slots[j]
+		if n == nil {
+			continue
+		}
+		assigned++
+		switch {
+		case n.failed():
+			fail++
+		case n.timedOut():
+			pfail++
+		default:
+			ok++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "cluster_state:%s\r\n", Cond(cs.state == clusterOk, "ok", "fail"))
+	fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", assigned)
+	fmt.Fprintf(&b, "cluster_slots_ok:%d\r\n", ok)
+	fmt.Fprintf(&b, "cluster_slots_pfail:%d\r\n", pfail)
+	fmt.Fprintf(&b, "cluster_slots_fail:%d\r\n", fail)
+	fmt.Fprintf(&b, "cluster_known_nodes:%d\r\n", len(cs.nodes))
+	fmt.Fprintf(&b, "cluster_size:%d\r\n", cs.size)
+	fmt.Fprintf(&b, "cluster_current_epoch:%d\r\n", cs.currentEpoch)
+	fmt.Fprintf(&b, "cluster_my_epoch:%d\r\n", cs.myself.configEpoch)
+
+	var sent, received int64
+	for typ := 0; typ < clusterMsgTypeCount; typ++ {
+		if n := cs.statsMessagesSent[typ]; n > 0 {
+			sent += n
+			fmt.Fprintf(&b, "cluster_stats_messages_%s_sent:%d\r\n", clusterMsgTypeName(typ), n)
+		}
+	}
+	fmt.Fprintf(&b, "cluster_stats_messages_sent:%d\r\n", sent)
+	for typ := 0; typ < clusterMsgTypeCount; typ++ {
+		if n := cs.statsMessagesReceived[typ]; n > 0 {
+			received += n
+			fmt.Fprintf(&b, "cluster_stats_messages_%s_received:%d\r\n", clusterMsgTypeName(typ), n)
+		}
+	}
+	fmt.Fprintf(&b, "cluster_stats_messages_received:%d\r\n", received)
+	c.addReplyBulkString(b.String())
+}
+
+// ClusterNodes replies with the description of the nodes, in the same
+// format of the cluster config file.
+func (c *Client) ClusterNodes() {
+	c.addReplyBulkString(c.Server.clusterGenNodesDescription(clusterNodeHandshake))
+}
+
+// clusterGenNodesDescription describes the nodes, one per line, skipping the
+// nodes with any of the filter flags:
+//
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> <slot> ... <slot>
+func (s *Server) clusterGenNodesDescription(filter int) string {
+	var b strings.Builder
+	for _, node := range s.clusterSortedNodes() {
+		if node.flags&filter != 0 {
+			continue
+		}
+		b.WriteString(s.clusterGenNodeDescription(node))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func (s *Server) clusterGenNodeDescription(node *clusterNode) string {
+	cs := s.cluster
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s:%d@%d ", node.name, node.ip, node.port, node.cport)
+
+	var flags []string
+	for _, f := range clusterNodeFlagsTable {
+		if node.flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	if len(flags) == 0 {
+		flags = append(flags, "noflags")
+	}
+	b.WriteString(strings.Join(flags, ","))
+
+	linkState := "disconnected"
+	if node == cs.myself || node.link != nil {
+		linkState = "connected"
+	}
+	fmt.Fprintf(&b, " - %d %d %d %s", node.pingSent, node.pongReceived, node.configEpoch, linkState)
+
+	for _, r := range node.slotRanges() {
+		if r[0] == r[1] {
+			fmt.Fprintf(&b, " %d", r[0])
+		} else {
+			fmt.Fprintf(&b, " %d-%d", r[0], r[1])
+		}
+	}
+
+	// Just for myself, output the open slots.
+	if node == cs.myself {
+		for j := 0; j < cluster.Slots; j++ {
+			if n := cs.migratingSlotsTo[j]; n != nil {
+				fmt.Fprintf(&b, " [%d->-%s]", j, n.name)
+			} else if n := cs.importingSlotsFrom[j]; n != nil {
+				fmt.Fprintf(&b, " [%d-<-%s]", j, n.name)
+			}
+		}
+	}
+	return b.String()
+}
+
+// slotRanges returns the ranges of consecutive slots served by the node.
+func (n *clusterNode) slotRanges() [][2]int {
+	var ranges [][2]int
+	start := -1
+	for j := 0; j <= cluster.Slots; j++ {
+		if j < cluster.Slots && n.slots.has(j) {
+			if start == -1 {
+				start = j
+			}
+			continue
+		}
+		if start != -1 {
+			ranges = append(ranges, [2]int{start, j - 1})
+			start = -1
+		}
+	}
+	return ranges
+}
+
+// clusterSortedNodes returns the nodes sorted by name, so that the
+// output is stable.
+func (s *Server) clusterSortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(s.cluster.nodes))
+	for _, node := range s.cluster.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].name < nodes[j].name })
+	return nodes
+}
+
+// ClusterSlots replies with the ranges of slots and the nodes serving them.
+func (c *Client) ClusterSlots() {
+	type slotRange struct {
+		start, end int
+		node       *clusterNode
+	}
+	var ranges []slotRange
+	for _, node := range c.Server.clusterSortedNodes() {
+		for _, r := range node.slotRanges() {
+			ranges = append(ranges, slotRange{r[0], r[1], node})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	c.AddReplyMultibulkLen(int64(len(ranges)))
+	for _, r := range ranges {
+		c.AddReplyMultibulkLen(3)
+		c.AddReplyInt64(int64(r.start))
+		c.AddReplyInt64(int64(r.end))
+		c.AddReplyMultibulkLen(3)
+		c.addReplyBulkString(r.node.ip)
+		c.AddReplyInt64(int64(r.node.port))
+		c.addReplyBulkString(r.node.name)
+	}
+}
+
+// ClusterShards replies with the shards of the cluster, every shard is a
+// master with its slots.
+func (c *Client) ClusterShards() {
+	s := c.Server
+	nodes := make([]*clusterNode, 0)
+	for _, node := range s.clusterSortedNodes() {
+		if node.isMaster() && !node.inHandshake() {
+			nodes = append(nodes, node)
+		}
+	}
+
+	c.AddReplyMultibulkLen(int64(len(nodes)))
+	for _, node := range nodes {
+		c.AddReplyMultibulkLen(4)
+		c.addReplyBulkString("slots")
+		ranges := node.slotRanges()
+		c.AddReplyMultibulkLen(int64(len(ranges) * 2))
+		for _, r := range ranges {
+			c.AddReplyInt64(int64(r[0]))
+			c.AddReplyInt64(int64(r[1]))
+		}
+		c.addReplyBulkString("nodes")
+		c.AddReplyMultibulkLen(1)
+		c.AddReplyMultibulkLen(14)
+		c.addReplyBulkString("id")
+		c.addReplyBulkString(node.name)
+		c.addReplyBulkString("port")
+		c.AddReplyInt64(int64(node.port))
+		c.addReplyBulkString("ip")
+		c.addReplyBulkString(node.ip)
+		c.addReplyBulkString("endpoint")
+		c.addReplyBulkString(node.ip)
+		c.addReplyBulkString("role")
+		c.addReplyBulkString("master")
+		c.addReplyBulkString("replication-offset")
+		c.AddReplyInt64(Cond(node == s.cluster.myself, s.MasterReplOffset, 0))
+		c.addReplyBulkString("health")
+		c.addReplyBulkString(Cond(node.failed(), "fail", "online"))
+	}
+}
+
+// ClusterAddSlots assigns the slots to our node.
+func (c *Client) ClusterAddSlots(slots []int) error {
+	cs := c.Server.cluster
+	seen := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		if cs.slots[slot] != nil {
+			return fmt.Errorf("Slot %d is already busy", slot)
+		}
+		if seen[slot] {
+			return fmt.Errorf("Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+	}
+	for _, slot := range slots {
+		// If this slot was set as importing we can clear this
+		// state as now we are the real owner of the slot.
+		cs.importingSlotsFrom[slot] = nil
+		c.Server.clusterAddSlot(cs.myself, slot)
+	}
+	cs.todoSaveConfig = true
+	cs.todoUpdateState = true
+	return nil
+}
+
+// ClusterDelSlots unassigns the slots.
+func (c *Client) ClusterDelSlots(slots []int) error {
+	cs := c.Server.cluster
+	seen := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		if cs.slots[slot] == nil {
+			return fmt.Errorf("Slot %d is already unassigned", slot)
+		}
+		if seen[slot] {
+			return fmt.Errorf("Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+	}
+	for _, slot := range slots {
+		c.Server.clusterDelSlot(slot)
+	}
+	cs.todoSaveConfig = true
+	cs.todoUpdateState = true
+	return nil
+}
+
+// ClusterMeet starts a handshake with the node, the node joins the cluster
+// once it replies.
+func (c *Client) ClusterMeet(ip string, port, cport int) error {
+	if cport == 0 {
+		cport = port + clusterPortIncr
+	}
+	if !c.Server.clusterStartHandshake(ip, port, cport) {
+		return fmt.Errorf("Invalid node address specified: %s:%d", ip, port)
+	}
+	return nil
+}
+
+// ClusterSetSlot changes the state of a slot:
+//
+// MIGRATING <node>: the slot is migrating to the node.
+// IMPORTING <node>: the slot is imported from the node.
+// STABLE: the migrating or importing state is cleared.
+// NODE <node>: the slot is assigned to the node.
+func (c *Client) ClusterSetSlot(slot int, action string, nodeid string) error {
+	s := c.Server
+	cs := s.cluster
+	var n *clusterNode
+	if action != "stable" {
+		if n = s.clusterLookupNode(nodeid); n == nil {
+			return fmt.Errorf("I don't know about node %s", nodeid)
+		}
+		if !n.isMaster() {
+			return errors.New("Target node is not a master")
+		}
+	}
+
+	switch action {
+	case "migrating":
+		if cs.slots[slot] != cs.myself {
+			return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+		}
+		cs.migratingSlotsTo[slot] = n
+	case "importing":
+		if cs.slots[slot] == cs.myself {
+			return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+		}
+		cs.importingSlotsFrom[slot] = n
+	case "stable":
+		cs.importingSlotsFrom[slot] = nil
+		cs.migratingSlotsTo[slot] = nil
+	case "node":
+		// If this hash slot was served by 'myself' before to switch
+		// make sure there are no longer local keys for this hash slot.
+		keys := s.DB.CountKeysInSlot(slot)
+		if cs.slots[slot] == cs.myself && n != cs.myself && keys != 0 {
+			return fmt.Errorf("Can't assign hashslot %d to a different node "+
+				"while I still hold keys for this hash slot.", slot)
+		}
+		// If this node was migrating the slot, and there are no
+		// longer keys, the migration is completed.
+		if keys == 0 && cs.migratingSlotsTo[slot] != nil {
+			cs.migratingSlotsTo[slot] = nil
+		}
+		s.clusterDelSlot(slot)
+		s.clusterAddSlot(n, slot)
+
+		// If this node was importing this slot, assigning the slot to
+		// itself also clears the importing status, and our config epoch
+		// is bumped, so that the new configuration wins over the one of
+		// the source node.
+		if n == cs.myself && cs.importingSlotsFrom[slot] != nil {
+			if s.clusterBumpConfigEpochWithoutConsensus() {
+				slog.Info("configEpoch updated after importing slot", "slot", slot)
+			}
+			cs.importingSlotsFrom[slot] = nil
+			// The new configuration is propagated as soon as possible.
+			s.clusterBroadcastPong()
+		}
+	}
+	cs.todoSaveConfig = true
+	cs.todoUpdateState = true
+	return nil
+}
+
+// CountKeysInSlot returns the number of keys in the slot.
+func (c *Client) CountKeysInSlot(slot int) int {
+	return c.Server.DB.CountKeysInSlot(slot)
+}
+
+// GetKeysInSlot returns at most count keys of the slot.
+func (c *Client) GetKeysInSlot(slot, count int) []string {
+	return c.Server.DB.GetKeysInSlot(slot, count)
+}
+
+// clusterSaveConfig saves the configuration of the cluster, that is the
+// description of the nodes and the current epoch. The file is replaced
+// atomically.
+func (s *Server) clusterSaveConfig() error {
+	cs := s.cluster
+	cs.todoSaveConfig = false
+
+	content := s.clusterGenNodesDescription(clusterNodeHandshake) +
+		fmt.Sprintf("vars currentEpoch %d lastVoteEpoch 0\n", cs.currentEpoch)
+	tmpfile := fmt.Sprintf("%s.tmp-%d", s.ClusterConfigFile, os.Getpid())
+	if err := os.WriteFile(tmpfile, []byte(content), 0644); err != nil {
+		return fmt.Errorf("writing the cluster config file: %w", err)
+	}
+	if err := os.Rename(tmpfile, s.ClusterConfigFile); err != nil {
+		os.Remove(tmpfile)
+		return fmt.Errorf("renaming the cluster config file: %w", err)
+	}
+	return nil
+}
+
+// clusterLoadConfig loads the configuration of the cluster, it returns false
+// if the file doesn't exist.
+func (s *Server) clusterLoadConfig(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	cs := s.cluster
+	// The nodes are created while they are referenced by the slots
+	// in the migrating or importing state.
+	lookupOrCreate := func(name string) *clusterNode {
+		node := s.clusterLookupNode(name)
+		if node == nil {
+			node = newClusterNode(name, clusterNodeNoAddr)
+			s.clusterAddNode(node)
+		}
+		return node
+	}
+
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		argv := strings.Fields(scanner.Text())
+		if len(argv) == 0 {
+			continue
+		}
+		if argv[0] == "vars" {
+			for j := 1; j+1 < len(argv); j += 2 {
+				if argv[j] == "currentEpoch" {
+					cs.currentEpoch, _ = strconv.ParseUint(argv[j+1], 10, 64)
+				}
+			}
+			continue
+		}
+		if len(argv) < 8 {
+			return false, fmt.Errorf("unrecoverable error: corrupted cluster config file at line %d", lineno)
+		}
+
+		node := lookupOrCreate(argv[0])
+		// Address and port: ip:port@cport.
+		addr, cport, found := strings.Cut(argv[1], "@")
+		if !found {
+			return false, fmt.Errorf("corrupted address at line %d", lineno)
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return false, fmt.Errorf("corrupted address at line %d: %w", lineno, err)
+		}
+		node.ip = host
+		node.port, _ = strconv.Atoi(port)
+		node.cport, _ = strconv.Atoi(cport)
+
+		node.flags = 0
+		for _, f := range strings.Split(argv[2], ",") {
+			switch f {
+			case "myself":
+				node.flags |= clusterNodeMyself
+				cs.myself = node
+			case "master":
+				node.flags |= clusterNodeMaster
+			case "fail?":
+				node.flags |= clusterNodePfail
+			case "fail":
+				node.flags |= clusterNodeFail
+				node.failTime = time.Now().UnixMilli()
+			case "noaddr":
+				node.flags |= clusterNodeNoAddr
+			}
+		}
+		node.configEpoch, _ = strconv.ParseUint(argv[6], 10, 64)
+
+		// Populate the hash slots served by this instance.
+		for _, arg := range argv[8:] {
+			if arg[0] == '[' {
+				// The migrating or importing slot: [slot->-node] or [slot-<-node].
+				arg = strings.Trim(arg, "[]")
+				if slot, name, ok := strings.Cut(arg, "->-"); ok {
+					j, _ := strconv.Atoi(slot)
+					cs.migratingSlotsTo[j] = lookupOrCreate(name)
+				} else if slot, name, ok := strings.Cut(arg, "-<-"); ok {
+					j, _ := strconv.Atoi(slot)
+					cs.importingSlotsFrom[j] = lookupOrCreate(name)
+				}
+				continue
+			}
+			start, end, _ := strings.Cut(arg, "-")
+			first, err1 := strconv.Atoi(start)
+			last := first
+			var err2 error
+			if end != "" {
+				last, err2 = strconv.Atoi(end)
+			}
+			if err1 != nil || err2 != nil || first < 0 || last >= cluster.Slots {
+				return false, fmt.Errorf("corrupted slot range at line %d", lineno)
+			}
+			for j := first; j <= last; j++ {
+				s.clusterAddSlot(node, j)
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return false, err
+	}
+	if cs.myself == nil {
+		return false, errors.New("myself node not found in the cluster config file")
+	}
+	slog.Info("node configuration loaded, I'm " + cs.myself.name)
+	return true, nil
+}
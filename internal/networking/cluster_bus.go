@@ -0,0 +1,772 @@
+package networking
+
+// The cluster bus.
+//
+// Every node has a TCP link with every other node of the cluster, the nodes
+// exchange PING and PONG messages carrying the configuration of the sender
+// (its config epoch and its slots) and a gossip section about a few random
+// nodes. This is how the nodes discover each other, agree on the owners of
+// the slots and detect the failures.
+//
+// The messages are gob-encoded. Every link has a writer goroutine, so that
+// sending a message never blocks, and a reader goroutine which processes the
+// received messages while holding the CmdLock.
+
+import (
+	"bufio"
+	"encoding/gob"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	. "github.com/sunminx/RDB/pkg/util"
+)
+
+// Types of the messages of the cluster bus.
+const (
+	clusterMsgTypePing   = iota // Ping.
+	clusterMsgTypePong          // Pong (reply to Ping).
+	clusterMsgTypeMeet          // Meet "let's join" message.
+	clusterMsgTypeFail          // Mark node xxx as failing.
+	clusterMsgTypeUpdate        // Another node slots configuration.
+	clusterMsgTypeCount         // Total number of message types.
+)
+
+// The buffered messages of a link, the messages are dropped when the buffer
+// is full, since the link can't keep up.
+const clusterLinkSendBufferSize = 1024
+
+// When a node is in FAIL state and is a master serving slots, the FAIL
+// flag is cleared after the node timeout multiplied by this factor if the
+// node is reachable again.
+const clusterFailUndoTimeMult = 2
+
+// The failure reports older than the node timeout multiplied by this
+// factor are expired.
+const clusterFailReportValidityMult = 2
+
+func clusterMsgTypeName(typ int) string {
+	switch typ {
+	case clusterMsgTypePing:
+		return "ping"
+	case clusterMsgTypePong:
+		return "pong"
+	case clusterMsgTypeMeet:
+		return "meet"
+	case clusterMsgTypeFail:
+		return "fail"
+	case clusterMsgTypeUpdate:
+		return "update"
+	}
+	return "unknown"
+}
+
+// clusterMsgGossip is what the sender knows about another node.
+type clusterMsgGossip struct {
+	Name         string
+	PingSent     int64
+	PongReceived int64
+	IP           string
+	Port         int
+	Cport        int
+	Flags        int
+}
+
+type clusterMsg struct {
+	Type         int
+	Sender       string
+	MyIP         string
+	Port         int
+	Cport        int
+	Flags        int
+	CurrentEpoch uint64
+	ConfigEpoch  uint64
+	Slots        slotBitmap
+
+	// PING, PONG and MEET.
+	Gossip []clusterMsgGossip
+
+	// FAIL.
+	FailNode string
+
+	// UPDATE.
+	UpdateNode        string
+	UpdateConfigEpoch uint64
+	UpdateSlots       slotBitmap
+}
+
+// clusterLink is a TCP link with another node. The links are created by us
+// in clusterCron (outbound links), or accepted by the bus listener (inbound
+// links), the node of an inbound link is known once it sent a message.
+type clusterLink struct {
+	conn   net.Conn
+	node   *clusterNode
+	sendCh chan *clusterMsg
+	ctime  int64
+	closed bool
+}
+
+// clusterListen starts listening for the links of the other nodes.
+func (s *Server) clusterListen() error {
+	cs := s.cluster
+	ip := s.Ip
+	if ip == "0.0.0.0" || ip == "::" {
+		ip = ""
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(cs.myself.cport)))
+	if err != nil {
+		return err
+	}
+	cs.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				slog.Warn("cluster bus stopped accepting connections", "err", err)
+				return
+			}
+			s.CmdLock.Lock()
+			s.createClusterLink(conn, nil)
+			s.CmdLock.Unlock()
+		}
+	}()
+	return nil
+}
+
+// createClusterLink creates the link on the connection, and starts the
+// goroutines reading and writing the link.
+func (s *Server) createClusterLink(conn net.Conn, node *clusterNode) *clusterLink {
+	link := &clusterLink{
+		conn:   conn,
+		node:   node,
+		sendCh: make(chan *clusterMsg, clusterLinkSendBufferSize),
+		ctime:  time.Now().UnixMilli(),
+	}
+	go link.writeLoop()
+	go s.clusterReadLoop(link)
+	return link
+}
+
+func (link *clusterLink) writeLoop() {
+	enc := gob.NewEncoder(link.conn)
+	for msg := range link.sendCh {
+		if err := enc.Encode(msg); err != nil {
+			// The reader notices the link is broken and frees it.
+			link.conn.Close()
+			for range link.sendCh {
+			}
+			return
+		}
+	}
+}
+
+func (s *Server) clusterReadLoop(link *clusterLink) {
+	dec := gob.NewDecoder(bufio.NewReader(link.conn))
+	for {
+		var msg clusterMsg
+		err := dec.Decode(&msg)
+		s.CmdLock.Lock()
+		if err != nil {
+			s.freeClusterLink(link)
+			s.CmdLock.Unlock()
+			return
+		}
+		if !link.closed {
+			s.clusterProcessPacket(link, &msg)
+		}
+		s.CmdLock.Unlock()
+	}
+}
+
+// freeClusterLink closes the link, it's unbound from its node.
+//
+// It should be called when holding the CmdLock.
+func (s *Server) freeClusterLink(link *clusterLink) {
+	if link == nil || link.closed {
+		return
+	}
+	link.closed = true
+	close(link.sendCh)
+	link.conn.Close()
+	if node := link.node; node != nil {
+		if node.link == link {
+			node.link = nil
+		}
+		if node.inboundLink == link {
+			node.inboundLink = nil
+		}
+	}
+}
+
+// clusterConnectNode creates the link with the node in background.
+func (s *Server) clusterConnectNode(node *clusterNode) {
+	node.connecting = true
+	addr := node.busAddr()
+	timeout := time.Duration(s.ClusterNodeTimeout) * time.Millisecond
+	go func() {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		s.CmdLock.Lock()
+		defer s.CmdLock.Unlock()
+		node.connecting = false
+		if s.cluster.nodes[node.name] != node {
+			// The node was removed in the meantime.
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			// The node is considered as timing out if we are not able to
+			// connect to it, as if the ping was not replied.
+			if node.pingSent == 0 {
+				node.pingSent = time.Now().UnixMilli()
+			}
+			slog.Debug("connecting with cluster node failed", "node", node.name, "addr", addr, "err", err)
+			return
+		}
+		node.link = s.createClusterLink(conn, node)
+
+		// Queue a PING in the new connection ASAP: this is crucial to avoid
+		// false positives in failure detection. If the node is flagged as
+		// MEET, we send a MEET message instead, to force the receiver to
+		// add us in its node table.
+		oldPingSent := node.pingSent
+		s.clusterSendPing(node.link, Cond(node.flags&clusterNodeMeet != 0, clusterMsgTypeMeet, clusterMsgTypePing))
+		if oldPingSent != 0 {
+			// The ping sent before the reconnection is still pending,
+			// so the failure detection isn't delayed.
+			node.pingSent = oldPingSent
+		}
+		node.flags &= ^clusterNodeMeet
+	}()
+}
+
+// clusterBuildMessage builds the header of the message, describing myself.
+func (s *Server) clusterBuildMessage(typ int) *clusterMsg {
+	cs := s.cluster
+	myself := cs.myself
+	return &clusterMsg{
+		Type:         typ,
+		Sender:       myself.name,
+		MyIP:         myself.ip,
+		Port:         myself.port,
+		Cport:        myself.cport,
+		Flags:        myself.flags,
+		CurrentEpoch: cs.currentEpoch,
+		ConfigEpoch:  myself.configEpoch,
+		Slots:        myself.slots,
+	}
+}
+
+func (s *Server) clusterSendMessage(link *clusterLink, msg *clusterMsg) {
+	if link == nil || link.closed {
+		return
+	}
+	select {
+	case link.sendCh <- msg:
+		s.cluster.statsMessagesSent[msg.Type]++
+	default:
+		slog.Warn("cluster link send buffer is full, message dropped", "type", clusterMsgTypeName(msg.Type))
+	}
+}
+
+// clusterBroadcastMessage sends the message to all the nodes we are
+// connected with, which completed the handshake.
+func (s *Server) clusterBroadcastMessage(msg *clusterMsg) {
+	for _, node := range s.cluster.nodes {
+		if node.flags&(clusterNodeMyself|clusterNodeHandshake) != 0 {
+			continue
+		}
+		s.clusterSendMessage(node.link, msg)
+	}
+}
+
+// clusterSendPing sends a PING, PONG or MEET message, with the gossip about
+// some random nodes, and about all the nodes in PFAIL state, since the
+// failure reports are needed to flag them as FAIL.
+func (s *Server) clusterSendPing(link *clusterLink, typ int) {
+	cs := s.cluster
+	msg := s.clusterBuildMessage(typ)
+
+	candidates := make([]*clusterNode, 0, len(cs.nodes))
+	var pfail []*clusterNode
+	for _, node := range cs.nodes {
+		// Don't include this node: the whole packet header is about us
+		// already. The nodes in handshake state or without an address are
+		// not useful, and the disconnected nodes without slots may be
+		// nodes which were removed from the cluster.
+		if node == cs.myself || node.flags&(clusterNodeHandshake|clusterNodeNoAddr) != 0 ||
+			(node.link == nil && node.numslots == 0) {
+			continue
+		}
+		if node.timedOut() {
+			pfail = append(pfail, node)
+			continue
+		}
+		candidates = append(candidates, node)
+	}
+
+	// We want to add at least 3 nodes, or a tenth of the nodes, so that the
+	// failure reports are received before the node timeout.
+	wanted := min(max(3, len(cs.nodes)/10), len(candidates))
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	for _, node := range append(candidates[:wanted], pfail...) {
+		msg.Gossip = append(msg.Gossip, clusterMsgGossip{
+			Name:         node.name,
+			PingSent:     node.pingSent,
+			PongReceived: node.pongReceived,
+			IP:           node.ip,
+			Port:         node.port,
+			Cport:        node.cport,
+			Flags:        node.flags,
+		})
+	}
+
+	if link.node != nil && typ == clusterMsgTypePing && link.node.pingSent == 0 {
+		link.node.pingSent = time.Now().UnixMilli()
+	}
+	s.clusterSendMessage(link, msg)
+}
+
+// clusterBroadcastPong sends a PONG to all the nodes, it is used to
+// propagate a new configuration as soon as possible.
+func (s *Server) clusterBroadcastPong() {
+	for _, node := range s.cluster.nodes {
+		if node.link == nil || node.flags&(clusterNodeMyself|clusterNodeHandshake) != 0 {
+			continue
+		}
+		s.clusterSendPing(node.link, clusterMsgTypePong)
+	}
+}
+
+// clusterSendFail tells all the nodes the node is failing.
+func (s *Server) clusterSendFail(name string) {
+	msg := s.clusterBuildMessage(clusterMsgTypeFail)
+	msg.FailNode = name
+	s.clusterBroadcastMessage(msg)
+}
+
+// clusterSendUpdate tells the node of the link the configuration of the node,
+// since the receiver claims slots with a stale configuration.
+func (s *Server) clusterSendUpdate(link *clusterLink, node *clusterNode) {
+	msg := s.clusterBuildMessage(clusterMsgTypeUpdate)
+	msg.UpdateNode = node.name
+	msg.UpdateConfigEpoch = node.configEpoch
+	msg.UpdateSlots = node.slots
+	s.clusterSendMessage(link, msg)
+}
+
+// clusterProcessPacket processes a message of the cluster bus.
+//
+// It should be called when holding the CmdLock.
+func (s *Server) clusterProcessPacket(link *clusterLink, msg *clusterMsg) {
+	cs := s.cluster
+	if msg.Type < 0 || msg.Type >= clusterMsgTypeCount {
+		slog.Warn("unknown cluster message type", "type", msg.Type)
+		return
+	}
+	cs.statsMessagesReceived[msg.Type]++
+	now := time.Now().UnixMilli()
+
+	sender := s.clusterLookupNode(msg.Sender)
+	if sender != nil && sender.inHandshake() {
+		sender = nil
+	}
+	// The node of an inbound link is learned from its messages.
+	if sender != nil && link.node == nil {
+		if sender.inboundLink != nil && sender.inboundLink != link {
+			s.freeClusterLink(sender.inboundLink)
+		}
+		sender.inboundLink = link
+		link.node = sender
+	}
+
+	if sender != nil {
+		// Update our current epoch if we see a newer epoch in the cluster.
+		if msg.CurrentEpoch > cs.currentEpoch {
+			cs.currentEpoch = msg.CurrentEpoch
+			cs.todoSaveConfig = true
+		}
+		if msg.ConfigEpoch > sender.configEpoch {
+			sender.configEpoch = msg.ConfigEpoch
+			cs.todoSaveConfig = true
+		}
+	}
+
+	switch msg.Type {
+	case clusterMsgTypePing, clusterMsgTypeMeet:
+		// We use the incoming messages in order to set the address for
+		// myself, since only the other nodes of the cluster send them.
+		if msg.Type == clusterMsgTypeMeet || cs.myself.ip == "" {
+			if ip := connLocalIP(link.conn); ip != "" && ip != cs.myself.ip {
+				cs.myself.ip = ip
+				slog.Info("IP address for this node updated to " + ip)
+				cs.todoSaveConfig = true
+			}
+		}
+
+		// Add this node if it is new for us and the message type is MEET.
+		// In this stage we don't try to add the node with the right flags
+		// and name, this will be resolved when we receive PONGs from the
+		// node.
+		if sender == nil && msg.Type == clusterMsgTypeMeet {
+			node := newClusterNode("", clusterNodeHandshake)
+			node.ip = Cond(msg.MyIP != "", msg.MyIP, connRemoteIP(link.conn))
+			node.port, node.cport = msg.Port, msg.Cport
+			s.clusterAddNode(node)
+			cs.todoSaveConfig = true
+			// If this is a MEET packet from an unknown node, we still
+			// process the gossip section here since we have to trust the
+			// sender because of the message type.
+			s.clusterProcessGossipSection(nil, msg)
+		}
+		// Anyway reply with a PONG.
+		s.clusterSendPing(link, clusterMsgTypePong)
+	}
+
+	switch msg.Type {
+	case clusterMsgTypePing, clusterMsgTypePong, clusterMsgTypeMeet:
+		if node := link.node; node != nil && node.link == link {
+			if node.inHandshake() {
+				// If we already have this node, try to change the IP/port
+				// of the node with the new one.
+				if sender != nil {
+					s.nodeUpdateAddressIfNeeded(sender, link, msg)
+					// Free this node as we already have it.
+					s.clusterDelNode(node)
+					return
+				}
+				// First thing to do is replacing the random name with the
+				// right node name if this was a handshake stage.
+				s.clusterRenameNode(node, msg.Sender)
+				node.flags &= ^clusterNodeHandshake
+				node.flags |= msg.Flags & (clusterNodeMaster | clusterNodeSlave)
+				cs.todoSaveConfig = true
+				sender = node
+			} else if node.name != msg.Sender {
+				// If the reply has a non matching node ID we disconnect
+				// this node and set it as not having an associated address.
+				slog.Info("PONG contains mismatching sender ID", "node", node.name, "sender", msg.Sender)
+				node.flags |= clusterNodeNoAddr
+				node.ip, node.port, node.cport = "", 0, 0
+				s.freeClusterLink(link)
+				cs.todoSaveConfig = true
+				return
+			}
+		}
+
+		// Update the address if the sender changed it.
+		if sender != nil && msg.Type == clusterMsgTypePing {
+			s.nodeUpdateAddressIfNeeded(sender, link, msg)
+		}
+
+		// Update our info about the node.
+		if node := link.node; node != nil && node.link == link && msg.Type == clusterMsgTypePong {
+			node.pongReceived = now
+			node.pingSent = 0
+			// The PFAIL condition can be reversed without external help
+			// if it is momentary (that is, if it does not turn into a
+			// FAIL state).
+			if node.timedOut() {
+				node.flags &= ^clusterNodePfail
+				cs.todoUpdateState = true
+			} else if node.failed() {
+				s.clearNodeFailureIfNeeded(node)
+			}
+		}
+
+		if sender == nil {
+			return
+		}
+
+		// Update our info about the served slots. If the sender claims
+		// slots we believe are served by another node with a greater
+		// config epoch, it has a stale configuration, tell it.
+		if sender.slots != msg.Slots {
+			s.clusterUpdateSlotsConfigWith(sender, msg.ConfigEpoch, &msg.Slots)
+			for j := 0; j < len(cs.slots); j++ {
+				if !msg.Slots.has(j) {
+					continue
+				}
+				if owner := cs.slots[j]; owner != nil && owner != sender && owner.configEpoch > msg.ConfigEpoch {
+					slog.Debug("node has an old slots configuration, sending an UPDATE message",
+						"node", sender.name, "slot", j, "owner", owner.name)
+					s.clusterSendUpdate(link, owner)
+					break
+				}
+			}
+		}
+
+		// If our config epoch collides with the sender's try to fix
+		// the problem.
+		if sender.isMaster() && cs.myself.isMaster() && msg.ConfigEpoch == cs.myself.configEpoch {
+			s.clusterHandleConfigEpochCollision(sender)
+		}
+
+		// Get info from the gossip section.
+		s.clusterProcessGossipSection(sender, msg)
+
+	case clusterMsgTypeFail:
+		if sender == nil {
+			return
+		}
+		failing := s.clusterLookupNode(msg.FailNode)
+		if failing != nil && failing.flags&(clusterNodeFail|clusterNodeMyself) == 0 {
+			slog.Info("FAIL message received", "from", sender.name, "about", failing.name)
+			failing.flags |= clusterNodeFail
+			failing.failTime = now
+			failing.flags &= ^clusterNodePfail
+			cs.todoUpdateState = true
+			cs.todoSaveConfig = true
+		}
+
+	case clusterMsgTypeUpdate:
+		if sender == nil {
+			return
+		}
+		node := s.clusterLookupNode(msg.UpdateNode)
+		if node == nil || node.configEpoch >= msg.UpdateConfigEpoch {
+			return
+		}
+		// Update the node's configEpoch.
+		node.configEpoch = msg.UpdateConfigEpoch
+		cs.todoSaveConfig = true
+		// Check the bitmap of served slots and update our config
+		// accordingly.
+		s.clusterUpdateSlotsConfigWith(node, msg.UpdateConfigEpoch, &msg.UpdateSlots)
+	}
+}
+
+// clusterProcessGossipSection processes what the sender knows about the other
+// nodes: the unknown nodes are met, and the failure reports are collected.
+func (s *Server) clusterProcessGossipSection(sender *clusterNode, msg *clusterMsg) {
+	cs := s.cluster
+	for _, g := range msg.Gossip {
+		node := s.clusterLookupNode(g.Name)
+		if node == nil {
+			// If it's not in NOADDR state and we don't have it, we add it
+			// to our trusted dict with exact nodeid and flag. Note that we
+			// cannot simply start a handshake against this IP/PORT pairs,
+			// since IP/PORT can be reused already, otherwise we risk
+			// joining another cluster.
+			if sender != nil && g.Flags&clusterNodeNoAddr == 0 && g.IP != "" {
+				node = newClusterNode(g.Name, clusterNodeMaster)
+				node.ip, node.port, node.cport = g.IP, g.Port, g.Cport
+				s.clusterAddNode(node)
+				cs.todoSaveConfig = true
+			}
+			continue
+		}
+
+		// We already know this node. Handle failure reports, only when the
+		// sender is a master.
+		if sender != nil && sender.isMaster() && node != cs.myself {
+			if g.Flags&(clusterNodeFail|clusterNodePfail) != 0 {
+				node.failReports[sender.name] = time.Now().UnixMilli()
+				s.markNodeAsFailingIfNeeded(node)
+			} else {
+				delete(node.failReports, sender.name)
+			}
+		}
+
+		// If we already know this node, but it is not reachable, and we see
+		// a different address in the gossip section of a node that can
+		// talk with this other node, update the address, disconnect the
+		// old link if any, so that we'll attempt to connect with the new
+		// address.
+		if node.flags&(clusterNodeFail|clusterNodePfail) != 0 && node.link == nil &&
+			g.IP != "" && (node.ip != g.IP || node.port != g.Port || node.cport != g.Cport) {
+			node.ip, node.port, node.cport = g.IP, g.Port, g.Cport
+			node.flags &= ^clusterNodeNoAddr
+			cs.todoSaveConfig = true
+		}
+	}
+}
+
+// nodeUpdateAddressIfNeeded updates the address of the node, if the sender
+// announces a different one. The link with the old address is freed.
+func (s *Server) nodeUpdateAddressIfNeeded(node *clusterNode, link *clusterLink, msg *clusterMsg) {
+	if node == s.cluster.myself || link == node.link {
+		return
+	}
+	ip := Cond(msg.MyIP != "", msg.MyIP, connRemoteIP(link.conn))
+	if node.ip == ip && node.port == msg.Port && node.cport == msg.Cport {
+		return
+	}
+	node.ip, node.port, node.cport = ip, msg.Port, msg.Cport
+	node.flags &= ^clusterNodeNoAddr
+	s.freeClusterLink(node.link)
+	slog.Info("address updated for node", "node", node.name, "addr", node.addr())
+	s.cluster.todoSaveConfig = true
+}
+
+// markNodeAsFailingIfNeeded flags the node in PFAIL state as FAIL, when the
+// majority of the masters reported it as failing. The other nodes are told
+// with a FAIL message, so that they flag the node as FAIL too.
+func (s *Server) markNodeAsFailingIfNeeded(node *clusterNode) {
+	cs := s.cluster
+	if !node.timedOut() || node.failed() {
+		return
+	}
+	needed := cs.size/2 + 1
+	failures := s.clusterNodeFailureReportsCount(node)
+	// Also count myself as a voter if I'm a master.
+	if cs.myself.isMaster() {
+		failures++
+	}
+	if failures < needed {
+		return
+	}
+	slog.Info("marking node as failing (quorum reached)", "node", node.name)
+
+	node.flags &= ^clusterNodePfail
+	node.flags |= clusterNodeFail
+	node.failTime = time.Now().UnixMilli()
+	s.clusterSendFail(node.name)
+	cs.todoUpdateState = true
+	cs.todoSaveConfig = true
+}
+
+// clusterNodeFailureReportsCount returns the number of valid failure reports.
+func (s *Server) clusterNodeFailureReportsCount(node *clusterNode) int {
+	maxAge := s.ClusterNodeTimeout * clusterFailReportValidityMult
+	now := time.Now().UnixMilli()
+	for name, t := range node.failReports {
+		if now-t > maxAge {
+			delete(node.failReports, name)
+		}
+	}
+	return len(node.failReports)
+}
+
+// clearNodeFailureIfNeeded clears the FAIL flag of the node which is
+// reachable again.
+func (s *Server) clearNodeFailureIfNeeded(node *clusterNode) {
+	now := time.Now().UnixMilli()
+	// For a master without slots, the FAIL flag is cleared immediately,
+	// since it doesn't need a failover.
+	if !node.isMaster() || node.numslots == 0 {
+		slog.Info("clear FAIL state for node: is reachable again", "node", node.name)
+		node.flags &= ^clusterNodeFail
+		s.cluster.todoUpdateState = true
+		s.cluster.todoSaveConfig = true
+		return
+	}
+	// If it is a master serving slots and it is still up after a while,
+	// nobody is taking over its slots, so the FAIL flag is cleared.
+	if now-node.failTime > s.ClusterNodeTimeout*clusterFailUndoTimeMult {
+		slog.Info("clear FAIL state for node: is reachable again and nobody is serving its slots after some time",
+			"node", node.name)
+		node.flags &= ^clusterNodeFail
+		s.cluster.todoUpdateState = true
+		s.cluster.todoSaveConfig = true
+	}
+}
+
+// clusterCron is called 10 times per second, it connects with the nodes,
+// pings them and detects the failures.
+func (s *Server) clusterCron() {
+	if !TryLockWithTimeout(s.CmdLock, 10*time.Millisecond) {
+		return
+	}
+	defer s.CmdLock.Unlock()
+
+	cs := s.cluster
+	now := time.Now().UnixMilli()
+	nodeTimeout := s.ClusterNodeTimeout
+	// The handshake timeout is the node timeout, but at least one second.
+	handshakeTimeout := max(nodeTimeout, 1000)
+
+	for _, node := range s.clusterSortedNodes() {
+		if node.flags&(clusterNodeMyself|clusterNodeNoAddr) != 0 {
+			continue
+		}
+		// A handshake node that never replied is removed.
+		if node.inHandshake() && now-node.ctime > handshakeTimeout {
+			s.clusterDelNode(node)
+			continue
+		}
+		if node.link == nil && !node.connecting {
+			s.clusterConnectNode(node)
+		}
+	}
+
+	// Ping some random node once every 10 iterations, so that we usually
+	// ping one random node every second.
+	if s.runWithPeriod(1000) {
+		var minPongNode *clusterNode
+		nodes := s.clusterSortedNodes()
+		for range 5 {
+			node := nodes[rand.Intn(len(nodes))]
+			// Don't ping nodes disconnected or with a ping currently active.
+			if node.link == nil || node.pingSent != 0 ||
+				node.flags&(clusterNodeMyself|clusterNodeHandshake) != 0 {
+				continue
+			}
+			if minPongNode == nil || minPongNode.pongReceived > node.pongReceived {
+				minPongNode = node
+			}
+		}
+		if minPongNode != nil {
+			s.clusterSendPing(minPongNode.link, clusterMsgTypePing)
+		}
+	}
+
+	for _, node := range cs.nodes {
+		if node.flags&(clusterNodeMyself|clusterNodeNoAddr|clusterNodeHandshake) != 0 {
+			continue
+		}
+		// If we are waiting for the PONG more than half the cluster
+		// timeout, reconnect the link: maybe there is a connection issue
+		// even if the node is alive.
+		if link := node.link; link != nil && now-link.ctime > nodeTimeout &&
+			node.pingSent != 0 && now-node.pingSent > nodeTimeout/2 &&
+			now-node.pongReceived > nodeTimeout/2 {
+			s.freeClusterLink(link)
+		}
+		// If we have currently no active ping in this instance, and the
+		// received PONG is older than half the cluster timeout, send a new
+		// ping now, to ensure all the nodes are pinged without a too big
+		// delay.
+		if node.link != nil && node.pingSent == 0 && now-node.pongReceived > nodeTimeout/2 {
+			s.clusterSendPing(node.link, clusterMsgTypePing)
+			continue
+		}
+		// Check if we are waiting for the PONG more than the timeout.
+		if node.pingSent != 0 && now-node.pingSent > nodeTimeout &&
+			node.flags&(clusterNodePfail|clusterNodeFail) == 0 {
+			slog.Debug("*** NODE is possibly failing", "node", node.name)
+			node.flags |= clusterNodePfail
+			cs.todoUpdateState = true
+		}
+	}
+
+	if cs.todoUpdateState || cs.state == clusterFail {
+		s.clusterUpdateState()
+	}
+	if cs.todoSaveConfig {
+		if err := s.clusterSaveConfig(); err != nil {
+			slog.Warn("saving the cluster config failed", "err", err)
+		}
+	}
+}
+
+func connLocalIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func connRemoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
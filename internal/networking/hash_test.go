@@ -0,0 +1,254 @@
+package networking
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sunminx/RDB/internal/db"
+	"github.com/sunminx/RDB/internal/hash"
+)
+
+// newHashTestClient returns a client of a server with the default hash
+// settings, see hash.MaxListpackEntries.
+func newHashTestClient() *Client {
+	s := NewServer()
+	s.Init()
+	s.DB = db.New()
+	return newParallelClient(s)
+}
+
+func TestHashCommands(t *testing.T) {
+	c := newHashTestClient()
+	for _, tc := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"hset", "h", "a", "1", "b", "2"}, ":2\r\n"},
+		{[]string{"hset", "h", "a", "10", "c", "3"}, ":1\r\n"},
+		{[]string{"hset", "h", "a"}, "-ERR wrong number of arguments for \"hset\" command\r\n"},
+		{[]string{"hmset", "h", "d", "4"}, "+OK\r\n"},
+		{[]string{"hsetnx", "h", "a", "x"}, ":0\r\n"},
+		{[]string{"hsetnx", "h", "e", "5"}, ":1\r\n"},
+		{[]string{"hget", "h", "a"}, "$2\r\n10\r\n"},
+		{[]string{"hget", "h", "nope"}, "$-1\r\n"},
+		{[]string{"hget", "nokey", "a"}, "$-1\r\n"},
+		{[]string{"hmget", "h", "b", "nope", "c"}, "*3\r\n$1\r\n2\r\n$-1\r\n$1\r\n3\r\n"},
+		{[]string{"hstrlen", "h", "a"}, ":2\r\n"},
+		{[]string{"hstrlen", "h", "nope"}, ":0\r\n"},
+		{[]string{"hincrby", "h", "a", "-15"}, ":-5\r\n"},
+		{[]string{"hincrby", "h", "new", "7"}, ":7\r\n"},
+		{[]string{"hincrby", "h", "a", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"hset", "h", "big", "9223372036854775807"}, ":1\r\n"},
+		{[]string{"hincrby", "h", "big", "1"}, "-ERR increment or decrement would overflow\r\n"},
+		{[]string{"hincrbyfloat", "h", "e", "0.5"}, "$3\r\n5.5\r\n"},
+		{[]string{"hincrbyfloat", "h", "f", "1e3"}, "$4\r\n1000\r\n"},
+		{[]string{"hset", "h", "s", "abc"}, ":1\r\n"},
+		{[]string{"hincrbyfloat", "h", "s", "1"}, "-ERR hash value is not a float\r\n"},
+		{[]string{"hincrby", "h", "s", "1"}, "-ERR hash value is not an integer\r\n"},
+		{[]string{"hdel", "h", "s", "big", "nope"}, ":2\r\n"},
+		{[]string{"hlen", "h"}, ":7\r\n"},
+		{[]string{"hlen", "nokey"}, ":0\r\n"},
+		{[]string{"hexists", "nokey", "a"}, ":0\r\n"},
+		{[]string{"hkeys", "nokey"}, "*0\r\n"},
+		{[]string{"hrandfield", "nokey"}, "$-1\r\n"},
+		{[]string{"hrandfield", "h", "0"}, "*0\r\n"},
+		{[]string{"hrandfield", "h", "1", "values"}, "-ERR syntax error\r\n"},
+		{[]string{"hrandfield", "h", "-4000000000000"}, "-ERR value is out of range\r\n"},
+		{[]string{"hrandfield", "h", "-1048577", "withvalues"}, "-ERR value is out of range\r\n"},
+		{[]string{"hscan", "nokey", "0"}, "*2\r\n$1\r\n0\r\n*0\r\n"},
+		{[]string{"hscan", "h", "x"}, "-ERR invalid cursor\r\n"},
+		{[]string{"hscan", "h", "0", "count", "0"}, "-ERR syntax error\r\n"},
+		{[]string{"hscan", "h", "0", "match", "a*", "novalues"}, "*2\r\n$1\r\n0\r\n*1\r\n$1\r\na\r\n"},
+		{[]string{"hscan", "h", "0", "match", "[ab]"}, "*2\r\n$1\r\n0\r\n*4\r\n$1\r\na\r\n$2\r\n-5\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{[]string{"set", "str", "v"}, "+OK\r\n"},
+		{[]string{"hget", "str", "a"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"hdel", "h", "a", "b", "c", "d", "e", "f", "new"}, ":7\r\n"},
+		{[]string{"exists", "h"}, ":0\r\n"},
+	} {
+		if reply := runMockCommand(c, tc.args...); reply != tc.reply {
+			t.Errorf("%v: %q, %q expected", tc.args, reply, tc.reply)
+		}
+	}
+}
+
+func TestHGetAllAndHRandField(t *testing.T) {
+	c := newHashTestClient()
+	runMockCommand(c, "hset", "h", "a", "1", "b", "2", "c", "3")
+
+	reply := runMockCommand(c, "hgetall", "h")
+	if !strings.HasPrefix(reply, "*6\r\n") {
+		t.Fatalf("hgetall: %q", reply)
+	}
+	for _, pair := range []string{"$1\r\na\r\n$1\r\n1\r\n", "$1\r\nb\r\n$1\r\n2\r\n", "$1\r\nc\r\n$1\r\n3\r\n"} {
+		if !strings.Contains(reply, pair) {
+			t.Errorf("hgetall: %q has no %q", reply, pair)
+		}
+	}
+	if reply := runMockCommand(c, "hvals", "h"); !strings.HasPrefix(reply, "*3\r\n") || !strings.Contains(reply, "$1\r\n3\r\n") {
+		t.Errorf("hvals: %q", reply)
+	}
+
+	// The fields are distinct with a positive count, up to all of them.
+	reply = runMockCommand(c, "hrandfield", "h", "10")
+	if !strings.HasPrefix(reply, "*3\r\n") || strings.Count(reply, "a\r\n") != 1 {
+		t.Errorf("hrandfield 10: %q", reply)
+	}
+	if reply := runMockCommand(c, "hrandfield", "h", "-10", "withvalues"); !strings.HasPrefix(reply, "*20\r\n") {
+		t.Errorf("hrandfield -10 withvalues: %q", reply)
+	}
+	if reply := runMockCommand(c, "hrandfield", "h"); !strings.HasPrefix(reply, "$1\r\n") {
+		t.Errorf("hrandfield: %q", reply)
+	}
+}
+
+// TestHScanHashtable scans a hashtable while it is modified, the fields in
+// it for the whole scan are returned.
+func TestHScanHashtable(t *testing.T) {
+	c := newHashTestClient()
+	const n = 2000
+	for i := range n {
+		runMockCommand(c, "hset", "h", "f"+strconv.Itoa(i), "v")
+	}
+
+	seen := make(map[string]int)
+	cursor, calls := "0", 0
+	for {
+		reply := runMockCommand(c, "hscan", "h", cursor, "count", "50", "novalues")
+		lines := strings.Split(reply, "\r\n")
+		// *2 $len cursor *n $len field ...
+		cursor = lines[2]
+		for i := 5; i < len(lines)-1; i += 2 {
+			seen[lines[i]]++
+		}
+		calls++
+		switch calls {
+		case 5:
+			for i := n; i < 2*n; i++ {
+				runMockCommand(c, "hset", "h", "f"+strconv.Itoa(i), "v")
+			}
+		case 10:
+			for i := n; i < 2*n; i++ {
+				runMockCommand(c, "hdel", "h", "f"+strconv.Itoa(i))
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	for i := range n {
+		if seen["f"+strconv.Itoa(i)] != 1 {
+			t.Fatalf("f%d scanned %d times in %d calls", i, seen["f"+strconv.Itoa(i)], calls)
+		}
+	}
+	if calls < 40 {
+		t.Errorf("%d calls of 50 fields for %d fields", calls, n)
+	}
+}
+
+func TestHashFieldExpireCommands(t *testing.T) {
+	c := newHashTestClient()
+	later := strconv.FormatInt(time.Now().Unix()+1000, 10)
+	for _, tc := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"hset", "h", "a", "1", "b", "2", "c", "3"}, ":3\r\n"},
+		{[]string{"hexpire", "nokey", "10", "fields", "1", "a"}, "*1\r\n:-2\r\n"},
+		{[]string{"hexpire", "h", "10", "fields", "2", "a"}, "-ERR The `numfields` parameter must match the number of arguments\r\n"},
+		{[]string{"hexpire", "h", "10", "fields", "0", "a"}, "-ERR Number of fields must be a positive integer\r\n"},
+		{[]string{"hexpire", "h", "10", "xx", "1", "a"}, "-ERR Mandatory argument FIELDS is missing or not at the right position\r\n"},
+		{[]string{"hexpire", "h", "-1", "fields", "1", "a"}, "-ERR invalid expire time, must be >= 0\r\n"},
+		{[]string{"hexpire", "h", "99999999999999", "fields", "1", "a"}, "-ERR invalid expire time in 'hexpire' command\r\n"},
+		{[]string{"hexpire", "h", "100", "xx", "fields", "1", "a"}, "*1\r\n:0\r\n"},
+		{[]string{"hexpire", "h", "100", "nx", "fields", "2", "a", "nope"}, "*2\r\n:1\r\n:-2\r\n"},
+		{[]string{"hexpire", "h", "200", "nx", "fields", "1", "a"}, "*1\r\n:0\r\n"},
+		{[]string{"hexpire", "h", "50", "gt", "fields", "1", "a"}, "*1\r\n:0\r\n"},
+		{[]string{"hexpire", "h", "200", "gt", "fields", "2", "a", "b"}, "*2\r\n:1\r\n:0\r\n"},
+		{[]string{"hpexpire", "h", "100000", "lt", "fields", "2", "a", "b"}, "*2\r\n:1\r\n:1\r\n"},
+		{[]string{"httl", "h", "fields", "3", "a", "c", "nope"}, "*3\r\n:100\r\n:-1\r\n:-2\r\n"},
+		{[]string{"hexpireat", "h", later, "fields", "1", "c"}, "*1\r\n:1\r\n"},
+		{[]string{"hexpiretime", "h", "fields", "1", "c"}, "*1\r\n:" + later + "\r\n"},
+		{[]string{"hpexpiretime", "h", "fields", "1", "c"}, "*1\r\n:" + later + "000\r\n"},
+		{[]string{"hpersist", "h", "fields", "3", "a", "a", "nope"}, "*3\r\n:1\r\n:-1\r\n:-2\r\n"},
+		{[]string{"hpttl", "nokey", "fields", "1", "a"}, "*1\r\n:-2\r\n"},
+		// A new value removes the TTL, an increment keeps it.
+		{[]string{"hincrby", "h", "b", "1"}, ":3\r\n"},
+		{[]string{"hset", "h", "c", "4"}, ":0\r\n"},
+		{[]string{"httl", "h", "fields", "2", "b", "c"}, "*2\r\n:100\r\n:-1\r\n"},
+		// A time already past deletes the fields, and the key with them.
+		{[]string{"hpexpireat", "h", "1", "fields", "2", "a", "b"}, "*2\r\n:2\r\n:2\r\n"},
+		{[]string{"hgetall", "h"}, "*2\r\n$1\r\nc\r\n$1\r\n4\r\n"},
+		{[]string{"hexpire", "h", "0", "fields", "1", "c"}, "*1\r\n:2\r\n"},
+		{[]string{"exists", "h"}, ":0\r\n"},
+	} {
+		if reply := runMockCommand(c, tc.args...); reply != tc.reply {
+			t.Errorf("%v: %q, %q expected", tc.args, reply, tc.reply)
+		}
+	}
+}
+
+// TestHashFieldExpirePropagation checks the commands fed to the AOF for the
+// field expires, which don't depend on the time they are executed.
+func TestHashFieldExpirePropagation(t *testing.T) {
+	c := newHashTestClient()
+	c.Server.AofState = AofOn
+	runMockCommand(c, "hset", "h", "a", "1", "b", "2")
+	propagated := func(args ...string) string {
+		c.Server.AofBuf = nil
+		runMockCommand(c, args...)
+		return string(c.Server.AofBuf)
+	}
+	command := func(args ...string) string {
+		argv := make([][]byte, len(args))
+		for i, arg := range args {
+			argv[i] = []byte(arg)
+		}
+		return string(catCommand(argv))
+	}
+
+	got := propagated("hpexpire", "h", "100000", "nx", "fields", "2", "a", "nope")
+	val, _ := c.DB.LookupKeyRead("h")
+	expire := strconv.FormatInt(hash.GetExpire(val, []byte("a")), 10)
+	if want := command("HPEXPIREAT", "h", expire, "FIELDS", "1", "a"); got != want {
+		t.Errorf("hpexpire is propagated as %q, %q expected", got, want)
+	}
+	// HSET would remove the TTL.
+	if got, want := propagated("hincrbyfloat", "h", "a", "0.5"), command("hincrbyfloat", "h", "a", "0.5"); got != want {
+		t.Errorf("hincrbyfloat is propagated as %q, %q expected", got, want)
+	}
+	if got := propagated("hpersist", "h", "fields", "1", "b"); got != "" {
+		t.Errorf("hpersist without a TTL is propagated as %q", got)
+	}
+	if got, want := propagated("hexpire", "h", "0", "fields", "2", "a", "b"), command("HDEL", "h", "a", "b"); got != want {
+		t.Errorf("hexpire in the past is propagated as %q, %q expected", got, want)
+	}
+}
+
+// TestActiveFieldExpire deletes the expired fields from databasesCron, the
+// hashes are read from a snapshot, which doesn't expire the fields.
+func TestActiveFieldExpire(t *testing.T) {
+	c := newHashTestClient()
+	s := c.Server
+	for i := range 10 {
+		key := "h" + strconv.Itoa(i)
+		runMockCommand(c, "hset", key, "a", "1", "b", "2")
+		runMockCommand(c, "hpexpire", key, "1", "fields", "1", "a")
+	}
+	time.Sleep(5 * time.Millisecond)
+	for range 100 {
+		s.databasesCron()
+	}
+
+	snap := s.DB.Snapshot()
+	defer snap.Release()
+	for e := range snap.Iterator() {
+		if hash.Exists(e.Val, []byte("a")) || !hash.Exists(e.Val, []byte("b")) {
+			t.Errorf("the fields of %s are not expired", e.Key)
+		}
+	}
+	if snap.Len() != 10 {
+		t.Errorf("%d keys left", snap.Len())
+	}
+}
@@ -0,0 +1,126 @@
+package networking
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	. "github.com/sunminx/RDB/pkg/util"
+)
+
+// infoSection is a section of the INFO command, gen writes its fields
+// as "<field>:<value>\r\n" lines.
+type infoSection struct {
+	name string
+	gen  func(s *Server, b *strings.Builder)
+}
+
+var infoSections = []infoSection{
+	{"server", genServerInfo},
+	{"memory", genMemoryInfo},
+	{"persistence", genPersistenceInfo},
+	{"replication", genReplicationInfo},
+	{"keyspace", genKeyspaceInfo},
+}
+
+// Info is the implementation of the INFO command. section is the name of
+// a section, or one of all, default and everything for all of them.
+func (c *Client) Info(section string) {
+	all := section == "all" || section == "default" || section == "everything"
+	var b strings.Builder
+	for _, sec := range infoSections {
+		if !all && sec.name != section {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", strings.ToUpper(sec.name[:1])+sec.name[1:])
+		sec.gen(c.Server, &b)
+	}
+	c.addReplyBulkString(b.String())
+}
+
+func genServerInfo(s *Server, b *strings.Builder) {
+	fmt.Fprintf(b, "redis_version:%s\r\n", s.Version)
+	fmt.Fprintf(b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(b, "tcp_port:%d\r\n", s.Port)
+	fmt.Fprintf(b, "hz:%d\r\n", s.Hz)
+	fmt.Fprintf(b, "io_threads:%d\r\n", s.IoThreads)
+	fmt.Fprintf(b, "config_file:%s\r\n", s.ConfigFile)
+}
+
+func genMemoryInfo(s *Server, b *strings.Builder) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	fmt.Fprintf(b, "used_memory:%d\r\n", ms.HeapAlloc)
+	fmt.Fprintf(b, "lazyfree_pending_objects:%d\r\n", s.lazyfreeObjects.Load())
+	fmt.Fprintf(b, "lazyfreed_objects:%d\r\n", s.lazyfreedObjects.Load())
+}
+
+func genPersistenceInfo(s *Server, b *strings.Builder) {
+	loading := s.Loading.Load()
+	fmt.Fprintf(b, "loading:%d\r\n", Cond(loading, 1, 0))
+	fmt.Fprintf(b, "async_loading:%d\r\n", Cond(loading && s.AsyncLoading, 1, 0))
+	if loading {
+		genLoadingInfo(s, b)
+	}
+	fmt.Fprintf(b, "rdb_changes_since_last_save:%d\r\n", s.Dirty)
+	fmt.Fprintf(b, "rdb_bgsave_in_progress:%d\r\n", Cond(s.RdbChildRunning.Load(), 1, 0))
+	fmt.Fprintf(b, "rdb_last_save_time:%d\r\n", s.LastSave/1000)
+	fmt.Fprintf(b, "rdb_last_bgsave_status:%s\r\n", Cond(s.RdbLastBgsaveOk, "ok", "err"))
+	fmt.Fprintf(b, "aof_enabled:%d\r\n", Cond(s.AofState != AofOff, 1, 0))
+	fmt.Fprintf(b, "aof_rewrite_in_progress:%d\r\n", Cond(s.AofChildRunning.Load(), 1, 0))
+	fmt.Fprintf(b, "aof_rewrite_scheduled:%d\r\n", Cond(s.aofRewriteScheduled, 1, 0))
+	fmt.Fprintf(b, "aof_last_write_status:%s\r\n",
+		Cond(s.AofLastWriteStatus == aofWriteOk && !s.aofBioFsyncFailed.Load(), "ok", "err"))
+	if s.AofState != AofOff {
+		fmt.Fprintf(b, "aof_current_size:%d\r\n", s.AofCurrSize)
+		fmt.Fprintf(b, "aof_base_size:%d\r\n", s.AofRewriteBaseSize)
+		s.propagateMu.Lock()
+		fmt.Fprintf(b, "aof_buffer_length:%d\r\n", len(s.AofBuf))
+		s.propagateMu.Unlock()
+		fmt.Fprintf(b, "aof_pending_bio_fsync:%d\r\n", s.bioPendingJobsOfType(bioAofFsync))
+		fmt.Fprintf(b, "aof_delayed_fsync:%d\r\n", s.AofDelayedFsync)
+	}
+}
+
+// genLoadingInfo writes the progress of the loading, the ETA is estimated
+// by the average speed so far.
+func genLoadingInfo(s *Server, b *strings.Builder) {
+	total := s.LoadingTotalBytes.Load()
+	loaded := s.LoadingLoadedBytes.Load()
+	elapsed := time.Now().UnixMilli() - s.LoadingStartTime
+	var perc float64
+	if total > 0 {
+		perc = float64(loaded) / float64(total) * 100
+	}
+	eta := int64(1)
+	if loaded > 0 {
+		eta = elapsed * (total - loaded) / loaded / 1000
+	}
+	fmt.Fprintf(b, "loading_start_time:%d\r\n", s.LoadingStartTime/1000)
+	fmt.Fprintf(b, "loading_total_bytes:%d\r\n", total)
+	fmt.Fprintf(b, "loading_loaded_bytes:%d\r\n", loaded)
+	fmt.Fprintf(b, "loading_loaded_perc:%.2f\r\n", perc)
+	fmt.Fprintf(b, "loading_eta_seconds:%d\r\n", max(eta, 0))
+}
+
+func genReplicationInfo(s *Server, b *strings.Builder) {
+	fmt.Fprintf(b, "role:%s\r\n", Cond(s.MasterHost == "", "master", "slave"))
+	if s.MasterHost != "" {
+		fmt.Fprintf(b, "master_host:%s\r\n", s.MasterHost)
+		fmt.Fprintf(b, "master_port:%d\r\n", s.MasterPort)
+	}
+	fmt.Fprintf(b, "connected_slaves:%d\r\n", len(s.slaves))
+	fmt.Fprintf(b, "master_replid:%s\r\n", s.ReplId)
+	fmt.Fprintf(b, "master_repl_offset:%d\r\n", s.MasterReplOffset)
+}
+
+func genKeyspaceInfo(s *Server, b *strings.Builder) {
+	if n := s.DB.Len(); n > 0 {
+		fmt.Fprintf(b, "db0:keys=%d,expires=%d\r\n", n, s.DB.ExpiresLen())
+	}
+}
@@ -0,0 +1,60 @@
+package networking
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sunminx/RDB/internal/db"
+	"github.com/sunminx/RDB/internal/sds"
+)
+
+func runMockCommand(c *Client, args ...string) string {
+	c.reply = c.reply[:0]
+	c.argv = make([][]byte, len(args))
+	for i, arg := range args {
+		c.argv[i] = []byte(arg)
+	}
+	c.argc = len(args)
+	c.processCommand()
+	c.serializeReplies()
+	return string(c.reply)
+}
+
+func TestProcessCommandWhileLoading(t *testing.T) {
+	c := NewMockClient(nil)
+	s := c.Server
+	s.Init()
+	s.DB = db.New()
+	c.DB = s.DB
+	s.DB.SetKey("a", sds.NewRobj(sds.New([]byte("one"))))
+	s.Loading.Store(true)
+	s.LoadingTotalBytes.Store(200)
+	s.LoadingLoadedBytes.Store(50)
+
+	if reply := runMockCommand(c, "get", "a"); !strings.HasPrefix(reply, "-LOADING") {
+		t.Errorf("get while loading: %q", reply)
+	}
+	reply := runMockCommand(c, "info", "persistence")
+	for _, field := range []string{"loading:1\r\n", "async_loading:0\r\n",
+		"loading_total_bytes:200\r\n", "loading_loaded_perc:25.00\r\n"} {
+		if !strings.Contains(reply, field) {
+			t.Errorf("info persistence: %q has no %q", reply, field)
+		}
+	}
+
+	// The read commands are served by the keys loaded so far.
+	s.AsyncLoading = true
+	if reply := runMockCommand(c, "get", "a"); reply != "$3\r\none\r\n" {
+		t.Errorf("get while async loading: %q", reply)
+	}
+	if reply := runMockCommand(c, "set", "a", "two"); !strings.HasPrefix(reply, "-LOADING") {
+		t.Errorf("set while async loading: %q", reply)
+	}
+
+	s.Loading.Store(false)
+	reply = runMockCommand(c, "info")
+	if !strings.Contains(reply, "loading:0\r\n") || strings.Contains(reply, "loading_total_bytes") ||
+		!strings.Contains(reply, "# Keyspace\r\ndb0:keys=1,expires=0\r\n") {
+		t.Errorf("info: %q", reply)
+	}
+}
@@ -0,0 +1,149 @@
+package networking
+
+import "strconv"
+
+// The traffic of a client is served by its event loop in three phases, see
+// processTrafficEvent:
+//
+//  1. the query is read and parsed into the pending commands of the client,
+//     see processInputBuffer;
+//  2. the pending commands are executed in order, each one in its critical
+//     section, see call. The replies are only recorded as reply items;
+//  3. the reply items are serialized into the protocol and written.
+//
+// Only the second phase holds the locks, the parsing and the serialization
+// of the clients of the different event loops, see io-threads, run in
+// parallel. Since a client is only served by its own event loop, the
+// pipelined commands of a connection are executed and replied in order.
+
+// pendingCommand is a command parsed and not executed yet.
+type pendingCommand struct {
+	argv [][]byte
+	// err is the protocol error replied in place of a command, after the
+	// replies of the commands before it.
+	err []byte
+}
+
+type replyKind uint8
+
+const (
+	// replyRaw is data already encoded in the protocol.
+	replyRaw replyKind = iota
+	replyStatus
+	replyError
+	replyInt
+	replyUint
+	replyBulk
+	// replyBulkInt is the integer n replied as a bulk string.
+	replyBulkInt
+	replyArrayLen
+)
+
+// replyItem is a reply recorded by a command, it is serialized out of the
+// critical section of the command, by serializeReplies.
+type replyItem struct {
+	kind replyKind
+	n    int64
+	data []byte
+}
+
+// Above this size the reply arena of a client isn't reused, so that a big
+// reply doesn't keep its memory.
+const replyArenaMaxSize = 64 * 1024
+
+// addReplyItem records a reply. The data is copied, since it may reference
+// the memory of a value, which is modified by the next commands.
+func (c *Client) addReplyItem(kind replyKind, n int64, data []byte) {
+	start := len(c.replyArena)
+	c.replyArena = append(c.replyArena, data...)
+	end := len(c.replyArena)
+	c.replies = append(c.replies, replyItem{kind: kind, n: n, data: c.replyArena[start:end:end]})
+}
+
+// serializeReplies encodes the recorded replies in c.reply.
+func (c *Client) serializeReplies() {
+	for _, r := range c.replies {
+		switch r.kind {
+		case replyRaw:
+			c.reply = append(c.reply, r.data...)
+		case replyStatus:
+			c.reply = append(c.reply, '+')
+			c.reply = append(c.reply, r.data...)
+			c.reply = append(c.reply, "\r\n"...)
+		case replyError:
+			if len(r.data) == 0 || r.data[0] != '-' {
+				c.reply = append(c.reply, "-ERR "...)
+			}
+			c.reply = append(c.reply, r.data...)
+			c.reply = append(c.reply, "\r\n"...)
+		case replyInt:
+			c.reply = append(c.reply, ':')
+			c.reply = strconv.AppendInt(c.reply, r.n, 10)
+			c.reply = append(c.reply, "\r\n"...)
+		case replyUint:
+			c.reply = append(c.reply, ':')
+			c.reply = strconv.AppendUint(c.reply, uint64(r.n), 10)
+			c.reply = append(c.reply, "\r\n"...)
+		case replyBulk:
+			c.reply = append(c.reply, '$')
+			c.reply = strconv.AppendInt(c.reply, int64(len(r.data)), 10)
+			c.reply = append(c.reply, "\r\n"...)
+			c.reply = append(c.reply, r.data...)
+			c.reply = append(c.reply, "\r\n"...)
+		case replyBulkInt:
+			var buf [20]byte
+			num := strconv.AppendInt(buf[:0], r.n, 10)
+			c.reply = append(c.reply, '$')
+			c.reply = strconv.AppendInt(c.reply, int64(len(num)), 10)
+			c.reply = append(c.reply, "\r\n"...)
+			c.reply = append(c.reply, num...)
+			c.reply = append(c.reply, "\r\n"...)
+		case replyArrayLen:
+			c.reply = append(c.reply, '*')
+			c.reply = strconv.AppendInt(c.reply, r.n, 10)
+			c.reply = append(c.reply, "\r\n"...)
+		}
+	}
+	c.discardReplyItems()
+}
+
+func (c *Client) discardReplyItems() {
+	clear(c.replies)
+	c.replies = c.replies[:0]
+	if cap(c.replyArena) > replyArenaMaxSize {
+		c.replyArena = nil
+	} else {
+		c.replyArena = c.replyArena[:0]
+	}
+}
+
+// discardReplies drops the replies of the client, eg. the replies to the
+// master.
+func (c *Client) discardReplies() {
+	c.discardReplyItems()
+	c.reply = c.reply[:0]
+}
+
+// processPendingCommands executes the pending commands in order, until the
+// client is blocked, its commands are then executed once it is unblocked.
+func (c *Client) processPendingCommands() {
+	// The arguments of a command being parsed are kept across the commands.
+	argv, argc := c.argv, c.argc
+	defer func() { c.argv, c.argc = argv, argc }()
+	i := 0
+	for ; i < len(c.pending); i++ {
+		if c.checkFlag(blocked) || c.checkFlag(closeASAP) {
+			break
+		}
+		pc := c.pending[i]
+		if pc.err != nil {
+			c.AddReplyError(pc.err)
+			continue
+		}
+		c.SetArgument(pc.argv)
+		c.processCommand()
+	}
+	n := copy(c.pending, c.pending[i:])
+	clear(c.pending[n:])
+	c.pending = c.pending[:n]
+}
@@ -0,0 +1,73 @@
+package networking
+
+// Lazy freeing of the deleted values. The memory of a value is reclaimed
+// by the GC once it is unreachable, so there is no free to move out of the
+// event loop: a value released lazily is kept by a job of the bioLazyFree
+// worker until the job runs, which only drops it. What this provides is
+// the interface of Redis, UNLINK, FLUSHALL ASYNC and the lazyfree-lazy-*
+// directives, and its stats of the lazily released objects.
+
+import (
+	"github.com/sunminx/RDB/internal/cmd"
+	"github.com/sunminx/RDB/internal/hash"
+	"github.com/sunminx/RDB/internal/list"
+	obj "github.com/sunminx/RDB/internal/object"
+)
+
+// lazyfreeThreshold is the free effort above which a value is released
+// in background, the smaller values are released at once.
+const lazyfreeThreshold = 64
+
+// lazyfreeGetFreeEffort returns the number of the elements of val, as the
+// cost of releasing it.
+func lazyfreeGetFreeEffort(val *obj.Robj) int64 {
+	switch val.Type() {
+	case obj.TypeList:
+		return int64(list.Cnt(val))
+	case obj.TypeHash:
+		return hash.Len(val)
+	default:
+		return 1
+	}
+}
+
+// freeObjectAsync releases val in background if it is big enough.
+func (s *Server) freeObjectAsync(val *obj.Robj) {
+	if lazyfreeGetFreeEffort(val) <= lazyfreeThreshold {
+		return
+	}
+	s.lazyfreeObjects.Add(1)
+	s.bioSubmitJob(bioLazyFree, func() {
+		_ = val
+		s.lazyfreeObjects.Add(-1)
+		s.lazyfreedObjects.Add(1)
+	})
+}
+
+// emptyDbAsync removes all the keys, which are released in background, and
+// returns their number.
+func (s *Server) emptyDbAsync() int {
+	old := s.DB.Detach()
+	n := int64(old.Len())
+	if n == 0 {
+		return 0
+	}
+	s.lazyfreeObjects.Add(n)
+	s.bioSubmitJob(bioLazyFree, func() {
+		_ = old
+		s.lazyfreeObjects.Add(-n)
+		s.lazyfreedObjects.Add(n)
+	})
+	return int(n)
+}
+
+// FlushAll is the implementation of the FLUSHALL and FLUSHDB commands,
+// flags is one of cmd.FlushDefault, cmd.FlushSync and cmd.FlushAsync. It
+// returns the number of the keys removed.
+func (c *Client) FlushAll(flags int) int {
+	s := c.Server
+	if flags == cmd.FlushAsync || (flags == cmd.FlushDefault && s.LazyfreeLazyUserFlush) {
+		return s.emptyDbAsync()
+	}
+	return s.DB.Empty()
+}
@@ -0,0 +1,52 @@
+package networking
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sunminx/RDB/internal/list"
+	"github.com/sunminx/RDB/internal/sds"
+)
+
+func TestUnlinkAndFlushAllAsync(t *testing.T) {
+	c := NewMockClient(nil)
+	s := c.Server
+	s.DB = NewServer().DB
+	s.Init()
+	c.DB = s.DB
+
+	val := list.NewRobj(list.NewQuicklist())
+	for i := range lazyfreeThreshold + 1 {
+		list.Push(val, []byte("v"+strconv.Itoa(i)))
+	}
+	s.DB.SetKey("big", val)
+	s.DB.SetKey("small", sds.NewRobj(sds.New([]byte("one"))))
+
+	// A slow release in progress.
+	release := make(chan struct{})
+	s.bioSubmitJob(bioLazyFree, func() { <-release })
+	if reply := runMockCommand(c, "unlink", "big", "small", "none"); reply != ":2\r\n" {
+		t.Fatalf("unlink: %q", reply)
+	}
+	if reply := runMockCommand(c, "info", "memory"); !strings.Contains(reply, "lazyfree_pending_objects:1\r\n") {
+		t.Errorf("info memory: %q", reply)
+	}
+	close(release)
+	waitBioJobs(t, s, bioLazyFree)
+
+	for i := range 3 {
+		s.DB.SetKey("k"+strconv.Itoa(i), sds.NewRobj(sds.New([]byte("one"))))
+	}
+	if reply := runMockCommand(c, "flushall", "now"); !strings.HasPrefix(reply, "-ERR") {
+		t.Errorf("flushall now: %q", reply)
+	}
+	if reply := runMockCommand(c, "flushall", "async"); reply != "+OK\r\n" || s.DB.Len() != 0 {
+		t.Fatalf("flushall async: %q, %d keys", reply, s.DB.Len())
+	}
+	waitBioJobs(t, s, bioLazyFree)
+	reply := runMockCommand(c, "info", "memory")
+	if !strings.Contains(reply, "lazyfree_pending_objects:0\r\n") || !strings.Contains(reply, "lazyfreed_objects:4\r\n") {
+		t.Errorf("info memory: %q", reply)
+	}
+}
@@ -0,0 +1,234 @@
+package networking
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/sunminx/RDB/internal/cmd"
+	obj "github.com/sunminx/RDB/internal/object"
+	. "github.com/sunminx/RDB/pkg/util"
+)
+
+const (
+	// migrateSocketCacheItems is the max number of the cached sockets.
+	migrateSocketCacheItems = 64
+	// migrateSocketCacheTTL is the time in milliseconds after which an
+	// unused cached socket is closed.
+	migrateSocketCacheTTL = 10 * 1000
+)
+
+// migrateSocket is a connection to the target instance of MIGRATE, which
+// is cached for the next MIGRATEs, that usually move many keys to the
+// same instance.
+type migrateSocket struct {
+	conn    net.Conn
+	rd      *bufio.Reader
+	lastUse int64
+	// lastDB is the DB selected by the last MIGRATE, a new connection
+	// starts from the DB 0.
+	lastDB int
+}
+
+var (
+	errMigrateConnect = errors.New("-IOERR error or timeout connecting to the client")
+	errMigrateWrite   = errors.New("-IOERR error or timeout writing to target instance")
+	errMigrateRead    = errors.New("-IOERR error or timeout reading to target instance")
+)
+
+// DumpObject serializes val as the payload of DUMP.
+func (c *Client) DumpObject(val *obj.Robj) []byte {
+	return c.Server.Dumper.DumpObject(c.Server, val)
+}
+
+// RestoreObject deserializes the payload of DUMP.
+func (c *Client) RestoreObject(payload []byte) (*obj.Robj, error) {
+	return c.Server.Dumper.RestoreObject(c.Server, payload)
+}
+
+// migrateGetSocket returns the cached socket to addr, or connects to it.
+// The second result tells if the socket was cached.
+func (s *Server) migrateGetSocket(addr string, timeout time.Duration) (*migrateSocket, bool, error) {
+	if ms, ok := s.migrateSockets[addr]; ok {
+		ms.lastUse = s.UnixTime
+		return ms, true, nil
+	}
+	if s.migrateSockets == nil {
+		s.migrateSockets = make(map[string]*migrateSocket)
+	}
+	// Too many items, drop one at random.
+	if len(s.migrateSockets) == migrateSocketCacheItems {
+		for addr := range s.migrateSockets {
+			s.migrateCloseSocket(addr)
+			break
+		}
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	ms := &migrateSocket{conn: conn, rd: bufio.NewReader(conn), lastUse: s.UnixTime}
+	s.migrateSockets[addr] = ms
+	return ms, false, nil
+}
+
+func (s *Server) migrateCloseSocket(addr string) {
+	if ms, ok := s.migrateSockets[addr]; ok {
+		ms.conn.Close()
+		delete(s.migrateSockets, addr)
+	}
+}
+
+// migrateCloseTimedoutSockets closes the cached sockets not used for
+// migrateSocketCacheTTL, it is called by the cron.
+func (s *Server) migrateCloseTimedoutSockets() {
+	for addr, ms := range s.migrateSockets {
+		if s.UnixTime-ms.lastUse > migrateSocketCacheTTL {
+			s.migrateCloseSocket(addr)
+		}
+	}
+}
+
+// Migrate is the implementation of the MIGRATE command. The keys are
+// restored by the target instance by a pipeline of RESTORE commands, and
+// the ones restored are deleted here, unless opts.Copy is set. It returns
+// the number of keys found here.
+//
+// Like Redis, the event loop is blocked until the target instance replies
+// or the timeout is reached.
+func (c *Client) Migrate(opts *cmd.MigrateOptions) (int, error) {
+	s := c.Server
+	var keys []string
+	var vals []*obj.Robj
+	for _, key := range opts.Keys {
+		if val, ok := c.LookupKeyRead(key); ok {
+			keys = append(keys, key)
+			vals = append(vals, val)
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	addr := net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
+	for retry := true; ; retry = false {
+		ms, cached, err := s.migrateGetSocket(addr, opts.Timeout)
+		if err != nil {
+			return 0, errMigrateConnect
+		}
+		err = c.migrateKeys(ms, opts, keys, vals)
+		if errors.Is(err, errMigrateWrite) || errors.Is(err, errMigrateRead) {
+			s.migrateCloseSocket(addr)
+			// The cached socket may have been closed by the target
+			// instance in the meantime, so the keys are sent again by
+			// a new connection, unless a part of them was moved.
+			if cached && retry && errors.Is(err, errMigrateWrite) {
+				continue
+			}
+		}
+		return len(keys), err
+	}
+}
+
+// migrateKeys sends the keys to the target instance, and deletes the ones
+// restored by it. The error replies of the target instance are returned
+// as an error, after processing all the replies.
+func (c *Client) migrateKeys(ms *migrateSocket, opts *cmd.MigrateOptions,
+	keys []string, vals []*obj.Robj) error {
+	s := c.Server
+	var buf []byte
+	if len(opts.Auth) > 0 {
+		buf = append(buf, catCommand(toArgv(append([]string{"AUTH"}, opts.Auth...)))...)
+	}
+	selectDB := ms.lastDB != opts.DB
+	if selectDB {
+		buf = append(buf, catCommand(toArgv([]string{"SELECT", strconv.Itoa(opts.DB)}))...)
+	}
+	// The target node may be importing the slot, so RESTORE-ASKING is
+	// used in cluster mode.
+	restore := []byte("RESTORE")
+	if s.ClusterEnabled {
+		restore = []byte("RESTORE-ASKING")
+	}
+	now := time.Now().UnixMilli()
+	for i, key := range keys {
+		var ttl int64
+		if expire := int64(c.Expire(key)); expire != -1 {
+			ttl = max(expire-now, 1)
+		}
+		argv := [][]byte{restore, []byte(key), []byte(strconv.FormatInt(ttl, 10)), c.DumpObject(vals[i])}
+		if opts.Replace {
+			argv = append(argv, []byte("REPLACE"))
+		}
+		buf = append(buf, catCommand(argv)...)
+	}
+
+	ms.conn.SetDeadline(time.Now().Add(opts.Timeout))
+	if _, err := ms.conn.Write(buf); err != nil {
+		return errMigrateWrite
+	}
+
+	var replyErr error
+	// readReplyOk reads a reply and reports if it is not an error reply,
+	// the first error reply is kept in replyErr.
+	readReplyOk := func() (bool, error) {
+		reply, err := readReply(ms.rd)
+		if err != nil {
+			return false, errMigrateRead
+		}
+		if e, ok := reply.(respError); ok {
+			if replyErr == nil {
+				replyErr = errors.New("Target instance replied with error: " + string(e))
+			}
+			return false, nil
+		}
+		return true, nil
+	}
+	if len(opts.Auth) > 0 {
+		if _, err := readReplyOk(); err != nil {
+			return err
+		}
+	}
+	if selectDB {
+		ok, err := readReplyOk()
+		if err != nil {
+			return err
+		}
+		// The DB is unknown if SELECT failed.
+		ms.lastDB = Cond(ok, opts.DB, -1)
+	}
+
+	var deleted [][]byte
+	var err error
+	for _, key := range keys {
+		var ok bool
+		if ok, err = readReplyOk(); err != nil {
+			break
+		}
+		if ok && !opts.Copy {
+			c.DelKey(key)
+			deleted = append(deleted, []byte(key))
+		}
+	}
+	ms.lastUse = s.UnixTime
+
+	// The deleted keys are propagated as a DEL.
+	if len(deleted) > 0 {
+		c.SetArgument(append([][]byte{[]byte("DEL")}, deleted...))
+		c.AddDirty(len(deleted))
+	}
+	if err != nil {
+		return err
+	}
+	return replyErr
+}
+
+func toArgv(args []string) [][]byte {
+	argv := make([][]byte, len(args))
+	for i, arg := range args {
+		argv[i] = []byte(arg)
+	}
+	return argv
+}
@@ -0,0 +1,107 @@
+package networking
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/sunminx/RDB/internal/cmd"
+)
+
+// Save is the implementation of the SAVE command.
+func (c *Client) Save() error {
+	s := c.Server
+	if s.RdbChildRunning.Load() {
+		return errors.New("Background save already in progress")
+	}
+	if !s.rdbSave() {
+		return errors.New("Errors trying to SAVE the DB, check the logs")
+	}
+	return nil
+}
+
+// rdbSave saves the RDB file in the foreground, no background save has
+// to be in progress.
+func (s *Server) rdbSave() bool {
+	if !s.RdbSave(s) {
+		return false
+	}
+	s.Dirty = 0
+	s.LastSave = time.Now().UnixMilli()
+	return true
+}
+
+// Bgsave is the implementation of the BGSAVE command, it returns true if
+// the save is scheduled because another background persisting is running.
+//
+// The CmdLock is held by the command, so the snapshot is taken now and the
+// file has the DB at the time of the command. With schedule the save waits
+// for the AOF rewrite or the transfer to the replicas, and it is started by
+// the cron.
+func (c *Client) Bgsave(schedule bool) (bool, error) {
+	s := c.Server
+	if s.RdbChildRunning.Load() && s.RdbChildType != RdbChildTypeSocket {
+		return false, errors.New("Background save already in progress")
+	}
+	if s.RdbChildRunning.Load() || s.AofChildRunning.Load() {
+		if !schedule {
+			return false, errors.New("Another child process is active (AOF?): can't BGSAVE right now. " +
+				"Use BGSAVE SCHEDULE in order to schedule a BGSAVE whenever possible.")
+		}
+		s.rdbBgsaveScheduled = true
+		return true, nil
+	}
+	if !s.RdbSaveBackgroundLocked(s) {
+		return false, errors.New("Background saving failed, check the logs")
+	}
+	return false, nil
+}
+
+// BgrewriteAof is the implementation of the BGREWRITEAOF command, the
+// rewrite is started by the next cron. With AOF off the rewrite only
+// produces a new base file, like in Redis.
+func (c *Client) BgrewriteAof() error {
+	s := c.Server
+	if s.AofChildRunning.Load() || s.aofRewriteScheduled {
+		return errors.New("Background append only file rewriting already in progress")
+	}
+	s.aofRewriteScheduled = true
+	return nil
+}
+
+// LastSave returns the unix time of the last successful save.
+func (c *Client) LastSave() int64 {
+	return c.Server.LastSave / 1000
+}
+
+// Shutdown is the implementation of the SHUTDOWN command. The shutdown
+// is performed by the cron, like the one started by SIGTERM.
+func (c *Client) Shutdown(flags int) error {
+	s := c.Server
+	if flags&cmd.ShutdownAbort != 0 {
+		if !s.Shutdown.Load() {
+			return errors.New("No shutdown in progress.")
+		}
+		s.abortShutdown()
+		slog.Warn("shutdown aborted by the user")
+		return nil
+	}
+	slog.Info("user requested shutdown...")
+	s.shutdownFlags = flags
+	s.Shutdown.Store(true)
+	return nil
+}
+
+// abortShutdown cancels the shutdown in progress, the server goes on serving.
+func (s *Server) abortShutdown() {
+	s.Shutdown.Store(false)
+	s.ShutdownStartTime = 0
+	s.shutdownFlags = 0
+	// The background persisting was canceled by the shutdown, the
+	// next ones need a new context.
+	if s.CancelCalled {
+		s.Ctx, s.CancelFunc = context.WithCancel(context.Background())
+		s.CancelCalled = false
+	}
+}
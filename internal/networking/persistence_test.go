@@ -0,0 +1,92 @@
+package networking
+
+import (
+	"testing"
+
+	"github.com/sunminx/RDB/internal/cmd"
+)
+
+// bgsaveDumper starts no save, it only marks the RDB child as running.
+type bgsaveDumper struct {
+	Dumper
+}
+
+func (bgsaveDumper) RdbSaveBackgroundLocked(s *Server) bool {
+	s.RdbChildRunning.Store(ChildInRunning)
+	s.RdbChildType = RdbChildTypeDisk
+	return true
+}
+
+func TestBgsave(t *testing.T) {
+	c := NewMockClient(nil)
+	s := c.Server
+	s.Dumper = bgsaveDumper{}
+	// The save is started by the command, not by the cron.
+	if scheduled, err := c.Bgsave(false); err != nil || scheduled || s.rdbBgsaveScheduled ||
+		!s.RdbChildRunning.Load() {
+		t.Fatalf("scheduled %v err %v", scheduled, err)
+	}
+	if _, err := c.Bgsave(true); err == nil {
+		t.Error("BGSAVE accepted while another one is in progress")
+	}
+
+	// BGSAVE SCHEDULE waits for the AOF rewrite.
+	s.RdbChildRunning.Store(ChildNotInRunning)
+	s.AofChildRunning.Store(ChildInRunning)
+	if _, err := c.Bgsave(false); err == nil {
+		t.Error("BGSAVE accepted during an AOF rewrite")
+	}
+	if scheduled, err := c.Bgsave(true); err != nil || !scheduled || !s.rdbBgsaveScheduled {
+		t.Errorf("BGSAVE SCHEDULE during an AOF rewrite scheduled %v err %v", scheduled, err)
+	}
+
+	s.rdbBgsaveScheduled = false
+	s.AofChildRunning.Store(ChildNotInRunning)
+	s.RdbChildRunning.Store(ChildInRunning)
+	s.RdbChildType = RdbChildTypeSocket
+	if _, err := c.Bgsave(false); err == nil {
+		t.Error("BGSAVE accepted during the transfer to the replicas")
+	}
+	if scheduled, err := c.Bgsave(true); err != nil || !scheduled || !s.rdbBgsaveScheduled {
+		t.Errorf("BGSAVE SCHEDULE scheduled %v err %v", scheduled, err)
+	}
+}
+
+func TestBgrewriteAof(t *testing.T) {
+	c := NewMockClient(nil)
+	s := c.Server
+	// A background save doesn't delay the rewrite, and the AOF may be off.
+	s.RdbChildRunning.Store(ChildInRunning)
+	if err := c.BgrewriteAof(); err != nil || !s.aofRewriteScheduled {
+		t.Errorf("scheduled %v err %v", s.aofRewriteScheduled, err)
+	}
+	if err := c.BgrewriteAof(); err == nil {
+		t.Error("BGREWRITEAOF accepted while another one is pending")
+	}
+	s.aofRewriteScheduled = false
+	s.AofChildRunning.Store(ChildInRunning)
+	if err := c.BgrewriteAof(); err == nil {
+		t.Error("BGREWRITEAOF accepted during an AOF rewrite")
+	}
+}
+
+func TestShutdownAbort(t *testing.T) {
+	c := NewMockClient(nil)
+	s := c.Server
+	if err := c.Shutdown(cmd.ShutdownAbort); err == nil {
+		t.Error("aborted without a shutdown in progress")
+	}
+	if err := c.Shutdown(cmd.ShutdownNosave | cmd.ShutdownNow); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Shutdown.Load() || s.shutdownFlags != cmd.ShutdownNosave|cmd.ShutdownNow {
+		t.Fatalf("shutdown %v flags %d", s.Shutdown.Load(), s.shutdownFlags)
+	}
+	s.ShutdownStartTime = 1
+	if err := c.Shutdown(cmd.ShutdownAbort); err != nil {
+		t.Fatal(err)
+	}
+	if s.Shutdown.Load() || s.isShutdownInited() || s.shutdownFlags != 0 {
+		t.Errorf("shutdown %v flags %d", s.Shutdown.Load(), s.shutdownFlags)
+	}
+}
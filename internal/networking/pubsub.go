@@ -0,0 +1,132 @@
+package networking
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/sunminx/RDB/internal/common"
+)
+
+// pubsubChannels are the channels the clients subscribed to, with the
+// subscribers. They are protected by the CmdLock.
+type pubsubChannels map[string]map[*Client]struct{}
+
+// Subscribe subscribes the client to the channels.
+func (c *Client) Subscribe(channels []string) {
+	s := c.Server
+	if s.pubsubChannels == nil {
+		s.pubsubChannels = make(pubsubChannels)
+	}
+	if c.pubsubChannels == nil {
+		c.pubsubChannels = make(map[string]struct{})
+	}
+	for _, channel := range channels {
+		if _, ok := c.pubsubChannels[channel]; !ok {
+			c.pubsubChannels[channel] = struct{}{}
+			if s.pubsubChannels[channel] == nil {
+				s.pubsubChannels[channel] = make(map[*Client]struct{})
+			}
+			s.pubsubChannels[channel][c] = struct{}{}
+		}
+		c.addReplyPubsubCount("subscribe", channel)
+	}
+	c.setFlag(pubsub)
+}
+
+// Unsubscribe unsubscribes the client from the channels, or from all the
+// channels if none is given.
+func (c *Client) Unsubscribe(channels []string) {
+	if len(channels) == 0 {
+		channels = c.subscribedChannels()
+		// We were subscribed to nothing? Still reply to the client.
+		if len(channels) == 0 {
+			c.AddReplyMultibulkLen(3)
+			c.addReplyBulkString("unsubscribe")
+			c.AddReplyRaw(common.Shared["nullbulk"])
+			c.AddReplyInt64(0)
+		}
+	}
+	for _, channel := range channels {
+		c.pubsubUnsubscribeChannel(channel)
+		c.addReplyPubsubCount("unsubscribe", channel)
+	}
+	if len(c.pubsubChannels) == 0 {
+		c.flag &= ^pubsub
+	}
+}
+
+// Publish sends the message to the subscribers of the channel, it returns
+// the number of the subscribers which received the message.
+func (c *Client) Publish(channel string, message []byte) int {
+	return c.Server.pubsubPublishMessage(channel, message)
+}
+
+func (s *Server) pubsubPublishMessage(channel string, message []byte) int {
+	subscribers := s.pubsubChannels[channel]
+	if len(subscribers) == 0 {
+		return 0
+	}
+	buf := []byte("*3\r\n$7\r\nmessage\r\n")
+	buf = appendBulkString(buf, channel)
+	buf = appendBulkString(buf, string(message))
+	for c := range subscribers {
+		c.writeAsync(buf)
+	}
+	return len(subscribers)
+}
+
+// pubsubUnsubscribeAllChannels is called when the client is freed.
+//
+// It should be called when holding the CmdLock.
+func (c *Client) pubsubUnsubscribeAllChannels() {
+	for channel := range c.pubsubChannels {
+		c.pubsubUnsubscribeChannel(channel)
+	}
+	c.flag &= ^pubsub
+}
+
+func (c *Client) pubsubUnsubscribeChannel(channel string) {
+	s := c.Server
+	delete(c.pubsubChannels, channel)
+	if subscribers, ok := s.pubsubChannels[channel]; ok {
+		delete(subscribers, c)
+		if len(subscribers) == 0 {
+			delete(s.pubsubChannels, channel)
+		}
+	}
+}
+
+func (c *Client) subscribedChannels() []string {
+	channels := make([]string, 0, len(c.pubsubChannels))
+	for channel := range c.pubsubChannels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func (c *Client) addReplyPubsubCount(kind, channel string) {
+	c.AddReplyMultibulkLen(3)
+	c.addReplyBulkString(kind)
+	c.addReplyBulkString(channel)
+	c.AddReplyInt64(int64(len(c.pubsubChannels)))
+}
+
+// writeAsync writes p to the client out of its own command execution.
+func (c *Client) writeAsync(p []byte) {
+	if c.Conn == nil {
+		c.AddReplyRaw(p)
+		return
+	}
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	_ = c.Conn.AsyncWrite(buf, nil)
+}
+
+func appendBulkString(buf []byte, s string) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(s)), 10)
+	buf = append(buf, "\r\n"...)
+	buf = append(buf, s...)
+	return append(buf, "\r\n"...)
+}
@@ -0,0 +1,1277 @@
+package networking
+
+// Replication overview.
+//
+// A replica connects to its master as a normal client and performs a small
+// handshake (PING, REPLCONF listening-port, REPLCONF capa), then it sends
+// PSYNC <replid> <offset> where replid/offset identify the history of the
+// dataset it already has.
+//
+//  1. If the master knows the history (replid is its current or previous id)
+//     and the requested offset is still covered by its backlog, it answers
+//     +CONTINUE and streams the missing part of the backlog (partial resync).
+//  2. Otherwise it answers +FULLRESYNC <replid> <offset>, takes a snapshot by
+//     BGSAVE and transfers the RDB file as a bulk payload. The writes executed
+//     after the snapshot was taken are accumulated and sent after the payload.
+//
+// Once the replica is online every write command is propagated to it from
+// Client.propagateNow, and the same bytes are appended to the replication
+// backlog so that a replica which loses the link for a short time is able to
+// continue from where it stopped. The replica reports the processed offset
+// with REPLCONF ACK <offset> every second.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"github.com/sunminx/RDB/internal/db"
+	. "github.com/sunminx/RDB/pkg/util"
+)
+
+// State of the replication from the point of view of the replica.
+const (
+	replStateNone       int32 = iota // No active replication.
+	replStateConnect                 // Must connect to master.
+	replStateConnecting              // Connecting to master, doing the handshake.
+	replStateTransfer                // Receiving the RDB payload from master.
+	replStateConnected               // Connected to master.
+)
+
+// State of a replica from the point of view of the master.
+const (
+	slaveStateNone            = iota
+	slaveStateWaitBgsaveStart // We need to produce a new RDB file.
+	slaveStateWaitBgsaveEnd   // Waiting for the RDB file creation to finish.
+	slaveStateOnline          // RDB file transmitted, sending just updates.
+)
+
+// Capabilities of a replica, declared with REPLCONF capa.
+const (
+	slaveCapaNone   = 0
+	slaveCapaEof    = 1 << 0 // Can parse the RDB EOF streaming format.
+	slaveCapaPsync2 = 1 << 1 // Supports PSYNC2 protocol.
+)
+
+// How the replica loads the RDB received by a diskless transfer.
+const (
+	ReplDisklessLoadDisabled    = iota // Save the RDB to disk, then load it.
+	ReplDisklessLoadWhenDbEmpty        // Load from the socket if the dataset is empty.
+	ReplDisklessLoadSwapdb             // Load from the socket into a new dataset.
+)
+
+const (
+	defReplBacklogSize       = 1024 * 1024
+	defReplPingPeriod        = 10
+	defReplTimeout           = 60
+	defReplDisklessSyncDelay = 5
+)
+
+// configRunIdSize is the length of the replication id in hex characters.
+const configRunIdSize = 40
+
+var (
+	errReplicaNoMasterLink = errors.New("NOMASTERLINK Can't SYNC while not connected with my master")
+	errReplicaSyncAborted  = errors.New("master aborted the synchronization")
+)
+
+// genRunId generates a random replication id of configRunIdSize hex characters.
+func genRunId() string {
+	buf := make([]byte, configRunIdSize/2)
+	if _, err := rand.Read(buf); err != nil {
+		// Fallback to the current time which is unique enough for a replid.
+		return fmt.Sprintf("%040x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// replBacklog is a circular buffer holding the latest part of the replication
+// stream, it is used to serve the partial resynchronizations.
+type replBacklog struct {
+	buf []byte
+	// idx is the position in buf where the next byte is written.
+	idx int64
+	// histlen is the amount of valid data in the backlog.
+	histlen int64
+	// off is the replication offset of the first byte in the backlog.
+	off int64
+}
+
+// newReplBacklog creates a backlog whose first byte will be at replication offset off.
+func newReplBacklog(size, off int64) *replBacklog {
+	return &replBacklog{
+		buf: make([]byte, size),
+		off: off,
+	}
+}
+
+func (b *replBacklog) size() int64 {
+	return int64(len(b.buf))
+}
+
+// feed appends p to the backlog, discarding the oldest data if needed.
+func (b *replBacklog) feed(p []byte) {
+	size := b.size()
+	b.histlen += int64(len(p))
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + int64(n)) % size
+		p = p[n:]
+	}
+	if b.histlen > size {
+		b.off += b.histlen - size
+		b.histlen = size
+	}
+}
+
+// contains reports whether the stream starting at replication offset
+// off can be served from the backlog.
+func (b *replBacklog) contains(off int64) bool {
+	return off >= b.off && off <= b.off+b.histlen
+}
+
+// rangeFrom returns a copy of the data in the backlog starting at replication offset off.
+// The caller should check the offset with contains firstly.
+func (b *replBacklog) rangeFrom(off int64) []byte {
+	size := b.size()
+	skip := off - b.off
+	ln := b.histlen - skip
+	data := make([]byte, 0, ln)
+	if ln <= 0 {
+		return data
+	}
+	pos := (b.idx - b.histlen + skip + size) % size
+	for ln > 0 {
+		n := Cond(pos+ln > size, size-pos, ln)
+		data = append(data, b.buf[pos:pos+n]...)
+		ln -= n
+		pos = (pos + n) % size
+	}
+	return data
+}
+
+// masterLink is the connection of a replica with its master.
+type masterLink struct {
+	host   string
+	port   int
+	conn   net.Conn
+	cli    *Client
+	cancel context.CancelFunc
+	// wmu serializes the writes, the ACKs are sent both by the cron and by
+	// the goroutine which processes the replication stream.
+	wmu             sync.Mutex
+	lastInteraction atomic.Int64
+}
+
+func (l *masterLink) write(p []byte) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	if l.conn == nil {
+		return errors.New("master link is not connected")
+	}
+	_, err := l.conn.Write(p)
+	return err
+}
+
+func (l *masterLink) sendCommand(args ...string) error {
+	argv := make([][]byte, 0, len(args))
+	for _, arg := range args {
+		argv = append(argv, []byte(arg))
+	}
+	return l.write(catCommand(argv))
+}
+
+// CurrentReplOffset returns the replication offset of the dataset, or -1 if
+// the replication stream is not being recorded since there is no backlog.
+//
+// It should be called when holding the CmdLock.
+func (s *Server) CurrentReplOffset() int64 {
+	if s.replBacklog == nil {
+		return -1
+	}
+	return s.MasterReplOffset
+}
+
+// createReplBacklogIfNeeded creates the backlog the first time a replica
+// connects, before that the replication stream isn't recorded at all.
+func (s *Server) createReplBacklogIfNeeded() {
+	if s.replBacklog != nil {
+		return
+	}
+	s.replBacklog = newReplBacklog(s.ReplBacklogSize, s.MasterReplOffset+1)
+	// A new backlog means a new history, since the writes before this point
+	// were not accounted in the master offset.
+	s.ReplId = genRunId()
+	s.ReplId2 = ""
+	s.SecondReplOffset = -1
+}
+
+// shiftReplicationId uses the current replication id as secondary id and
+// creates a new one, the replicas of the old master are still able to
+// partially resync with us until the offset in which we switched.
+func (s *Server) shiftReplicationId() {
+	s.ReplId2 = s.ReplId
+	// The offset is +1 since the replicas ask for the next byte they want.
+	s.SecondReplOffset = s.MasterReplOffset + 1
+	s.ReplId = genRunId()
+	slog.Info("setting secondary replication ID", "replid2", s.ReplId2,
+		"offset", s.SecondReplOffset, "replid", s.ReplId)
+}
+
+// replicationFeedSlaves appends the command stream to the backlog and sends
+// it to the replicas.
+//
+// It should be called when holding the CmdLock and the propagateMu.
+func (s *Server) replicationFeedSlaves(buf []byte) {
+	// If there are no replicas and no backlog, there is no need to
+	// accumulate the stream at all.
+	if s.replBacklog == nil && len(s.slaves) == 0 {
+		return
+	}
+	s.createReplBacklogIfNeeded()
+	s.replBacklog.feed(buf)
+	s.MasterReplOffset += int64(len(buf))
+
+	for _, slave := range s.slaves {
+		slave.feedReplicationStream(buf)
+	}
+}
+
+// feedReplicationStream sends the stream to the replica or keeps it in the
+// pending buffer if the replica is still waiting for the RDB file.
+func (c *Client) feedReplicationStream(buf []byte) {
+	switch c.replState {
+	case slaveStateWaitBgsaveStart:
+		// The stream is not needed since the snapshot is not yet created.
+	case slaveStateWaitBgsaveEnd:
+		c.replPending = append(c.replPending, buf...)
+	case slaveStateOnline:
+		if c.replStartStreamOnAck {
+			c.replPending = append(c.replPending, buf...)
+		} else {
+			c.writeToReplica(buf)
+		}
+	}
+}
+
+// writeToReplica writes p to the replica, the write is always asynchronous
+// since the replication stream may be fed from the goroutine that processes
+// the stream of our own master.
+func (c *Client) writeToReplica(p []byte) {
+	c.writeAsync(p)
+}
+
+// Psync is the implementation of SYNC and PSYNC, the replid is empty for SYNC.
+func (c *Client) Psync(replid string, offset int64) {
+	s := c.Server
+	// Ignore SYNC if already replica or in monitor mode.
+	if c.checkFlag(slave) {
+		return
+	}
+
+	// Refuse SYNC requests if we are a replica but the link with our master
+	// is not ok, since our dataset may be stale.
+	if s.MasterHost != "" && s.replState.Load() != replStateConnected {
+		c.AddReplyError([]byte(errReplicaNoMasterLink.Error()))
+		return
+	}
+
+	if replid != "" {
+		if s.tryPartialResynchronization(c, replid, offset) {
+			return
+		}
+	}
+
+	// Full resynchronization.
+	c.setFlag(slave)
+	c.replState = slaveStateWaitBgsaveStart
+	c.psyncFullResync = replid != ""
+	s.slaves = append(s.slaves, c)
+	s.createReplBacklogIfNeeded()
+	slog.Info("replica asks for synchronization, full resync is needed",
+		"replica", c.replicaName(), "replid", replid, "offset", offset)
+
+	// If a BGSAVE to disk is in progress and the writes performed after its
+	// snapshot are still in the backlog, we can attach to it.
+	if s.RdbChildRunning.Load() && s.RdbChildType == RdbChildTypeDisk &&
+		s.RdbSaveOffset != -1 && s.replBacklog.contains(s.RdbSaveOffset+1) {
+		s.attachToBgsave(c)
+		slog.Info("waiting for end of BGSAVE for SYNC", "replica", c.replicaName())
+	} else {
+		// Otherwise the BGSAVE will be started by the replicationCron.
+		slog.Info("waiting for next BGSAVE for SYNC", "replica", c.replicaName())
+	}
+}
+
+// tryPartialResynchronization replies +CONTINUE and sends the backlog to the
+// replica if the requested history is available, otherwise it returns false
+// and a full resynchronization is needed.
+func (s *Server) tryPartialResynchronization(c *Client, replid string, offset int64) bool {
+	if s.replBacklog == nil {
+		return false
+	}
+	if !strings.EqualFold(replid, s.ReplId) &&
+		(!strings.EqualFold(replid, s.ReplId2) || offset > s.SecondReplOffset) {
+		if replid != "?" {
+			slog.Info("partial resynchronization not accepted, replication ID mismatch",
+				"replica", c.replicaName(), "replid", replid)
+		}
+		return false
+	}
+	if !s.replBacklog.contains(offset) {
+		slog.Info("unable to partial resync with replica, lack of backlog",
+			"replica", c.replicaName(), "offset", offset)
+		return false
+	}
+
+	c.setFlag(slave)
+	c.replState = slaveStateOnline
+	c.replAckTime = s.UnixTime
+	s.slaves = append(s.slaves, c)
+
+	data := s.replBacklog.rangeFrom(offset)
+	c.writeToReplica([]byte("+CONTINUE " + s.ReplId + "\r\n"))
+	if len(data) > 0 {
+		c.writeToReplica(data)
+	}
+	slog.Info("partial resynchronization request accepted",
+		"replica", c.replicaName(), "sending(bytes)", len(data), "offset", offset)
+	return true
+}
+
+// attachToBgsave marks the replica as waiting for the end of the current BGSAVE.
+// The writes performed after the snapshot was taken are copied from the backlog.
+func (s *Server) attachToBgsave(c *Client) {
+	c.replState = slaveStateWaitBgsaveEnd
+	c.psyncInitialOffset = s.RdbSaveOffset
+	c.replPending = s.replBacklog.rangeFrom(s.RdbSaveOffset + 1)
+	if c.psyncFullResync {
+		reply := fmt.Sprintf("+FULLRESYNC %s %d\r\n", s.ReplId, c.psyncInitialOffset)
+		c.writeToReplica([]byte(reply))
+	}
+}
+
+// replicationStartPendingFork starts a BGSAVE for the replicas which are
+// waiting for a new snapshot.
+func (s *Server) replicationStartPendingFork() {
+	waiting, maxIdle, mincapa := 0, int64(0), -1
+	now := time.Now().UnixMilli()
+	s.CmdLock.Lock()
+	for _, slave := range s.slaves {
+		if slave.replState == slaveStateWaitBgsaveStart {
+			waiting++
+			maxIdle = max(maxIdle, now-slave.lastInteraction.Load())
+			mincapa &= slave.replCapa
+		}
+	}
+	s.CmdLock.Unlock()
+
+	if waiting == 0 || s.RdbChildRunning.Load() {
+		return
+	}
+
+	// The RDB is streamed to the sockets only if all the replicas
+	// are able to parse the EOF format.
+	if s.ReplDisklessSync && mincapa&slaveCapaEof != 0 {
+		// Wait a bit in the hope that more replicas arrive, since the
+		// replicas arriving during the transfer have to wait for the next one.
+		if maxIdle < s.ReplDisklessSyncDelay*1000 {
+			return
+		}
+		s.rdbSaveToSlavesSockets(waiting)
+		return
+	}
+
+	slog.Info("starting BGSAVE for SYNC", "replicas", waiting, "target", "disk")
+	if !s.RdbSaveBackground(s) {
+		slog.Warn("BGSAVE for replication failed")
+		return
+	}
+
+	s.CmdLock.Lock()
+	defer s.CmdLock.Unlock()
+	for _, slave := range s.slaves {
+		if slave.replState == slaveStateWaitBgsaveStart {
+			s.attachToBgsave(slave)
+		}
+	}
+}
+
+// replicaSocketsWriter writes the RDB produced by a diskless BGSAVE to the
+// sockets of the replicas.
+type replicaSocketsWriter struct {
+	conns []gnet.Conn
+	// ready is closed once the replicas are attached, since the RDB
+	// must follow the +FULLRESYNC reply.
+	ready chan struct{}
+}
+
+func (w *replicaSocketsWriter) Write(p []byte) (int, error) {
+	<-w.ready
+	for _, conn := range w.conns {
+		buf := make([]byte, len(p))
+		copy(buf, p)
+		_ = conn.AsyncWrite(buf, nil)
+	}
+	return len(p), nil
+}
+
+// rdbSaveToSlavesSockets starts a BGSAVE which streams the RDB directly to
+// the sockets of the replicas waiting for it, without touching the disk.
+//
+// The payload is sent in the EOF format: $EOF:<mark>\r\n<rdb><mark>, since
+// its size is unknown in advance.
+func (s *Server) rdbSaveToSlavesSockets(waiting int) {
+	slog.Info("starting BGSAVE for SYNC", "replicas", waiting, "target", "replicas sockets")
+	wr := &replicaSocketsWriter{ready: make(chan struct{})}
+	if !s.RdbSaveToSlavesSockets(s, wr) {
+		slog.Warn("BGSAVE for replication failed")
+		return
+	}
+
+	s.CmdLock.Lock()
+	defer s.CmdLock.Unlock()
+	mark := genRunId()
+	for _, slave := range s.slaves {
+		if slave.replState == slaveStateWaitBgsaveStart {
+			s.attachToBgsave(slave)
+			slave.replEofMark = mark
+			slave.writeToReplica([]byte("$EOF:" + mark + "\r\n"))
+			if slave.Conn != nil {
+				wr.conns = append(wr.conns, slave.Conn)
+			}
+		}
+	}
+	close(wr.ready)
+}
+
+// UpdateSlavesWaitingBgsave is called when a BGSAVE is terminated, the RDB file
+// is transferred to the replicas which are waiting for it, or the diskless
+// transfer is terminated.
+//
+// It should be called when holding the CmdLock.
+func (s *Server) UpdateSlavesWaitingBgsave(ok bool, childType int) {
+	var payload []byte
+	for _, slave := range copySlaves(s.slaves) {
+		if slave.replState != slaveStateWaitBgsaveEnd {
+			continue
+		}
+		if !ok {
+			slog.Warn("SYNC failed. BGSAVE child returned an error", "replica", slave.replicaName())
+			s.freeSlave(slave)
+			continue
+		}
+		if childType == RdbChildTypeSocket {
+			if slave.replEofMark == "" {
+				continue
+			}
+			slave.writeToReplica([]byte(slave.replEofMark))
+			slave.replEofMark = ""
+			// The replica is loading the RDB from the socket now, the
+			// updates are sent once it is able to ACK.
+			slave.replState = slaveStateOnline
+			slave.replStartStreamOnAck = true
+			slave.replAckTime = time.Now().UnixMilli()
+			slog.Info("streamed RDB transfer with replica succeeded (socket)."+
+				" Waiting for REPLCONF ACK from replica to enable streaming",
+				"replica", slave.replicaName())
+			continue
+		}
+		if payload == nil {
+			data, err := os.ReadFile(s.RdbFilename)
+			if err != nil {
+				slog.Warn("SYNC failed. can't open the RDB file", "err", err)
+				s.freeSlave(slave)
+				continue
+			}
+			payload = data
+		}
+
+		slave.writeToReplica([]byte("$" + strconv.Itoa(len(payload)) + "\r\n"))
+		slave.writeToReplica(payload)
+		if len(slave.replPending) > 0 {
+			slave.writeToReplica(slave.replPending)
+		}
+		slave.replPending = nil
+		slave.replState = slaveStateOnline
+		slave.replAckTime = time.Now().UnixMilli()
+		slog.Info("synchronization with replica succeeded", "replica", slave.replicaName())
+	}
+}
+
+// copySlaves returns a copy of the replicas, so that the replicas can be freed while iterating.
+func copySlaves(slaves []*Client) []*Client {
+	dup := make([]*Client, len(slaves))
+	copy(dup, slaves)
+	return dup
+}
+
+// freeSlave closes the connection of the replica and forgets it.
+func (s *Server) freeSlave(c *Client) {
+	s.removeSlave(c)
+	if c.Conn != nil {
+		_ = c.Conn.Close()
+	}
+}
+
+func (s *Server) removeSlave(c *Client) {
+	for i, slave := range s.slaves {
+		if slave == c {
+			s.slaves = append(s.slaves[:i], s.slaves[i+1:]...)
+			break
+		}
+	}
+	c.flag &= ^slave
+	c.replState = slaveStateNone
+	c.replPending = nil
+	c.replEofMark = ""
+	c.replStartStreamOnAck = false
+}
+
+// disconnectSlaves closes the connections of all the replicas, so that they
+// will reconnect and learn about the change of the replication history.
+func (s *Server) disconnectSlaves() {
+	for _, slave := range copySlaves(s.slaves) {
+		s.freeSlave(slave)
+	}
+}
+
+func (c *Client) replicaName() string {
+	if c.Conn == nil {
+		return "unknown"
+	}
+	host, _, err := net.SplitHostPort(c.Conn.RemoteAddr().String())
+	if err != nil {
+		host = c.Conn.RemoteAddr().String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.replListeningPort))
+}
+
+// ReplconfListeningPort records the port the replica is listening to.
+func (c *Client) ReplconfListeningPort(port int) {
+	c.replListeningPort = port
+}
+
+// ReplconfCapa records a capability of the replica, the unknown
+// capabilities are ignored.
+func (c *Client) ReplconfCapa(capa string) {
+	switch strings.ToLower(capa) {
+	case "eof":
+		c.replCapa |= slaveCapaEof
+	case "psync2":
+		c.replCapa |= slaveCapaPsync2
+	}
+}
+
+// ReplconfAck updates the offset the replica has processed, and the offset it
+// has fsynced to the AOF if aofOffset isn't -1.
+func (c *Client) ReplconfAck(offset, aofOffset int64) {
+	if !c.checkFlag(slave) {
+		return
+	}
+	if offset > c.replAckOff {
+		c.replAckOff = offset
+	}
+	if aofOffset > c.replAofOff {
+		c.replAofOff = aofOffset
+	}
+	c.replAckTime = time.Now().UnixMilli()
+	// The first ACK after a diskless transfer means the replica loaded
+	// the RDB, so it's time to send the accumulated updates.
+	if c.replStartStreamOnAck {
+		c.replStartStreamOnAck = false
+		if len(c.replPending) > 0 {
+			c.writeToReplica(c.replPending)
+		}
+		c.replPending = nil
+		slog.Info("synchronization with replica succeeded", "replica", c.replicaName())
+	}
+	// The ACK may satisfy the clients blocked by WAIT or WAITAOF.
+	if len(c.Server.waitingClients) > 0 {
+		c.Server.processClientsWaitingReplicas()
+	}
+}
+
+// ReplconfGetAck sends REPLCONF ACK to master as soon as possible.
+func (c *Client) ReplconfGetAck() {
+	if !c.checkFlag(master) {
+		return
+	}
+	c.Server.replicationSendAck()
+}
+
+// ReplicaOf makes the server a replica of host:port, or turns it into a master
+// when host is empty.
+func (c *Client) ReplicaOf(host string, port int) error {
+	s := c.Server
+	if s.ClusterEnabled {
+		return errors.New("REPLICAOF not allowed in cluster mode.")
+	}
+	if host == "" {
+		if s.MasterHost != "" {
+			s.replicationUnsetMaster()
+			slog.Info("MASTER MODE enabled (user request from client)")
+		}
+		return nil
+	}
+
+	if c.checkFlag(slave) {
+		return errors.New("Command is not valid when client is a replica.")
+	}
+	if s.MasterHost == host && s.MasterPort == port {
+		slog.Info("REPLICAOF would result into synchronization with the master we are already connected with. No operation performed.")
+		return nil
+	}
+	s.replicationSetMaster(host, port)
+	slog.Info("REPLICAOF enabled (user request from client)", "host", host, "port", port)
+	return nil
+}
+
+// replicationSetMaster sets the master and starts the replication from the cron.
+func (s *Server) replicationSetMaster(host string, port int) {
+	s.MasterHost, s.MasterPort = host, port
+	s.DB.SetReplica(true)
+	s.cancelMasterLink()
+	// The replicas have to learn about the new history.
+	s.disconnectSlaves()
+	s.replState.Store(replStateConnect)
+	slog.Info("connecting to MASTER", "host", host, "port", port)
+}
+
+// replicationUnsetMaster turns the replica into a master.
+func (s *Server) replicationUnsetMaster() {
+	s.MasterHost, s.MasterPort = "", 0
+	// From now on we expire the keys, and propagate their deletion.
+	s.DB.SetReplica(false)
+	s.cancelMasterLink()
+	// A new history starts here, the replicas of the old master which
+	// are now connecting to us are able to partially resync anyway.
+	s.shiftReplicationId()
+	s.disconnectSlaves()
+	s.replState.Store(replStateNone)
+}
+
+func (s *Server) cancelMasterLink() {
+	if s.master != nil {
+		s.master.cancel()
+		s.master = nil
+	}
+}
+
+// replicationSendAck sends REPLCONF ACK with the processed offset to master.
+//
+// It should be called when holding the CmdLock.
+func (s *Server) replicationSendAck() {
+	link := s.master
+	if link == nil || s.replState.Load() != replStateConnected {
+		return
+	}
+	offset := strconv.FormatInt(s.MasterReplOffset, 10)
+	aofOffset := strconv.FormatInt(s.fsyncedReplOff.Load(), 10)
+	if err := link.sendCommand("REPLCONF", "ACK", offset, "FACK", aofOffset); err != nil {
+		slog.Warn("failed sending REPLCONF ACK to master", "err", err)
+	}
+}
+
+// connectWithMaster starts the goroutine which synchronizes with the master
+// and then processes the replication stream.
+//
+// It should be called when holding the CmdLock.
+func (s *Server) connectWithMaster() {
+	ctx, cancel := context.WithCancel(s.Ctx)
+	link := &masterLink{host: s.MasterHost, port: s.MasterPort, cancel: cancel}
+	link.lastInteraction.Store(time.Now().UnixMilli())
+	s.master = link
+	s.replState.Store(replStateConnecting)
+
+	go func() {
+		err := s.syncWithMaster(ctx, link)
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("replication with master broken", "host", link.host,
+				"port", link.port, "err", err)
+		}
+		cancel()
+		link.wmu.Lock()
+		if link.conn != nil {
+			link.conn.Close()
+		}
+		link.wmu.Unlock()
+
+		s.CmdLock.Lock()
+		// Retry from the cron if we are still a replica of this master.
+		if s.master == link {
+			s.master = nil
+			s.replState.Store(replStateConnect)
+		}
+		s.CmdLock.Unlock()
+	}()
+}
+
+func (s *Server) syncWithMaster(ctx context.Context, link *masterLink) error {
+	addr := net.JoinHostPort(link.host, strconv.Itoa(link.port))
+	dialer := net.Dialer{Timeout: time.Duration(s.ReplTimeout) * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error condition on socket for SYNC: %w", err)
+	}
+	link.wmu.Lock()
+	link.conn = conn
+	link.wmu.Unlock()
+	// The blocking reads are interrupted by closing the connection.
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	slog.Info("MASTER <-> REPLICA sync started")
+
+	rd := bufio.NewReader(conn)
+	if err := s.replicaHandshake(link, rd); err != nil {
+		return err
+	}
+
+	s.CmdLock.Lock()
+	replid, offset := s.cachedMaster()
+	s.CmdLock.Unlock()
+	if replid == "?" {
+		slog.Info("partial resynchronization not possible (no cached master)")
+	} else {
+		slog.Info("trying a partial resynchronization", "replid", replid, "offset", offset)
+	}
+	if err := link.sendCommand("PSYNC", replid, strconv.FormatInt(offset, 10)); err != nil {
+		return err
+	}
+
+	reply, err := readReplyLine(rd)
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(reply, "+FULLRESYNC"):
+		fields := strings.Fields(reply)
+		if len(fields) != 3 || len(fields[1]) != configRunIdSize {
+			return fmt.Errorf("master replied with wrong +FULLRESYNC syntax: %q", reply)
+		}
+		replid = fields[1]
+		offset, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("master replied with wrong +FULLRESYNC syntax: %q", reply)
+		}
+		slog.Info("full resync from master", "replid", replid, "offset", offset)
+		if err := s.readSyncBulkPayload(ctx, link, rd, replid, offset); err != nil {
+			return err
+		}
+	case strings.HasPrefix(reply, "+CONTINUE"):
+		slog.Info("successful partial resynchronization with master")
+		s.CmdLock.Lock()
+		if fields := strings.Fields(reply); len(fields) == 2 && fields[1] != s.ReplId {
+			// Master ID changed: the master was turned from a replica into a
+			// master, we take the same path by shifting the id.
+			s.ReplId2 = s.ReplId
+			s.SecondReplOffset = s.MasterReplOffset + 1
+			s.ReplId = fields[1]
+			slog.Info("master replication ID changed", "replid", s.ReplId)
+			s.disconnectSlaves()
+		}
+		if s.replBacklog == nil {
+			s.replBacklog = newReplBacklog(s.ReplBacklogSize, s.MasterReplOffset+1)
+		}
+		s.replState.Store(replStateConnected)
+		s.CmdLock.Unlock()
+	default:
+		return fmt.Errorf("unexpected reply to PSYNC from master: %q", reply)
+	}
+
+	link.cli = NewClient(nil, s.DB)
+	link.cli.Server = s
+	link.cli.setFlag(master)
+	return s.readFromMaster(link, rd)
+}
+
+// cachedMaster returns the replication id and the offset to ask the master
+// to continue with PSYNC, or "?" and -1 to ask for a full resynchronization
+// if there is no cached master. The history is cached in the backlog, which
+// exists once we were synchronized with a master, or we were a master with
+// replicas, whose history may be continued by our new master.
+//
+// It should be called when holding the CmdLock.
+func (s *Server) cachedMaster() (string, int64) {
+	if s.replBacklog == nil {
+		return "?", -1
+	}
+	return s.ReplId, s.MasterReplOffset + 1
+}
+
+// replicaHandshake performs the handshake before asking for the synchronization.
+func (s *Server) replicaHandshake(link *masterLink, rd *bufio.Reader) error {
+	if err := link.sendCommand("PING"); err != nil {
+		return err
+	}
+	reply, err := readReplyLine(rd)
+	if err != nil {
+		return err
+	}
+	// We accept only two replies as valid, a positive +PONG reply and an
+	// authentication error, since the master may require a password.
+	if reply[0] == '-' && !strings.HasPrefix(reply, "-NOAUTH") &&
+		!strings.HasPrefix(reply, "-NOPERM") {
+		return fmt.Errorf("error reply to PING from master: %q", reply)
+	}
+
+	if err := link.sendCommand("REPLCONF", "listening-port", strconv.Itoa(s.Port)); err != nil {
+		return err
+	}
+	// Ignore the error if any, not all the Redis versions support
+	// REPLCONF listening-port.
+	if reply, err = readReplyLine(rd); err != nil {
+		return err
+	} else if reply[0] == '-' {
+		slog.Info("(Non critical) master does not understand REPLCONF listening-port", "reply", reply)
+	}
+
+	if err := link.sendCommand("REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		return err
+	}
+	if reply, err = readReplyLine(rd); err != nil {
+		return err
+	} else if reply[0] == '-' {
+		slog.Info("(Non critical) master does not understand REPLCONF capa", "reply", reply)
+	}
+	return nil
+}
+
+// readSyncBulkPayload receives the RDB file from master and loads it.
+func (s *Server) readSyncBulkPayload(ctx context.Context, link *masterLink,
+	rd *bufio.Reader, replid string, offset int64) error {
+	s.replState.Store(replStateTransfer)
+
+	line, err := readReplyLine(rd)
+	if err != nil {
+		return err
+	}
+	link.lastInteraction.Store(time.Now().UnixMilli())
+	if line[0] == '-' {
+		return fmt.Errorf("%w: %s", errReplicaSyncAborted, line)
+	}
+	if line[0] != '$' {
+		return fmt.Errorf("bad protocol from MASTER, the first byte is not '$': %q", line)
+	}
+	// The master sends the RDB in the EOF format when it streams the RDB
+	// directly from the BGSAVE to the socket: $EOF:<40 bytes mark>.
+	var mark string
+	size, diskless := int64(-1), false
+	if strings.HasPrefix(line, "$EOF:") && len(line) >= 5+configRunIdSize {
+		mark = line[5 : 5+configRunIdSize]
+		diskless = s.useDisklessLoad()
+		target := "disk"
+		if diskless {
+			target = "parser"
+		}
+		slog.Info("MASTER <-> REPLICA sync: receiving streamed RDB from master with EOF", "to", target)
+	} else {
+		size, err = strconv.ParseInt(line[1:], 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("bad bulk length from MASTER: %q", line)
+		}
+		slog.Info("MASTER <-> REPLICA sync: receiving bytes from master to disk", "size", size)
+	}
+
+	if diskless {
+		if err = s.readSyncPayloadDiskless(ctx, link, rd, mark); err != nil {
+			return err
+		}
+		s.replicationFinishSync(replid, offset)
+		s.CmdLock.Unlock()
+		return nil
+	}
+
+	tempfile := fmt.Sprintf("temp-%d.%d.rdb", time.Now().Unix(), os.Getpid())
+	file, err := os.Create(tempfile)
+	if err != nil {
+		return fmt.Errorf("opening the temp file needed for MASTER <-> REPLICA synchronization: %w", err)
+	}
+	defer os.Remove(tempfile)
+	if mark != "" {
+		err = copyUntilEOFMark(file, &progressReader{rd, link}, mark)
+	} else {
+		_, err = io.CopyN(file, &progressReader{rd, link}, size)
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("I/O error trying to sync with MASTER: %w", err)
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	s.CmdLock.Lock()
+	defer s.CmdLock.Unlock()
+
+	slog.Info("MASTER <-> REPLICA sync: flushing old data")
+	_ = s.DB.Empty()
+	if err = os.Rename(tempfile, s.RdbFilename); err != nil {
+		return fmt.Errorf("failed trying to rename the temp DB into %s: %w", s.RdbFilename, err)
+	}
+	slog.Info("MASTER <-> REPLICA sync: loading DB in memory")
+	if !s.RdbLoad(s) {
+		return errors.New("failed trying to load the MASTER synchronization DB from disk")
+	}
+	s.replicationFinishSync(replid, offset)
+	return nil
+}
+
+// useDisklessLoad returns true if the RDB streamed by the master is loaded
+// directly from the socket, according to repl-diskless-load.
+func (s *Server) useDisklessLoad() bool {
+	switch s.ReplDisklessLoad {
+	case ReplDisklessLoadSwapdb:
+		return true
+	case ReplDisklessLoadWhenDbEmpty:
+		s.CmdLock.RLock()
+		defer s.CmdLock.RUnlock()
+		return s.DB.Len() == 0
+	}
+	return false
+}
+
+// readSyncPayloadDiskless loads the RDB streamed by the master directly from
+// the socket. With swapdb the RDB is loaded into a new dataset, so the old one
+// keeps serving the clients until the transfer is completed, otherwise the RDB
+// is loaded in the empty dataset.
+//
+// On success it returns holding the CmdLock.
+func (s *Server) readSyncPayloadDiskless(ctx context.Context, link *masterLink,
+	rd *bufio.Reader, mark string) error {
+	target := s.DB
+	if s.ReplDisklessLoad == ReplDisklessLoadSwapdb {
+		target = db.New()
+	} else {
+		s.CmdLock.Lock()
+		slog.Info("MASTER <-> REPLICA sync: flushing old data")
+		_ = s.DB.Empty()
+	}
+
+	loadErr := func() error {
+		slog.Info("MASTER <-> REPLICA sync: loading DB in memory")
+		// The reader is shared with the replication stream, so the RDB
+		// parser must not read beyond the end of the payload.
+		if !s.RdbLoadStream(s, rd, target) {
+			return errors.New("failed trying to load the MASTER synchronization DB from socket")
+		}
+		buf := make([]byte, configRunIdSize)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return fmt.Errorf("I/O error trying to sync with MASTER: %w", err)
+		}
+		if string(buf) != mark {
+			return errors.New("replication stream EOF marker is broken")
+		}
+		link.lastInteraction.Store(time.Now().UnixMilli())
+		return nil
+	}()
+
+	if target != s.DB {
+		if loadErr != nil {
+			return loadErr
+		}
+		s.CmdLock.Lock()
+		slog.Info("MASTER <-> REPLICA sync: swapping the loaded DB with the old one")
+		s.DB.Swap(target)
+		return nil
+	}
+	if loadErr != nil {
+		// The partially loaded dataset is not valid.
+		_ = s.DB.Empty()
+		s.CmdLock.Unlock()
+		return loadErr
+	}
+	return nil
+}
+
+// copyUntilEOFMark copies the payload from src to dst until the mark is
+// found at the end of the read data, the mark is not copied.
+func copyUntilEOFMark(dst io.Writer, src io.Reader, mark string) error {
+	buf := make([]byte, 0, 32*1024+len(mark))
+	for {
+		n, err := src.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if bytes.HasSuffix(buf, []byte(mark)) {
+			_, werr := dst.Write(buf[:len(buf)-len(mark)])
+			return werr
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		// Hold back the last bytes, they may be a part of the mark.
+		if keep := len(mark); len(buf) > keep {
+			if _, err := dst.Write(buf[:len(buf)-keep]); err != nil {
+				return err
+			}
+			buf = buf[:copy(buf, buf[len(buf)-keep:])]
+		}
+	}
+}
+
+// replicationFinishSync is called when the replica loaded the RDB received
+// from the master.
+//
+// It should be called when holding the CmdLock.
+func (s *Server) replicationFinishSync(replid string, offset int64) {
+	// The replica inherits the history of its master.
+	s.ReplId = replid
+	s.MasterReplOffset = offset
+	s.ReplId2 = ""
+	s.SecondReplOffset = -1
+	s.replBacklog = newReplBacklog(s.ReplBacklogSize, offset+1)
+	// Our own replicas have a dataset which is no longer valid.
+	s.disconnectSlaves()
+	if s.AofState != AofOff {
+		// The AOF has to be rebuilt from the new dataset.
+		s.aofRewriteScheduled = true
+	}
+	s.replState.Store(replStateConnected)
+	slog.Info("MASTER <-> REPLICA sync: finished with success")
+}
+
+// readFromMaster processes the replication stream until the link is broken.
+func (s *Server) readFromMaster(link *masterLink, rd *bufio.Reader) error {
+	for {
+		argv, raw, err := readCommand(rd)
+		if err != nil {
+			return err
+		}
+		link.lastInteraction.Store(time.Now().UnixMilli())
+		if len(argv) == 0 {
+			continue
+		}
+		s.CmdLock.Lock()
+		s.processCommandFromMaster(link.cli, argv, raw)
+		s.CmdLock.Unlock()
+	}
+}
+
+// processCommandFromMaster executes a command of the replication stream, the
+// stream is then fed as it is to our own backlog and replicas.
+//
+// It should be called when holding the CmdLock.
+func (s *Server) processCommandFromMaster(c *Client, argv [][]byte, raw []byte) {
+	c.SetArgument(argv)
+	name := strings.ToLower(string(argv[0]))
+	command, ok := s.LookupCommand(name)
+	if !ok {
+		slog.Warn("unknown command in the replication stream", "name", name)
+	} else {
+		c.cmd = command
+		if c.flag&multi != 0 && command.Name != "exec" {
+			c.QueueMultiCommand()
+		} else {
+			c.dirty = 0
+			s.DB.SetMasterCommand(true)
+			_ = command.Proc(c)
+			s.DB.SetMasterCommand(false)
+			if c.dirty > 0 {
+				s.propagateMu.Lock()
+				s.Dirty += c.dirty
+				if c.flag&preventProp == 0 {
+					c.afterCommand()
+				}
+				s.propagateMu.Unlock()
+			}
+			c.flag &= ^preventProp
+		}
+	}
+	// The replies to the master are discarded.
+	c.discardReplies()
+	c.argc = 0
+
+	s.propagateMu.Lock()
+	s.replicationFeedSlaves(raw)
+	s.propagateMu.Unlock()
+}
+
+// replicationCron is called every second to handle the replication
+// timeouts, pings and the pending synchronizations.
+func (s *Server) replicationCron() {
+	if !TryLockWithTimeout(s.CmdLock, 10*time.Millisecond) {
+		return
+	}
+	now := time.Now().UnixMilli()
+	timeout := s.ReplTimeout * 1000
+
+	if s.MasterHost != "" {
+		switch s.replState.Load() {
+		case replStateConnect:
+			s.connectWithMaster()
+		case replStateConnecting, replStateTransfer, replStateConnected:
+			if link := s.master; link != nil && now-link.lastInteraction.Load() > timeout {
+				slog.Warn("MASTER timeout: no data nor PING received...")
+				s.cancelMasterLink()
+				s.replState.Store(replStateConnect)
+			}
+		}
+		// Send ACK to master from time to time.
+		s.replicationSendAck()
+	}
+
+	// Ping the replicas, so that they are able to implement the timeout
+	// and detect a broken link even if no write is performed.
+	if len(s.slaves) > 0 && s.ReplPingPeriod > 0 &&
+		s.CronLoops%(s.ReplPingPeriod*int64(s.Hz)) == 0 && s.MasterHost == "" {
+		s.propagateMu.Lock()
+		s.replicationFeedSlaves(catCommand([][]byte{[]byte("PING")}))
+		s.propagateMu.Unlock()
+	}
+
+	// Newlines keep the replicas which are waiting for the snapshot alive,
+	// but not the ones receiving the RDB from the socket.
+	for _, slave := range copySlaves(s.slaves) {
+		switch slave.replState {
+		case slaveStateWaitBgsaveStart, slaveStateWaitBgsaveEnd:
+			if slave.replEofMark == "" {
+				slave.writeToReplica([]byte("\n"))
+			}
+		case slaveStateOnline:
+			if now-slave.replAckTime > timeout {
+				slog.Warn("disconnecting timedout replica (streaming sync)", "replica", slave.replicaName())
+				s.freeSlave(slave)
+			}
+		}
+	}
+	s.CmdLock.Unlock()
+
+	s.replicationStartPendingFork()
+}
+
+// Role replies with the role of the server in the replication.
+func (c *Client) Role() {
+	s := c.Server
+	if s.sentinel != nil {
+		c.sentinelRole()
+		return
+	}
+	if s.MasterHost == "" {
+		c.AddReplyMultibulkLen(3)
+		c.addReplyBulkString("master")
+		c.AddReplyInt64(s.MasterReplOffset)
+		c.AddReplyMultibulkLen(int64(len(s.slaves)))
+		for _, slave := range s.slaves {
+			host, port, _ := net.SplitHostPort(slave.replicaName())
+			c.AddReplyMultibulkLen(3)
+			c.addReplyBulkString(host)
+			c.addReplyBulkString(port)
+			c.addReplyBulkString(strconv.FormatInt(slave.replAckOff, 10))
+		}
+		return
+	}
+
+	var state string
+	switch s.replState.Load() {
+	case replStateNone:
+		state = "none"
+	case replStateConnect:
+		state = "connect"
+	case replStateConnecting:
+		state = "connecting"
+	case replStateTransfer:
+		state = "sync"
+	case replStateConnected:
+		state = "connected"
+	}
+	c.AddReplyMultibulkLen(5)
+	c.addReplyBulkString("slave")
+	c.addReplyBulkString(s.MasterHost)
+	c.AddReplyInt64(int64(s.MasterPort))
+	c.addReplyBulkString(state)
+	c.AddReplyInt64(s.MasterReplOffset)
+}
+
+// readReplyLine reads a line of reply without the trailing CRLF. The empty
+// lines are skipped, since the master sends newlines to keep the link alive
+// while the snapshot is being created.
+func readReplyLine(rd *bufio.Reader) (string, error) {
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			return line, nil
+		}
+	}
+}
+
+// readCommand reads a command of the replication stream, it returns the
+// arguments and the raw bytes of the command.
+func readCommand(rd *bufio.Reader) ([][]byte, []byte, error) {
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	raw := line
+	if len(line) < 3 || line[0] != '*' {
+		// Newlines are used by master to keep the link alive.
+		if strings.TrimSpace(string(line)) == "" {
+			return nil, raw, nil
+		}
+		return nil, nil, fmt.Errorf("protocol error in the replication stream: %q", line)
+	}
+	argc, err := strconv.Atoi(string(line[1 : len(line)-2]))
+	if err != nil || argc < 0 {
+		return nil, nil, fmt.Errorf("invalid multibulk length in the replication stream: %q", line)
+	}
+
+	argv := make([][]byte, 0, argc)
+	for i := 0; i < argc; i++ {
+		line, err = rd.ReadBytes('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		raw = append(raw, line...)
+		if len(line) < 3 || line[0] != '$' {
+			return nil, nil, fmt.Errorf("expected '$' in the replication stream: %q", line)
+		}
+		ln, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil || ln < 0 {
+			return nil, nil, fmt.Errorf("invalid bulk length in the replication stream: %q", line)
+		}
+		bulk := make([]byte, ln+2)
+		if _, err = io.ReadFull(rd, bulk); err != nil {
+			return nil, nil, err
+		}
+		raw = append(raw, bulk...)
+		argv = append(argv, bulk[:ln])
+	}
+	return argv, raw, nil
+}
+
+// progressReader refreshes the last interaction of the link while reading the payload.
+type progressReader struct {
+	rd   io.Reader
+	link *masterLink
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.link.lastInteraction.Store(time.Now().UnixMilli())
+	return n, err
+}
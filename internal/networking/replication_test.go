@@ -0,0 +1,282 @@
+package networking
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/sunminx/RDB/internal/db"
+	"github.com/sunminx/RDB/internal/hash"
+)
+
+func TestReplBacklogFeed(t *testing.T) {
+	testcases := []struct {
+		size     int64
+		feeds    []string
+		wantOff  int64
+		wantData string
+	}{
+		{size: 8, feeds: []string{"abc"}, wantOff: 1, wantData: "abc"},
+		{size: 8, feeds: []string{"abcd", "efgh"}, wantOff: 1, wantData: "abcdefgh"},
+		{size: 8, feeds: []string{"abcdef", "ghij"}, wantOff: 3, wantData: "cdefghij"},
+		{size: 4, feeds: []string{"abcdefghij"}, wantOff: 7, wantData: "ghij"},
+		{size: 4, feeds: []string{"ab", "cd", "ef", "g"}, wantOff: 4, wantData: "defg"},
+	}
+
+	for _, tc := range testcases {
+		b := newReplBacklog(tc.size, 1)
+		for _, f := range tc.feeds {
+			b.feed([]byte(f))
+		}
+		if b.off != tc.wantOff {
+			t.Errorf("backlog off: %d want: %d", b.off, tc.wantOff)
+		}
+		if data := string(b.rangeFrom(b.off)); data != tc.wantData {
+			t.Errorf("backlog data: %q want: %q", data, tc.wantData)
+		}
+	}
+}
+
+func TestReplBacklogRangeFrom(t *testing.T) {
+	b := newReplBacklog(8, 1)
+	b.feed([]byte("abcdef"))
+	b.feed([]byte("ghij"))
+
+	testcases := []struct {
+		off      int64
+		contains bool
+		want     string
+	}{
+		{off: 2, contains: false},
+		{off: 3, contains: true, want: "cdefghij"},
+		{off: 7, contains: true, want: "ghij"},
+		{off: 10, contains: true, want: "j"},
+		{off: 11, contains: true, want: ""},
+		{off: 12, contains: false},
+	}
+
+	for _, tc := range testcases {
+		if b.contains(tc.off) != tc.contains {
+			t.Errorf("contains(%d): %v want: %v", tc.off, !tc.contains, tc.contains)
+			continue
+		}
+		if !tc.contains {
+			continue
+		}
+		if data := string(b.rangeFrom(tc.off)); data != tc.want {
+			t.Errorf("rangeFrom(%d): %q want: %q", tc.off, data, tc.want)
+		}
+	}
+}
+
+func TestCopyUntilEOFMark(t *testing.T) {
+	mark := strings.Repeat("m", configRunIdSize)
+	payloads := []string{
+		"",
+		"REDIS0009 payload",
+		strings.Repeat("x", 100000),
+		mark[:configRunIdSize-1] + "x",
+	}
+
+	for _, payload := range payloads {
+		for _, src := range []io.Reader{
+			strings.NewReader(payload + mark),
+			iotest.OneByteReader(strings.NewReader(payload + mark)),
+		} {
+			var dst bytes.Buffer
+			if err := copyUntilEOFMark(&dst, src, mark); err != nil {
+				t.Errorf("copyUntilEOFMark: %v", err)
+				continue
+			}
+			if dst.String() != payload {
+				t.Errorf("copyUntilEOFMark: %d bytes want: %d", dst.Len(), len(payload))
+			}
+		}
+	}
+
+	var dst bytes.Buffer
+	if err := copyUntilEOFMark(&dst, strings.NewReader("truncated"), mark); err != io.ErrUnexpectedEOF {
+		t.Errorf("copyUntilEOFMark: %v want: %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestCachedMaster(t *testing.T) {
+	s := NewServer()
+	if replid, offset := s.cachedMaster(); replid != "?" || offset != -1 {
+		t.Errorf("PSYNC %s %d without a cached master", replid, offset)
+	}
+	s.MasterReplOffset = 100
+	s.replicationFinishSync(s.ReplId, 100)
+	if replid, offset := s.cachedMaster(); replid != s.ReplId || offset != 101 {
+		t.Errorf("PSYNC %s %d after a synchronization", replid, offset)
+	}
+}
+
+// newTestMaster returns a client of a master, which keeps its replication
+// stream in the backlog and its AOF in AofBuf.
+func newTestMaster() *Client {
+	s := NewServer()
+	s.DB = db.New()
+	s.Init()
+	s.AofState = AofOn
+	s.createReplBacklogIfNeeded()
+	return newParallelClient(s)
+}
+
+// newTestServer returns a server, which is a replica of primary if replica
+// is set, after it executed the commands of stream, like the replica does
+// with the replication stream of its master, or the loading does with the AOF.
+func newTestServer(t *testing.T, primary *Server, stream []byte, replica bool) *Server {
+	s := NewServer()
+	s.DB = db.New()
+	if replica {
+		s.MasterHost, s.MasterPort = "127.0.0.1", primary.Port
+	}
+	s.Init()
+	c := newParallelClient(s)
+	c.setFlag(master)
+	rd := bufio.NewReader(bytes.NewReader(stream))
+	for {
+		argv, raw, err := readCommand(rd)
+		if err == io.EOF {
+			return s
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if len(argv) == 0 {
+			continue
+		}
+		s.CmdLock.Lock()
+		s.processCommandFromMaster(c, argv, raw)
+		s.CmdLock.Unlock()
+	}
+}
+
+// replicaOf returns a replica which received the replication stream of master.
+func replicaOf(t *testing.T, master *Server) *Server {
+	return newTestServer(t, master, master.replBacklog.rangeFrom(master.replBacklog.off), true)
+}
+
+// reloadAof returns a server which loaded the AOF of master.
+func reloadAof(t *testing.T, master *Server) *Server {
+	return newTestServer(t, master, master.AofBuf, false)
+}
+
+func TestFlushAllPropagation(t *testing.T) {
+	for _, mode := range []string{"sync", "async", ""} {
+		c := newTestMaster()
+		runMockCommand(c, "set", "a", "1")
+		runMockCommand(c, "set", "b", "1")
+		args := []string{"flushall"}
+		if mode != "" {
+			args = append(args, mode)
+		}
+		runMockCommand(c, args...)
+		runMockCommand(c, "set", "c", "1")
+		// The flush of an empty db is propagated too.
+		runMockCommand(c, "flushdb")
+		runMockCommand(c, "set", "d", "1")
+
+		for name, s := range map[string]*Server{
+			"replica": replicaOf(t, c.Server),
+			"aof":     reloadAof(t, c.Server),
+		} {
+			for _, key := range []string{"a", "b", "c"} {
+				if _, ok := s.DB.LookupKeyRead(key); ok {
+					t.Errorf("flushall %s: key %s is on the %s", mode, key, name)
+				}
+			}
+			if _, ok := s.DB.LookupKeyRead("d"); !ok {
+				t.Errorf("flushall %s: key d is not on the %s", mode, name)
+			}
+		}
+	}
+}
+
+func TestExpirePropagation(t *testing.T) {
+	c := newTestMaster()
+	ms := c.Server
+	runMockCommand(c, "setex", "k", "100", "v")
+	runMockCommand(c, "set", "px", "v", "px", "100000")
+	for _, key := range []string{"lazy", "active"} {
+		runMockCommand(c, "set", key, "v")
+		runMockCommand(c, "pexpireat", key, "1")
+	}
+	soon := strconv.FormatInt(time.Now().UnixMilli()+20, 10)
+	runMockCommand(c, "set", "soon", "v")
+	runMockCommand(c, "pexpireat", "soon", soon)
+	runMockCommand(c, "hset", "h", "a", "1", "b", "2", "c", "3")
+	runMockCommand(c, "hset", "h2", "a", "1", "b", "2")
+	for key, fields := range map[string][]string{"h": {"a"}, "h2": {"a", "b"}} {
+		val, _ := ms.DB.LookupKeyWrite(key)
+		for _, field := range fields {
+			hash.SetExpire(val, []byte(field), 1)
+		}
+		ms.DB.TrackFieldExpires(key)
+	}
+
+	// The expired keys and fields are deleted by the lookups and the active
+	// expire cycles, and their deletion is propagated.
+	if reply := runMockCommand(c, "get", "lazy"); reply != "$-1\r\n" {
+		t.Errorf("get lazy: %q", reply)
+	}
+	if reply := runMockCommand(c, "hget", "h", "b"); reply != "$1\r\n2\r\n" {
+		t.Errorf("hget h b: %q", reply)
+	}
+	ms.DB.ActiveExpireCycle(time.Second)
+	ms.DB.ActiveFieldExpireCycle(time.Second)
+	del := "DEL"
+	if ms.LazyfreeLazyExpire {
+		del = "UNLINK"
+	}
+	// The relative TTLs are propagated as absolute times.
+	pxat := func(key string) string {
+		return "SET " + key + " v PXAT " + strconv.FormatInt(int64(ms.DB.Expire(key)), 10)
+	}
+	stream := ms.replBacklog.rangeFrom(ms.replBacklog.off)
+	for name, buf := range map[string][]byte{"replication stream": stream, "aof": ms.AofBuf} {
+		for _, cmd := range []string{del + " lazy", del + " active", "HDEL h a", pxat("k"), pxat("px")} {
+			if !bytes.Contains(buf, catCommand(bytes.Fields([]byte(cmd)))) {
+				t.Errorf("%q is not in the %s", cmd, name)
+			}
+		}
+	}
+
+	for name, s := range map[string]*Server{
+		"replica": replicaOf(t, ms),
+		"aof":     reloadAof(t, ms),
+	} {
+		for _, key := range []string{"k", "px"} {
+			if got, want := s.DB.Expire(key), ms.DB.Expire(key); got != want {
+				t.Errorf("expire of %s on the %s is %d, not %d", key, name, got, want)
+			}
+		}
+		if val, ok := s.DB.LookupKeyRead("h"); !ok || hash.Len(val) != 2 || hash.Exists(val, []byte("a")) {
+			t.Errorf("the expired field of h is on the %s", name)
+		}
+		if n := s.DB.Len(); n != ms.DB.Len() {
+			t.Errorf("%d keys on the %s, not %d", n, name, ms.DB.Len())
+		}
+	}
+
+	// A replica doesn't expire the keys, the expired ones are only missing
+	// for the clients until the master propagates their deletion.
+	s := replicaOf(t, ms)
+	time.Sleep(30 * time.Millisecond)
+	s.DB.ActiveExpireCycle(time.Second)
+	if _, ok := s.DB.LookupKeyRead("soon"); ok {
+		t.Error("the expired key is found on the replica")
+	}
+	if n := s.DB.Len(); n != ms.DB.Len() {
+		t.Errorf("%d keys on the replica, not %d", n, ms.DB.Len())
+	}
+	runMockCommand(c, "get", "soon")
+	if s = replicaOf(t, ms); s.DB.Len() != ms.DB.Len() || ms.DB.Len() != 3 {
+		t.Errorf("%d keys on the replica and %d on the master", s.DB.Len(), ms.DB.Len())
+	}
+}
@@ -0,0 +1,2088 @@
+package networking
+
+// Sentinel.
+//
+// When started with --sentinel, the server doesn't serve a dataset, it
+// monitors masters and their replicas instead. The sentinels monitoring the
+// same master discover each other with the hello messages they publish on
+// the __sentinel__:hello channel of the master and of its replicas.
+//
+// A master not replying for down-after-milliseconds is subjectively down
+// (SDOWN). When enough sentinels (the quorum) agree it is down, it becomes
+// objectively down (ODOWN) and a failover starts: a leader is elected among
+// the sentinels, the leader promotes the best replica with REPLICAOF NO ONE,
+// reconfigures the other replicas to replicate with it, and the new
+// configuration is propagated to the other sentinels with the hello messages.
+//
+// The state of the sentinel is protected by the CmdLock.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sunminx/RDB/internal/common"
+	. "github.com/sunminx/RDB/pkg/util"
+)
+
+const (
+	sentinelDefaultPort  = 26379
+	sentinelHelloChannel = "__sentinel__:hello"
+
+	sentinelInfoPeriod             = 10000
+	sentinelPingPeriod             = 1000
+	sentinelAskPeriod              = 1000
+	sentinelPublishPeriod          = 2000
+	sentinelDefaultDownAfter       = 30000
+	sentinelDefaultFailoverTimeout = 180000
+	sentinelDefaultParallelSyncs   = 1
+	sentinelMaxPendingCommands     = 100
+	sentinelMinLinkReconnectPeriod = 15000
+	sentinelSlaveReconfTimeout     = 10000
+	sentinelElectionTimeout        = 10000
+	// sentinelMaxDesync delays the start of the failovers by a random amount
+	// of time, so that the sentinels don't start the election together.
+	sentinelMaxDesync = 1000
+)
+
+// Flags of the monitored instances.
+const (
+	sriMaster             = 1 << iota
+	sriSlave              // Replica of a monitored master.
+	sriSentinel           // Another sentinel monitoring the master.
+	sriSDown              // Subjectively down (no quorum).
+	sriODown              // Objectively down (confirmed by others).
+	sriMasterDown         // A Sentinel with this flag set thinks that its master is down.
+	sriFailoverInProgress // Failover is in progress for this master.
+	sriPromoted           // Slave selected for promotion.
+	sriReconfSent         // REPLICAOF <newmaster> sent.
+	sriReconfInprog       // Slave synchronization in progress.
+	sriReconfDone         // Slave synchronized with new master.
+	sriForceFailover      // Force failover with master up.
+)
+
+var sriFlagsTable = []struct {
+	flag int
+	name string
+}{
+	{sriMaster, "master"},
+	{sriSlave, "slave"},
+	{sriSentinel, "sentinel"},
+	{sriSDown, "s_down"},
+	{sriODown, "o_down"},
+	{sriMasterDown, "master_down"},
+	{sriFailoverInProgress, "failover_in_progress"},
+	{sriPromoted, "promoted"},
+	{sriReconfSent, "reconf_sent"},
+	{sriReconfInprog, "reconf_inprog"},
+	{sriReconfDone, "reconf_done"},
+	{sriForceFailover, "force_failover"},
+}
+
+// Failover machine different states.
+const (
+	sentinelFailoverStateNone             = iota // No failover in progress.
+	sentinelFailoverStateWaitStart               // Wait for failover_start_time.
+	sentinelFailoverStateSelectSlave             // Select slave to promote.
+	sentinelFailoverStateSendSlaveofNoone        // Slave -> Master.
+	sentinelFailoverStateWaitPromotion           // Wait slave to change role.
+	sentinelFailoverStateReconfSlaves            // REPLICAOF newmaster.
+	sentinelFailoverStateUpdateConfig            // Monitor promoted slave.
+)
+
+var sentinelFailoverStateNames = []string{
+	"none", "wait_start", "select_slave", "send_slaveof_noone",
+	"wait_promotion", "reconf_slaves", "update_config",
+}
+
+type sentinelState struct {
+	myid         string
+	currentEpoch uint64
+	masters      map[string]*sentinelRedisInstance
+	announceIP   string
+	announcePort int
+}
+
+// instanceLink is the link with a monitored instance: a connection for the
+// commands, and a connection subscribed to the hello channel, which is only
+// used for masters and replicas.
+type instanceLink struct {
+	disconnected    bool
+	connecting      bool
+	conn            net.Conn
+	pconn           net.Conn
+	reqCh           chan *sentinelRequest
+	pendingCommands int
+
+	ccConnTime     int64 // cc connection time.
+	pcConnTime     int64 // pc connection time.
+	pcLastActivity int64 // Last time we received any message.
+	lastReconnTime int64
+	// actPingTime is the time at which the last pending ping (no pong
+	// received after it) was sent. This field is set to 0 when a pong is
+	// received, and set again to the current time if the value is 0 and a
+	// new ping is sent.
+	actPingTime   int64
+	lastPingTime  int64 // Time at which we sent the last ping.
+	lastPongTime  int64 // Last time the instance replied to ping, whatever the reply was.
+	lastAvailTime int64 // Last time the instance replied to ping with a reply we consider valid.
+}
+
+type sentinelRequest struct {
+	argv     [][]byte
+	callback func(reply any)
+}
+
+// respError is an error reply of a monitored instance.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+type sentinelRedisInstance struct {
+	flags       int
+	name        string // Master name, or ip:port for replicas and sentinels.
+	runid       string // Run ID of this instance, only known for sentinels.
+	configEpoch uint64
+	ip          string
+	port        int
+	link        *instanceLink
+	released    bool
+
+	lastPubTime             int64 // Last time we sent hello via Pub/Sub.
+	lastHelloTime           int64 // Last time we received a hello from this sentinel.
+	lastMasterDownReplyTime int64 // Time of last reply to SENTINEL is-master-down command.
+	sDownSinceTime          int64 // Subjectively down since time.
+	oDownSinceTime          int64 // Objectively down since time.
+	downAfterPeriod         int64 // Consider it down after that period.
+	infoRefresh             int64 // Time at which we received the last ROLE reply.
+	roleReported            int
+	roleReportedTime        int64
+
+	// Master specific.
+	sentinels     map[string]*sentinelRedisInstance // Other sentinels monitoring the same master.
+	slaves        map[string]*sentinelRedisInstance // Slaves for this master instance.
+	quorum        int                               // Number of sentinels that need to agree on failure.
+	parallelSyncs int                               // How many slaves to reconfigure at same time.
+
+	// Slave specific.
+	slaveConfChangeTime int64 // Last time slave master addr changed.
+	slaveMasterHost     string
+	slaveMasterPort     int
+	slaveMasterLinkUp   bool
+	slaveReplOffset     int64
+	slaveReconfSentTime int64 // Time at which we sent REPLICAOF <new>.
+	master              *sentinelRedisInstance
+
+	// Failover.
+	leader                  string // If this is a master instance, this is the runid of the Sentinel that should perform the failover. If this is a Sentinel, this is the runid of the Sentinel that this Sentinel voted as leader.
+	leaderEpoch             uint64 // Epoch of the 'leader' field.
+	failoverEpoch           uint64 // Epoch of the currently started failover.
+	failoverState           int
+	failoverStateChangeTime int64
+	failoverStartTime       int64 // Last failover attempt start time.
+	failoverTimeout         int64 // Max time to refresh failover state.
+	failoverDelayLogged     int64
+	promotedSlave           *sentinelRedisInstance // Promoted slave instance.
+}
+
+// InitSentinel prepares the server to run in sentinel mode, it must be
+// called before loading the config file.
+func (s *Server) InitSentinel() {
+	s.Port = sentinelDefaultPort
+	s.sentinel = &sentinelState{masters: make(map[string]*sentinelRedisInstance)}
+}
+
+// SentinelIsRunning is called once the config file is loaded, a sentinel
+// needs a writable config file, since the state of the sentinel is saved in
+// the config file.
+func (s *Server) SentinelIsRunning() error {
+	if s.ConfigFile == "" {
+		return errors.New("sentinel started without a config file, exiting")
+	}
+	file, err := os.OpenFile(s.ConfigFile, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("sentinel config file %s is not writable: %w, exiting", s.ConfigFile, err)
+	}
+	file.Close()
+
+	st := s.sentinel
+	if st.myid == "" {
+		st.myid = genRunId()
+		s.sentinelFlushConfig()
+	}
+	slog.Info("Sentinel ID is " + st.myid)
+	for _, master := range sortedInstances(st.masters) {
+		s.sentinelEvent(slog.LevelWarn, "+monitor", master, "quorum %d", master.quorum)
+	}
+	return nil
+}
+
+// SentinelHandleConfiguration handles a sentinel directive of the config
+// file, argv doesn't include "sentinel".
+func (s *Server) SentinelHandleConfiguration(argv []string) error {
+	st := s.sentinel
+	if st == nil {
+		return errors.New("sentinel directive while not in sentinel mode")
+	}
+	lookupMaster := func(name string) (*sentinelRedisInstance, error) {
+		if ri := st.masters[name]; ri != nil {
+			return ri, nil
+		}
+		return nil, errors.New("No such master with specified name.")
+	}
+
+	var err error
+	switch strings.ToLower(argv[0]) {
+	case "monitor":
+		// monitor <name> <host> <port> <quorum>
+		if len(argv) != 5 {
+			break
+		}
+		quorum, err := strconv.Atoi(argv[4])
+		if err != nil || quorum <= 0 {
+			return errors.New("Quorum must be 1 or greater.")
+		}
+		port, err := strconv.Atoi(argv[3])
+		if err != nil {
+			return errors.New("Invalid port")
+		}
+		_, err = s.createSentinelRedisInstance(argv[1], sriMaster, argv[2], port, quorum, nil)
+		return err
+	case "down-after-milliseconds", "failover-timeout", "parallel-syncs":
+		// down-after-milliseconds <name> <milliseconds>
+		// failover-timeout <name> <milliseconds>
+		// parallel-syncs <name> <milliseconds>
+		if len(argv) != 3 {
+			break
+		}
+		ri, err := lookupMaster(argv[1])
+		if err != nil {
+			return err
+		}
+		return s.sentinelSetOption(ri, strings.ToLower(argv[0]), argv[2])
+	case "myid":
+		// myid <id>
+		if len(argv) != 2 {
+			break
+		}
+		if len(argv[1]) != configRunIdSize {
+			return errors.New("Malformed Sentinel id in myid option.")
+		}
+		st.myid = argv[1]
+		return nil
+	case "current-epoch":
+		// current-epoch <epoch>
+		if len(argv) != 2 {
+			break
+		}
+		st.currentEpoch, err = strconv.ParseUint(argv[1], 10, 64)
+		return err
+	case "config-epoch", "leader-epoch":
+		// config-epoch <name> <epoch>
+		// leader-epoch <name> <epoch>
+		if len(argv) != 3 {
+			break
+		}
+		ri, err := lookupMaster(argv[1])
+		if err != nil {
+			return err
+		}
+		epoch, err := strconv.ParseUint(argv[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(argv[0], "config-epoch") {
+			ri.configEpoch = epoch
+			// When loading, we need to also set current epoch to the max of
+			// all the config epochs, so that a failover doesn't use an
+			// already used epoch.
+			st.currentEpoch = max(st.currentEpoch, epoch)
+		} else {
+			ri.leaderEpoch = epoch
+		}
+		return nil
+	case "known-replica", "known-slave":
+		// known-replica <name> <ip> <port>
+		if len(argv) != 4 {
+			break
+		}
+		ri, err := lookupMaster(argv[1])
+		if err != nil {
+			return err
+		}
+		port, err := strconv.Atoi(argv[3])
+		if err != nil {
+			return errors.New("Invalid port")
+		}
+		_, err = s.createSentinelRedisInstance("", sriSlave, argv[2], port, ri.quorum, ri)
+		return err
+	case "known-sentinel":
+		// known-sentinel <name> <ip> <port> <runid>
+		if len(argv) != 5 {
+			break
+		}
+		ri, err := lookupMaster(argv[1])
+		if err != nil {
+			return err
+		}
+		port, err := strconv.Atoi(argv[3])
+		if err != nil {
+			return errors.New("Invalid port")
+		}
+		si, err := s.createSentinelRedisInstance("", sriSentinel, argv[2], port, ri.quorum, ri)
+		if err != nil {
+			return err
+		}
+		si.runid = argv[4]
+		return nil
+	case "announce-ip":
+		// announce-ip <ip-address>
+		if len(argv) != 2 {
+			break
+		}
+		st.announceIP = argv[1]
+		return nil
+	case "announce-port":
+		// announce-port <port>
+		if len(argv) != 2 {
+			break
+		}
+		st.announcePort, err = strconv.Atoi(argv[1])
+		return err
+	}
+	return errors.New("Unrecognized sentinel configuration statement.")
+}
+
+// sentinelSetOption sets an option of the master, it is used by the config
+// file and SENTINEL SET.
+func (s *Server) sentinelSetOption(ri *sentinelRedisInstance, option, value string) error {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("Invalid argument '%s' for SENTINEL SET '%s'", value, option)
+	}
+	switch option {
+	case "down-after-milliseconds":
+		ri.downAfterPeriod = n
+		for _, si := range ri.slaves {
+			si.downAfterPeriod = n
+		}
+		for _, si := range ri.sentinels {
+			si.downAfterPeriod = n
+		}
+	case "failover-timeout":
+		ri.failoverTimeout = n
+	case "parallel-syncs":
+		ri.parallelSyncs = int(n)
+	case "quorum":
+		ri.quorum = int(n)
+	default:
+		return fmt.Errorf("Invalid argument '%s' for SENTINEL SET", option)
+	}
+	return nil
+}
+
+// createSentinelRedisInstance creates a monitored instance, the master of
+// the replicas and of the sentinels is given.
+func (s *Server) createSentinelRedisInstance(name string, flags int, ip string, port int,
+	quorum int, master *sentinelRedisInstance) (*sentinelRedisInstance, error) {
+	if net.ParseIP(ip) == nil {
+		return nil, errors.New("Invalid IP address specified")
+	}
+	if port <= 0 || port > 65535 {
+		return nil, errors.New("Invalid port")
+	}
+
+	// For slaves and sentinels we use ip:port as name.
+	var table map[string]*sentinelRedisInstance
+	switch {
+	case flags&sriMaster != 0:
+		table = s.sentinel.masters
+	case flags&sriSlave != 0:
+		name = net.JoinHostPort(ip, strconv.Itoa(port))
+		table = master.slaves
+	case flags&sriSentinel != 0:
+		name = net.JoinHostPort(ip, strconv.Itoa(port))
+		table = master.sentinels
+	}
+	if _, ok := table[name]; ok {
+		return nil, errors.New("Duplicated master name.")
+	}
+
+	now := time.Now().UnixMilli()
+	ri := &sentinelRedisInstance{
+		flags:               flags,
+		name:                name,
+		ip:                  ip,
+		port:                port,
+		link:                newInstanceLink(),
+		downAfterPeriod:     sentinelDefaultDownAfter,
+		roleReported:        flags & (sriMaster | sriSlave),
+		roleReportedTime:    now,
+		slaveConfChangeTime: now,
+		quorum:              quorum,
+		parallelSyncs:       sentinelDefaultParallelSyncs,
+		failoverTimeout:     sentinelDefaultFailoverTimeout,
+		master:              master,
+	}
+	if master != nil {
+		ri.downAfterPeriod = master.downAfterPeriod
+	}
+	if flags&sriMaster != 0 {
+		ri.sentinels = make(map[string]*sentinelRedisInstance)
+		ri.slaves = make(map[string]*sentinelRedisInstance)
+	}
+	table[name] = ri
+	return ri, nil
+}
+
+// releaseSentinelRedisInstance closes the link of the instance, and of its
+// replicas and sentinels if it's a master.
+func (s *Server) releaseSentinelRedisInstance(ri *sentinelRedisInstance) {
+	for _, si := range ri.sentinels {
+		s.releaseSentinelRedisInstance(si)
+	}
+	for _, si := range ri.slaves {
+		s.releaseSentinelRedisInstance(si)
+	}
+	ri.released = true
+	s.instanceLinkCloseConnection(ri.link)
+}
+
+func newInstanceLink() *instanceLink {
+	now := time.Now().UnixMilli()
+	return &instanceLink{
+		disconnected: true,
+		// We set the actPingTime to "now" even if we actually don't have
+		// yet a connection with the node, nor we sent a ping. This is
+		// useful to detect a timeout in case we'll not be able to connect
+		// with the node at all.
+		actPingTime:   now,
+		lastAvailTime: now,
+		lastPongTime:  now,
+	}
+}
+
+// instanceLinkCloseConnection disconnects the link, it's connected again
+// by the sentinelTimer.
+func (s *Server) instanceLinkCloseConnection(link *instanceLink) {
+	if link.disconnected {
+		return
+	}
+	link.disconnected = true
+	close(link.reqCh)
+	link.conn.Close()
+	link.conn = nil
+	if link.pconn != nil {
+		link.pconn.Close()
+		link.pconn = nil
+	}
+	link.pendingCommands = 0
+}
+
+// sentinelReconnectInstance creates the connections of the link with the
+// instance in background, if the link is disconnected.
+func (s *Server) sentinelReconnectInstance(ri *sentinelRedisInstance) {
+	link := ri.link
+	if !link.disconnected || link.connecting {
+		return
+	}
+	now := time.Now().UnixMilli()
+	if now-link.lastReconnTime < sentinelPingPeriod {
+		return
+	}
+	link.lastReconnTime = now
+	link.connecting = true
+
+	addr := net.JoinHostPort(ri.ip, strconv.Itoa(ri.port))
+	pubsub := ri.flags&(sriMaster|sriSlave) != 0
+	go func() {
+		timeout := sentinelPingPeriod * time.Millisecond
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		var pconn net.Conn
+		if err == nil && pubsub {
+			if pconn, err = net.DialTimeout("tcp", addr, timeout); err != nil {
+				conn.Close()
+			}
+		}
+
+		s.CmdLock.Lock()
+		defer s.CmdLock.Unlock()
+		link.connecting = false
+		if err != nil {
+			s.sentinelEvent(slog.LevelDebug, "-cmd-link-reconnection", ri, "%s", err)
+			return
+		}
+		if ri.released || ri.link != link {
+			conn.Close()
+			if pconn != nil {
+				pconn.Close()
+			}
+			return
+		}
+
+		now := time.Now().UnixMilli()
+		link.conn, link.pconn = conn, pconn
+		link.disconnected = false
+		link.ccConnTime, link.pcConnTime, link.pcLastActivity = now, now, now
+		link.reqCh = make(chan *sentinelRequest, sentinelMaxPendingCommands)
+		go s.sentinelCommandLoop(link, conn, link.reqCh)
+		if pconn != nil {
+			go s.sentinelPubsubLoop(ri, link, pconn)
+		}
+		// Send a PING ASAP when reconnecting.
+		s.sentinelSendPing(ri)
+	}()
+}
+
+// sentinelCommandLoop sends the commands of the link, the callbacks are
+// called with the replies while holding the CmdLock.
+func (s *Server) sentinelCommandLoop(link *instanceLink, conn net.Conn, reqCh chan *sentinelRequest) {
+	rd := bufio.NewReader(conn)
+	for req := range reqCh {
+		var reply any
+		_, err := conn.Write(catCommand(req.argv))
+		if err == nil {
+			reply, err = readReply(rd)
+		}
+
+		s.CmdLock.Lock()
+		if link.conn == conn {
+			link.pendingCommands--
+			if err != nil {
+				s.instanceLinkCloseConnection(link)
+			} else if req.callback != nil {
+				req.callback(reply)
+			}
+		}
+		s.CmdLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sentinelPubsubLoop subscribes the hello channel of the instance, and
+// processes the hello messages.
+func (s *Server) sentinelPubsubLoop(ri *sentinelRedisInstance, link *instanceLink, pconn net.Conn) {
+	rd := bufio.NewReader(pconn)
+	_, err := pconn.Write(catCommand([][]byte{[]byte("SUBSCRIBE"), []byte(sentinelHelloChannel)}))
+	for err == nil {
+		var reply any
+		if reply, err = readReply(rd); err != nil {
+			break
+		}
+		s.CmdLock.Lock()
+		if link.pconn == pconn {
+			link.pcLastActivity = time.Now().UnixMilli()
+			s.sentinelReceiveHelloMessages(ri, reply)
+		}
+		s.CmdLock.Unlock()
+	}
+
+	s.CmdLock.Lock()
+	if link.pconn == pconn {
+		s.instanceLinkCloseConnection(link)
+	}
+	s.CmdLock.Unlock()
+}
+
+// sentinelSendCommand queues the command to the instance, the callback is
+// called with the reply. It returns false if the link is down or too many
+// commands are pending.
+func (s *Server) sentinelSendCommand(ri *sentinelRedisInstance, callback func(reply any), args ...string) bool {
+	link := ri.link
+	if link.disconnected {
+		return false
+	}
+	argv := make([][]byte, 0, len(args))
+	for _, arg := range args {
+		argv = append(argv, []byte(arg))
+	}
+	select {
+	case link.reqCh <- &sentinelRequest{argv: argv, callback: callback}:
+		link.pendingCommands++
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) sentinelSendPing(ri *sentinelRedisInstance) bool {
+	link := ri.link
+	ok := s.sentinelSendCommand(ri, func(reply any) {
+		now := time.Now().UnixMilli()
+		link.lastPongTime = now
+		// We consider valid the PONG, and the LOADING and MASTERDOWN errors,
+		// since the instance is up.
+		switch r := reply.(type) {
+		case string:
+			if r == "PONG" {
+				link.lastAvailTime, link.actPingTime = now, 0
+			}
+		case respError:
+			if strings.HasPrefix(string(r), "LOADING") || strings.HasPrefix(string(r), "MASTERDOWN") {
+				link.lastAvailTime, link.actPingTime = now, 0
+			}
+		}
+	}, "PING")
+	if ok {
+		link.lastPingTime = time.Now().UnixMilli()
+		// We update the active ping time only if we received the pong for
+		// the previous ping, otherwise we are technically waiting since the
+		// first ping that did not receive a reply.
+		if link.actPingTime == 0 {
+			link.actPingTime = link.lastPingTime
+		}
+	}
+	return ok
+}
+
+// sentinelSendHello publishes our address and the configuration of the
+// master on the hello channel of the instance:
+//
+// sentinel_ip,sentinel_port,sentinel_runid,current_epoch,
+// master_name,master_ip,master_port,master_config_epoch.
+func (s *Server) sentinelSendHello(ri *sentinelRedisInstance) bool {
+	st := s.sentinel
+	master := ri
+	if ri.flags&sriMaster == 0 {
+		master = ri.master
+	}
+	masterIP, masterPort := sentinelGetCurrentMasterAddress(master)
+
+	ip := st.announceIP
+	if ip == "" {
+		ip = connLocalIP(ri.link.conn)
+	}
+	port := Cond(st.announcePort != 0, st.announcePort, s.Port)
+	payload := fmt.Sprintf("%s,%d,%s,%d,%s,%s,%d,%d", ip, port, st.myid, st.currentEpoch,
+		master.name, masterIP, masterPort, master.configEpoch)
+	if s.sentinelSendCommand(ri, nil, "PUBLISH", sentinelHelloChannel, payload) {
+		ri.lastPubTime = time.Now().UnixMilli()
+		return true
+	}
+	return false
+}
+
+// sentinelForceHelloUpdateForMaster makes the next sentinelTimer publish the
+// hello messages for the master, so that a new configuration is propagated
+// to the other sentinels as soon as possible.
+func sentinelForceHelloUpdateForMaster(master *sentinelRedisInstance) {
+	master.lastPubTime = 0
+	for _, slave := range master.slaves {
+		slave.lastPubTime = 0
+	}
+}
+
+func (s *Server) sentinelReceiveHelloMessages(ri *sentinelRedisInstance, reply any) {
+	r, ok := reply.([]any)
+	if !ok || len(r) != 3 {
+		return
+	}
+	kind, _ := r[0].(string)
+	channel, _ := r[1].(string)
+	payload, _ := r[2].(string)
+	if kind != "message" || channel != sentinelHelloChannel {
+		return
+	}
+	// We are not interested in meeting ourselves.
+	if strings.Contains(payload, s.sentinel.myid) {
+		return
+	}
+	s.sentinelProcessHelloMessage(payload)
+}
+
+// sentinelProcessHelloMessage processes the hello message of another
+// sentinel: the sentinel is added to the sentinels of the master if it's
+// unknown, and we switch to the configuration of the master announced by the
+// sentinel if it's newer than ours.
+func (s *Server) sentinelProcessHelloMessage(hello string) {
+	st := s.sentinel
+	token := strings.Split(hello, ",")
+	if len(token) != 8 {
+		return
+	}
+	ip, runid, masterName, masterIP := token[0], token[2], token[4], token[5]
+	port, err1 := strconv.Atoi(token[1])
+	currentEpoch, err2 := strconv.ParseUint(token[3], 10, 64)
+	masterPort, err3 := strconv.Atoi(token[6])
+	masterConfigEpoch, err4 := strconv.ParseUint(token[7], 10, 64)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return
+	}
+
+	master := st.masters[masterName]
+	if master == nil {
+		return
+	}
+	now := time.Now().UnixMilli()
+
+	// First, try to see if we already have this sentinel.
+	si := master.sentinels[net.JoinHostPort(ip, strconv.Itoa(port))]
+	if si == nil || si.runid != runid {
+		// If not, remove all the sentinels that have the same runid or the
+		// same address, since the sentinel was restarted or its address
+		// changed.
+		if s.removeMatchingSentinelFromMaster(master, ip, port, runid) {
+			s.sentinelEvent(slog.LevelInfo, "+sentinel-address-switch", master,
+				"ip %s port %d for %s", ip, port, runid)
+		}
+		// Add the new sentinel.
+		si, err := s.createSentinelRedisInstance("", sriSentinel, ip, port, master.quorum, master)
+		if err != nil {
+			return
+		}
+		si.runid = runid
+		s.sentinelEvent(slog.LevelInfo, "+sentinel", si, "")
+		s.sentinelFlushConfig()
+	}
+	si = master.sentinels[net.JoinHostPort(ip, strconv.Itoa(port))]
+
+	// Update local current_epoch if received current_epoch is greater.
+	if currentEpoch > st.currentEpoch {
+		st.currentEpoch = currentEpoch
+		s.sentinelFlushConfig()
+		s.sentinelEvent(slog.LevelWarn, "+new-epoch", nil, "%d", st.currentEpoch)
+	}
+
+	// Update master info if received configuration is newer.
+	if master.configEpoch < masterConfigEpoch {
+		master.configEpoch = masterConfigEpoch
+		if masterPort != master.port || masterIP != master.ip {
+			oldIP, oldPort := master.ip, master.port
+			s.sentinelEvent(slog.LevelWarn, "+config-update-from", si, "")
+			s.sentinelEvent(slog.LevelWarn, "+switch-master", nil, "%s %s %d %s %d",
+				master.name, oldIP, oldPort, masterIP, masterPort)
+			s.sentinelResetMasterAndChangeAddress(master, masterIP, masterPort)
+		}
+	}
+	si.lastHelloTime = now
+}
+
+// removeMatchingSentinelFromMaster removes the sentinels of the master with
+// the runid or the address, it returns true if any was removed.
+func (s *Server) removeMatchingSentinelFromMaster(master *sentinelRedisInstance, ip string, port int, runid string) bool {
+	removed := false
+	for name, si := range master.sentinels {
+		if si.runid == runid || (si.ip == ip && si.port == port) {
+			s.releaseSentinelRedisInstance(si)
+			delete(master.sentinels, name)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// sentinelRefreshInstanceInfo processes the ROLE reply of a master or of a
+// replica: the replicas of the masters are discovered, and the replicas
+// being reconfigured are followed during the failover.
+func (s *Server) sentinelRefreshInstanceInfo(ri *sentinelRedisInstance, reply any) {
+	r, ok := reply.([]any)
+	if !ok || len(r) == 0 {
+		return
+	}
+	now := time.Now().UnixMilli()
+	role, _ := r[0].(string)
+
+	var reportedRole int
+	switch role {
+	case "master":
+		reportedRole = sriMaster
+		// Discover the replicas of the master.
+		if ri.flags&sriMaster != 0 && len(r) == 3 {
+			replicas, _ := r[2].([]any)
+			for _, replica := range replicas {
+				fields, ok := replica.([]any)
+				if !ok || len(fields) < 2 {
+					continue
+				}
+				ip, _ := fields[0].(string)
+				port, ok := replyToInt(fields[1])
+				if !ok {
+					continue
+				}
+				if ri.slaves[net.JoinHostPort(ip, strconv.Itoa(port))] == nil {
+					slave, err := s.createSentinelRedisInstance("", sriSlave, ip, port, ri.quorum, ri)
+					if err == nil {
+						s.sentinelEvent(slog.LevelInfo, "+slave", slave, "")
+						s.sentinelFlushConfig()
+					}
+				}
+			}
+		}
+	case "slave":
+		reportedRole = sriSlave
+		if len(r) == 5 {
+			host, _ := r[1].(string)
+			port, _ := replyToInt(r[2])
+			state, _ := r[3].(string)
+			offset, _ := r[4].(int64)
+			if ri.slaveMasterHost != host || ri.slaveMasterPort != port {
+				ri.slaveMasterHost, ri.slaveMasterPort = host, port
+				ri.slaveConfChangeTime = now
+			}
+			ri.slaveMasterLinkUp = state == "connected"
+			ri.slaveReplOffset = offset
+		}
+	default:
+		return
+	}
+	ri.infoRefresh = now
+
+	if ri.roleReported != reportedRole {
+		ri.roleReportedTime = now
+		ri.roleReported = reportedRole
+		if reportedRole == sriSlave {
+			ri.slaveConfChangeTime = now
+		}
+		// Log the event only if we are not waiting for the change, that is
+		// the instance reports the role we believe it has.
+		expected := ri.flags & (sriMaster | sriSlave)
+		s.sentinelEvent(slog.LevelDebug, Cond(reportedRole == expected, "-role-change", "+role-change"),
+			ri, "new reported role is %s", role)
+	}
+
+	// Masters claiming to be replicas are considered to be unreachable by
+	// sentinelCheckSubjectivelyDown, so eventually a failover is triggered.
+
+	// Handle slave -> master role switch.
+	if ri.flags&sriSlave != 0 && reportedRole == sriMaster {
+		master := ri.master
+		if ri.flags&sriPromoted != 0 && master.flags&sriFailoverInProgress != 0 &&
+			master.failoverState == sentinelFailoverStateWaitPromotion {
+			// Now that we are sure the slave was reconfigured as a master set
+			// the master configuration epoch to the epoch we won the election
+			// to perform this failover. This will force the other Sentinels
+			// to update their config (assuming there is not a newer one
+			// already available).
+			master.configEpoch = master.failoverEpoch
+			master.failoverState = sentinelFailoverStateReconfSlaves
+			master.failoverStateChangeTime = now
+			s.sentinelFlushConfig()
+			s.sentinelEvent(slog.LevelWarn, "+promoted-slave", ri, "")
+			s.sentinelEvent(slog.LevelWarn, "+failover-state-reconf-slaves", master, "")
+			sentinelForceHelloUpdateForMaster(master)
+		} else {
+			// A slave turned into a master. We want to force our view and
+			// reconfigure as slave. Wait some time after the change before
+			// going forward, to receive new configs if any.
+			waitTime := int64(sentinelPublishPeriod * 4)
+			if ri.flags&sriPromoted == 0 && sentinelMasterLooksSane(master) &&
+				sentinelRedisInstanceNoDownFor(ri, waitTime) && now-ri.roleReportedTime > waitTime {
+				if s.sentinelSendSlaveOf(ri, master.ip, master.port) {
+					s.sentinelEvent(slog.LevelInfo, "+convert-to-slave", ri, "")
+				}
+			}
+		}
+	}
+
+	// Handle slaves replicating to a different master address.
+	if ri.flags&sriSlave != 0 && reportedRole == sriSlave &&
+		(ri.slaveMasterPort != ri.master.port || ri.slaveMasterHost != ri.master.ip) {
+		waitTime := ri.master.failoverTimeout
+		// Make sure the master is sane before reconfiguring this instance
+		// into a slave.
+		if sentinelMasterLooksSane(ri.master) && sentinelRedisInstanceNoDownFor(ri, waitTime) &&
+			now-ri.slaveConfChangeTime > waitTime {
+			if s.sentinelSendSlaveOf(ri, ri.master.ip, ri.master.port) {
+				s.sentinelEvent(slog.LevelInfo, "+fix-slave-config", ri, "")
+			}
+		}
+	}
+
+	// Detect if the slave that is in the process of being reconfigured
+	// changed state.
+	if ri.flags&sriSlave != 0 && reportedRole == sriSlave && ri.flags&(sriReconfSent|sriReconfInprog) != 0 {
+		promoted := ri.master.promotedSlave
+		// SRI_RECONF_SENT -> SRI_RECONF_INPROG.
+		if ri.flags&sriReconfSent != 0 && promoted != nil &&
+			ri.slaveMasterHost == promoted.ip && ri.slaveMasterPort == promoted.port {
+			ri.flags &= ^sriReconfSent
+			ri.flags |= sriReconfInprog
+			s.sentinelEvent(slog.LevelInfo, "+slave-reconf-inprog", ri, "")
+		}
+		// SRI_RECONF_INPROG -> SRI_RECONF_DONE.
+		if ri.flags&sriReconfInprog != 0 && ri.slaveMasterLinkUp {
+			ri.flags &= ^sriReconfInprog
+			ri.flags |= sriReconfDone
+			s.sentinelEvent(slog.LevelInfo, "+slave-reconf-done", ri, "")
+		}
+	}
+}
+
+func replyToInt(reply any) (int, bool) {
+	switch r := reply.(type) {
+	case int64:
+		return int(r), true
+	case string:
+		n, err := strconv.Atoi(r)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// sentinelMasterLooksSane returns true if the master looks "sane", that is
+// it is flagged as master, it reports itself as master, it's not SDOWN or
+// ODOWN, and we got a ROLE reply recently.
+func sentinelMasterLooksSane(master *sentinelRedisInstance) bool {
+	return master.flags&sriMaster != 0 && master.roleReported == sriMaster &&
+		master.flags&(sriSDown|sriODown) == 0 &&
+		time.Now().UnixMilli()-master.infoRefresh < sentinelInfoPeriod*2
+}
+
+// sentinelRedisInstanceNoDownFor returns true if the instance was not
+// SDOWN or ODOWN in the latest ms milliseconds.
+func sentinelRedisInstanceNoDownFor(ri *sentinelRedisInstance, ms int64) bool {
+	mostRecent := max(ri.sDownSinceTime, ri.oDownSinceTime)
+	return mostRecent == 0 || time.Now().UnixMilli()-mostRecent > ms
+}
+
+// sentinelSendSlaveOf sends REPLICAOF to the instance, if the host is empty
+// REPLICAOF NO ONE is sent, to turn the instance into a master.
+func (s *Server) sentinelSendSlaveOf(ri *sentinelRedisInstance, host string, port int) bool {
+	if host == "" {
+		return s.sentinelSendCommand(ri, nil, "REPLICAOF", "NO", "ONE")
+	}
+	return s.sentinelSendCommand(ri, nil, "REPLICAOF", host, strconv.Itoa(port))
+}
+
+// sentinelGetCurrentMasterAddress returns the address of the master, which is
+// the address of the promoted replica once it accepted to be the master
+// during the failover.
+func sentinelGetCurrentMasterAddress(master *sentinelRedisInstance) (string, int) {
+	if master.flags&sriFailoverInProgress != 0 && master.promotedSlave != nil &&
+		master.failoverState >= sentinelFailoverStateReconfSlaves {
+		return master.promotedSlave.ip, master.promotedSlave.port
+	}
+	return master.ip, master.port
+}
+
+// sentinelResetMaster resets the state of the master, the replicas are
+// forgotten, and the sentinels too if resetSentinels is true.
+func (s *Server) sentinelResetMaster(ri *sentinelRedisInstance, resetSentinels bool) {
+	for _, slave := range ri.slaves {
+		s.releaseSentinelRedisInstance(slave)
+	}
+	ri.slaves = make(map[string]*sentinelRedisInstance)
+	if resetSentinels {
+		for _, si := range ri.sentinels {
+			s.releaseSentinelRedisInstance(si)
+		}
+		ri.sentinels = make(map[string]*sentinelRedisInstance)
+	}
+	s.instanceLinkCloseConnection(ri.link)
+	ri.link = newInstanceLink()
+
+	now := time.Now().UnixMilli()
+	ri.flags &= sriMaster
+	ri.leader = ""
+	ri.failoverState = sentinelFailoverStateNone
+	ri.failoverStateChangeTime = 0
+	ri.failoverStartTime = 0
+	ri.promotedSlave = nil
+	ri.sDownSinceTime = 0
+	ri.oDownSinceTime = 0
+	ri.infoRefresh = 0
+	ri.roleReported = sriMaster
+	ri.roleReportedTime = now
+	s.sentinelEvent(slog.LevelWarn, "+reset-master", ri, "")
+}
+
+// sentinelResetMasterAndChangeAddress resets the master and changes its
+// address. The replicas of the old master, and the old master itself, are
+// the replicas of the new one.
+func (s *Server) sentinelResetMasterAndChangeAddress(master *sentinelRedisInstance, ip string, port int) {
+	type addr struct {
+		ip   string
+		port int
+	}
+	var slaves []addr
+	for _, slave := range sortedInstances(master.slaves) {
+		if slave.ip == ip && slave.port == port {
+			continue
+		}
+		slaves = append(slaves, addr{slave.ip, slave.port})
+	}
+	// If we are switching to a different address, include the old master
+	// as a slave as well, so that we'll be able to sense / reconfigure the
+	// old master.
+	if master.ip != ip || master.port != port {
+		slaves = append(slaves, addr{master.ip, master.port})
+	}
+
+	s.sentinelResetMaster(master, false)
+	master.ip, master.port = ip, port
+	for _, a := range slaves {
+		if slave, err := s.createSentinelRedisInstance("", sriSlave, a.ip, a.port, master.quorum, master); err == nil {
+			s.sentinelEvent(slog.LevelInfo, "+slave", slave, "")
+		}
+	}
+	s.sentinelFlushConfig()
+}
+
+// sentinelTimer is called 10 times per second.
+func (s *Server) sentinelTimer() {
+	if !TryLockWithTimeout(s.CmdLock, 10*time.Millisecond) {
+		return
+	}
+	defer s.CmdLock.Unlock()
+	s.sentinelHandleDictOfRedisInstances(s.sentinel.masters)
+}
+
+func (s *Server) sentinelHandleDictOfRedisInstances(instances map[string]*sentinelRedisInstance) {
+	var switchToPromoted *sentinelRedisInstance
+	for _, ri := range sortedInstances(instances) {
+		s.sentinelHandleRedisInstance(ri)
+		if ri.flags&sriMaster != 0 {
+			s.sentinelHandleDictOfRedisInstances(ri.slaves)
+			s.sentinelHandleDictOfRedisInstances(ri.sentinels)
+			if ri.failoverState == sentinelFailoverStateUpdateConfig {
+				switchToPromoted = ri
+			}
+		}
+	}
+	if switchToPromoted != nil {
+		s.sentinelFailoverSwitchToPromotedSlave(switchToPromoted)
+	}
+}
+
+func (s *Server) sentinelHandleRedisInstance(ri *sentinelRedisInstance) {
+	// Every kind of instance.
+	s.sentinelReconnectInstance(ri)
+	s.sentinelSendPeriodicCommands(ri)
+	s.sentinelCheckSubjectivelyDown(ri)
+
+	// Only masters.
+	if ri.flags&sriMaster != 0 {
+		s.sentinelCheckObjectivelyDown(ri)
+		if s.sentinelStartFailoverIfNeeded(ri) {
+			s.sentinelAskMasterStateToOtherSentinels(ri, true)
+		}
+		s.sentinelFailoverStateMachine(ri)
+		s.sentinelAskMasterStateToOtherSentinels(ri, false)
+	}
+}
+
+// sentinelSendPeriodicCommands sends ROLE, PING and the hello messages to
+// the instance.
+func (s *Server) sentinelSendPeriodicCommands(ri *sentinelRedisInstance) {
+	link := ri.link
+	if link.disconnected {
+		return
+	}
+	// For ROLE, PING, PUBLISH that are not critical commands to send we
+	// also have a limit of pending commands. We don't want to use a lot of
+	// memory just because a link is not working correctly.
+	if link.pendingCommands >= sentinelMaxPendingCommands {
+		return
+	}
+	now := time.Now().UnixMilli()
+
+	// If this is a slave of a master in ODOWN condition we start sending
+	// it ROLE every second, instead of the usual period, since we need to
+	// follow the reconfiguration of the slaves during the failover.
+	infoPeriod := int64(sentinelInfoPeriod)
+	if ri.flags&sriSlave != 0 && ri.master.flags&(sriODown|sriFailoverInProgress) != 0 {
+		infoPeriod = 1000
+	}
+	// We ping instances every time the last received pong is older than
+	// the configured 'down-after-milliseconds' time, but every second
+	// anyway if 'down-after-milliseconds' is greater than 1 second.
+	pingPeriod := min(ri.downAfterPeriod, sentinelPingPeriod)
+
+	if ri.flags&sriSentinel == 0 && (ri.infoRefresh == 0 || now-ri.infoRefresh > infoPeriod) {
+		s.sentinelSendCommand(ri, func(reply any) {
+			s.sentinelRefreshInstanceInfo(ri, reply)
+		}, "ROLE")
+	}
+	if now-link.lastPongTime > pingPeriod && now-link.lastPingTime > pingPeriod/2 {
+		s.sentinelSendPing(ri)
+	}
+	if ri.flags&sriSentinel == 0 && now-ri.lastPubTime > sentinelPublishPeriod {
+		s.sentinelSendHello(ri)
+	}
+}
+
+// sentinelCheckSubjectivelyDown flags the instance as SDOWN if it doesn't
+// reply to the pings for down-after-milliseconds.
+func (s *Server) sentinelCheckSubjectivelyDown(ri *sentinelRedisInstance) {
+	link := ri.link
+	now := time.Now().UnixMilli()
+	var elapsed int64
+	if link.actPingTime != 0 {
+		elapsed = now - link.actPingTime
+	} else if link.disconnected {
+		elapsed = now - link.lastAvailTime
+	}
+
+	// Check if we are in need for a reconnection of one of the links,
+	// because we are detecting low activity.
+	//
+	// 1) Check if the command link seems connected, was connected not less
+	//    than SENTINEL_MIN_LINK_RECONNECT_PERIOD, but still we have a
+	//    pending ping for more than half the timeout. Maybe there is a
+	//    connection issue even if the instance is alive.
+	// 2) Check if the pubsub link seems connected, was connected not less
+	//    than SENTINEL_MIN_LINK_RECONNECT_PERIOD, but still we have no
+	//    activity in the Pub/Sub channel for more than
+	//    SENTINEL_PUBLISH_PERIOD * 3.
+	if !link.disconnected && now-link.ccConnTime > sentinelMinLinkReconnectPeriod &&
+		link.actPingTime != 0 && now-link.actPingTime > ri.downAfterPeriod/2 &&
+		now-link.lastPongTime > ri.downAfterPeriod/2 {
+		s.instanceLinkCloseConnection(link)
+	}
+	if !link.disconnected && link.pconn != nil && now-link.pcConnTime > sentinelMinLinkReconnectPeriod &&
+		now-link.pcLastActivity > sentinelPublishPeriod*3 {
+		s.instanceLinkCloseConnection(link)
+	}
+
+	// Update the SDOWN flag. We believe the instance is SDOWN if it doesn't
+	// reply, or if it's a master reporting as slave for too long.
+	if elapsed > ri.downAfterPeriod ||
+		(ri.flags&sriMaster != 0 && ri.roleReported == sriSlave &&
+			now-ri.roleReportedTime > ri.downAfterPeriod+sentinelInfoPeriod*2) {
+		// Is subjectively down.
+		if ri.flags&sriSDown == 0 {
+			s.sentinelEvent(slog.LevelWarn, "+sdown", ri, "")
+			ri.sDownSinceTime = now
+			ri.flags |= sriSDown
+		}
+	} else if ri.flags&sriSDown != 0 {
+		// Is subjectively up.
+		s.sentinelEvent(slog.LevelWarn, "-sdown", ri, "")
+		ri.flags &= ^sriSDown
+	}
+}
+
+// sentinelCheckObjectivelyDown flags the master as ODOWN if enough
+// sentinels, including us, believe the master is down.
+func (s *Server) sentinelCheckObjectivelyDown(master *sentinelRedisInstance) {
+	quorum, odown := 0, false
+	if master.flags&sriSDown != 0 {
+		// Is down for enough sentinels?
+		quorum = 1 // the current sentinel.
+		for _, ri := range master.sentinels {
+			if ri.flags&sriMasterDown != 0 {
+				quorum++
+			}
+		}
+		odown = quorum >= master.quorum
+	}
+
+	// Set the flag accordingly to the outcome.
+	if odown {
+		if master.flags&sriODown == 0 {
+			s.sentinelEvent(slog.LevelWarn, "+odown", master, "#quorum %d/%d", quorum, master.quorum)
+			master.flags |= sriODown
+			master.oDownSinceTime = time.Now().UnixMilli()
+		}
+	} else if master.flags&sriODown != 0 {
+		s.sentinelEvent(slog.LevelWarn, "-odown", master, "")
+		master.flags &= ^sriODown
+	}
+}
+
+// sentinelAskMasterStateToOtherSentinels asks the other sentinels if they
+// believe the master is down too, with SENTINEL is-master-down-by-addr. When
+// a failover is started, our runid is sent, to ask the sentinels to vote us
+// as the leader.
+func (s *Server) sentinelAskMasterStateToOtherSentinels(master *sentinelRedisInstance, force bool) {
+	st := s.sentinel
+	now := time.Now().UnixMilli()
+	for _, ri := range master.sentinels {
+		elapsed := now - ri.lastMasterDownReplyTime
+		// If the master state from other sentinel is too old, we clear it.
+		if elapsed > sentinelAskPeriod*5 {
+			ri.flags &= ^sriMasterDown
+			ri.leader = ""
+		}
+
+		// Only ask if master is down to other sentinels if:
+		//
+		// 1) We believe it is down, or there is a failover in progress.
+		// 2) Sentinel is connected.
+		// 3) We did not receive the info within SENTINEL_ASK_PERIOD ms.
+		if master.flags&sriSDown == 0 || ri.link.disconnected {
+			continue
+		}
+		if !force && elapsed < sentinelAskPeriod {
+			continue
+		}
+
+		runid := "*"
+		if master.failoverState > sentinelFailoverStateNone {
+			runid = st.myid
+		}
+		s.sentinelSendCommand(ri, func(reply any) {
+			s.sentinelReceiveIsMasterDownReply(ri, reply)
+		}, "SENTINEL", "is-master-down-by-addr", master.ip, strconv.Itoa(master.port),
+			strconv.FormatUint(st.currentEpoch, 10), runid)
+	}
+}
+
+// sentinelReceiveIsMasterDownReply processes the reply of another sentinel
+// to SENTINEL is-master-down-by-addr: <down state> <leader> <leader epoch>.
+func (s *Server) sentinelReceiveIsMasterDownReply(ri *sentinelRedisInstance, reply any) {
+	r, ok := reply.([]any)
+	if !ok || len(r) != 3 {
+		return
+	}
+	down, ok1 := r[0].(int64)
+	leader, ok2 := r[1].(string)
+	leaderEpoch, ok3 := r[2].(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return
+	}
+
+	ri.lastMasterDownReplyTime = time.Now().UnixMilli()
+	if down == 1 {
+		ri.flags |= sriMasterDown
+	} else {
+		ri.flags &= ^sriMasterDown
+	}
+	if leader != "*" {
+		if ri.leaderEpoch != uint64(leaderEpoch) {
+			s.sentinelEvent(slog.LevelInfo, "+vote-for-leader", nil, "%s %d", leader, leaderEpoch)
+		}
+		ri.leader = leader
+		ri.leaderEpoch = uint64(leaderEpoch)
+	}
+}
+
+// sentinelVoteLeader votes a leader for the epoch, the leader is voted only
+// once per epoch: the first sentinel asking for the vote is voted.
+func (s *Server) sentinelVoteLeader(master *sentinelRedisInstance, reqEpoch uint64, reqRunid string) (string, uint64) {
+	st := s.sentinel
+	if reqEpoch > st.currentEpoch {
+		st.currentEpoch = reqEpoch
+		s.sentinelFlushConfig()
+		s.sentinelEvent(slog.LevelWarn, "+new-epoch", nil, "%d", st.currentEpoch)
+	}
+
+	if master.leaderEpoch < reqEpoch && st.currentEpoch <= reqEpoch {
+		master.leader = reqRunid
+		master.leaderEpoch = st.currentEpoch
+		s.sentinelFlushConfig()
+		s.sentinelEvent(slog.LevelWarn, "+vote-for-leader", nil, "%s %d", master.leader, master.leaderEpoch)
+		// If we did not voted for ourselves, set the master failover start
+		// time to now, in order to force a delay before we can start a
+		// failover for the same master.
+		if master.leader != st.myid {
+			master.failoverStartTime = time.Now().UnixMilli() + rand.Int63n(sentinelMaxDesync)
+		}
+	}
+	return master.leader, master.leaderEpoch
+}
+
+// sentinelGetLeader returns the leader of the epoch, that is the sentinel
+// voted by the majority of the sentinels, and at least by the quorum. An
+// empty string is returned if there is no leader yet.
+func (s *Server) sentinelGetLeader(master *sentinelRedisInstance, epoch uint64) string {
+	st := s.sentinel
+	voters := len(master.sentinels) + 1 // All the other sentinels and me.
+	counters := make(map[string]int)
+
+	// Count other sentinels votes.
+	for _, ri := range master.sentinels {
+		if ri.leader != "" && ri.leaderEpoch == st.currentEpoch {
+			counters[ri.leader]++
+		}
+	}
+	winner := func() (string, int) {
+		var name string
+		var votes int
+		for candidate, n := range counters {
+			if n > votes || (n == votes && candidate < name) {
+				name, votes = candidate, n
+			}
+		}
+		return name, votes
+	}
+
+	// Vote for the most voted sentinel, or ourselves if there's no winner.
+	leader, _ := winner()
+	var myvote string
+	var leaderEpoch uint64
+	if leader != "" {
+		myvote, leaderEpoch = s.sentinelVoteLeader(master, epoch, leader)
+	} else {
+		myvote, leaderEpoch = s.sentinelVoteLeader(master, epoch, st.myid)
+	}
+	if myvote != "" && leaderEpoch == epoch {
+		counters[myvote]++
+	}
+
+	// The winner needs the majority of the voters, and at least the quorum.
+	leader, votes := winner()
+	if leader != "" && (votes < voters/2+1 || votes < master.quorum) {
+		return ""
+	}
+	return leader
+}
+
+// sentinelStartFailoverIfNeeded starts the failover if the master is
+// ODOWN, no failover is in progress, and the previous failover was not
+// tried recently.
+func (s *Server) sentinelStartFailoverIfNeeded(master *sentinelRedisInstance) bool {
+	// We can't failover if the master is not in O_DOWN state.
+	if master.flags&sriODown == 0 {
+		return false
+	}
+	// Failover already in progress?
+	if master.flags&sriFailoverInProgress != 0 {
+		return false
+	}
+	// Last failover attempt started too little time ago?
+	now := time.Now().UnixMilli()
+	if now-master.failoverStartTime < master.failoverTimeout*2 {
+		if master.failoverDelayLogged != master.failoverStartTime {
+			master.failoverDelayLogged = master.failoverStartTime
+			next := time.UnixMilli(master.failoverStartTime + master.failoverTimeout*2)
+			slog.Warn("Next failover delay: I will not start a failover before " + next.Format(time.TimeOnly))
+		}
+		return false
+	}
+	s.sentinelStartFailover(master)
+	return true
+}
+
+func (s *Server) sentinelStartFailover(master *sentinelRedisInstance) {
+	st := s.sentinel
+	now := time.Now().UnixMilli()
+	master.failoverState = sentinelFailoverStateWaitStart
+	master.flags |= sriFailoverInProgress
+	st.currentEpoch++
+	master.failoverEpoch = st.currentEpoch
+	s.sentinelEvent(slog.LevelWarn, "+new-epoch", nil, "%d", st.currentEpoch)
+	s.sentinelEvent(slog.LevelWarn, "+try-failover", master, "")
+	master.failoverStartTime = now + rand.Int63n(sentinelMaxDesync)
+	master.failoverStateChangeTime = now
+}
+
+func (s *Server) sentinelFailoverStateMachine(ri *sentinelRedisInstance) {
+	if ri.flags&sriFailoverInProgress == 0 {
+		return
+	}
+	switch ri.failoverState {
+	case sentinelFailoverStateWaitStart:
+		s.sentinelFailoverWaitStart(ri)
+	case sentinelFailoverStateSelectSlave:
+		s.sentinelFailoverSelectSlave(ri)
+	case sentinelFailoverStateSendSlaveofNoone:
+		s.sentinelFailoverSendSlaveOfNoOne(ri)
+	case sentinelFailoverStateWaitPromotion:
+		s.sentinelFailoverWaitPromotion(ri)
+	case sentinelFailoverStateReconfSlaves:
+		s.sentinelFailoverReconfNextSlave(ri)
+	}
+}
+
+func (s *Server) sentinelFailoverWaitStart(ri *sentinelRedisInstance) {
+	now := time.Now().UnixMilli()
+	// Check if we are the leader for the failover epoch.
+	leader := s.sentinelGetLeader(ri, ri.failoverEpoch)
+	isLeader := leader != "" && leader == s.sentinel.myid
+
+	// If I'm not the leader, and it is not a forced failover via
+	// SENTINEL FAILOVER, then I can't continue with the failover.
+	if !isLeader && ri.flags&sriForceFailover == 0 {
+		electionTimeout := min(int64(sentinelElectionTimeout), ri.failoverTimeout)
+		// The election timed out? Abort the failover.
+		if now-ri.failoverStartTime > electionTimeout {
+			s.sentinelEvent(slog.LevelWarn, "-failover-abort-not-elected", ri, "")
+			s.sentinelAbortFailover(ri)
+		}
+		return
+	}
+	s.sentinelEvent(slog.LevelWarn, "+elected-leader", ri, "")
+	ri.failoverState = sentinelFailoverStateSelectSlave
+	ri.failoverStateChangeTime = now
+	s.sentinelEvent(slog.LevelWarn, "+failover-state-select-slave", ri, "")
+}
+
+func (s *Server) sentinelFailoverSelectSlave(ri *sentinelRedisInstance) {
+	slave := sentinelSelectSlave(ri)
+	if slave == nil {
+		s.sentinelEvent(slog.LevelWarn, "-failover-abort-no-good-slave", ri, "")
+		s.sentinelAbortFailover(ri)
+		return
+	}
+	s.sentinelEvent(slog.LevelWarn, "+selected-slave", slave, "")
+	slave.flags |= sriPromoted
+	ri.promotedSlave = slave
+	ri.failoverState = sentinelFailoverStateSendSlaveofNoone
+	ri.failoverStateChangeTime = time.Now().UnixMilli()
+	s.sentinelEvent(slog.LevelInfo, "+failover-state-send-slaveof-noone", slave, "")
+}
+
+func (s *Server) sentinelFailoverSendSlaveOfNoOne(ri *sentinelRedisInstance) {
+	now := time.Now().UnixMilli()
+	// We can't send the command to the promoted slave if it is now
+	// disconnected. Retry again and again with this state until the
+	// timeout is reached, then abort the failover.
+	if ri.promotedSlave.link.disconnected {
+		if now-ri.failoverStateChangeTime > ri.failoverTimeout {
+			s.sentinelEvent(slog.LevelWarn, "-failover-abort-slave-timeout", ri, "")
+			s.sentinelAbortFailover(ri)
+		}
+		return
+	}
+
+	// Send REPLICAOF NO ONE command to turn the slave into a master. We
+	// actually register a generic callback for this command as we don't
+	// really care about the reply. We check if it worked indirectly
+	// observing if ROLE returns a different role (master instead of slave).
+	if !s.sentinelSendSlaveOf(ri.promotedSlave, "", 0) {
+		return
+	}
+	s.sentinelEvent(slog.LevelInfo, "+failover-state-wait-promotion", ri.promotedSlave, "")
+	ri.failoverState = sentinelFailoverStateWaitPromotion
+	ri.failoverStateChangeTime = now
+}
+
+// sentinelFailoverWaitPromotion aborts the failover if the promotion timed
+// out, the promotion itself is detected by sentinelRefreshInstanceInfo.
+func (s *Server) sentinelFailoverWaitPromotion(ri *sentinelRedisInstance) {
+	if time.Now().UnixMilli()-ri.failoverStateChangeTime > ri.failoverTimeout {
+		s.sentinelEvent(slog.LevelWarn, "-failover-abort-slave-timeout", ri, "")
+		s.sentinelAbortFailover(ri)
+	}
+}
+
+// sentinelFailoverReconfNextSlave sends REPLICAOF <new master> to the
+// replicas, at most parallel-syncs replicas are reconfigured at the same time.
+func (s *Server) sentinelFailoverReconfNextSlave(master *sentinelRedisInstance) {
+	now := time.Now().UnixMilli()
+	inProgress := 0
+	for _, slave := range master.slaves {
+		if slave.flags&(sriReconfSent|sriReconfInprog) != 0 {
+			inProgress++
+		}
+	}
+
+	promoted := master.promotedSlave
+	for _, slave := range sortedInstances(master.slaves) {
+		if inProgress >= master.parallelSyncs {
+			break
+		}
+		// Skip the promoted slave, and already configured slaves.
+		if slave.flags&(sriPromoted|sriReconfDone) != 0 {
+			continue
+		}
+		// If too much time elapsed without the slave moving forward to the
+		// next state, consider it reconfigured even if it is not. Sentinels
+		// will detect the slave as misconfigured and fix its configuration
+		// later.
+		if slave.flags&sriReconfSent != 0 && now-slave.slaveReconfSentTime > sentinelSlaveReconfTimeout {
+			s.sentinelEvent(slog.LevelInfo, "-slave-reconf-sent-timeout", slave, "")
+			slave.flags &= ^sriReconfSent
+			slave.flags |= sriReconfDone
+			continue
+		}
+		// Nothing to do for instances that are disconnected or already in
+		// RECONF_SENT state.
+		if slave.flags&(sriReconfSent|sriReconfInprog) != 0 || slave.link.disconnected {
+			continue
+		}
+		// Send REPLICAOF <new master>.
+		if s.sentinelSendSlaveOf(slave, promoted.ip, promoted.port) {
+			slave.flags |= sriReconfSent
+			slave.slaveReconfSentTime = now
+			s.sentinelEvent(slog.LevelInfo, "+slave-reconf-sent", slave, "")
+			inProgress++
+		}
+	}
+
+	// Check if all the slaves are reconfigured and handle timeout.
+	s.sentinelFailoverDetectEnd(master)
+}
+
+func (s *Server) sentinelFailoverDetectEnd(master *sentinelRedisInstance) {
+	promoted := master.promotedSlave
+	// We can't consider failover finished if the promoted slave is not
+	// reachable.
+	if promoted == nil || promoted.flags&sriSDown != 0 {
+		return
+	}
+
+	// The failover terminates once all the reachable slaves are properly
+	// configured.
+	notReconfigured := 0
+	for _, slave := range master.slaves {
+		if slave.flags&(sriPromoted|sriReconfDone|sriSDown) == 0 {
+			notReconfigured++
+		}
+	}
+
+	// Force end of failover on timeout.
+	timeout := false
+	if time.Now().UnixMilli()-master.failoverStateChangeTime > master.failoverTimeout {
+		notReconfigured = 0
+		timeout = true
+		s.sentinelEvent(slog.LevelWarn, "+failover-end-for-timeout", master, "")
+	}
+	if notReconfigured == 0 {
+		s.sentinelEvent(slog.LevelWarn, "+failover-end", master, "")
+		master.failoverState = sentinelFailoverStateUpdateConfig
+		master.failoverStateChangeTime = time.Now().UnixMilli()
+	}
+
+	// If I'm the leader it is a good idea to send a best effort REPLICAOF
+	// command to all the slaves still not reconfigured to replicate with
+	// the new master.
+	if timeout {
+		for _, slave := range master.slaves {
+			if slave.flags&(sriPromoted|sriReconfDone|sriReconfSent) != 0 || slave.link.disconnected {
+				continue
+			}
+			if s.sentinelSendSlaveOf(slave, promoted.ip, promoted.port) {
+				s.sentinelEvent(slog.LevelInfo, "+slave-reconf-sent-be", slave, "")
+				slave.flags |= sriReconfSent
+			}
+		}
+	}
+}
+
+// sentinelFailoverSwitchToPromotedSlave is called when the failover ends,
+// the promoted replica becomes the monitored master.
+func (s *Server) sentinelFailoverSwitchToPromotedSlave(master *sentinelRedisInstance) {
+	ref := master
+	if master.promotedSlave != nil {
+		ref = master.promotedSlave
+	}
+	s.sentinelEvent(slog.LevelWarn, "+switch-master", nil, "%s %s %d %s %d",
+		master.name, master.ip, master.port, ref.ip, ref.port)
+	s.sentinelResetMasterAndChangeAddress(master, ref.ip, ref.port)
+}
+
+func (s *Server) sentinelAbortFailover(ri *sentinelRedisInstance) {
+	ri.flags &= ^(sriFailoverInProgress | sriForceFailover)
+	ri.failoverState = sentinelFailoverStateNone
+	ri.failoverStateChangeTime = time.Now().UnixMilli()
+	if ri.promotedSlave != nil {
+		ri.promotedSlave.flags &= ^sriPromoted
+		ri.promotedSlave = nil
+	}
+}
+
+// sentinelSelectSlave selects the replica to promote: the replicas which are
+// down, disconnected, or which didn't reply recently are excluded, then the
+// replica with the greatest replication offset is selected.
+func sentinelSelectSlave(master *sentinelRedisInstance) *sentinelRedisInstance {
+	now := time.Now().UnixMilli()
+	infoValidityTime := int64(sentinelInfoPeriod * 3)
+	if master.flags&sriSDown != 0 {
+		// ROLE is sent every second to the replicas when the master is down.
+		infoValidityTime = sentinelPingPeriod * 5
+	}
+
+	var candidates []*sentinelRedisInstance
+	for _, slave := range master.slaves {
+		if slave.flags&(sriSDown|sriODown) != 0 || slave.link.disconnected {
+			continue
+		}
+		if now-slave.link.lastAvailTime > sentinelPingPeriod*5 {
+			continue
+		}
+		if now-slave.infoRefresh > infoValidityTime || slave.roleReported != sriSlave {
+			continue
+		}
+		candidates = append(candidates, slave)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].slaveReplOffset != candidates[j].slaveReplOffset {
+			return candidates[i].slaveReplOffset > candidates[j].slaveReplOffset
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	return candidates[0]
+}
+
+// sentinelEvent logs the event, and publishes it on the channel named as the
+// event, so that the clients can follow what is happening. The message is:
+//
+// <instance type> <instance name> <ip> <port> @ <master name> <master ip> <master port> <details>
+//
+// The instance is omitted if ri is nil, and the master is only included if
+// the instance is not a master.
+func (s *Server) sentinelEvent(level slog.Level, typ string, ri *sentinelRedisInstance, format string, args ...any) {
+	var msg string
+	if ri != nil {
+		kind := "master"
+		switch {
+		case ri.flags&sriSlave != 0:
+			kind = "slave"
+		case ri.flags&sriSentinel != 0:
+			kind = "sentinel"
+		}
+		msg = fmt.Sprintf("%s %s %s %d", kind, ri.name, ri.ip, ri.port)
+		if ri.master != nil {
+			msg += fmt.Sprintf(" @ %s %s %d", ri.master.name, ri.master.ip, ri.master.port)
+		}
+	}
+	if format != "" {
+		if msg != "" {
+			msg += " "
+		}
+		msg += fmt.Sprintf(format, args...)
+	}
+	slog.Log(s.Ctx, level, typ+" "+msg)
+	if level != slog.LevelDebug {
+		s.pubsubPublishMessage(typ, []byte(msg))
+	}
+}
+
+// sentinelFlushConfig saves the state of the sentinel in the config file.
+func (s *Server) sentinelFlushConfig() {
+	if err := s.sentinelRewriteConfig(); err != nil {
+		slog.Warn("WARNING: Sentinel was not able to save the new configuration on disk!!!", "err", err)
+	}
+}
+
+// sentinelRewriteConfig rewrites the config file, the sentinel directives are
+// replaced with the current state, the other lines are kept.
+func (s *Server) sentinelRewriteConfig() error {
+	if s.ConfigFile == "" {
+		return nil
+	}
+	content, err := os.ReadFile(s.ConfigFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var lines []string
+	if len(content) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 && strings.EqualFold(fields[0], "sentinel") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, s.sentinelGenConfig()...)
+
+	tmpfile := fmt.Sprintf("%s.tmp-%d", s.ConfigFile, os.Getpid())
+	if err = os.WriteFile(tmpfile, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpfile, s.ConfigFile); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return nil
+}
+
+// sentinelGenConfig generates the sentinel directives describing the state.
+func (s *Server) sentinelGenConfig() []string {
+	st := s.sentinel
+	lines := []string{"sentinel myid " + st.myid}
+	for _, master := range sortedInstances(st.masters) {
+		ip, port := sentinelGetCurrentMasterAddress(master)
+		lines = append(lines, fmt.Sprintf("sentinel monitor %s %s %d %d", master.name, ip, port, master.quorum))
+		if master.downAfterPeriod != sentinelDefaultDownAfter {
+			lines = append(lines, fmt.Sprintf("sentinel down-after-milliseconds %s %d", master.name, master.downAfterPeriod))
+		}
+		if master.failoverTimeout != sentinelDefaultFailoverTimeout {
+			lines = append(lines, fmt.Sprintf("sentinel failover-timeout %s %d", master.name, master.failoverTimeout))
+		}
+		if master.parallelSyncs != sentinelDefaultParallelSyncs {
+			lines = append(lines, fmt.Sprintf("sentinel parallel-syncs %s %d", master.name, master.parallelSyncs))
+		}
+		lines = append(lines, fmt.Sprintf("sentinel config-epoch %s %d", master.name, master.configEpoch))
+		lines = append(lines, fmt.Sprintf("sentinel leader-epoch %s %d", master.name, master.leaderEpoch))
+		for _, slave := range sortedInstances(master.slaves) {
+			slaveIP, slavePort := slave.ip, slave.port
+			// If the master address is equal to this slave's address, a
+			// failover is in progress and the slave was already promoted,
+			// so the old master address is used instead.
+			if slaveIP == ip && slavePort == port {
+				slaveIP, slavePort = master.ip, master.port
+			}
+			lines = append(lines, fmt.Sprintf("sentinel known-replica %s %s %d", master.name, slaveIP, slavePort))
+		}
+		for _, si := range sortedInstances(master.sentinels) {
+			if si.runid == "" {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("sentinel known-sentinel %s %s %d %s", master.name, si.ip, si.port, si.runid))
+		}
+	}
+	if st.announceIP != "" {
+		lines = append(lines, "sentinel announce-ip "+st.announceIP)
+	}
+	if st.announcePort != 0 {
+		lines = append(lines, fmt.Sprintf("sentinel announce-port %d", st.announcePort))
+	}
+	lines = append(lines, fmt.Sprintf("sentinel current-epoch %d", st.currentEpoch))
+	return lines
+}
+
+func sortedInstances(instances map[string]*sentinelRedisInstance) []*sentinelRedisInstance {
+	sorted := make([]*sentinelRedisInstance, 0, len(instances))
+	for _, ri := range instances {
+		sorted = append(sorted, ri)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	return sorted
+}
+
+// readReply reads a reply of a monitored instance, the error replies are
+// returned as respError.
+func readReply(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("protocol error: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		elems := make([]any, n)
+		for i := range elems {
+			if elems[i], err = readReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	}
+	return nil, fmt.Errorf("protocol error: unexpected reply %q", line)
+}
+
+// The SENTINEL subcommands.
+
+// SentinelMyId replies with the id of the sentinel.
+func (c *Client) SentinelMyId() {
+	c.addReplyBulkString(c.Server.sentinel.myid)
+}
+
+// SentinelMasters replies with the state of the monitored masters.
+func (c *Client) SentinelMasters() {
+	masters := sortedInstances(c.Server.sentinel.masters)
+	c.AddReplyMultibulkLen(int64(len(masters)))
+	for _, ri := range masters {
+		c.addReplySentinelRedisInstance(ri)
+	}
+}
+
+// SentinelMaster replies with the state of the master.
+func (c *Client) SentinelMaster(name string) {
+	if ri := c.sentinelGetMasterByNameOrReplyError(name); ri != nil {
+		c.addReplySentinelRedisInstance(ri)
+	}
+}
+
+// SentinelReplicas replies with the state of the replicas of the master.
+func (c *Client) SentinelReplicas(name string) {
+	if ri := c.sentinelGetMasterByNameOrReplyError(name); ri != nil {
+		c.addReplySentinelRedisInstances(ri.slaves)
+	}
+}
+
+// SentinelSentinels replies with the other sentinels monitoring the master.
+func (c *Client) SentinelSentinels(name string) {
+	if ri := c.sentinelGetMasterByNameOrReplyError(name); ri != nil {
+		c.addReplySentinelRedisInstances(ri.sentinels)
+	}
+}
+
+// SentinelGetMasterAddrByName replies with the address of the master, a
+// null reply is sent if the master is unknown.
+func (c *Client) SentinelGetMasterAddrByName(name string) {
+	ri := c.Server.sentinel.masters[name]
+	if ri == nil {
+		c.AddReplyRaw([]byte("*-1\r\n"))
+		return
+	}
+	ip, port := sentinelGetCurrentMasterAddress(ri)
+	c.AddReplyMultibulkLen(2)
+	c.addReplyBulkString(ip)
+	c.addReplyBulkString(strconv.Itoa(port))
+}
+
+// SentinelIsMasterDownByAddr replies if we believe the master at the
+// address is down, and votes the leader if runid is not "*":
+// <down state> <leader> <leader epoch>.
+func (c *Client) SentinelIsMasterDownByAddr(ip string, port int, reqEpoch uint64, runid string) {
+	s := c.Server
+	var ri *sentinelRedisInstance
+	for _, master := range s.sentinel.masters {
+		if master.ip == ip && master.port == port {
+			ri = master
+			break
+		}
+	}
+	isdown := ri != nil && ri.flags&sriSDown != 0
+	leader, leaderEpoch := "", uint64(0)
+	// Vote for the master (or fetch the previous vote) if the request
+	// includes a runid, otherwise the sender is not seeking for a vote.
+	if ri != nil && runid != "*" {
+		leader, leaderEpoch = s.sentinelVoteLeader(ri, reqEpoch, runid)
+	}
+	c.AddReplyMultibulkLen(3)
+	c.AddReplyInt64(int64(Cond(isdown, 1, 0)))
+	c.addReplyBulkString(Cond(leader != "", leader, "*"))
+	c.AddReplyInt64(int64(leaderEpoch))
+}
+
+// SentinelFailover forces a failover of the master, as if the master was
+// not reachable, and without asking for agreement to other sentinels.
+func (c *Client) SentinelFailover(name string) {
+	s := c.Server
+	ri := c.sentinelGetMasterByNameOrReplyError(name)
+	if ri == nil {
+		return
+	}
+	if ri.flags&sriFailoverInProgress != 0 {
+		c.AddReplyError([]byte("-INPROG Failover already in progress"))
+		return
+	}
+	if sentinelSelectSlave(ri) == nil {
+		c.AddReplyError([]byte("-NOGOODSLAVE No suitable replica to promote"))
+		return
+	}
+	slog.Warn(fmt.Sprintf("Executing user requested FAILOVER of '%s'", ri.name))
+	s.sentinelStartFailover(ri)
+	ri.flags |= sriForceFailover
+	c.AddReplyStatus(common.Shared["ok"])
+}
+
+// SentinelReset resets the masters matching the pattern, it returns the
+// number of masters reset.
+func (c *Client) SentinelReset(pattern string) int {
+	s := c.Server
+	reset := 0
+	for _, ri := range sortedInstances(s.sentinel.masters) {
+		if matched, _ := filepath.Match(pattern, ri.name); matched {
+			s.sentinelResetMaster(ri, true)
+			reset++
+		}
+	}
+	if reset > 0 {
+		s.sentinelFlushConfig()
+	}
+	return reset
+}
+
+// SentinelMonitor starts monitoring a new master.
+func (c *Client) SentinelMonitor(name, ip string, port, quorum int) error {
+	s := c.Server
+	ri, err := s.createSentinelRedisInstance(name, sriMaster, ip, port, quorum, nil)
+	if err != nil {
+		return err
+	}
+	s.sentinelFlushConfig()
+	s.sentinelEvent(slog.LevelWarn, "+monitor", ri, "quorum %d", ri.quorum)
+	return nil
+}
+
+// SentinelRemove stops monitoring the master.
+func (c *Client) SentinelRemove(name string) error {
+	s := c.Server
+	ri := s.sentinel.masters[name]
+	if ri == nil {
+		return errors.New("No such master with that name")
+	}
+	s.sentinelEvent(slog.LevelWarn, "-monitor", ri, "")
+	s.releaseSentinelRedisInstance(ri)
+	delete(s.sentinel.masters, name)
+	s.sentinelFlushConfig()
+	return nil
+}
+
+// SentinelSet sets the options of the master.
+func (c *Client) SentinelSet(name string, options []string) error {
+	s := c.Server
+	ri := s.sentinel.masters[name]
+	if ri == nil {
+		return errors.New("No such master with that name")
+	}
+	for i := 0; i+1 < len(options); i += 2 {
+		option, value := strings.ToLower(options[i]), options[i+1]
+		if err := s.sentinelSetOption(ri, option, value); err != nil {
+			return err
+		}
+		s.sentinelEvent(slog.LevelWarn, "+set", ri, "%s %s", option, value)
+	}
+	s.sentinelFlushConfig()
+	return nil
+}
+
+// SentinelCkquorum checks if the current sentinel configuration is able to
+// reach the quorum needed to failover the master, and the majority needed to
+// authorize the failover.
+func (c *Client) SentinelCkquorum(name string) {
+	ri := c.sentinelGetMasterByNameOrReplyError(name)
+	if ri == nil {
+		return
+	}
+	voters := len(ri.sentinels) + 1
+	usable := 1 // Sentinel running this command.
+	for _, si := range ri.sentinels {
+		if si.flags&(sriSDown|sriODown) == 0 {
+			usable++
+		}
+	}
+	switch {
+	case usable < ri.quorum:
+		c.AddReplyErrorFormat("-NOQUORUM %d usable Sentinels. Not enough available Sentinels "+
+			"to reach the specified quorum for this master", usable)
+	case usable < voters/2+1:
+		c.AddReplyErrorFormat("-NOQUORUM %d usable Sentinels. Not enough available Sentinels "+
+			"to reach the majority and authorize a failover", usable)
+	default:
+		c.AddReplyStatus([]byte(fmt.Sprintf("OK %d usable Sentinels. Quorum and failover "+
+			"authorization can be reached", usable)))
+	}
+}
+
+// SentinelFlushConfig saves the state of the sentinel in the config file.
+func (c *Client) SentinelFlushConfig() error {
+	return c.Server.sentinelRewriteConfig()
+}
+
+func (c *Client) sentinelGetMasterByNameOrReplyError(name string) *sentinelRedisInstance {
+	ri := c.Server.sentinel.masters[name]
+	if ri == nil {
+		c.AddReplyError([]byte("No such master with that name"))
+	}
+	return ri
+}
+
+func (c *Client) addReplySentinelRedisInstances(instances map[string]*sentinelRedisInstance) {
+	sorted := sortedInstances(instances)
+	c.AddReplyMultibulkLen(int64(len(sorted)))
+	for _, ri := range sorted {
+		c.addReplySentinelRedisInstance(ri)
+	}
+}
+
+// addReplySentinelRedisInstance replies with the state of the instance, as
+// a flat list of field-value pairs.
+func (c *Client) addReplySentinelRedisInstance(ri *sentinelRedisInstance) {
+	now := time.Now().UnixMilli()
+	link := ri.link
+	var fields []string
+	add := func(field string, value any) {
+		fields = append(fields, field, fmt.Sprint(value))
+	}
+
+	add("name", ri.name)
+	add("ip", ri.ip)
+	add("port", ri.port)
+	add("runid", ri.runid)
+
+	var flags []string
+	for _, f := range sriFlagsTable {
+		if ri.flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	if link.disconnected {
+		flags = append(flags, "disconnected")
+	}
+	add("flags", strings.Join(flags, ","))
+	add("link-pending-commands", link.pendingCommands)
+	add("last-ping-sent", Cond(link.actPingTime != 0, now-link.actPingTime, 0))
+	add("last-ok-ping-reply", now-link.lastAvailTime)
+	add("last-ping-reply", now-link.lastPongTime)
+	if ri.flags&sriSDown != 0 {
+		add("s-down-time", now-ri.sDownSinceTime)
+	}
+	if ri.flags&sriODown != 0 {
+		add("o-down-time", now-ri.oDownSinceTime)
+	}
+	add("down-after-milliseconds", ri.downAfterPeriod)
+
+	// Masters and Slaves.
+	if ri.flags&(sriMaster|sriSlave) != 0 {
+		add("info-refresh", Cond(ri.infoRefresh != 0, now-ri.infoRefresh, 0))
+		add("role-reported", Cond(ri.roleReported == sriMaster, "master", "slave"))
+		add("role-reported-time", now-ri.roleReportedTime)
+	}
+
+	// Only masters.
+	if ri.flags&sriMaster != 0 {
+		add("config-epoch", ri.configEpoch)
+		add("num-slaves", len(ri.slaves))
+		add("num-other-sentinels", len(ri.sentinels))
+		add("quorum", ri.quorum)
+		add("failover-timeout", ri.failoverTimeout)
+		add("parallel-syncs", ri.parallelSyncs)
+		if ri.flags&sriFailoverInProgress != 0 {
+			add("failover-state", sentinelFailoverStateNames[ri.failoverState])
+		}
+	}
+
+	// Only slaves.
+	if ri.flags&sriSlave != 0 {
+		add("master-link-status", Cond(ri.slaveMasterLinkUp, "ok", "err"))
+		add("master-host", ri.slaveMasterHost)
+		add("master-port", ri.slaveMasterPort)
+		add("slave-repl-offset", ri.slaveReplOffset)
+	}
+
+	// Only sentinels.
+	if ri.flags&sriSentinel != 0 {
+		add("last-hello-message", now-ri.lastHelloTime)
+		add("voted-leader", Cond(ri.leader != "", ri.leader, "?"))
+		add("voted-leader-epoch", ri.leaderEpoch)
+	}
+
+	c.AddReplyMultibulkLen(int64(len(fields)))
+	for _, f := range fields {
+		c.addReplyBulkString(f)
+	}
+}
+
+// sentinelRole replies to ROLE in sentinel mode, with the monitored masters.
+func (c *Client) sentinelRole() {
+	masters := sortedInstances(c.Server.sentinel.masters)
+	c.AddReplyMultibulkLen(2)
+	c.addReplyBulkString("sentinel")
+	c.AddReplyMultibulkLen(int64(len(masters)))
+	for _, ri := range masters {
+		c.addReplyBulkString(ri.name)
+	}
+}
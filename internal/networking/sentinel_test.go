@@ -0,0 +1,64 @@
+package networking
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSentinelReadReply(t *testing.T) {
+	testcases := []struct {
+		in   string
+		want any
+	}{
+		{in: "+PONG\r\n", want: "PONG"},
+		{in: "-ERR oops\r\n", want: respError("ERR oops")},
+		{in: ":42\r\n", want: int64(42)},
+		{in: "$5\r\nhello\r\n", want: "hello"},
+		{in: "$-1\r\n", want: nil},
+		{in: "*2\r\n$6\r\nmaster\r\n:10\r\n", want: []any{"master", int64(10)}},
+	}
+
+	for _, tc := range testcases {
+		got, err := readReply(bufio.NewReader(strings.NewReader(tc.in)))
+		if err != nil {
+			t.Errorf("readReply(%q) err: %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("readReply(%q): %#v want: %#v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSentinelGetLeader(t *testing.T) {
+	s := NewServer()
+	s.InitSentinel()
+	s.sentinel.myid = strings.Repeat("a", 40)
+	s.sentinel.currentEpoch = 1
+	for _, argv := range [][]string{
+		{"monitor", "mymaster", "127.0.0.1", "7001", "2"},
+		{"known-sentinel", "mymaster", "127.0.0.1", "26380", strings.Repeat("b", 40)},
+		{"known-sentinel", "mymaster", "127.0.0.1", "26381", strings.Repeat("c", 40)},
+	} {
+		if err := s.SentinelHandleConfiguration(argv); err != nil {
+			t.Fatalf("sentinel %v: %v", argv, err)
+		}
+	}
+	master := s.sentinel.masters["mymaster"]
+
+	// No other sentinel voted yet: we only have our own vote.
+	if leader := s.sentinelGetLeader(master, 1); leader != "" {
+		t.Errorf("leader: %q want: none", leader)
+	}
+
+	// One more sentinel voted for us, that's the majority.
+	for _, ri := range master.sentinels {
+		ri.leader, ri.leaderEpoch = s.sentinel.myid, 1
+		break
+	}
+	if leader := s.sentinelGetLeader(master, 1); leader != s.sentinel.myid {
+		t.Errorf("leader: %q want: %q", leader, s.sentinel.myid)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -15,6 +17,9 @@ import (
 	"github.com/sunminx/RDB/internal/cmd"
 	"github.com/sunminx/RDB/internal/db"
 	"github.com/sunminx/RDB/internal/debug"
+	"github.com/sunminx/RDB/internal/hash"
+	"github.com/sunminx/RDB/internal/list"
+	obj "github.com/sunminx/RDB/internal/object"
 	. "github.com/sunminx/RDB/pkg/util"
 )
 
@@ -23,38 +28,60 @@ var assert = debug.Assert
 type Server struct {
 	gnet.BuiltinEventEngine
 	Dumper
-	Ctx                    context.Context
-	CancelFunc             context.CancelFunc
-	CancelCalled           bool
-	Daemonize              bool
-	MaxIdleTime            int64
-	TcpKeepalive           int
-	ProtectedMode          bool
-	TcpBacklog             int
-	Ip                     string
-	Port                   int
-	ProtoAddr              string
-	MaxFd                  int
-	Clients                []*Client
-	cmds                   []cmd.Command
-	Requirepass            bool
-	DB                     *db.DB
-	CronLoops              int64
-	Hz                     int
-	LogLevel               string
-	LogPath                string
-	Version                string
-	MasterReplOffset       int64
-	RunnableClientCh       chan *Client
-	CmdLock                *sync.RWMutex
-	UnlockNotice           chan struct{}
-	RdbVersion             int
-	RdbFilename            string
+	Ctx                   context.Context
+	CancelFunc            context.CancelFunc
+	CancelCalled          bool
+	Daemonize             bool
+	MaxIdleTime           int64
+	TcpKeepalive          int
+	ProtectedMode         bool
+	TcpBacklog            int
+	Ip                    string
+	Port                  int
+	ProtoAddr             string
+	MaxFd                 int
+	Clients               []*Client
+	cmds                  []cmd.Command
+	Requirepass           bool
+	DB                    *db.DB
+	CronLoops             int64
+	Hz                    int
+	LogLevel              string
+	LogPath               string
+	Version               string
+	MasterReplOffset      int64
+	ReplId                string
+	ReplId2               string
+	SecondReplOffset      int64
+	ReplBacklogSize       int64
+	ReplPingPeriod        int64
+	ReplTimeout           int64
+	ReplicaReadOnly       bool
+	ReplDisklessSync      bool
+	ReplDisklessSyncDelay int64
+	ReplDisklessLoad      int
+	MasterHost            string
+	MasterPort            int
+	CmdLock               *sync.RWMutex
+	RdbVersion            int
+	RdbFilename           string
+	RdbChecksum           bool
+	RdbCompression        bool
+	// RdbSkipUnsupported tells whether the keys of the types we have no data
+	// type for, the sets and the sorted sets, are skipped when loading a RDB
+	// file, instead of failing the load.
+	RdbSkipUnsupported     bool
 	RdbChildType           int
 	RdbChildRunning        atomic.Bool
 	RdbSaveTimeStart       int64
 	RdbSaveTimeUsed        int64
+	RdbSaveOffset          int64
+	RdbSaveKeys            int
+	RdbLastBgsaveOk        bool
 	BackgroundDoneChan     chan uint8
+	BackupDir              string
+	BackupInterval         int
+	BackupKeep             int
 	SaveParams             []SaveParam
 	UnixTime               int64
 	LastSave               int64
@@ -64,26 +91,63 @@ type Server struct {
 	AofBuf                 []byte
 	AofLastWriteStatus     bool
 	AofFsync               int
-	AofFsyncInProgress     atomic.Bool
 	AofFsyncPostponedStart int64
-	AofChildRunning        atomic.Bool
-	AofFilename            string
-	AofDirname             string
-	AofLoadTruncated       bool
-	AofUseRdbPreamble      bool
-	AofRewriteTimeStart    int64
-	AofState               uint8
-	AofRewriteBaseSize     int64
-	AofCurrSize            int64
-	AofRewriteMinSize      int64
-	AofRewritePerc         int64
-	AofLastFsync           int64
-	AofLastIncrFsyncOffset int64
-	AofLastIncrSize        int64
-	LoadingLoadedBytes     int64
-	Shutdown               atomic.Bool
-	ShutdownTimeout        int64
-	ShutdownStartTime      int64
+	AofDelayedFsync        int64
+	AofNoFsyncOnRewrite    bool
+	// LazyfreeLazyEviction is accepted for compatibility, there is no
+	// eviction by maxmemory yet.
+	LazyfreeLazyEviction       bool
+	LazyfreeLazyExpire         bool
+	LazyfreeLazyServerDel      bool
+	LazyfreeLazyUserFlush      bool
+	AofChildRunning            atomic.Bool
+	AofFilename                string
+	AofDirname                 string
+	AofLoadTruncated           bool
+	AofUseRdbPreamble          bool
+	AofTimestampEnabled        bool
+	AofCurTimestamp            int64
+	AofRewriteTimeStart        int64
+	AofState                   uint8
+	AofRewriteBaseSize         int64
+	AofCurrSize                int64
+	AofRewriteMinSize          int64
+	AofRewritePerc             int64
+	AofLastFsync               int64
+	AofLastIncrFsyncOffset     int64
+	AofLastIncrSize            int64
+	Loading                    atomic.Bool
+	AsyncLoading               bool
+	LoadingStartTime           int64
+	LoadingTotalBytes          atomic.Int64
+	LoadingLoadedBytes         atomic.Int64
+	Shutdown                   atomic.Bool
+	ShutdownTimeout            int64
+	ShutdownStartTime          int64
+	ClusterEnabled             bool
+	ClusterConfigFile          string
+	ClusterNodeTimeout         int64
+	ClusterPort                int
+	ClusterRequireFullCoverage bool
+	ConfigFile                 string
+
+	// IoThreads is the number of the event loops, which read, parse and
+	// write the traffic of their clients in parallel.
+	IoThreads int
+
+	// ActiveRehashing tells whether the dicts are rehashed by the cron, and
+	// not only by the operations on them.
+	ActiveRehashing bool
+
+	// HashMaxListpackEntries and HashMaxListpackValue are the limits of the
+	// hashes encoded as listpacks, see hash.MaxListpackEntries.
+	HashMaxListpackEntries int
+	HashMaxListpackValue   int
+
+	// ListMaxListpackSize and ListCompressDepth are the fill and the compress
+	// depth of the lists, see list.MaxListpackSize and list.CompressDepth.
+	ListMaxListpackSize int
+	ListCompressDepth   int
 
 	// status indicates what status the server is in.
 	status serverStatus
@@ -97,6 +161,75 @@ type Server struct {
 	// wakeupRunner is used to avoid adding multiple crons to the task queue of eventLoop.
 	// Only when the previous cron finishes execution can a new cron be added.
 	wakeupRunner atomic.Int32
+
+	// propagateMu serializes the commands running in parallel on different
+	// shards of the keyspace when they account their changes in Dirty and
+	// feed the AOF buffer and the replication stream, see Client.call. It
+	// is also held by the cron flushing the AOF buffer, which doesn't take
+	// the CmdLock.
+	propagateMu sync.Mutex
+
+	// clientsMu protects Clients, the clients are opened and closed by all
+	// the event loops.
+	clientsMu sync.Mutex
+
+	// slaves are the replicas connected to us, protected by the CmdLock.
+	slaves []*Client
+
+	// replBacklog keeps the latest part of the replication stream for
+	// the partial resynchronizations.
+	replBacklog *replBacklog
+
+	// master is the link with our master when we are a replica.
+	master *masterLink
+
+	// migrateSockets are the sockets cached by MIGRATE, by address.
+	migrateSockets map[string]*migrateSocket
+
+	// replState is the state of the replication when we are a replica.
+	replState atomic.Int32
+
+	// aofRewriteScheduled indicates a rewrite of AOF should be started as soon as possible.
+	aofRewriteScheduled bool
+	// rdbBgsaveScheduled indicates a BGSAVE should be started as soon as possible.
+	rdbBgsaveScheduled bool
+
+	// lastBackup is the unix time in milliseconds of the last backup of the RDB file.
+	lastBackup int64
+
+	// shutdownFlags are the options of the SHUTDOWN command, eg. cmd.ShutdownNosave.
+	shutdownFlags int
+
+	// fsyncedReplOff is the replication offset which is fsynced to the AOF,
+	// it is -1 when AOF is off.
+	fsyncedReplOff atomic.Int64
+	// aofBioFsyncFailed indicates the last fsync of the AOF in background failed.
+	aofBioFsyncFailed atomic.Bool
+
+	// bioJobs are the job queues of the background I/O workers, and
+	// bioPending are the numbers of their jobs not yet done.
+	bioJobs    [bioNumOps]chan bioJob
+	bioPending [bioNumOps]atomic.Int64
+
+	// lazyfreeObjects is the number of the objects waiting to be released
+	// in background, and lazyfreedObjects the number of the ones released.
+	lazyfreeObjects  atomic.Int64
+	lazyfreedObjects atomic.Int64
+
+	// waitingClients are the clients blocked by WAIT or WAITAOF.
+	waitingClients []*Client
+
+	// getAckFromSlaves indicates REPLCONF GETACK should be sent to the replicas.
+	getAckFromSlaves bool
+
+	// cluster is the state of the cluster, protected by the CmdLock.
+	cluster *clusterState
+
+	// pubsubChannels are the channels subscribed by the clients.
+	pubsubChannels pubsubChannels
+
+	// sentinel is the state of the sentinel, it is nil if not in sentinel mode.
+	sentinel *sentinelState
 }
 
 type serverStatus int8
@@ -124,6 +257,13 @@ const (
 	ChildNotInRunning = false
 )
 
+// RDB active child save type.
+const (
+	RdbChildTypeNone   = 0
+	RdbChildTypeDisk   = 1 // rdb is written to disk.
+	RdbChildTypeSocket = 2 // rdb is written to slave socket.
+)
+
 type SaveParam struct {
 	Seconds int
 	Changes int
@@ -133,7 +273,12 @@ type Dumper interface {
 	RdbLoad(*Server) bool
 	RdbSave(*Server) bool
 	RdbSaveBackground(*Server) bool
+	RdbSaveBackgroundLocked(*Server) bool
 	RdbSaveBackgroundDoneHandler(*Server)
+	RdbSaveToSlavesSockets(*Server, io.Writer) bool
+	RdbLoadStream(*Server, io.Reader, *db.DB) bool
+	DumpObject(*Server, *obj.Robj) []byte
+	RestoreObject(*Server, []byte) (*obj.Robj, error)
 	AofLoad(*Server) bool
 	AofRewriteBackground(*Server) bool
 	AofRewriteBackgroundDoneHandler(*Server)
@@ -157,6 +302,13 @@ func (s *Server) OnOpen(conn gnet.Conn) (out []byte, action gnet.Action) {
 	// the network events is completed in every loop.
 	s.initCronRunner(conn.EventLoop())
 
+	cli := NewClient(conn, s.DB)
+	cli.Server = s
+	cli.lastInteraction.Store(time.Now().UnixMilli())
+	conn.SetContext(cli)
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
 	fd := conn.Fd()
 	if s.MaxFd <= fd {
 		s.MaxFd = 2 * fd
@@ -164,11 +316,6 @@ func (s *Server) OnOpen(conn gnet.Conn) (out []byte, action gnet.Action) {
 		s.Clients = initClients(s.MaxFd)
 		copy(s.Clients, oldClients)
 	}
-
-	cli := NewClient(conn, s.DB)
-	cli.Server = s
-	cli.cmdLock = s.CmdLock
-	cli.lastInteraction = time.Now().UnixMilli()
 	s.Clients[fd] = cli
 	return nil, gnet.None
 }
@@ -185,9 +332,23 @@ func (s *Server) initCronRunner(el gnet.EventLoop) {
 }
 
 func (s *Server) OnClose(conn gnet.Conn, err error) (action gnet.Action) {
-	fd := conn.Fd()
-	if fd < s.MaxFd {
-		s.Clients[fd].fd = -1
+	cli, ok := conn.Context().(*Client)
+	if ok {
+		s.CmdLock.Lock()
+		if cli.checkFlag(blocked) {
+			cli.unblockClient()
+		}
+		if cli.checkFlag(slave) {
+			slog.Info("connection with replica lost", "replica", cli.replicaName())
+			s.removeSlave(cli)
+		}
+		if cli.checkFlag(pubsub) {
+			cli.pubsubUnsubscribeAllChannels()
+		}
+		s.CmdLock.Unlock()
+		s.clientsMu.Lock()
+		cli.fd = -1
+		s.clientsMu.Unlock()
 	}
 
 	if err != nil {
@@ -197,9 +358,6 @@ func (s *Server) OnClose(conn gnet.Conn, err error) (action gnet.Action) {
 }
 
 func (s *Server) OnTraffic(conn gnet.Conn) gnet.Action {
-	if conn.Fd() > s.MaxFd {
-		return gnet.Close
-	}
 	action := s.processTrafficEvent(conn)
 	return action
 }
@@ -231,57 +389,60 @@ func (s *Server) OnShutdown(_ gnet.Engine) {
 
 var protoIOBufLen = 1024 * 16
 
-// processTrafficEvent read request from conn and write response to conn.
+// processTrafficEvent read request from conn and write response to conn,
+// see io.go for the phases of the processing.
 func (s *Server) processTrafficEvent(conn gnet.Conn) gnet.Action {
-	cli := s.Clients[conn.Fd()]
-	if cli == nil || cli.fd == -1 {
+	cli, ok := conn.Context().(*Client)
+	if !ok || cli.fd == -1 {
 		return gnet.Close
 	}
 
 	cli.state = runnableState
-	cli.lastInteraction = time.Now().UnixMilli()
+	cli.lastInteraction.Store(time.Now().UnixMilli())
 
-	if cli.flag&queueCall == 0 {
-		if !s.readQuery(cli) {
-			// Failed to locked the cmdLock for call command.
-			// It has been added to the waiting queue and is waiting to be notified.
-			return gnet.None
-		}
-	} else {
-		// Be notified. The requested data has been parsed.
-		// Try to execute the command immediately.
-		if !cli.call() {
-			return gnet.None
-		}
+	s.readQuery(cli)
+
+	// The replies of a blocked client are written once it is unblocked,
+	// the event loop is then woken up.
+	if cli.checkFlag(blocked) {
+		cli.state = idleState
+		return gnet.None
 	}
+	cli.processPendingCommands()
 
 	if (cli.flag & closeASAP) != 0 {
 		return gnet.Close
 	}
 
+	cli.serializeReplies()
 	if len(cli.reply) > 0 {
 		conn.Write(cli.reply)
-		cli.reply = make([]byte, 0)
+		if cap(cli.reply) > replyArenaMaxSize {
+			cli.reply = nil
+		} else {
+			cli.reply = cli.reply[:0]
+		}
 	}
 
 	cli.state = idleState
 
 	// If the server is going shutdown, we will write close the connection after output response.
-	if s.Shutdown.Load() || (cli.flag&closeAfterReply) != 0 {
+	// The commands after a blocking command are executed once the client is unblocked.
+	if s.Shutdown.Load() || ((cli.flag&closeAfterReply) != 0 && len(cli.pending) == 0) {
 		return gnet.Close
 	}
 	return gnet.None
 }
 
-func (s *Server) readQuery(cli *Client) bool {
+func (s *Server) readQuery(cli *Client) {
 	conn := cli.Conn
 	buf, err := conn.Next(-1)
 	if err != nil {
-		return true
+		return
 	}
 
 	cli.querybuf = append(cli.querybuf, buf...)
-	return cli.processInputBuffer()
+	cli.processInputBuffer()
 }
 
 const defMaxFd = 1024
@@ -293,33 +454,52 @@ const defAofBufCapacity = 1024 * 1024 * 10
 func NewServer() *Server {
 	start := time.Now()
 	ctx, cancelFunc := context.WithCancel(context.Background())
-	n := atomic.Int32{}
 	return &Server{
-		Ctx:                ctx,
-		CancelFunc:         cancelFunc,
-		wakeupRunner:       n,
-		Daemonize:          false,
-		MaxIdleTime:        0,
-		TcpKeepalive:       300,
-		ProtectedMode:      false,
-		TcpBacklog:         512,
-		Ip:                 "0.0.0.0",
-		Port:               6379,
-		ProtoAddr:          fmt.Sprintf("tcp://%s:%d", "0.0.0.0", 6379),
-		DB:                 db.New(),
-		MaxFd:              defMaxFd,
-		Clients:            initClients(defMaxFd),
-		CronLoops:          0,
-		Hz:                 100,
-		LogLevel:           "notice",
-		LogPath:            "",
-		Version:            "0.0.1",
-		RdbVersion:         9,
-		LastSave:           start.UnixMilli(),
-		RdbFilename:        "dump.rdb",
-		AofState:           AofOff,
-		AofBuf:             make([]byte, 0, defAofBufCapacity),
-		AofLastWriteStatus: aofWriteOk,
+		Ctx:                        ctx,
+		CancelFunc:                 cancelFunc,
+		Daemonize:                  false,
+		MaxIdleTime:                0,
+		TcpKeepalive:               300,
+		ProtectedMode:              false,
+		TcpBacklog:                 512,
+		Ip:                         "0.0.0.0",
+		Port:                       6379,
+		ProtoAddr:                  fmt.Sprintf("tcp://%s:%d", "0.0.0.0", 6379),
+		DB:                         db.New(),
+		MaxFd:                      defMaxFd,
+		Clients:                    initClients(defMaxFd),
+		CronLoops:                  0,
+		Hz:                         100,
+		IoThreads:                  runtime.NumCPU(),
+		ActiveRehashing:            true,
+		HashMaxListpackEntries:     hash.MaxListpackEntries,
+		HashMaxListpackValue:       hash.MaxListpackValue,
+		ListMaxListpackSize:        list.MaxListpackSize,
+		ListCompressDepth:          list.CompressDepth,
+		LogLevel:                   "notice",
+		LogPath:                    "",
+		Version:                    "0.0.1",
+		RdbVersion:                 12,
+		ReplId:                     genRunId(),
+		SecondReplOffset:           -1,
+		ReplBacklogSize:            defReplBacklogSize,
+		ReplPingPeriod:             defReplPingPeriod,
+		ReplTimeout:                defReplTimeout,
+		ReplicaReadOnly:            true,
+		ReplDisklessSyncDelay:      defReplDisklessSyncDelay,
+		ClusterConfigFile:          defClusterConfigFile,
+		ClusterNodeTimeout:         defClusterNodeTimeout,
+		ClusterRequireFullCoverage: true,
+		RdbSaveOffset:              -1,
+		RdbLastBgsaveOk:            true,
+		LastSave:                   start.UnixMilli(),
+		RdbFilename:                "dump.rdb",
+		RdbChecksum:                true,
+		RdbCompression:             true,
+		AofState:                   AofOff,
+		AofBuf:                     make([]byte, 0, defAofBufCapacity),
+		AofLastWriteStatus:         aofWriteOk,
+		AofFsync:                   AofFsyncSec,
 	}
 }
 
@@ -334,39 +514,86 @@ func initClients(n int) []*Client {
 // Init is used to initialize partial field of server.
 func (s *Server) Init() {
 	s.cmds = cmd.CommandTable
+	if s.sentinel != nil {
+		s.cmds = cmd.SentinelCommandTable
+	}
 	s.CmdLock = &sync.RWMutex{}
-	s.UnlockNotice = make(chan struct{})
-	s.RunnableClientCh = make(chan *Client, 1024)
-	s.BackgroundDoneChan = make(chan uint8, 1)
+	s.BackgroundDoneChan = make(chan uint8, 2)
 	s.status = running
+	s.fsyncedReplOff.Store(-1)
+	s.bioInit()
+	hash.MaxListpackEntries, hash.MaxListpackValue = s.HashMaxListpackEntries, s.HashMaxListpackValue
+	list.MaxListpackSize, list.CompressDepth = s.ListMaxListpackSize, s.ListCompressDepth
+	if s.DB != nil {
+		s.DB.SetLazyfree(s.freeObjectAsync, s.LazyfreeLazyExpire, s.LazyfreeLazyServerDel)
+		s.DB.SetExpirePropagation(s.propagateExpire)
+		s.DB.SetReplica(s.MasterHost != "")
+	}
+	if s.MasterHost != "" {
+		s.replState.Store(replStateConnect)
+	}
+}
 
-	// Receive the message that the lock of command execution is released.
-	// check if there are any clients currently blocking and waiting to execute command,
-	// and wake up the client that is blocking and waiting first.
+// LoadDataFromDisk rebuild DB by load RDB or AOF file during the server startup.
+// The loading goes on in background while the server accepts the clients,
+// which are replied with -LOADING until it is completed, see processCommand.
+// The AOF file is opened once the DB is loaded.
+func (s *Server) LoadDataFromDisk() {
+	s.startLoading()
 	go func() {
-		for {
-			select {
-			case <-s.UnlockNotice:
-				select {
-				case rcmd := <-s.RunnableClientCh:
-					rcmd.Wake()
-				default:
-				}
-			}
-		}
+		s.loadDataFromDisk()
+		s.OpenAofFileIfNeeded()
+		s.stopLoading()
 	}()
 }
 
-// LoadDataFromDisk rebuild DB by load RDB or AOF file during the server startup.
-func (s *Server) LoadDataFromDisk() {
+// startLoading takes the CmdLock for the loading, which is released by
+// stopLoading and from time to time by LoadingProgress.
+func (s *Server) startLoading() {
+	s.CmdLock.Lock()
+	s.LoadingStartTime = time.Now().UnixMilli()
+	s.LoadingTotalBytes.Store(0)
+	s.LoadingLoadedBytes.Store(0)
+	s.Loading.Store(true)
+}
+
+func (s *Server) stopLoading() {
+	s.Loading.Store(false)
+	s.CmdLock.Unlock()
+}
+
+// LoadingProgress accounts the delta bytes loaded since the last call. When
+// the dataset is loaded at startup, the clients waiting for the CmdLock run
+// their commands before the loading goes on: the waiting readers take the
+// lock as soon as it is released, and so does a writer waiting for more
+// than a millisecond, which is handed the lock by the sync.Mutex.
+func (s *Server) LoadingProgress(delta int64) {
+	s.LoadingLoadedBytes.Add(delta)
+	if !s.Loading.Load() {
+		return
+	}
+	s.CmdLock.Unlock()
+	s.CmdLock.Lock()
+}
+
+func (s *Server) loadDataFromDisk() {
 	start := time.Now()
 	if s.AofState == AofOn {
 		if s.AofLoad(s) {
 			slog.Info("AOF loaded from disk", "timecost(s)", time.Since(start).Milliseconds())
 		}
 	} else {
+		if err := s.restoreBackupIfNeeded(); err != nil {
+			slog.Error("failed restoring the backup, remove the restore file in the backup dir "+
+				"to start without restoring it", "err", err)
+			os.Exit(1)
+		}
 		if s.RdbLoad(s) {
 			slog.Info("DB loaded from disk", "timecost(s)", time.Since(start).Milliseconds())
+		} else if _, err := os.Stat(s.RdbFilename); err == nil {
+			// Serving without the dataset would replace the file at the next save.
+			slog.Error("fatal error loading the DB, exiting")
+			os.Exit(1)
 		}
 	}
 }
@@ -376,6 +603,10 @@ func (s *Server) LoadDataFromDisk() {
 func (s *Server) OpenAofFileIfNeeded() {
 	if s.AofState == AofOn {
 		s.AofOpenOnServerStart(s)
+		// WAITAOF needs the replication offset, so the replication stream
+		// is accounted even if there are no replicas.
+		s.createReplBacklogIfNeeded()
+		s.fsyncedReplOff.Store(s.MasterReplOffset)
 	}
 }
 
@@ -415,13 +646,48 @@ const (
 func (s *Server) cron() {
 	s.UnixTime = time.Now().UnixMilli()
 
+	// The DB belongs to the loading until it is completed.
+	if s.Loading.Load() {
+		s.loadingCron()
+		return
+	}
+
 	// Handle background operations on Redis databases.
 	s.databasesCron()
 
 	// We need to do a few operations on clients asynchronously.
 	s.clientsCron()
 
+	// Replication cron function, called every second.
+	if s.runWithPeriod(1000) {
+		s.replicationCron()
+	}
+
+	// Close the idle sockets cached by MIGRATE.
+	if s.runWithPeriod(1000) && TryLockWithTimeout(s.CmdLock, 10*time.Millisecond) {
+		s.migrateCloseTimedoutSockets()
+		s.CmdLock.Unlock()
+	}
+
+	// Run the cluster cron 10 times per second.
+	if s.ClusterEnabled && s.runWithPeriod(100) {
+		s.clusterCron()
+	}
+
+	// Run the sentinel timer 10 times per second.
+	if s.sentinel != nil && s.runWithPeriod(100) {
+		s.sentinelTimer()
+	}
+
 	// Shutting down in a safe way when we received SIGTERM or SIGINT.
+	// A sentinel has no dataset, and its config file is always up to date,
+	// so it doesn't wait for the clients, which are mostly other sentinels
+	// reconnecting.
+	if s.Shutdown.Load() && s.sentinel != nil {
+		slog.Info("sentinel is now ready to exit, bye bye...")
+		s.status = terminated
+		return
+	}
 	if s.Shutdown.Load() && !s.isShutdownInited() {
 		slog.Info("the shutdown is started", "startTime", s.UnixTime)
 		if s.prepareForShutdown() {
@@ -432,7 +698,12 @@ func (s *Server) cron() {
 		if s.UnixTime-s.ShutdownStartTime > s.ShutdownTimeout ||
 			s.isReadyShutdown() {
 			slog.Info("start do the work before shutdown")
-			if s.finishShutdown() {
+			// The commands of the clients not freed yet are excluded
+			// while the dataset is saved.
+			s.CmdLock.Lock()
+			done := s.finishShutdown()
+			s.CmdLock.Unlock()
+			if done {
 				slog.Info("the work before shutdown is completed")
 				s.status = terminated
 				return
@@ -451,13 +722,19 @@ func (s *Server) cron() {
 			}
 		default:
 		}
-	} else {
-		// If there is not a background saving/rewrite in progress check if
-		// we have to save/rewrite now.
+	}
+
+	// Every background persisting reads its own snapshot of the DB, so a
+	// save and an AOF rewrite don't wait for each other.
+	if !s.RdbChildRunning.Load() {
+		// If there is not a background saving in progress check if
+		// we have to save now.
+		s.propagateMu.Lock()
+		dirty := s.Dirty
+		s.propagateMu.Unlock()
 		for _, sp := range s.SaveParams {
-			if s.Dirty >= sp.Changes &&
-				int(s.UnixTime-s.LastSave) > 1000*sp.Seconds &&
-				s.DB.InNormalState() {
+			if dirty >= sp.Changes &&
+				int(s.UnixTime-s.LastSave) > 1000*sp.Seconds {
 				// We reached the given amount of changes.
 				slog.Info(fmt.Sprintf("%d changes in %d seconds. Saving...\n",
 					sp.Changes, sp.Seconds))
@@ -465,41 +742,77 @@ func (s *Server) cron() {
 				break
 			}
 		}
+	}
 
-		if !s.isBgsaveOrAofRewriteRunning() && s.DB.InNormalState() &&
-			s.AofState == AofOn &&
-			s.AofRewritePerc > 0 && s.AofCurrSize > s.AofRewriteMinSize {
-			// Calculate whether the growth rate of the current AOF file size
-			// after the last rewrite exceeds the threshold.
-			base := Cond(s.AofRewriteBaseSize > 0, s.AofRewriteBaseSize, 1)
-			growth := (s.AofCurrSize*100)/base - 100
-			if growth >= s.AofRewritePerc {
-				slog.Info(fmt.Sprintf("starting automatic rewriting of AOF on %d%% growth\n", growth))
-				_ = s.AofRewriteBackground(s)
-			}
+	if !s.AofChildRunning.Load() && s.AofState == AofOn &&
+		s.AofRewritePerc > 0 && s.AofCurrSize > s.AofRewriteMinSize {
+		// Calculate whether the growth rate of the current AOF file size
+		// after the last rewrite exceeds the threshold.
+		base := Cond(s.AofRewriteBaseSize > 0, s.AofRewriteBaseSize, 1)
+		growth := (s.AofCurrSize*100)/base - 100
+		if growth >= s.AofRewritePerc {
+			slog.Info(fmt.Sprintf("starting automatic rewriting of AOF on %d%% growth\n", growth))
+			_ = s.AofRewriteBackground(s)
+		}
+	}
 
+	// Start a scheduled AOF rewrite if this was requested.
+	if s.aofRewriteScheduled && !s.AofChildRunning.Load() {
+		if s.AofRewriteBackground(s) {
+			s.aofRewriteScheduled = false
 		}
 	}
 
-	// After the db persistence is completed, move the key-val pair in sdbs[1] step by step to sdbs[0].
-	if TryLockWithTimeout(s.CmdLock, 20*time.Millisecond) {
-		_ = s.DB.MergeIfNeeded(100 * time.Millisecond)
-		s.CmdLock.Unlock()
+	// Start a scheduled BGSAVE if this was requested, BGSAVE SCHEDULE
+	// waits for the AOF rewrite too.
+	if s.rdbBgsaveScheduled && !s.RdbChildRunning.Load() && !s.AofChildRunning.Load() {
+		if s.RdbSaveBackground(s) {
+			s.rdbBgsaveScheduled = false
+		}
 	}
 
 	if s.AofState != AofOff {
+		s.propagateMu.Lock()
 		s.flushAppendOnlyFile(false)
+		s.propagateMu.Unlock()
 	}
 
+	// Serve the clients blocked by WAIT and WAITAOF.
+	s.blockedClientsCron()
+
+	s.CronLoops++
 	if s.el != nil {
 		s.wakeupRunner.Store(0)
 	}
 }
 
+// loadingCron is the cron while the dataset is loading, only the clients
+// are served. A shutdown doesn't wait for the loading, and doesn't save the
+// partially loaded dataset.
+func (s *Server) loadingCron() {
+	s.clientsCron()
+	if s.Shutdown.Load() {
+		slog.Warn("shutdown during the loading, the dataset is not saved")
+		s.status = terminated
+		return
+	}
+	s.CronLoops++
+	if s.el != nil {
+		s.wakeupRunner.Store(0)
+	}
+}
+
+// runWithPeriod reports whether a job with the period of ms milliseconds
+// should be run in the current cron loop.
+func (s *Server) runWithPeriod(ms int) bool {
+	period := ms / (1000 / s.Hz)
+	return period <= 1 || s.CronLoops%int64(period) == 0
+}
+
 const (
-	aofFsyncNo     = 0
-	aofFsyncSec    = 1
-	aofFsyncAlways = 2
+	AofFsyncNo     = 0
+	AofFsyncSec    = 1
+	AofFsyncAlways = 2
 )
 
 const (
@@ -510,67 +823,154 @@ const (
 // flushAppendOnlyFile output the aof buffer and flush the kernel buffer to stable storage.
 //
 // Note that the flushing is not done every time and the rate depends on the AofSync.
+// With everysec, the fsync is done by the background I/O worker, and the
+// write is postponed while an fsync is in progress, since a write(2) to a
+// file being fsynced blocks anyway. The write is postponed for 2 seconds at
+// most, then it is done without waiting and counted by AofDelayedFsync.
+//
+// It should be called when holding the propagateMu.
 func (s *Server) flushAppendOnlyFile(force bool) {
-	if len(s.AofBuf) > 0 {
-		n, err := s.AofFile.Write(s.AofBuf)
-		if err != nil {
-			if err != syscall.EINTR {
-				if s.AofFsync == aofFsyncAlways {
-					slog.Error("can't recover from AOF write error" +
-						"when the AOF fsync policy is 'always'. Exiting...")
-					os.Exit(1)
-				}
-				slog.Warn("flush aof file failed", "err", err)
-				s.AofLastWriteStatus = aofWriteErr
-			}
+	// All the writes until this offset are in the aof buffer.
+	reploff := s.MasterReplOffset
+	syncInProgress := s.AofFsync == AofFsyncSec && s.aofFsyncInProgress()
+
+	if len(s.AofBuf) == 0 {
+		// The last writes may not be fsynced yet with everysec, since the
+		// fsync is skipped while another one is in progress.
+		if s.AofFsync == AofFsyncSec && s.AofLastIncrFsyncOffset != s.AofLastIncrSize &&
+			s.UnixTime-s.AofLastFsync >= 1000 && !syncInProgress {
+			s.tryFsyncAppendOnlyFile(reploff, syncInProgress)
+			return
 		}
-		if s.AofLastWriteStatus == aofWriteErr {
-			slog.Info("AOF write error looks solved, Redis can write again")
-			s.AofLastWriteStatus = aofWriteOk
+		// Nothing is written since the last fsync, the whole stream is durable.
+		if s.AofLastIncrFsyncOffset == s.AofLastIncrSize && !syncInProgress {
+			s.updateFsyncedReplOff(reploff)
 		}
+		return
+	}
 
-		s.AofCurrSize += int64(n)
-		s.AofLastIncrSize += int64(n)
-		s.AofBuf = s.AofBuf[n:]
+	if syncInProgress && !force {
+		if s.AofFsyncPostponedStart == 0 {
+			s.AofFsyncPostponedStart = s.UnixTime
+			return
+		} else if s.UnixTime-s.AofFsyncPostponedStart < 2000 {
+			return
+		}
+		s.AofDelayedFsync++
+		slog.Info("Asynchronous AOF fsync is taking too long (disk is busy?). " +
+			"Writing the AOF buffer without waiting for fsync to complete, this may slow down Redis.")
 	}
 
-	if s.AofFsync == aofFsyncNo {
+	n, err := s.AofFile.Write(s.AofBuf)
+	s.AofFsyncPostponedStart = 0
+	s.AofCurrSize += int64(n)
+	s.AofLastIncrSize += int64(n)
+	s.AofBuf = s.AofBuf[n:]
+	if err != nil {
+		if s.AofFsync == AofFsyncAlways {
+			slog.Error("can't recover from AOF write error "+
+				"when the AOF fsync policy is 'always'. Exiting...", "err", err)
+			os.Exit(1)
+		}
+		if err != syscall.EINTR && s.AofLastWriteStatus == aofWriteOk {
+			slog.Warn("flush aof file failed", "err", err)
+		}
+		s.AofLastWriteStatus = aofWriteErr
 		return
 	}
-	if s.AofFsync == aofFsyncSec && !force {
-		if s.AofFsyncInProgress.Load() {
-			if s.AofFsyncPostponedStart == 0 {
-				s.AofFsyncPostponedStart = s.UnixTime
-				return
-			} else if s.UnixTime-s.AofRewriteTimeStart < 2*int64(time.Second) {
-				return
-			}
+	if s.AofLastWriteStatus == aofWriteErr {
+		slog.Info("AOF write error looks solved, Redis can write again")
+		s.AofLastWriteStatus = aofWriteOk
+	}
+
+	s.tryFsyncAppendOnlyFile(reploff, syncInProgress)
+}
+
+// tryFsyncAppendOnlyFile fsyncs the AOF according to the AofFsync policy.
+func (s *Server) tryFsyncAppendOnlyFile(reploff int64, syncInProgress bool) {
+	// The fsync is skipped while a background save is writing a lot to
+	// the disk, with no-appendfsync-on-rewrite.
+	if s.AofNoFsyncOnRewrite && (s.RdbChildRunning.Load() || s.AofChildRunning.Load()) {
+		return
+	}
+
+	if s.AofFsync == AofFsyncAlways {
+		if err := s.AofFile.Sync(); err != nil {
+			slog.Error("can't recover from AOF fsync error "+
+				"when the AOF fsync policy is 'always'. Exiting...", "err", err)
+			os.Exit(1)
 		}
+		s.AofLastFsync = s.UnixTime
+		s.AofLastIncrFsyncOffset = s.AofLastIncrSize
+		s.updateFsyncedReplOff(reploff)
+	} else if s.AofFsync == AofFsyncSec && s.UnixTime-s.AofLastFsync >= 1000 {
+		if !syncInProgress {
+			s.bioCreateFsyncJob(s.AofFile, reploff)
+			s.AofLastIncrFsyncOffset = s.AofLastIncrSize
+		}
+		s.AofLastFsync = s.UnixTime
 	}
+}
 
-	s.AofFsyncPostponedStart = 0
+// aofFsyncInProgress reports whether an fsync of the AOF is in progress in background.
+func (s *Server) aofFsyncInProgress() bool {
+	return s.bioPendingJobsOfType(bioAofFsync) != 0
+}
 
-	if s.AofFsync == aofFsyncAlways {
-		s.AofFile.Sync()
-	} else if s.AofFsync == aofFsyncSec && s.UnixTime-s.AofLastFsync > int64(time.Second) {
-		go func(fsyncFlag atomic.Bool) {
-			fsyncFlag.Store(true)
-			defer fsyncFlag.Store(false)
-			s.AofFile.Sync()
+// SwitchAofFile makes file the AOF file where the writes are appended from
+// now on, once persist records it. The buffered writes are flushed to the
+// old file, which is fsynced and closed in background.
+func (s *Server) SwitchAofFile(file *os.File, persist func() error) error {
+	s.propagateMu.Lock()
+	defer s.propagateMu.Unlock()
+	s.flushAppendOnlyFile(true)
+	if len(s.AofBuf) > 0 {
+		return errors.New("can't flush the AOF buffer to the old AOF file")
+	}
+	if err := persist(); err != nil {
+		return err
+	}
+	if s.AofFile != nil {
+		s.bioCreateCloseAofJob(s.AofFile, s.MasterReplOffset)
+	}
+	s.AofFile = file
+	s.AofLastIncrSize = 0
+	s.AofLastIncrFsyncOffset = 0
+	return nil
+}
 
-		}(s.AofFsyncInProgress)
+// updateFsyncedReplOff records the replication offset which is fsynced to the AOF.
+// The offset never goes back, even if the fsync jobs complete out of order.
+func (s *Server) updateFsyncedReplOff(reploff int64) {
+	for {
+		old := s.fsyncedReplOff.Load()
+		if old >= reploff || s.fsyncedReplOff.CompareAndSwap(old, reploff) {
+			return
+		}
 	}
-	s.AofLastFsync = s.UnixTime
-	s.AofLastIncrFsyncOffset = s.AofLastIncrSize
 }
 
 func (s *Server) databasesCron() {
-	// delete expired key
-	expireTimeLimit := 1000000 * activeExpireCycleSlowTimePerc / s.Hz / 100
-	s.DB.ActiveExpireCycle(time.Duration(expireTimeLimit))
+	// Delete the expired keys, and the expired fields of the hashes, the
+	// shards are locked in turn, so that the commands on the other shards
+	// go on.
+	if !s.CmdLock.TryRLock() {
+		return
+	}
+	expireTimeLimit := time.Duration(1000000 * activeExpireCycleSlowTimePerc / s.Hz / 100)
+	s.DB.ActiveExpireCycle(expireTimeLimit)
+	s.DB.ActiveFieldExpireCycle(expireTimeLimit)
+
+	// Rehash the dicts for a millisecond every 100 milliseconds.
+	if s.ActiveRehashing && s.runWithPeriod(100) {
+		s.DB.IncrementallyRehash(time.Millisecond)
+	}
+	s.CmdLock.RUnlock()
 }
 
 func (s *Server) clientsCron() {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
 	now := time.Now()
 	for i := s.MaxFd; i >= 0; i-- {
 		cli := s.Clients[i]
@@ -594,6 +994,8 @@ var errWaitBeforeDoFinishShutdown = errors.New("waiting for replicas before shut
 func (s *Server) prepareForShutdown() bool {
 	s.ShutdownStartTime = s.UnixTime
 
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
 	for _, cli := range s.Clients {
 		if cli.fd != -1 && cli.state == idleState {
 			cli.fd = -1
@@ -615,7 +1017,7 @@ func (s *Server) isShutdownInited() bool {
 // 6. Update AOF manifest file.
 // 7. Flush all slaves Output buffer.
 func (s *Server) finishShutdown() bool {
-	if !s.isAllClientFreed() {
+	if !s.isAllClientFreed() && s.shutdownFlags&cmd.ShutdownNow == 0 {
 		slog.Warn("there are still active clients, so try to finish shutdown later")
 		return false
 	}
@@ -637,16 +1039,28 @@ func (s *Server) finishShutdown() bool {
 
 	if s.AofState != AofOff {
 		slog.Info("flush forcely AOF file")
+		s.propagateMu.Lock()
 		s.flushAppendOnlyFile(true)
+		s.propagateMu.Unlock()
+		if err := s.AofFile.Sync(); err != nil {
+			slog.Warn("failed fsync AOF file on shutdown", "err", err)
+		}
 	}
 
-	if s.SaveParams != nil && len(s.SaveParams) > 0 {
+	// SHUTDOWN SAVE saves even if no save point is configured, and
+	// SHUTDOWN NOSAVE doesn't save even if some are configured.
+	if s.shutdownFlags&cmd.ShutdownNosave == 0 &&
+		(len(s.SaveParams) > 0 || s.shutdownFlags&cmd.ShutdownSave != 0) {
 		slog.Info("save a new RDB file")
 		// Before reaching this point, there are no client requests and
 		// no async persisting.
-		if !s.Dumper.RdbSave(s) {
-			slog.Error("error save RDB file")
-			return false
+		if !s.rdbSave() {
+			if s.shutdownFlags&cmd.ShutdownForce == 0 {
+				slog.Error("error trying to save the DB, can't exit")
+				s.abortShutdown()
+				return false
+			}
+			slog.Warn("error trying to save the DB, exit anyway")
 		}
 	}
 
@@ -654,13 +1068,18 @@ func (s *Server) finishShutdown() bool {
 		slog.Info("flush AOF manifest file")
 		if err := s.Dumper.FlushAofManifest(s); err != nil {
 			slog.Error("error flush AOF manifest file", "err", err)
-			return false
+			if s.shutdownFlags&cmd.ShutdownForce == 0 {
+				s.abortShutdown()
+				return false
+			}
 		}
 	}
 	return true
 }
 
 func (s *Server) isAllClientFreed() bool {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
 	for _, cli := range s.Clients {
 		if cli.fd != -1 {
 			return false
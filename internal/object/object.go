@@ -18,17 +18,17 @@ const (
 	EncodingZiplist
 	EncodingQuicklist
 	EncodingZipmap
+	EncodingHashtable
 )
 
 type Robj struct {
 	typ      RobjType
 	encoding EncodingType
 	val      any
-	deleted  bool
 }
 
 func New(val any, typ RobjType, encoding EncodingType) *Robj {
-	return &Robj{typ, encoding, val, false}
+	return &Robj{typ, encoding, val}
 }
 
 func (o *Robj) Val() any {
@@ -63,17 +63,6 @@ func (o *Robj) CheckEncoding(encoding EncodingType) bool {
 	return o.encoding == encoding
 }
 
-func (o *Robj) Deleted() bool {
-	return o.deleted
-}
-
-func (o *Robj) SetDeleted(deleted bool) {
-	if deleted {
-		o.val = nil
-	}
-	o.deleted = deleted
-}
-
 type Iterator interface {
 	HasNext() bool
 	Next() any
@@ -0,0 +1,17 @@
+package rio
+
+import "hash/crc64"
+
+// The CRC64 variant used by Redis for the RDB checksum: Jones polynomial
+// (0xad93d23594c935a9), reflected input and output, no initial or final
+// xor. It is checked against crc64(0, "123456789") == 0xe9c6d914c4b8d9ca.
+const crc64JonesReversed = 0x95ac9329ac4bc9b5
+
+var crc64Table = crc64.MakeTable(crc64JonesReversed)
+
+// Crc64 updates crc with the bytes of p.
+func Crc64(crc uint64, p []byte) uint64 {
+	// crc64.Update inverts the crc before and after the update, which the
+	// Jones variant does not.
+	return ^crc64.Update(^crc, crc64Table, p)
+}
@@ -0,0 +1,16 @@
+package rio
+
+import "testing"
+
+func TestCrc64(t *testing.T) {
+	if got := Crc64(0, nil); got != 0 {
+		t.Errorf("crc64 of nothing: %#x want: 0", got)
+	}
+	if got := Crc64(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("crc64(123456789): %#x want: %#x", got, uint64(0xe9c6d914c4b8d9ca))
+	}
+	// The checksum can be computed incrementally.
+	if got := Crc64(Crc64(0, []byte("1234")), []byte("56789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("incremental crc64(123456789): %#x want: %#x", got, uint64(0xe9c6d914c4b8d9ca))
+	}
+}
@@ -2,6 +2,7 @@ package rio
 
 import (
 	"bufio"
+	"errors"
 	"io"
 	"os"
 
@@ -10,7 +11,9 @@ import (
 
 type Reader struct {
 	*os.File
-	rd *bufio.Reader
+	rd          *bufio.Reader
+	updateCksum bool
+	cksum       uint64
 }
 
 func NewReader(file *os.File) (*Reader, error) {
@@ -21,20 +24,49 @@ func NewReader(file *os.File) (*Reader, error) {
 	}, nil
 }
 
+// NewStreamReader creates a Reader on a stream which is not seekable, eg. a socket.
+// If r is a *bufio.Reader it is used as it is, so that no more bytes than
+// requested are consumed from r.
+func NewStreamReader(r io.Reader) (*Reader, error) {
+	return &Reader{
+		rd: bufio.NewReader(r),
+	}, nil
+}
+
 func (r *Reader) Read(p []byte) (n int, err error) {
-	return r.rd.Read(p)
+	n, err = r.rd.Read(p)
+	if r.updateCksum {
+		r.cksum = Crc64(r.cksum, p[:n])
+	}
+	return n, err
+}
+
+// EnableCksum starts computing the CRC64 of the bytes read from now on.
+func (r *Reader) EnableCksum() {
+	r.updateCksum = true
+	r.cksum = 0
+}
+
+// Cksum returns the CRC64 of the bytes read since EnableCksum.
+func (r *Reader) Cksum() uint64 {
+	return r.cksum
 }
 
 func (r *Reader) ReadLine() ([]byte, bool, error) {
 	return r.rd.ReadLine()
 }
 
+// Tell returns the offset of the next byte to read, the bytes which are
+// buffered but not read yet are not counted.
 func (r *Reader) Tell() int64 {
+	if r.File == nil {
+		return -1
+	}
 	pos, err := r.Seek(0, 1)
 	if err != nil {
 		return -1
 	}
-	return pos
+	return pos - int64(r.rd.Buffered())
 }
 
 func (r *Reader) EOF() bool {
@@ -43,6 +75,9 @@ func (r *Reader) EOF() bool {
 }
 
 func (r *Reader) Reset() error {
+	if r.File == nil {
+		return errors.New("can't reset a stream reader")
+	}
 	_, err := r.Seek(0, 0)
 	if err != nil {
 		return err
@@ -55,6 +90,7 @@ type Writer struct {
 	wr              *bufio.Writer
 	updateCksum     bool
 	updateCksumFn   updateCksumFn
+	cksum           uint64
 	processBytes    int
 	maxProcessChunk int
 }
@@ -63,8 +99,18 @@ type Writer struct {
 // without modifying the original byte array.
 type updateCksumFn func(*Writer, []byte, int)
 
+// genericUpdateCksum updates the CRC64 with the first n bytes of p.
+func genericUpdateCksum(w *Writer, p []byte, n int) {
+	w.cksum = Crc64(w.cksum, p[:n])
+}
+
 func NewWriter(file *os.File) (*Writer, error) {
-	wr := bufio.NewWriter(file)
+	return NewStreamWriter(file)
+}
+
+// NewStreamWriter creates a Writer on any stream, eg. the sockets of replicas.
+func NewStreamWriter(w io.Writer) (*Writer, error) {
+	wr := bufio.NewWriter(w)
 	return &Writer{
 		wr:              wr,
 		processBytes:    0,
@@ -90,3 +136,20 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	}
 	return (w.processBytes - processBytes), nil
 }
+
+// EnableCksum starts computing the CRC64 of the bytes written from now on.
+func (w *Writer) EnableCksum() {
+	w.updateCksum = true
+	w.updateCksumFn = genericUpdateCksum
+	w.cksum = 0
+}
+
+// Cksum returns the CRC64 of the bytes written since EnableCksum.
+func (w *Writer) Cksum() uint64 {
+	return w.cksum
+}
+
+// Flush writes any buffered data to the underlying file.
+func (w *Writer) Flush() error {
+	return w.wr.Flush()
+}
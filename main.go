@@ -19,12 +19,16 @@ import (
 func main() {
 	var configfile string
 	flag.StringVar(&configfile, "conf", "rdb.conf", "--conf rdb.conf")
+	subprocess := flag.Bool("subprocess", false, "flag subprocess")
+	sentinel := flag.Bool("sentinel", false, "run in sentinel mode")
+	flag.Parse()
 
 	server := networking.NewServer()
+	if *sentinel {
+		server.InitSentinel()
+	}
 	conf.Load(server, configfile)
 
-	subprocess := flag.Bool("subprocess", false, "flag subprocess")
-	flag.Parse()
 	// Determine whether it is a parent process or a child process
 	// through the subprocess startup flag.
 	if server.Daemonize && *subprocess == false {
@@ -52,12 +56,25 @@ func main() {
 
 	registerSignalHandler(server)
 
-	server.LoadDataFromDisk()
-	server.OpenAofFileIfNeeded()
+	if *sentinel {
+		// A sentinel doesn't serve a dataset, there's nothing to load.
+		if err := server.SentinelIsRunning(); err != nil {
+			slog.Error("can't start the sentinel", "err", err)
+			os.Exit(1)
+		}
+	} else {
+		if err := server.ClusterInit(); err != nil {
+			slog.Error("can't init the cluster", "err", err)
+			os.Exit(1)
+		}
+
+		server.LoadDataFromDisk()
+	}
 
 	opts := []gnet.Option{
 		gnet.WithReusePort(true),
 		gnet.WithTicker(true),
+		gnet.WithNumEventLoop(server.IoThreads),
 		gnet.WithLogger(rlog.New()),
 		gnet.WithLogLevel(common.ToGnetLevel(server.LogLevel)),
 		gnet.WithLogPath(server.LogPath),
@@ -71,9 +88,12 @@ func registerSignalHandler(server *networking.Server) {
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		<-signalCh
-		slog.Info("we received SIGINT or SIGTERM, and exit after finish tail-in work")
-		server.Shutdown.Store(true)
+		// The shutdown may be aborted, eg. when the DB can't be saved,
+		// so the signals are received again.
+		for range signalCh {
+			slog.Info("we received SIGINT or SIGTERM, and exit after finish tail-in work")
+			server.Shutdown.Store(true)
+		}
 	}()
 }
 
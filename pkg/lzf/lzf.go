@@ -0,0 +1,185 @@
+// Package lzf implements the LZF compression format of liblzf, which is used
+// by Redis to compress the strings of the RDB files.
+//
+// The compressed data is a sequence of chunks, each starting with a control
+// byte. A control byte lower than 32 is followed by control+1 literal bytes,
+// otherwise the three high bits are the length of a back reference (7 means
+// the length continues in the next byte) and the five low bits are the high
+// bits of its offset, whose low bits are in the byte that follows.
+package lzf
+
+import (
+	"errors"
+	"sync"
+
+	. "github.com/sunminx/RDB/pkg/util"
+)
+
+const (
+	hlog   = 16
+	hsize  = 1 << hlog
+	maxLit = 1 << 5
+	maxOff = 1 << 13
+	maxRef = (1 << 8) + (1 << 3)
+)
+
+var (
+	// ErrOutputTooSmall is returned when the decompressed data don't fit in the output.
+	ErrOutputTooSmall = errors.New("lzf: output buffer too small")
+	// ErrCorrupted is returned when the compressed data are invalid.
+	ErrCorrupted = errors.New("lzf: corrupted data")
+)
+
+// The hash table is not cleared between uses, as liblzf does, since every
+// candidate match is checked against the input anyway.
+var htabPool = sync.Pool{
+	New: func() any { return new([hsize]uint32) },
+}
+
+// Compress compresses in into out, and returns the number of bytes written
+// to out. Zero is returned if the compressed data don't fit in out, which is
+// also the case when in is empty.
+func Compress(in, out []byte) int {
+	htab := htabPool.Get().(*[hsize]uint32)
+	defer htabPool.Put(htab)
+
+	inEnd, outEnd := len(in), len(out)
+	ip, op, lit := 0, 1, 0 // Start a literal run.
+
+	for ip < inEnd-2 {
+		hval := uint32(in[ip])<<16 | uint32(in[ip+1])<<8 | uint32(in[ip+2])
+		slot := ((hval >> (3*8 - hlog)) - hval*5) & (hsize - 1)
+		ref := int(htab[slot])
+		htab[slot] = uint32(ip)
+
+		off := ip - ref - 1
+		if ref > 0 && ref < ip && off < maxOff &&
+			in[ref] == in[ip] && in[ref+1] == in[ip+1] && in[ref+2] == in[ip+2] {
+			// Match found: the back reference needs at most 3 bytes, and
+			// the literal run we are going to close may be dropped.
+			if op+3+1 >= outEnd && op-Cond(lit == 0, 1, 0)+3+1 >= outEnd {
+				return 0
+			}
+			out[op-lit-1] = byte(lit - 1) // Stop the literal run.
+			if lit == 0 {
+				op-- // Undo the run if its length is zero.
+			}
+
+			n := 2
+			maxLen := min(inEnd-ip-n, maxRef)
+			for {
+				n++
+				if n >= maxLen || in[ref+n] != in[ip+n] {
+					break
+				}
+			}
+			n -= 2 // The length is now the number of bytes - 1.
+			ip++
+
+			if n < 7 {
+				out[op] = byte(off>>8 + n<<5)
+				op++
+			} else {
+				out[op] = byte(off>>8 + 7<<5)
+				out[op+1] = byte(n - 7)
+				op += 2
+			}
+			out[op] = byte(off)
+			op += 2 // Start a new literal run.
+			lit = 0
+
+			ip += n + 1
+		} else {
+			if op >= outEnd {
+				return 0
+			}
+			out[op] = in[ip]
+			op++
+			ip++
+			lit++
+			if lit == maxLit {
+				out[op-lit-1] = byte(lit - 1) // Stop the literal run.
+				op++                          // Start a new one.
+				lit = 0
+			}
+		}
+	}
+
+	for ip < inEnd {
+		if op >= outEnd {
+			return 0
+		}
+		out[op] = in[ip]
+		op++
+		ip++
+		lit++
+		if lit == maxLit {
+			out[op-lit-1] = byte(lit - 1)
+			op++
+			lit = 0
+		}
+	}
+
+	if lit == 0 {
+		return op - 1 // Undo the run if its length is zero.
+	}
+	out[op-lit-1] = byte(lit - 1) // End the literal run.
+	return op
+}
+
+// Decompress decompresses in into out, and returns the number of bytes
+// written to out.
+func Decompress(in, out []byte) (int, error) {
+	inEnd, outEnd := len(in), len(out)
+	ip, op := 0, 0
+
+	for ip < inEnd {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < maxLit {
+			// Literal run.
+			ctrl++
+			if op+ctrl > outEnd {
+				return 0, ErrOutputTooSmall
+			}
+			if ip+ctrl > inEnd {
+				return 0, ErrCorrupted
+			}
+			copy(out[op:], in[ip:ip+ctrl])
+			op += ctrl
+			ip += ctrl
+			continue
+		}
+
+		// Back reference.
+		n := ctrl >> 5
+		ref := op - (ctrl&0x1f)<<8 - 1
+		if ip >= inEnd {
+			return 0, ErrCorrupted
+		}
+		if n == 7 {
+			n += int(in[ip])
+			ip++
+			if ip >= inEnd {
+				return 0, ErrCorrupted
+			}
+		}
+		ref -= int(in[ip])
+		ip++
+
+		n += 2
+		if op+n > outEnd {
+			return 0, ErrOutputTooSmall
+		}
+		if ref < 0 {
+			return 0, ErrCorrupted
+		}
+		// The reference may overlap the output, so copy byte by byte.
+		for i := 0; i < n; i++ {
+			out[op+i] = out[ref+i]
+		}
+		op += n
+	}
+	return op, nil
+}
@@ -0,0 +1,67 @@
+package lzf
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompressDecompress(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	testcases := []string{
+		"a",
+		"abc",
+		strings.Repeat("a", 100),
+		strings.Repeat("abcdefgh", 1000),
+		strings.Repeat("hello world, ", 50) + "bye",
+		string(random),
+	}
+
+	for _, tc := range testcases {
+		out := make([]byte, len(tc)+len(tc)/32+1)
+		n := Compress([]byte(tc), out)
+		if n == 0 {
+			t.Errorf("compress %d bytes failed", len(tc))
+			continue
+		}
+		dec := make([]byte, len(tc))
+		m, err := Decompress(out[:n], dec)
+		if err != nil {
+			t.Errorf("decompress %d bytes: %v", len(tc), err)
+			continue
+		}
+		if m != len(tc) || !bytes.Equal(dec, []byte(tc)) {
+			t.Errorf("decompress %d bytes: got %d bytes mismatch", len(tc), m)
+		}
+	}
+}
+
+func TestCompressOutputTooSmall(t *testing.T) {
+	random := make([]byte, 100)
+	rand.New(rand.NewSource(1)).Read(random)
+	if n := Compress(random, make([]byte, len(random)-4)); n != 0 {
+		t.Errorf("compress random data into a small buffer: %d want: 0", n)
+	}
+	if n := Compress([]byte(strings.Repeat("a", 100)), make([]byte, 96)); n == 0 {
+		t.Error("compress repeated data failed")
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	// "aaaaaaaaaa" encoded as a literal 'a', then a back
+	// reference of 9 bytes at offset 0.
+	in := []byte{0x00, 'a', 0xe0, 0x00, 0x00}
+	out := make([]byte, 10)
+	n, err := Decompress(in, out)
+	if err != nil || string(out[:n]) != "aaaaaaaaaa" {
+		t.Errorf("decompress: %q %v", out[:n], err)
+	}
+	if _, err = Decompress(in, make([]byte, 5)); err != ErrOutputTooSmall {
+		t.Errorf("decompress into a small buffer: %v want: %v", err, ErrOutputTooSmall)
+	}
+	if _, err = Decompress([]byte{0x05, 'a'}, out); err != ErrCorrupted {
+		t.Errorf("decompress truncated data: %v want: %v", err, ErrCorrupted)
+	}
+}
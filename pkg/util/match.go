@@ -0,0 +1,86 @@
+package util
+
+// StringMatch tells whether s matches the glob-style pattern, as the MATCH
+// option of the SCAN family of commands does: '*' matches any sequence of
+// bytes, '/' included, '?' a single byte, "[abc]" one of the bytes, "[^abc]"
+// any other, "[a-z]" a range, and "\x" matches x.
+func StringMatch(pattern, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if StringMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			var match bool
+			match, pattern = matchClass(pattern[1:], s[0])
+			if !match {
+				return false
+			}
+			s = s[1:]
+			// pattern is at the closing bracket.
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
+
+// matchClass matches c against the class at the start of pattern, after
+// the opening bracket. It returns the pattern from the closing bracket, an
+// unterminated class ends with the pattern.
+func matchClass(pattern []byte, c byte) (bool, []byte) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			pattern = pattern[1:]
+			match = match || pattern[0] == c
+		case len(pattern) > 2 && pattern[1] == '-':
+			start, end := pattern[0], pattern[2]
+			if start > end {
+				start, end = end, start
+			}
+			match = match || (c >= start && c <= end)
+			pattern = pattern[2:]
+		default:
+			match = match || pattern[0] == c
+		}
+		pattern = pattern[1:]
+	}
+	if len(pattern) == 0 {
+		// The caller skips the closing bracket.
+		pattern = []byte{']'}
+	}
+	return match != not, pattern
+}
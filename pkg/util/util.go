@@ -120,20 +120,31 @@ func cond(c bool) int64 {
 	return 0
 }
 
+// TryLockWithTimeout locks lock, unless it isn't acquired in timeout. While
+// waiting it blocks the new readers, so that a writer is not starved by the
+// readers continuously taking the lock in turn.
 func TryLockWithTimeout(lock *sync.RWMutex, timeout time.Duration) bool {
-	t := time.NewTimer(timeout)
-	defer t.Stop()
+	if lock.TryLock() {
+		return true
+	}
 
-	for {
-		if lock.TryLock() {
-			return true
-		}
+	locked := make(chan struct{})
+	go func() {
+		lock.Lock()
+		locked <- struct{}{}
+	}()
 
-		select {
-		case <-t.C:
-			return false
-		default:
-			time.Sleep(10 * time.Millisecond)
-		}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-locked:
+		return true
+	case <-t.C:
+		// Give up, the lock is released as soon as it is acquired.
+		go func() {
+			<-locked
+			lock.Unlock()
+		}()
+		return false
 	}
 }
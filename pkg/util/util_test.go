@@ -1,9 +1,61 @@
 package util
 
-import "testing"
+import (
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestInt64ToBytes(t *testing.T) {
 	var n int64 = -9223372036854775808
 	dst := Int64ToBytes(n)
 	t.Log(string(dst))
 }
+
+func TestTryLockWithTimeout(t *testing.T) {
+	var lock sync.RWMutex
+	lock.RLock()
+	if TryLockWithTimeout(&lock, 10*time.Millisecond) {
+		t.Fatal("locked while a reader holds the lock")
+	}
+	// The writer gave up, its pending lock is released once acquired.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		lock.RUnlock()
+	}()
+	if !TryLockWithTimeout(&lock, time.Second) {
+		t.Fatal("not locked after the reader is gone")
+	}
+	lock.Unlock()
+}
+
+func TestStringMatch(t *testing.T) {
+	testcases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "a/b", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hello!", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"field:*:name", "field:42:name", true},
+		{"[abc", "c", true},
+		{"a**b", "axxb", true},
+	}
+	for _, tc := range testcases {
+		if got := StringMatch([]byte(tc.pattern), []byte(tc.s)); got != tc.match {
+			t.Errorf("%q against %q: %v", tc.s, tc.pattern, got)
+		}
+	}
+}